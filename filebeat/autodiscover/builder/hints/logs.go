@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"regexp"
 
+	"github.com/dustin/go-humanize"
 	"github.com/elastic/go-ucfg"
 
 	"github.com/elastic/beats/v7/filebeat/fileset"
@@ -44,8 +45,17 @@ const (
 	excludeLines = "exclude_lines"
 	processors   = "processors"
 	json         = "json"
+	format       = "format"
+	maxBytes     = "max_bytes"
 )
 
+// jsonFormat decodes json lines, the message key keeps the content and the
+// other keys are put under json.
+var jsonFormat = common.MapStr{
+	"message_key":   "message",
+	"add_error_key": true,
+}
+
 // validModuleNames to sanitize user input
 var validModuleNames = regexp.MustCompile("[^a-zA-Z0-9\\_\\-]+")
 
@@ -120,8 +130,13 @@ func (l *logHints) CreateConfig(event bus.Event, options ...ucfg.Option) []*comm
 		tempCfg := common.MapStr{}
 		mline := l.getMultiline(h)
 		if len(mline) != 0 {
+			// the multiline of the container replaces the default one
+			config.Remove(multiline, -1)
 			tempCfg.Put(multiline, mline)
 		}
+		if size := l.getMaxBytes(h); size > 0 {
+			tempCfg.Put(maxBytes, size)
+		}
 		if ilines := l.getIncludeLines(h); len(ilines) != 0 {
 			tempCfg.Put(includeLines, ilines)
 		}
@@ -133,7 +148,13 @@ func (l *logHints) CreateConfig(event bus.Event, options ...ucfg.Option) []*comm
 			tempCfg.Put(processors, procs)
 		}
 
-		if jsonOpts := l.getJSONOptions(h); len(jsonOpts) != 0 {
+		jsonOpts := l.getJSONOptions(h)
+		if l.getFormat(h) == json {
+			opts := jsonFormat.Clone()
+			opts.DeepUpdate(jsonOpts)
+			jsonOpts = opts
+		}
+		if len(jsonOpts) != 0 {
 			tempCfg.Put(json, jsonOpts)
 		}
 		// Merge config template with the configs from the annotations
@@ -174,7 +195,41 @@ func (l *logHints) CreateConfig(event bus.Event, options ...ucfg.Option) []*comm
 }
 
 func (l *logHints) getMultiline(hints common.MapStr) common.MapStr {
-	return builder.GetHintMapStr(hints, l.config.Key, multiline)
+	mline := builder.GetHintMapStr(hints, l.config.Key, multiline)
+	if len(mline) == 0 {
+		return nil
+	}
+	mline = mline.Clone()
+	// multiline of the log input takes a list of patterns
+	if pattern, ok := mline["pattern"]; ok {
+		delete(mline, "pattern")
+		mline["patterns"] = []interface{}{pattern}
+	}
+	return mline
+}
+
+func (l *logHints) getMaxBytes(hints common.MapStr) int {
+	str := builder.GetHintString(hints, l.config.Key, maxBytes)
+	if str == "" {
+		return 0
+	}
+	size, err := humanize.ParseBytes(str)
+	if err != nil {
+		logp.Debug("hints.builder", "unable to parse max_bytes hint %s: %v", str, err)
+		return 0
+	}
+	return int(size)
+}
+
+// getFormat returns the format of the logs, json or raw.
+func (l *logHints) getFormat(hints common.MapStr) string {
+	f := builder.GetHintString(hints, l.config.Key, format)
+	switch f {
+	case "", "raw", json:
+	default:
+		logp.Debug("hints.builder", "unknown format hint %s, must be raw or json", f)
+	}
+	return f
 }
 
 func (l *logHints) getIncludeLines(hints common.MapStr) []string {
@@ -296,8 +296,8 @@ func TestGenerateHints(t *testing.T) {
 						"ids": []interface{}{"abc"},
 					},
 					"multiline": map[string]interface{}{
-						"pattern": "^test",
-						"negate":  "true",
+						"patterns": []interface{}{"^test"},
+						"negate":   "true",
 					},
 					"close_timeout": "true",
 				},
@@ -948,3 +948,58 @@ func TestGenerateHintsWithPaths(t *testing.T) {
 
 	}
 }
+
+func TestGenerateHintsOverrideDefaultConfig(t *testing.T) {
+	cfg := common.MustNewConfigFrom(map[string]interface{}{
+		"key": "log",
+		"default_config": map[string]interface{}{
+			"type":      "container",
+			"paths":     []string{"/var/lib/docker/containers/${data.container.id}/*.log"},
+			"max_bytes": 51200,
+			"multiline": map[string]interface{}{
+				"patterns": []string{"^a", "^b"},
+				"match":    "after",
+			},
+		},
+	})
+	l, err := NewLogHints(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfgs := l.CreateConfig(bus.Event{
+		"host": "1.2.3.4",
+		"container": common.MapStr{
+			"name": "foobar",
+			"id":   "abc",
+		},
+		"hints": common.MapStr{
+			"log": common.MapStr{
+				"multiline": common.MapStr{
+					"preset": "java",
+				},
+				"format":        "json",
+				"json":          common.MapStr{"message_key": "msg"},
+				"max_bytes":     "1MiB",
+				"exclude_lines": "^DEBUG",
+			},
+		},
+	})
+	assert.Equal(t, 1, len(cfgs))
+
+	config := common.MapStr{}
+	assert.NoError(t, cfgs[0].Unpack(&config))
+	assert.Equal(t, common.MapStr{
+		"type":      "container",
+		"paths":     []interface{}{"/var/lib/docker/containers/abc/*.log"},
+		"max_bytes": uint64(1 << 20),
+		"multiline": map[string]interface{}{
+			"preset": "java",
+		},
+		"json": map[string]interface{}{
+			"message_key":   "msg",
+			"add_error_key": true,
+		},
+		"exclude_lines": []interface{}{"^DEBUG"},
+	}, config)
+}
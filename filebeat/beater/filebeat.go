@@ -252,6 +252,16 @@ func (fb *Filebeat) Run(b *beat.Beat) error {
 	}
 	defer stateStore.Close()
 
+	if apiStore, err := stateStore.Access(); err == nil {
+		registryAPI.setStore(apiStore)
+		defer func() {
+			registryAPI.setStore(nil)
+			apiStore.Close()
+		}()
+	} else {
+		logp.Warn("Failed to access state store for the registry api: %v", err)
+	}
+
 	// Setup registrar to persist state
 	registrar, err := registrar.New(stateStore, finishedLogger, config.Registry.FlushTimeout)
 	if err != nil {
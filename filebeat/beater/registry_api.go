@@ -0,0 +1,85 @@
+package beater
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/elastic/beats/v7/filebeat/registrar"
+	"github.com/elastic/beats/v7/libbeat/api"
+	"github.com/elastic/beats/v7/libbeat/logp"
+	"github.com/elastic/beats/v7/libbeat/statestore"
+)
+
+// registryAPI serves the registry read only on the http endpoint, the
+// handlers are added before the server is created and the store is set
+// when filebeat runs.
+var registryAPI = &registryHandler{}
+
+func init() {
+	if err := api.AddHandlerFunc("/registry", registryAPI.list); err != nil {
+		logp.Err("Fail to add registry api: %v", err)
+	}
+	if err := api.AddHandlerFunc("/registry/export", registryAPI.export); err != nil {
+		logp.Err("Fail to add registry export api: %v", err)
+	}
+}
+
+type registryHandler struct {
+	mu    sync.RWMutex
+	store *statestore.Store
+}
+
+func (h *registryHandler) setStore(store *statestore.Store) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.store = store
+}
+
+// list returns the entries, filtered by the query parameters path, inode,
+// input and orphaned.
+func (h *registryHandler) list(w http.ResponseWriter, r *http.Request) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.store == nil {
+		http.Error(w, "registry is not opened", http.StatusServiceUnavailable)
+		return
+	}
+
+	query := r.URL.Query()
+	_, orphaned := query["orphaned"]
+	entries, err := registrar.ListEntries(h.store, registrar.EntryFilter{
+		Path:     query.Get("path"),
+		Inode:    query.Get("inode"),
+		Input:    query.Get("input"),
+		Orphaned: orphaned,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if entries == nil {
+		entries = []registrar.Entry{}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	enc := json.NewEncoder(w)
+	if _, ok := query["pretty"]; ok {
+		enc.SetIndent("", "  ")
+	}
+	enc.Encode(entries)
+}
+
+func (h *registryHandler) export(w http.ResponseWriter, r *http.Request) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.store == nil {
+		http.Error(w, "registry is not opened", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := registrar.Export(h.store, w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -21,11 +21,11 @@ import (
 	"time"
 
 	"github.com/elastic/beats/v7/filebeat/config"
+	"github.com/elastic/beats/v7/filebeat/registrar"
 	"github.com/elastic/beats/v7/libbeat/beat"
 	"github.com/elastic/beats/v7/libbeat/logp"
 	"github.com/elastic/beats/v7/libbeat/paths"
 	"github.com/elastic/beats/v7/libbeat/statestore"
-	"github.com/elastic/beats/v7/libbeat/statestore/backend/memlog"
 )
 
 type filebeatStore struct {
@@ -35,16 +35,13 @@ type filebeatStore struct {
 }
 
 func openStateStore(info beat.Info, logger *logp.Logger, cfg config.Registry) (*filebeatStore, error) {
-	memlog, err := memlog.New(logger, memlog.Settings{
-		Root:     paths.Resolve(paths.Data, cfg.Path),
-		FileMode: cfg.Permissions,
-	})
+	registryBackend, err := registrar.NewBackend(logger, paths.Resolve(paths.Data, cfg.Path), cfg)
 	if err != nil {
 		return nil, err
 	}
 
 	return &filebeatStore{
-		registry:      statestore.NewRegistry(memlog),
+		registry:      statestore.NewRegistry(registryBackend),
 		storeName:     info.Beat,
 		cleanInterval: cfg.CleanInterval,
 	}, nil
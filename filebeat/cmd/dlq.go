@@ -0,0 +1,101 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/elastic/beats/v7/libbeat/cmd/instance"
+	"github.com/elastic/beats/v7/libbeat/common/cli"
+	"github.com/elastic/beats/v7/libbeat/publisher/pipeline"
+)
+
+// genDLQCmd initializes the dlq command to handle the events kept by the
+// dead letter queue with the following subcommands:
+//  - replay
+func genDLQCmd(settings instance.Settings) *cobra.Command {
+	dlqCmd := cobra.Command{
+		Use:   "dlq",
+		Short: "Handle the events the outputs rejected",
+		Long: "Handle the events the outputs permanently rejected, kept in the files of dead_letter.file.\n" +
+			"Filebeat must be stopped when the events are replayed.",
+	}
+	dlqCmd.AddCommand(genDLQReplayCmd(settings))
+	return &dlqCmd
+}
+
+func genDLQReplayCmd(settings instance.Settings) *cobra.Command {
+	var timeout time.Duration
+	var dryRun bool
+	command := &cobra.Command{
+		Use:   "replay",
+		Short: "Publish the events of the dead letter files to the outputs again",
+		Long: "Publish the events of the dead letter files to the outputs which rejected them, the oldest first.\n" +
+			"A file is removed once all its events are acknowledged, the events rejected again are kept in new files.",
+		Run: cli.RunWith(func(cmd *cobra.Command, args []string) error {
+			b, err := instance.NewInitializedBeat(settings)
+			if err != nil {
+				return fmt.Errorf("error initializing beat: %s", err)
+			}
+			dlqConfig := b.Config.DeadLetter
+			if dlqConfig == nil || !dlqConfig.Enabled() {
+				return fmt.Errorf("dead_letter is not configured")
+			}
+
+			if dryRun {
+				counts := map[[2]string]int{}
+				stats, err := pipeline.ReadDeadLetters(dlqConfig, func(record *pipeline.DeadLetterRecord) {
+					counts[[2]string{record.Output, record.Reason}]++
+				})
+				if err != nil {
+					return err
+				}
+				return printDeadLetters(stats, counts)
+			}
+
+			publisher, closePublisher, err := b.NewReplayPublisher()
+			if err != nil {
+				return err
+			}
+			defer closePublisher()
+
+			stats, err := pipeline.ReplayDeadLetters(publisher, dlqConfig, timeout)
+			fmt.Printf("Replayed %d events of %d files\n", stats.Events, stats.Files)
+			if stats.Invalid > 0 {
+				fmt.Printf("Skipped %d invalid records\n", stats.Invalid)
+			}
+			return err
+		}),
+	}
+	command.Flags().DurationVar(&timeout, "timeout", time.Minute, "wait for the acknowledgement of the events of a file, 0 waits forever")
+	command.Flags().BoolVar(&dryRun, "dry-run", false, "count the events per output and reason without replaying them")
+	return command
+}
+
+func printDeadLetters(stats pipeline.ReplayStats, counts map[[2]string]int) error {
+	keys := make([][2]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "OUTPUT\tEVENTS\tREASON")
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s\t%d\t%s\n", key[0], counts[key], key[1])
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	fmt.Printf("%d events in %d files, %d invalid records\n", stats.Events, stats.Files, stats.Invalid)
+	return nil
+}
@@ -0,0 +1,250 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"github.com/elastic/beats/v7/filebeat/config"
+	"github.com/elastic/beats/v7/filebeat/registrar"
+	"github.com/elastic/beats/v7/libbeat/cmd/instance"
+	"github.com/elastic/beats/v7/libbeat/common/cli"
+	"github.com/elastic/beats/v7/libbeat/logp"
+	"github.com/elastic/beats/v7/libbeat/paths"
+	"github.com/elastic/beats/v7/libbeat/statestore/backend"
+)
+
+// genRegistryCmd initializes the registry command to inspect and repair the
+// registry of a stopped filebeat with the following subcommands:
+//  - list
+//  - set-offset
+//  - compact
+//  - export
+//  - import
+func genRegistryCmd(settings instance.Settings) *cobra.Command {
+	registryCmd := cobra.Command{
+		Use:   "registry",
+		Short: "Inspect and repair the registry",
+		Long: "Inspect and repair the registry of the file states.\n" +
+			"Filebeat must be stopped when the registry is changed, set-offset, compact and import fail while filebeat is running.",
+	}
+	registryCmd.PersistentFlags().String("registry-path", "", "Path of the registry, registry.path of the config by default")
+
+	registryCmd.AddCommand(genRegistryListCmd(settings))
+	registryCmd.AddCommand(genRegistrySetOffsetCmd(settings))
+	registryCmd.AddCommand(genRegistryCompactCmd(settings))
+	registryCmd.AddCommand(genRegistryExportCmd(settings))
+	registryCmd.AddCommand(genRegistryImportCmd(settings))
+
+	return &registryCmd
+}
+
+func genRegistryListCmd(settings instance.Settings) *cobra.Command {
+	var filter registrar.EntryFilter
+	var asJSON bool
+	command := &cobra.Command{
+		Use:   "list",
+		Short: "List the file states of the registry",
+		Run: cli.RunWith(func(cmd *cobra.Command, args []string) error {
+			return withRegistry(cmd, settings, false, func(store backend.Store) error {
+				entries, err := registrar.ListEntries(store, filter)
+				if err != nil {
+					return err
+				}
+				if asJSON {
+					enc := json.NewEncoder(os.Stdout)
+					enc.SetIndent("", "  ")
+					return enc.Encode(entries)
+				}
+				return printEntries(os.Stdout, entries)
+			})
+		}),
+	}
+	addEntryFilterFlags(command, &filter)
+	command.Flags().BoolVar(&asJSON, "json", false, "print the states as json")
+	return command
+}
+
+func genRegistrySetOffsetCmd(settings instance.Settings) *cobra.Command {
+	var filter registrar.EntryFilter
+	var reset, end bool
+	var offset int64
+	command := &cobra.Command{
+		Use:   "set-offset",
+		Short: "Reset or advance the offsets of the selected file states",
+		Run: cli.RunWith(func(cmd *cobra.Command, args []string) error {
+			if filter == (registrar.EntryFilter{}) {
+				return fmt.Errorf("one of --path, --inode, --input or --orphaned is required")
+			}
+			to := offset
+			switch {
+			case reset && !end && !cmd.Flags().Changed("offset"):
+				to = 0
+			case end && !reset && !cmd.Flags().Changed("offset"):
+				to = -1
+			case cmd.Flags().Changed("offset") && !reset && !end:
+				if offset < 0 {
+					return fmt.Errorf("offset %d is negative", offset)
+				}
+			default:
+				return fmt.Errorf("exactly one of --reset, --end or --offset is required")
+			}
+
+			return withRegistry(cmd, settings, true, func(store backend.Store) error {
+				entries, err := registrar.ListEntries(store, filter)
+				if err != nil {
+					return err
+				}
+				updated, err := registrar.SetOffsets(store, entries, to)
+				if err != nil {
+					return err
+				}
+				fmt.Printf("Updated %d of %d file states\n", updated, len(entries))
+				return checkpoint(store)
+			})
+		}),
+	}
+	addEntryFilterFlags(command, &filter)
+	command.Flags().BoolVar(&reset, "reset", false, "read the files from the beginning")
+	command.Flags().BoolVar(&end, "end", false, "skip to the end of the files")
+	command.Flags().Int64Var(&offset, "offset", 0, "set the offset of the files")
+	return command
+}
+
+func genRegistryCompactCmd(settings instance.Settings) *cobra.Command {
+	return &cobra.Command{
+		Use:   "compact",
+		Short: "Compact the registry, checkpoint memlog or collect the value log of kv",
+		Run: cli.RunWith(func(cmd *cobra.Command, args []string) error {
+			return withRegistry(cmd, settings, true, checkpoint)
+		}),
+	}
+}
+
+func genRegistryExportCmd(settings instance.Settings) *cobra.Command {
+	return &cobra.Command{
+		Use:   "export [file]",
+		Short: "Export the registry as json, to stdout if no file is given",
+		Args:  cobra.MaximumNArgs(1),
+		Run: cli.RunWith(func(cmd *cobra.Command, args []string) error {
+			return withRegistry(cmd, settings, false, func(store backend.Store) error {
+				if len(args) == 0 {
+					return registrar.Export(store, os.Stdout)
+				}
+				f, err := os.Create(args[0])
+				if err != nil {
+					return fmt.Errorf("fail to create %s: %v", args[0], err)
+				}
+				defer f.Close()
+				return registrar.Export(store, f)
+			})
+		}),
+	}
+}
+
+func genRegistryImportCmd(settings instance.Settings) *cobra.Command {
+	return &cobra.Command{
+		Use:   "import <file>",
+		Short: "Import the json of registry export, existing states of the same keys are overwritten",
+		Args:  cobra.ExactArgs(1),
+		Run: cli.RunWith(func(cmd *cobra.Command, args []string) error {
+			f, err := os.Open(args[0])
+			if err != nil {
+				return fmt.Errorf("fail to open %s: %v", args[0], err)
+			}
+			defer f.Close()
+
+			return withRegistry(cmd, settings, true, func(store backend.Store) error {
+				imported, err := registrar.Import(store, f)
+				if err != nil {
+					return err
+				}
+				fmt.Printf("Imported %d entries\n", imported)
+				return checkpoint(store)
+			})
+		}),
+	}
+}
+
+func addEntryFilterFlags(cmd *cobra.Command, filter *registrar.EntryFilter) {
+	cmd.Flags().StringVar(&filter.Path, "path", "", "select the files matching the glob pattern or containing the path")
+	cmd.Flags().StringVar(&filter.Inode, "inode", "", "select the files of the inode")
+	cmd.Flags().StringVar(&filter.Input, "input", "", "select the files of the input type, or of the filestream input ID")
+	cmd.Flags().BoolVar(&filter.Orphaned, "orphaned", false, "select the files removed or replaced")
+}
+
+func printEntries(w io.Writer, entries []registrar.Entry) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "INPUT\tSOURCE\tIDENTITY\tOFFSET\tSIZE\tSTATUS")
+	for _, entry := range entries {
+		size := "-"
+		if entry.Size >= 0 {
+			size = strconv.FormatInt(entry.Size, 10)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%s\n", entry.Input, entry.Source, entry.Identity, entry.Offset, size, entry.Status)
+	}
+	return tw.Flush()
+}
+
+// withRegistry opens the registry of the config, or the registry of the
+// type of the config in the --registry-path flag. If the registry is
+// changed, the lock on the data path is held, so that it fails while
+// filebeat is running.
+func withRegistry(cmd *cobra.Command, settings instance.Settings, change bool, fn func(store backend.Store) error) error {
+	b, err := instance.NewInitializedBeat(settings)
+	if err != nil {
+		return fmt.Errorf("error initializing beat: %s", err)
+	}
+	if change {
+		unlock, err := b.LockDataPath()
+		if err == instance.ErrAlreadyLocked {
+			return fmt.Errorf("filebeat is running on the data path %s, stop it before changing the registry", paths.Resolve(paths.Data, ""))
+		}
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+
+	cfg := config.DefaultConfig
+	beatConfig, err := b.BeatConfig()
+	if err != nil {
+		return err
+	}
+	if err := beatConfig.Unpack(&cfg); err != nil {
+		return fmt.Errorf("fail to unpack config: %v", err)
+	}
+	registryPath, _ := cmd.Flags().GetString("registry-path")
+	if registryPath == "" {
+		registryPath = paths.Resolve(paths.Data, cfg.Registry.Path)
+	}
+
+	registryBackend, err := registrar.NewBackend(logp.NewLogger("registry"), registryPath, cfg.Registry)
+	if err != nil {
+		return fmt.Errorf("fail to open registry %s: %v", registryPath, err)
+	}
+	defer registryBackend.Close()
+
+	store, err := registryBackend.Access(settings.Name)
+	if err != nil {
+		return fmt.Errorf("fail to access registry store: %v", err)
+	}
+	defer store.Close()
+	return fn(store)
+}
+
+func checkpoint(store backend.Store) error {
+	checkpointer, ok := store.(interface{ Checkpoint() error })
+	if !ok {
+		return nil
+	}
+	if err := checkpointer.Checkpoint(); err != nil {
+		return fmt.Errorf("fail to write registry checkpoint: %v", err)
+	}
+	return nil
+}
@@ -58,5 +58,7 @@ func Filebeat(inputs beater.PluginFactory, settings instance.Settings) *cmd.Beat
 	command.SetupCmd.Flags().AddGoFlag(flag.CommandLine.Lookup("modules"))
 	command.AddCommand(cmd.GenModulesCmd(Name, "", buildModulesManager))
 	command.AddCommand(genGenerateCmd())
+	command.AddCommand(genRegistryCmd(settings))
+	command.AddCommand(genDLQCmd(settings))
 	return command
 }
@@ -28,6 +28,7 @@ import (
 	"github.com/elastic/beats/v7/libbeat/autodiscover"
 	"github.com/elastic/beats/v7/libbeat/cfgfile"
 	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/common/cfgtype"
 	"github.com/elastic/beats/v7/libbeat/common/cfgwarn"
 	"github.com/elastic/beats/v7/libbeat/logp"
 	"github.com/elastic/beats/v7/libbeat/paths"
@@ -56,12 +57,44 @@ type Registry struct {
 	FlushTimeout  time.Duration `config:"flush"`
 	CleanInterval time.Duration `config:"cleanup_interval"`
 	MigrateFile   string        `config:"migrate_file"`
+
+	// Type of the statestore backend, memlog or kv. The states of memlog
+	// are copied to kv once when switching to kv.
+	Type string     `config:"type"`
+	KV   KVRegistry `config:"kv"`
+
+	// MigrateToFilestream copies the states of the log inputs to the
+	// filestream input with the ID.
+	MigrateToFilestream *FilestreamMigration `config:"migrate_to_filestream"`
+}
+
+func (r *Registry) Validate() error {
+	switch r.Type {
+	case "memlog", "kv":
+		return nil
+	}
+	return fmt.Errorf("unknown registry type %v, memlog or kv", r.Type)
+}
+
+type KVRegistry struct {
+	SyncWrites bool             `config:"sync_writes"`
+	GCInterval time.Duration    `config:"gc_interval"`
+	CacheSize  cfgtype.ByteSize `config:"cache_size"`
+}
+
+type FilestreamMigration struct {
+	ID string `config:"id" validate:"required"`
+	// Types of the log inputs migrated, log and container by default.
+	Types []string `config:"types"`
+	// Paths are glob patterns of the files migrated, all by default.
+	Paths []string `config:"paths"`
 }
 
 var (
 	DefaultConfig = Config{
 		Registry: Registry{
 			Path:          "registry",
+			Type:          "memlog",
 			Permissions:   0600,
 			MigrateFile:   "",
 			CleanInterval: 5 * time.Minute,
@@ -25,6 +25,9 @@ import (
 var defaultConfig = config{
 	Stream: "all",
 	Format: "auto",
+	MultilinePreset: multilinePresetConfig{
+		Key: "MULTILINE_PRESET",
+	},
 }
 
 type config struct {
@@ -33,6 +36,9 @@ type config struct {
 
 	// Format can be auto, cri, json-file
 	Format string `config:"format"`
+
+	// MultilinePreset selects the multiline preset per container
+	MultilinePreset multilinePresetConfig `config:"multiline_preset"`
 }
 
 // Validate validates the config.
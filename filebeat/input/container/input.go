@@ -70,5 +70,13 @@ func NewInput(
 		context.Meta["stream"] = config.Stream
 	}
 
-	return log.NewInput(cfg, outletFactory, context)
+	in, err := log.NewInput(cfg, outletFactory, context)
+	if err != nil {
+		return nil, err
+	}
+	if config.MultilinePreset.Key != "" {
+		presets := newMultilinePresets(config.MultilinePreset)
+		in.(*log.Input).SetHarvesterConfig(presets.harvesterConfig)
+	}
+	return in, nil
 }
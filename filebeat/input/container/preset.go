@@ -0,0 +1,119 @@
+package container
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+
+	"github.com/elastic/beats/v7/filebeat/reader/multiline"
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/logp"
+)
+
+// multilinePresetConfig selects the multiline preset of a container by the
+// value of a label or env of the container, such as MULTILINE_PRESET=java.
+type multilinePresetConfig struct {
+	Key string `config:"key"`
+	// ConfigPaths are the config files of the containers, %s is replaced by
+	// the container ID.
+	ConfigPaths []string `config:"config_paths"`
+}
+
+var defaultContainerConfigPaths = []string{
+	// docker
+	"/var/lib/docker/containers/%s/config.v2.json",
+	// OCI bundles of containerd and cri-o
+	"/run/containerd/io.containerd.runtime.v2.task/k8s.io/%s/config.json",
+	"/run/containers/storage/overlay-containers/%s/userdata/config.json",
+}
+
+// containerIDPattern matches the container ID in
+// /var/lib/docker/containers/<id>/<id>-json.log and
+// /var/log/containers/<pod>_<namespace>_<container>-<id>.log.
+var containerIDPattern = regexp.MustCompile(`[0-9a-f]{64}`)
+
+// containerSpec holds the envs and labels of the docker config.v2.json and
+// of the OCI config.json.
+type containerSpec struct {
+	Config *struct {
+		Env    []string          `json:"Env"`
+		Labels map[string]string `json:"Labels"`
+	} `json:"Config"`
+	Process *struct {
+		Env []string `json:"env"`
+	} `json:"process"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+type multilinePresets struct {
+	log         *logp.Logger
+	key         string
+	configPaths []string
+}
+
+func newMultilinePresets(config multilinePresetConfig) *multilinePresets {
+	paths := config.ConfigPaths
+	if len(paths) == 0 {
+		paths = defaultContainerConfigPaths
+	}
+	return &multilinePresets{
+		log:         logp.NewLogger("container"),
+		key:         config.Key,
+		configPaths: paths,
+	}
+}
+
+// harvesterConfig returns the multiline preset of the container writing the
+// log file at source, nil if the container names none.
+func (m *multilinePresets) harvesterConfig(source string) *common.Config {
+	ids := containerIDPattern.FindAllString(source, -1)
+	if len(ids) == 0 {
+		return nil
+	}
+	preset := m.lookup(ids[len(ids)-1])
+	if preset == "" {
+		return nil
+	}
+	if !stringInSlice(strings.ToLower(preset), multiline.PresetNames()) {
+		m.log.Warnf("Unknown multiline preset %s of %s, must be one of %s", preset, source, strings.Join(multiline.PresetNames(), ", "))
+		return nil
+	}
+	m.log.Debugf("Using multiline preset %s for %s", preset, source)
+	return common.MustNewConfigFrom(common.MapStr{"multiline.preset": preset})
+}
+
+// lookup returns the value of the key in the envs or labels of a container.
+func (m *multilinePresets) lookup(cid string) string {
+	for _, pattern := range m.configPaths {
+		data, err := ioutil.ReadFile(fmt.Sprintf(pattern, cid))
+		if err != nil {
+			continue
+		}
+		var spec containerSpec
+		if err := json.Unmarshal(data, &spec); err != nil {
+			m.log.Debugf("Fail to decode config of container %s: %v", cid, err)
+			continue
+		}
+
+		var envs []string
+		var labels map[string]string
+		if spec.Config != nil {
+			envs, labels = spec.Config.Env, spec.Config.Labels
+		}
+		if spec.Process != nil {
+			envs = spec.Process.Env
+		}
+		if spec.Annotations != nil {
+			labels = spec.Annotations
+		}
+		for _, env := range envs {
+			if strings.HasPrefix(env, m.key+"=") {
+				return strings.TrimPrefix(env, m.key+"=")
+			}
+		}
+		return labels[m.key]
+	}
+	return ""
+}
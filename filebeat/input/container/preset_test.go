@@ -0,0 +1,56 @@
+// +build !integration
+
+package container
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMultilinePresets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "container")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	docker, oci := strings.Repeat("a", 64), strings.Repeat("b", 64)
+	files := map[string]string{
+		filepath.Join(dir, "docker", docker+".json"): `{"Config":{"Env":["PATH=/bin","MULTILINE_PRESET=java"],"Labels":{"MULTILINE_PRESET":"go"}}}`,
+		filepath.Join(dir, "oci", oci+".json"):       `{"process":{"env":["PATH=/bin"]},"annotations":{"MULTILINE_PRESET":"python"}}`,
+	}
+	for name, content := range files {
+		require.NoError(t, os.MkdirAll(filepath.Dir(name), 0755))
+		require.NoError(t, ioutil.WriteFile(name, []byte(content), 0644))
+	}
+
+	presets := newMultilinePresets(multilinePresetConfig{
+		Key:         "MULTILINE_PRESET",
+		ConfigPaths: []string{filepath.Join(dir, "docker", "%s.json"), filepath.Join(dir, "oci", "%s.json")},
+	})
+	cases := map[string]string{
+		"/var/lib/docker/containers/" + docker + "/" + docker + "-json.log": "java",
+		"/var/log/containers/app_default_app-" + oci + ".log":               "python",
+		"/var/log/containers/app_default_app-" + strings.Repeat("c", 64):    "",
+		"/var/log/messages": "",
+	}
+	for source, preset := range cases {
+		cfg := presets.harvesterConfig(source)
+		if preset == "" {
+			assert.Nil(t, cfg, source)
+			continue
+		}
+		require.NotNil(t, cfg, source)
+		name, err := cfg.String("multiline.preset", -1)
+		require.NoError(t, err)
+		assert.Equal(t, preset, name, source)
+	}
+
+	// Unknown presets are ignored.
+	presets.key = "PATH"
+	assert.Nil(t, presets.harvesterConfig("/var/lib/docker/containers/"+docker+"/"+docker+"-json.log"))
+}
@@ -69,7 +69,8 @@ type readerConfig struct {
 	MaxBytes       int                     `config:"message_max_bytes" validate:"min=0,nonzero"`
 	Tail           bool                    `config:"seek_to_tail"`
 
-	Parsers []*common.ConfigNamespace `config:"parsers"` // TODO multiline, json, syslog?
+	// Parsers are applied in order: multiline, ndjson, container or syslog.
+	Parsers []*common.ConfigNamespace `config:"parsers"`
 }
 
 type backoffConfig struct {
@@ -118,6 +119,24 @@ func defaultReaderConfig() readerConfig {
 	}
 }
 
+// readConfig unpacks the options of a file stream. ucfg skips the unexported
+// embedded readerConfig, so the reader options are unpacked into it
+// separately.
+func readConfig(cfg *common.Config) (config, error) {
+	c := defaultConfig()
+	if err := cfg.Unpack(&c); err != nil {
+		return c, err
+	}
+	if err := cfg.Unpack(&c.readerConfig); err != nil {
+		return c, err
+	}
+	return c, nil
+}
+
+func (c *readerConfig) Validate() error {
+	return validateParsers(c.Parsers)
+}
+
 func (c *config) Validate() error {
 	if len(c.Paths) == 0 {
 		return fmt.Errorf("no path is configured")
@@ -20,7 +20,10 @@ package filestream
 import (
 	"testing"
 
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/beats/v7/libbeat/common"
 )
 
 func TestConfigValidate(t *testing.T) {
@@ -30,3 +33,18 @@ func TestConfigValidate(t *testing.T) {
 		require.Error(t, err)
 	})
 }
+
+func TestReadConfig(t *testing.T) {
+	cfg := common.MustNewConfigFrom(map[string]interface{}{
+		"paths":       []string{"/var/log/*.log"},
+		"encoding":    "utf-16le",
+		"buffer_size": 1024,
+		"parsers":     []map[string]interface{}{{"ndjson": map[string]interface{}{}}},
+	})
+	c, err := readConfig(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/var/log/*.log"}, c.Paths)
+	assert.Equal(t, "utf-16le", c.Encoding)
+	assert.Equal(t, 1024, c.BufferSize)
+	assert.Len(t, c.Parsers, 1)
+}
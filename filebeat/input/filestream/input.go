@@ -82,8 +82,8 @@ func Plugin(log *logp.Logger, store loginp.StateStore) input.Plugin {
 }
 
 func configure(cfg *common.Config) (loginp.Prospector, loginp.Harvester, error) {
-	config := defaultConfig()
-	if err := cfg.Unpack(&config); err != nil {
+	config, err := readConfig(cfg)
+	if err != nil {
 		return nil, nil, err
 	}
 
@@ -226,6 +226,13 @@ func (inp *filestream) open(log *logp.Logger, canceler input.Canceler, path stri
 	}
 
 	r = readfile.NewStripNewline(r, inp.lineTerminator)
+
+	r, err = newParsers(r, inp.readerConfig.Parsers, inp.maxBytes)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
 	r = readfile.NewLimitReader(r, inp.maxBytes)
 
 	return r, nil
@@ -318,13 +325,14 @@ func (inp *filestream) readFromSource(
 			return nil
 		}
 
+		offset := s.Offset
 		s.Offset += int64(message.Bytes)
 
 		if message.IsEmpty() || inp.isDroppedLine(log, string(message.Content)) {
 			continue
 		}
 
-		event := inp.eventFromMessage(message, path)
+		event := inp.eventFromMessage(message, path, offset)
 		if err := p.Publish(event, s); err != nil {
 			return err
 		}
@@ -360,10 +368,10 @@ func matchAny(matchers []match.Matcher, text string) bool {
 	return false
 }
 
-func (inp *filestream) eventFromMessage(m reader.Message, path string) beat.Event {
+func (inp *filestream) eventFromMessage(m reader.Message, path string, offset int64) beat.Event {
 	fields := common.MapStr{
 		"log": common.MapStr{
-			"offset": m.Bytes, // Offset here is the offset before the starting char.
+			"offset": offset, // Offset here is the offset before the starting char.
 			"file": common.MapStr{
 				"path": path,
 			},
@@ -371,6 +379,13 @@ func (inp *filestream) eventFromMessage(m reader.Message, path string) beat.Even
 	}
 	fields.DeepUpdate(m.Fields)
 
+	// the document id set by the ndjson parser
+	var meta common.MapStr
+	if md, ok := fields["@metadata"].(common.MapStr); ok {
+		meta = md
+		delete(fields, "@metadata")
+	}
+
 	if len(m.Content) > 0 {
 		if fields == nil {
 			fields = common.MapStr{}
@@ -381,5 +396,6 @@ func (inp *filestream) eventFromMessage(m reader.Message, path string) beat.Even
 	return beat.Event{
 		Timestamp: m.Ts,
 		Fields:    fields,
+		Meta:      meta,
 	}
 }
@@ -0,0 +1,44 @@
+package filestream
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	input "github.com/elastic/beats/v7/filebeat/input/v2"
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/logp"
+)
+
+type eventsPublisher struct {
+	events  []beat.Event
+	offsets []int64
+}
+
+func (p *eventsPublisher) Publish(event beat.Event, cursor interface{}) error {
+	p.events = append(p.events, event)
+	p.offsets = append(p.offsets, cursor.(state).Offset)
+	return nil
+}
+
+func TestReadFromSourceOffsets(t *testing.T) {
+	inp := &filestream{}
+	r := &linesReader{lines: []string{"first", "", "second line"}}
+	p := &eventsPublisher{}
+	ctx := input.Context{Cancelation: context.Background()}
+	require.NoError(t, inp.readFromSource(ctx, logp.L(), r, "/var/log/app.log", state{Offset: 10}, p))
+	require.Len(t, p.events, 2)
+
+	// log.offset is the offset of the start of the line, the cursor the
+	// offset after it.
+	var offsets []interface{}
+	for _, event := range p.events {
+		offset, err := event.GetValue("log.offset")
+		require.NoError(t, err)
+		offsets = append(offsets, offset)
+	}
+	assert.Equal(t, []interface{}{int64(10), int64(17)}, offsets)
+	assert.Equal(t, []int64{16, 29}, p.offsets)
+}
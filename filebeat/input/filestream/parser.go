@@ -0,0 +1,173 @@
+package filestream
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/elastic/beats/v7/filebeat/input/syslog"
+	"github.com/elastic/beats/v7/filebeat/reader/multiline"
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/logp"
+	"github.com/elastic/beats/v7/libbeat/reader"
+	"github.com/elastic/beats/v7/libbeat/reader/readfile"
+	"github.com/elastic/beats/v7/libbeat/reader/readjson"
+)
+
+// parsers are applied in the order of the parsers option, for example:
+//
+//	parsers:
+//	  - container: {stream: all}
+//	  - ndjson: {message_key: log}
+//	  - multiline: {patterns: ['^\d{4}-'], match: after}
+var parsers = map[string]func(r reader.Reader, cfg *common.Config, maxBytes int) (reader.Reader, error){
+	"multiline": newMultilineParser,
+	"ndjson":    newNDJSONParser,
+	"container": newContainerParser,
+	"syslog":    newSyslogParser,
+}
+
+func newParsers(r reader.Reader, configs []*common.ConfigNamespace, maxBytes int) (reader.Reader, error) {
+	for _, ns := range configs {
+		if ns == nil || !ns.IsSet() {
+			continue
+		}
+		factory, ok := parsers[ns.Name()]
+		if !ok {
+			return nil, fmt.Errorf("unknown parser %s", ns.Name())
+		}
+		var err error
+		r, err = factory(r, ns.Config(), maxBytes)
+		if err != nil {
+			return nil, fmt.Errorf("fail to create parser %s: %v", ns.Name(), err)
+		}
+	}
+	return r, nil
+}
+
+func validateParsers(configs []*common.ConfigNamespace) error {
+	_, err := newParsers(nopReader{}, configs, 0)
+	return err
+}
+
+type nopReader struct{}
+
+func (nopReader) Next() (reader.Message, error) { return reader.Message{}, nil }
+func (nopReader) Close() error                  { return nil }
+
+func newMultilineParser(r reader.Reader, cfg *common.Config, maxBytes int) (reader.Reader, error) {
+	var config multiline.Config
+	if err := cfg.Unpack(&config); err != nil {
+		return nil, err
+	}
+	return multiline.New(r, "\n", maxBytes, &config)
+}
+
+func newContainerParser(r reader.Reader, cfg *common.Config, maxBytes int) (reader.Reader, error) {
+	config := readjson.DockerJsonConfig{
+		Stream:   "all",
+		Partial:  true,
+		Format:   "auto",
+		CRIFlags: true,
+	}
+	if err := cfg.Unpack(&config); err != nil {
+		return nil, err
+	}
+	// the log of a container line keeps its newline
+	return readfile.NewStripNewline(readjson.New(r, maxBytes, &config), readfile.AutoLineTerminator), nil
+}
+
+// ndjsonParser decodes a json object per line and merges it into the fields
+// of the message like the json option of the log input.
+type ndjsonParser struct {
+	reader *readjson.JSONReader
+	config readjson.Config
+}
+
+func newNDJSONParser(r reader.Reader, cfg *common.Config, _ int) (reader.Reader, error) {
+	var config readjson.Config
+	if err := cfg.Unpack(&config); err != nil {
+		return nil, err
+	}
+	return &ndjsonParser{
+		reader: readjson.NewJSONReader(r, &config),
+		config: config,
+	}, nil
+}
+
+func (p *ndjsonParser) Next() (reader.Message, error) {
+	message, err := p.reader.Next()
+	if err != nil {
+		return message, err
+	}
+
+	jsonFields, _ := message.Fields["json"].(common.MapStr)
+	delete(message.Fields, "json")
+	if len(jsonFields) == 0 {
+		return message, nil
+	}
+
+	text := string(message.Content)
+	id, ts := readjson.MergeJSONFields(message.Fields, jsonFields, &text, p.config)
+	if !ts.IsZero() {
+		message.Ts = ts
+	}
+	if id != "" {
+		message.Fields["@metadata"] = common.MapStr{"_id": id}
+	}
+	message.Content = []byte(text)
+	return message, nil
+}
+
+func (p *ndjsonParser) Close() error {
+	return p.reader.Close()
+}
+
+type syslogConfig struct {
+	Timezone string `config:"timezone"`
+}
+
+// syslogParser parses RFC3164 syslog lines, other lines are returned as is.
+type syslogParser struct {
+	reader   reader.Reader
+	timezone *time.Location
+	log      *logp.Logger
+}
+
+func newSyslogParser(r reader.Reader, cfg *common.Config, _ int) (reader.Reader, error) {
+	config := syslogConfig{Timezone: "Local"}
+	if err := cfg.Unpack(&config); err != nil {
+		return nil, err
+	}
+	timezone, err := time.LoadLocation(config.Timezone)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogParser{
+		reader:   r,
+		timezone: timezone,
+		log:      logp.NewLogger("filestream.syslog"),
+	}, nil
+}
+
+func (p *syslogParser) Next() (reader.Message, error) {
+	message, err := p.reader.Next()
+	if err != nil || len(message.Content) == 0 {
+		return message, err
+	}
+
+	event, ok := syslog.ParseEvent(message.Content, p.timezone, p.log)
+	if !ok {
+		p.log.Debugf("Line is not a syslog message: %s", message.Content)
+		return message, nil
+	}
+	text, _ := event.Fields["message"].(string)
+	delete(event.Fields, "message")
+	message.Content = []byte(text)
+	message.Ts = event.Timestamp
+	message.AddFields(event.Fields)
+	return message, nil
+}
+
+func (p *syslogParser) Close() error {
+	return p.reader.Close()
+}
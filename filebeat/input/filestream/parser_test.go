@@ -0,0 +1,146 @@
+package filestream
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/reader"
+)
+
+type linesReader struct {
+	lines []string
+}
+
+func (r *linesReader) Next() (reader.Message, error) {
+	if len(r.lines) == 0 {
+		return reader.Message{}, io.EOF
+	}
+	line := r.lines[0]
+	r.lines = r.lines[1:]
+	return reader.Message{Ts: time.Now(), Content: []byte(line), Bytes: len(line) + 1}, nil
+}
+
+func (r *linesReader) Close() error { return nil }
+
+func TestParsers(t *testing.T) {
+	tests := map[string]struct {
+		parsers string
+		lines   []string
+		content []string
+		fields  []common.MapStr
+	}{
+		"container and multiline": {
+			parsers: `
+- container: {stream: stderr}
+- multiline: {patterns: ['^\S'], match: after, timeout: 0s}`,
+			lines: []string{
+				`{"log":"Exception: boom\n","stream":"stderr","time":"2021-01-01T12:00:00.000000000Z"}`,
+				`{"log":"out\n","stream":"stdout","time":"2021-01-01T12:00:00.100000000Z"}`,
+				`{"log":"\tat App.main\n","stream":"stderr","time":"2021-01-01T12:00:00.200000000Z"}`,
+				`2021-01-01T12:00:01.000000000Z stderr F next`,
+			},
+			content: []string{"Exception: boom\n\tat App.main", "next"},
+		},
+		"ndjson": {
+			parsers: `
+- ndjson: {keys_under_root: true, message_key: msg}`,
+			lines: []string{
+				`{"msg":"hello","level":"info"}`,
+			},
+			content: []string{"hello"},
+			fields:  []common.MapStr{{"msg": "hello", "level": "info"}},
+		},
+		"multiline preset": {
+			parsers: `
+- multiline: {preset: java, timeout: 0s}`,
+			lines: []string{
+				"java.lang.IllegalStateException: boom",
+				"\tat com.example.App.run(App.java:10)",
+				"2021-01-01 12:00:01.000 INFO retry",
+			},
+			content: []string{
+				"java.lang.IllegalStateException: boom\n\tat com.example.App.run(App.java:10)",
+				"2021-01-01 12:00:01.000 INFO retry",
+			},
+		},
+		"syslog": {
+			parsers: `
+- syslog: {timezone: UTC}`,
+			lines: []string{
+				"<13>Oct 11 22:14:15 host app[42]: started",
+				"not syslog",
+			},
+			content: []string{"started", "not syslog"},
+			fields: []common.MapStr{
+				{
+					"hostname": "host",
+					"process":  common.MapStr{"pid": 42, "program": "app"},
+					"syslog":   common.MapStr{"priority": 13, "facility": 1, "facility_label": "user-level", "severity_label": "Notice"},
+					"event":    common.MapStr{"severity": 5},
+				},
+				nil,
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			cfg, err := common.NewConfigWithYAML([]byte("parsers: "+test.parsers), "")
+			require.NoError(t, err)
+			var config struct {
+				Parsers []*common.ConfigNamespace `config:"parsers"`
+			}
+			require.NoError(t, cfg.Unpack(&config))
+
+			r, err := newParsers(&linesReader{lines: test.lines}, config.Parsers, 1<<20)
+			require.NoError(t, err)
+
+			var content []string
+			var fields []common.MapStr
+			total := 0
+			for {
+				m, err := r.Next()
+				if err == io.EOF {
+					break
+				}
+				require.NoError(t, err)
+				content = append(content, string(m.Content))
+				fields = append(fields, m.Fields)
+				total += m.Bytes
+			}
+			assert.Equal(t, test.content, content)
+			if test.fields != nil {
+				assert.Equal(t, test.fields, fields)
+			}
+
+			lines := 0
+			for _, line := range test.lines {
+				lines += len(line) + 1
+			}
+			assert.Equal(t, lines, total)
+		})
+	}
+}
+
+func TestParsersConfig(t *testing.T) {
+	for parsers, valid := range map[string]bool{
+		`[{multiline: {patterns: ['^a'], match: after}}]`: true,
+		`[{multiline: {match: after}}]`:                   false,
+		`[{ndjson: {message_key: msg}}, {container: {}}]`: true,
+		`[{syslog: {timezone: Nowhere/Land}}]`:            false,
+		`[{xml: {root: log}}]`:                            false,
+	} {
+		cfg := common.MustNewConfigFrom(map[string]interface{}{"paths": []string{"/var/log/*.log"}})
+		parsersCfg, err := common.NewConfigWithYAML([]byte("parsers: "+parsers), "")
+		require.NoError(t, err)
+		require.NoError(t, cfg.Merge(parsersCfg))
+
+		_, err = readConfig(cfg)
+		assert.Equal(t, valid, err == nil, "%s: %v", parsers, err)
+	}
+}
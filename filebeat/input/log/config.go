@@ -72,6 +72,8 @@ type config struct {
 
 	// Hidden on purpose, used by the docker input:
 	DockerJSON *readjson.DockerJsonConfig `config:"docker-json"`
+
+	Monitoring MonitoringConfig `config:"monitoring"`
 }
 
 type LogConfig struct {
@@ -132,6 +134,10 @@ func defaultConfig() config {
 		BufferSize:     16 * humanize.KiByte,
 		MaxBytes:       10 * humanize.MiByte,
 		LineTerminator: readfile.AutoLineTerminator,
+		Monitoring: MonitoringConfig{
+			Enabled: false,
+			Period:  30 * time.Second,
+		},
 		LogConfig: LogConfig{
 			Backoff:       1 * time.Second,
 			BackoffFactor: 2,
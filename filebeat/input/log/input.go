@@ -71,6 +71,11 @@ type Input struct {
 	meta                map[string]string
 	stopOnce            sync.Once
 	fileStateIdentifier file.StateIdentifier
+	monitor             *inputMonitor // nil if monitoring is disabled
+
+	// harvesterConfig returns settings overriding the input config for the
+	// harvester of a file, nil to use the input config.
+	harvesterConfig func(source string) *common.Config
 }
 
 // NewInput instantiates a new Log
@@ -156,6 +161,11 @@ func NewInput(
 
 	logp.Info("Configured paths: %v", p.config.Paths)
 
+	if inputConfig.Monitoring.Enabled {
+		p.monitor = newInputMonitor(inputConfig.Monitoring, inputConfig.Paths, channel.SubOutlet(out))
+		p.monitor.start()
+	}
+
 	cleanupNeeded = false
 	go p.stopWhenDone()
 
@@ -668,11 +678,29 @@ func subOutletWrap(outlet channel.Outleter) func() channel.Outleter {
 	}
 }
 
+// SetHarvesterConfig sets the function returning the settings overriding
+// the input config for the harvester of a file. Inputs wrapping the log
+// input use it to configure harvesters per file.
+func (p *Input) SetHarvesterConfig(f func(source string) *common.Config) {
+	p.harvesterConfig = f
+}
+
 // createHarvester creates a new harvester instance from the given state
 func (p *Input) createHarvester(state file.State, onTerminate func()) (*Harvester, error) {
+	cfg := p.cfg
+	if p.harvesterConfig != nil && state.Source != "" {
+		if override := p.harvesterConfig(state.Source); override != nil {
+			merged, err := common.MergeConfigs(p.cfg, override)
+			if err != nil {
+				return nil, err
+			}
+			cfg = merged
+		}
+	}
+
 	// Each wraps the outlet, for closing the outlet individually
 	h, err := NewHarvester(
-		p.cfg,
+		cfg,
 		state,
 		p.states,
 		func(state file.State) bool {
@@ -699,7 +727,13 @@ func (p *Input) startHarvester(state file.State, offset int64) error {
 	state.Offset = offset
 
 	// Create harvester with state
-	h, err := p.createHarvester(state, func() { p.numHarvesters.Dec() })
+	var h *Harvester
+	h, err := p.createHarvester(state, func() {
+		p.numHarvesters.Dec()
+		if p.monitor != nil {
+			p.monitor.remove(h)
+		}
+	})
 	if err != nil {
 		p.numHarvesters.Dec()
 		return err
@@ -716,8 +750,14 @@ func (p *Input) startHarvester(state file.State, offset int64) error {
 	// This is synchronous state update as part of the scan
 	h.SendStateUpdate()
 
+	if p.monitor != nil {
+		p.monitor.add(h)
+	}
 	if err = p.harvesters.Start(h); err != nil {
 		p.numHarvesters.Dec()
+		if p.monitor != nil {
+			p.monitor.remove(h)
+		}
 	}
 	return err
 }
@@ -778,6 +818,10 @@ func (p *Input) Stop() {
 		// Otherwise Stop will wait until output is complete
 		p.harvesters.Stop()
 
+		if p.monitor != nil {
+			p.monitor.stop()
+		}
+
 		// close state updater
 		p.stateOutlet.Close()
 
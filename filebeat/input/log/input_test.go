@@ -263,6 +263,33 @@ func TestMatchesMeta(t *testing.T) {
 	}
 }
 
+func TestHarvesterConfig(t *testing.T) {
+	p := &Input{
+		cfg: common.MustNewConfigFrom(common.MapStr{
+			"paths":              []string{"/var/log/*.log"},
+			"multiline.patterns": []string{"^\\d{4}"},
+			"multiline.match":    "after",
+		}),
+		states: file.NewStates(),
+	}
+	p.SetHarvesterConfig(func(source string) *common.Config {
+		if source != "/var/log/java.log" {
+			return nil
+		}
+		return common.MustNewConfigFrom(common.MapStr{"multiline.preset": "java"})
+	})
+
+	h, err := p.createHarvester(file.State{Source: "/var/log/java.log"}, nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "java", h.config.Multiline.Preset)
+	}
+	h, err = p.createHarvester(file.State{Source: "/var/log/other.log"}, nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "", h.config.Multiline.Preset)
+		assert.Len(t, h.config.Multiline.Patterns, 1)
+	}
+}
+
 type TestFileInfo struct {
 	time time.Time
 }
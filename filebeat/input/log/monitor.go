@@ -0,0 +1,187 @@
+package log
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elastic/beats/v7/filebeat/channel"
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/logp"
+)
+
+// MonitoringConfig configures the self-monitoring events of an input. It is
+// set either to a bool or to an object:
+//
+//	monitoring: false
+//	monitoring:
+//	  container_envs: "DICE_ORG_NAME,DICE_SERVICE_NAME"
+//	  period: 30s
+type MonitoringConfig struct {
+	Enabled       bool          `config:"enabled"`
+	ContainerEnvs []string      `config:"container_envs"` // Env vars to tag the events with, comma separated.
+	Period        time.Duration `config:"period" validate:"min=0,nonzero"`
+}
+
+func defaultMonitoringConfig() MonitoringConfig {
+	return MonitoringConfig{
+		Enabled: true,
+		Period:  30 * time.Second,
+	}
+}
+
+// Unpack accepts a bool as well as an object, which enables the monitoring
+// unless it sets enabled: false.
+func (c *MonitoringConfig) Unpack(v interface{}) error {
+	switch val := v.(type) {
+	case bool:
+		*c = defaultMonitoringConfig()
+		c.Enabled = val
+		return nil
+	case map[string]interface{}:
+		cfg, err := common.NewConfigFrom(val)
+		if err != nil {
+			return err
+		}
+		// Unpack into a type without this method, not to recurse.
+		type plainConfig MonitoringConfig
+		config := plainConfig(defaultMonitoringConfig())
+		if err := cfg.Unpack(&config); err != nil {
+			return err
+		}
+		*c = MonitoringConfig(config)
+		return nil
+	}
+	return fmt.Errorf("monitoring must be a bool or an object, got %T", v)
+}
+
+// envs returns the values of the configured env vars which are set.
+func (c *MonitoringConfig) envs() common.MapStr {
+	envs := common.MapStr{}
+	for _, item := range c.ContainerEnvs {
+		for _, key := range strings.Split(item, ",") {
+			key = strings.TrimSpace(key)
+			if v, ok := os.LookupEnv(key); ok && key != "" && v != "" {
+				envs[key] = v
+			}
+		}
+	}
+	return envs
+}
+
+// inputMonitor periodically publishes the progress of the harvesters of an
+// input, so that stalled inputs can be detected downstream.
+type inputMonitor struct {
+	config MonitoringConfig
+	paths  []string
+	out    channel.Outleter
+	done   chan struct{}
+	wg     sync.WaitGroup
+
+	mu         sync.Mutex
+	harvesters map[string]*harvesterProgressMetrics
+}
+
+func newInputMonitor(config MonitoringConfig, paths []string, out channel.Outleter) *inputMonitor {
+	return &inputMonitor{
+		config:     config,
+		paths:      paths,
+		out:        out,
+		done:       make(chan struct{}),
+		harvesters: make(map[string]*harvesterProgressMetrics),
+	}
+}
+
+func (m *inputMonitor) add(h *Harvester) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.harvesters[h.id.String()] = h.metrics
+}
+
+func (m *inputMonitor) remove(h *Harvester) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.harvesters, h.id.String())
+}
+
+func (m *inputMonitor) start() {
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		ticker := time.NewTicker(m.config.Period)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.done:
+				return
+			case <-ticker.C:
+				for _, event := range m.events(time.Now()) {
+					if !m.out.OnEvent(event) {
+						return
+					}
+				}
+			}
+		}
+	}()
+}
+
+func (m *inputMonitor) stop() {
+	close(m.done)
+	m.out.Close()
+	m.wg.Wait()
+}
+
+// events returns one event per running harvester, or a single event without
+// file metrics if the input has no running harvester. The events carry the
+// metrics as JSON in message and the read offset in log.offset, which the
+// collector output requires of every event.
+func (m *inputMonitor) events(now time.Time) []beat.Event {
+	m.mu.Lock()
+	metrics := make([]*harvesterProgressMetrics, 0, len(m.harvesters))
+	for _, hm := range m.harvesters {
+		metrics = append(metrics, hm)
+	}
+	m.mu.Unlock()
+
+	envs := m.config.envs()
+	newEvent := func(monitoring common.MapStr, offset int64) beat.Event {
+		monitoring["harvesters"] = len(metrics)
+		monitoring["paths"] = m.paths
+		fields := common.MapStr{
+			"monitoring": monitoring,
+			"message":    monitoring.String(),
+			"log":        common.MapStr{"offset": offset},
+		}
+		if len(envs) > 0 {
+			fields.Put("terminus.tags", envs.Clone())
+		}
+		return beat.Event{Timestamp: now, Fields: fields}
+	}
+
+	if len(metrics) == 0 {
+		return []beat.Event{newEvent(common.MapStr{}, 0)}
+	}
+	events := make([]beat.Event, 0, len(metrics))
+	for _, hm := range metrics {
+		harvester := common.MapStr{
+			"name":        hm.filename.Get(),
+			"start_time":  hm.started.Get(),
+			"size":        hm.currentSize.Get(),
+			"read_offset": hm.readOffset.Get(),
+		}
+		if t := hm.lastPublished.Get(); !t.IsZero() {
+			harvester["last_event_published_time"] = t
+		}
+		if t := hm.lastPublishedEventTimestamp.Get(); !t.IsZero() {
+			harvester["last_event_timestamp"] = t
+		}
+		event := newEvent(common.MapStr{"harvester": harvester}, hm.readOffset.Get())
+		event.Fields.Put("log.file.path", hm.filename.Get())
+		events = append(events, event)
+	}
+	logp.Debug("input", "Publishing %d monitoring events", len(events))
+	return events
+}
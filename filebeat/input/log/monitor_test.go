@@ -0,0 +1,165 @@
+// +build !integration
+
+package log
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/common/atomic"
+	"github.com/elastic/beats/v7/libbeat/outputs"
+	_ "github.com/elastic/beats/v7/libbeat/outputs/collector"
+	"github.com/elastic/beats/v7/libbeat/outputs/outest"
+)
+
+func TestMonitoringConfig(t *testing.T) {
+	cases := map[string]struct {
+		cfg  map[string]interface{}
+		want MonitoringConfig
+	}{
+		"default": {
+			cfg:  map[string]interface{}{},
+			want: MonitoringConfig{Enabled: false, Period: 30 * time.Second},
+		},
+		"disabled": {
+			cfg:  map[string]interface{}{"monitoring": false},
+			want: MonitoringConfig{Enabled: false, Period: 30 * time.Second},
+		},
+		"enabled": {
+			cfg:  map[string]interface{}{"monitoring": true},
+			want: MonitoringConfig{Enabled: true, Period: 30 * time.Second},
+		},
+		"object": {
+			cfg: map[string]interface{}{"monitoring": map[string]interface{}{
+				"container_envs": "DICE_ORG_NAME,DICE_SERVICE_NAME",
+				"period":         "10s",
+			}},
+			want: MonitoringConfig{Enabled: true, ContainerEnvs: []string{"DICE_ORG_NAME,DICE_SERVICE_NAME"}, Period: 10 * time.Second},
+		},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			c.cfg["paths"] = []string{"/var/log/*.log"}
+			config := defaultConfig()
+			err := common.MustNewConfigFrom(c.cfg).Unpack(&config)
+			assert.NoError(t, err)
+			assert.Equal(t, c.want, config.Monitoring)
+		})
+	}
+
+	config := defaultConfig()
+	err := common.MustNewConfigFrom(map[string]interface{}{
+		"paths":      []string{"/var/log/*.log"},
+		"monitoring": map[string]interface{}{"period": "0s"},
+	}).Unpack(&config)
+	assert.Error(t, err)
+}
+
+func TestInputMonitorEvents(t *testing.T) {
+	os.Setenv("TEST_MONITOR_ORG", "erda")
+	defer os.Unsetenv("TEST_MONITOR_ORG")
+
+	events := make(chan beat.Event, 10)
+	m := newInputMonitor(MonitoringConfig{
+		Enabled:       true,
+		ContainerEnvs: []string{"TEST_MONITOR_ORG, TEST_MONITOR_UNSET"},
+		Period:        10 * time.Millisecond,
+	}, []string{"/var/log/*.log"}, NewEventCapturer(events))
+
+	now := time.Now()
+	idle := m.events(now)
+	assert.Equal(t, []beat.Event{{
+		Timestamp: now,
+		Fields: common.MapStr{
+			"monitoring": common.MapStr{"harvesters": 0, "paths": []string{"/var/log/*.log"}},
+			"message":    `{"harvesters":0,"paths":["/var/log/*.log"]}`,
+			"log":        common.MapStr{"offset": int64(0)},
+			"terminus":   common.MapStr{"tags": common.MapStr{"TEST_MONITOR_ORG": "erda"}},
+		},
+	}}, idle)
+
+	h := &Harvester{id: uuid.Must(uuid.NewV4())}
+	h.metrics = newHarvesterProgressMetrics(h.id.String())
+	defer filesMetrics.Remove(h.id.String())
+	h.metrics.filename.Set("/var/log/app.log")
+	h.metrics.currentSize.Set(100)
+	h.metrics.readOffset.Set(40)
+	h.metrics.lastPublished.Set(now)
+	m.add(h)
+
+	m.start()
+	event := <-events
+	m.stop()
+
+	v, _ := event.GetValue("monitoring.harvester")
+	assert.Equal(t, common.MapStr{
+		"name":                      "/var/log/app.log",
+		"start_time":                "",
+		"size":                      int64(100),
+		"read_offset":               int64(40),
+		"last_event_published_time": now,
+	}, v)
+	path, _ := event.GetValue("log.file.path")
+	assert.Equal(t, "/var/log/app.log", path)
+	offset, _ := event.GetValue("log.offset")
+	assert.Equal(t, int64(40), offset)
+
+	m.remove(h)
+	assert.Len(t, m.harvesters, 0)
+}
+
+// dropObserver counts the events an output drops.
+type dropObserver struct {
+	outputs.Observer
+	dropped atomic.Int
+}
+
+func (o *dropObserver) DroppedWithReason(_ string, n int) {
+	o.dropped.Add(n)
+}
+
+func TestInputMonitorEventsExported(t *testing.T) {
+	var requests atomic.Int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Inc()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	// The sidecar exports the events with the terminus_export output.
+	observer := &dropObserver{Observer: outputs.NewNilObserver()}
+	group, err := outputs.FindFactory("terminus_export")(nil, beat.Info{}, observer, common.MustNewConfigFrom(map[string]interface{}{
+		"hosts": []string{srv.URL},
+	}))
+	require.NoError(t, err)
+	out := group.Clients[0]
+	defer out.Close()
+	require.NoError(t, out.(outputs.NetworkClient).Connect())
+
+	m := newInputMonitor(MonitoringConfig{Enabled: true, Period: time.Second}, []string{"/var/log/*.log"}, nil)
+	h := &Harvester{id: uuid.Must(uuid.NewV4())}
+	h.metrics = newHarvesterProgressMetrics(h.id.String())
+	defer filesMetrics.Remove(h.id.String())
+	h.metrics.filename.Set("/var/log/app.log")
+	h.metrics.readOffset.Set(40)
+
+	events := m.events(time.Now())
+	m.add(h)
+	events = append(events, m.events(time.Now())...)
+
+	batch := outest.NewBatch(events...)
+	require.NoError(t, out.Publish(context.Background(), batch))
+	assert.Equal(t, outest.BatchACK, batch.Signals[0].Tag)
+	assert.Equal(t, 0, observer.dropped.Load())
+	assert.Equal(t, 1, requests.Load())
+}
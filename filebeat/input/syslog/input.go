@@ -244,6 +244,17 @@ func parseAndCreateEvent(data []byte, metadata inputsource.NetworkMetadata, time
 	return createEvent(ev, metadata, time.Local, log)
 }
 
+// ParseEvent parses a RFC3164 syslog message into an event, it returns false
+// if data is not a syslog message.
+func ParseEvent(data []byte, timezone *time.Location, log *logp.Logger) (beat.Event, bool) {
+	ev := newEvent()
+	Parse(data, ev)
+	if !ev.IsValid() {
+		return beat.Event{}, false
+	}
+	return createEvent(ev, inputsource.NetworkMetadata{}, timezone, log), true
+}
+
 func newBeatEvent(timestamp time.Time, metadata inputsource.NetworkMetadata, fields common.MapStr) beat.Event {
 	event := beat.Event{
 		Timestamp: timestamp,
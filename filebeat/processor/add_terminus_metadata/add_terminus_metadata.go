@@ -12,7 +12,6 @@ import (
 	"github.com/elastic/beats/v7/libbeat/common/docker"
 	"github.com/elastic/beats/v7/libbeat/logp"
 	"github.com/elastic/beats/v7/libbeat/processors"
-	"github.com/elastic/beats/v7/libbeat/processors/actions"
 	"github.com/elastic/gosigar/cgroup"
 	"github.com/pkg/errors"
 )
@@ -33,17 +32,18 @@ func init() {
 
 type addDockerMetadata struct {
 	log                     *logp.Logger
-	watcher                 docker.Watcher
+	runtime                 containerRuntime // Docker or CRI, nil if no runtime exists in env
+	pods                    *podMetadata     // Pods of the node, nil if kubernetes is disabled
+	precedence              []string         // Order of env, label and annotation lookups
+	idPrecedence            []string         // Order of the lookups of the job ID and the output collector
 	fields                  []string
-	sourceProcessor         processors.Processor
 	allLogAnalyse           bool
 	monitorLogCollectorAddr string
 
-	pidFields       []string      // Field names that contain PIDs.
-	cgroups         *common.Cache // Cache of PID (int) to cgropus (map[string]string).
-	hostFS          string        // Directory where /proc is found
-	dedot           bool          // If set to true, replace dots in labels with `_`.
-	dockerAvailable bool          // If Docker exists in env, then it is set to true
+	pidFields []string      // Field names that contain PIDs.
+	cgroups   *common.Cache // Cache of PID (int) to cgropus (map[string]string).
+	hostFS    string        // Directory where /proc is found
+	dedot     bool          // If set to true, replace dots in labels with `_`.
 
 	jobIDKey           string
 	outputCollectorKey string
@@ -62,41 +62,32 @@ func buildDockerMetadataProcessor(log *logp.Logger, cfg *common.Config, watcherC
 		return nil, errors.Wrapf(err, "fail to unpack the %v configuration", processorName)
 	}
 
-	var dockerAvailable bool
-
-	watcher, err := watcherConstructor(log, config.Host, config.TLS, config.MatchShortID)
+	runtime, err := newRuntime(log, config, watcherConstructor)
 	if err != nil {
-		dockerAvailable = false
-		log.Errorf("%v: docker environment not detected: %+v", processorName, err)
-	} else {
-		dockerAvailable = true
-		log.Infof("%v: docker environment detected", processorName)
-		if err = watcher.Start(); err != nil {
-			return nil, errors.Wrap(err, "failed to start watcher")
-		}
+		return nil, err
 	}
 
-	// Use extract_field processor to get container ID from source file path.
-	var sourceProcessor processors.Processor
-	if config.MatchSource {
-		var procConf, _ = common.NewConfigFrom(map[string]interface{}{
-			"field":     "log.file.path",
-			"separator": string(os.PathSeparator),
-			"index":     config.SourceIndex,
-			"target":    dockerContainerIDKey,
-		})
-		sourceProcessor, err = actions.NewExtractField(procConf)
+	idPrecedence := config.Precedence
+	if len(config.Precedence) == 0 {
+		config.Precedence = defaultPrecedence
+		idPrecedence = defaultIDPrecedence
+	}
+
+	var pods *podMetadata
+	if config.Kubernetes.Enabled {
+		pods, err = newPodMetadata(log, config.Kubernetes, config.CleanupTimeout)
 		if err != nil {
-			return nil, err
+			log.Errorf("%v: kubernetes metadata not available: %v", processorName, err)
 		}
 	}
 
 	return &addDockerMetadata{
-		dockerAvailable:         dockerAvailable,
 		log:                     logp.NewLogger(processorName),
-		watcher:                 watcher,
+		runtime:                 runtime,
+		pods:                    pods,
+		precedence:              config.Precedence,
+		idPrecedence:            idPrecedence,
 		fields:                  config.Fields,
-		sourceProcessor:         sourceProcessor,
 		pidFields:               config.MatchPIDs,
 		hostFS:                  config.HostFS,
 		jobIDKey:                config.JobIDKey,
@@ -122,24 +113,22 @@ func lazyCgroupCacheInit(d *addDockerMetadata) {
 
 func (d *addDockerMetadata) Run(event *beat.Event) (*beat.Event, error) {
 	var cid string
-	var err error
 
-	if !d.dockerAvailable {
+	if d.runtime == nil && d.pods == nil {
 		return event, nil
 	}
 
 	// Extract CID from the filepath contained in the "log.file.path" field.
-	if d.sourceProcessor != nil {
-		lfp, _ := event.Fields.GetValue("log.file.path")
-		if lfp != nil {
-			event, err = d.sourceProcessor.Run(event)
-			if err != nil {
-				d.log.Debugf("Error while extracting container ID from source path: %v", err)
-				return event, nil
+	if lfp, _ := event.Fields.GetValue("log.file.path"); lfp != nil {
+		if path, ok := lfp.(string); ok {
+			if d.runtime != nil {
+				cid = d.runtime.ContainerID(path)
 			}
-
-			if v, err := event.GetValue(dockerContainerIDKey); err == nil {
-				cid, _ = v.(string)
+			if cid == "" && d.pods != nil {
+				cid = d.pods.ContainerID(path)
+			}
+			if cid != "" {
+				event.PutValue(dockerContainerIDKey, cid)
 			}
 		}
 	}
@@ -179,52 +168,58 @@ func (d *addDockerMetadata) Run(event *beat.Event) (*beat.Event, error) {
 		},
 	})
 
-	container := d.watcher.Container(cid)
-	if container == nil {
+	// Without a container runtime the metadata comes from the pod only.
+	var container *docker.Container
+	if d.runtime != nil {
+		container = d.runtime.Container(cid)
+	}
+	md := containerMetadata{precedence: d.precedence, container: container}
+	if d.pods != nil {
+		md.pod = d.pods.Pod(cid, container)
+	}
+	if container == nil && md.pod == nil {
 		d.log.Debugf("Container not found: cid=%s", cid)
 		return event, nil
 	}
+	id := cid
+	if container != nil {
+		id = container.ID
+		md.name, _ = container.LookUpLabel(containerNameLabel)
+	} else {
+		md.name = md.pod.names[cid]
+	}
 
 	var jobID, outputCollector string
 	tags := make(map[string]interface{})
 	labelRel := make(map[string]interface{})
 
 	// check is Job and update jobID
-	if v, ok := container.LookUpEnv(d.jobIDKey); ok {
-		jobID = v
-	}
-	if v, ok := container.LookUpLabel(d.jobIDKey); ok {
+	idMD := md
+	idMD.precedence = d.idPrecedence
+	if v, source := idMD.lookup(d.jobIDKey); source != "" {
 		jobID = v
 	}
 	// 检查并设置导出地址
-	if v, ok := container.LookUpEnv(d.outputCollectorKey); ok {
-		outputCollector = v
-	}
-	if v, ok := container.LookUpLabel(d.outputCollectorKey); ok {
+	if v, source := idMD.lookup(d.outputCollectorKey); source != "" {
 		outputCollector = v
 	}
 	if d.allLogAnalyse {
 		outputCollector = d.monitorLogCollectorAddr
 	}
 
-	// update tag from containers labels and envs
+	// update tag from containers labels, envs and pod annotations
 	for _, key := range d.tagKeyRel {
-		if v, ok := container.LookUpLabel(key); ok {
-			key = strings.TrimPrefix(key, "io.kubernetes.")
-			key = normalize(key)
-			tags[key] = v
-		}
-		if v, ok := container.LookUpEnv(key); ok {
+		if v, source := md.lookup(key); source != "" {
+			if source != sourceEnv {
+				key = strings.TrimPrefix(key, "io.kubernetes.")
+			}
 			tags[normalize(key)] = v
 		}
 	}
 
-	// update tag from containers labels and envs.
+	// update label from containers labels, envs and pod annotations.
 	for _, key := range d.labelKeyRel {
-		if v, ok := container.LookUpLabel(key); ok {
-			labelRel[key] = v
-		}
-		if v, ok := container.LookUpEnv(key); ok {
+		if v, source := md.lookup(key); source != "" {
 			labelRel[key] = v
 		}
 	}
@@ -232,7 +227,7 @@ func (d *addDockerMetadata) Run(event *beat.Event) (*beat.Event, error) {
 
 	if jobID == "" {
 		meta.Put("terminus.source", "container")
-		meta.Put("terminus.id", container.ID)
+		meta.Put("terminus.id", id)
 	} else {
 		meta.Put("terminus.source", "job")
 		meta.Put("terminus.id", jobID)
@@ -260,9 +255,22 @@ func (d *addDockerMetadata) bindDefaultTags(tags map[string]interface{}) {
 	}
 }
 
+func (d *addDockerMetadata) Close() error {
+	if d.runtime != nil {
+		d.runtime.Stop()
+	}
+	if d.pods != nil {
+		d.pods.Stop()
+	}
+	if d.cgroups != nil {
+		d.cgroups.StopJanitor()
+	}
+	return nil
+}
+
 func (d *addDockerMetadata) String() string {
-	return fmt.Sprintf("%v=[match_fields=[%v] match_pids=[%v]]",
-		processorName, strings.Join(d.fields, ", "), strings.Join(d.pidFields, ", "))
+	return fmt.Sprintf("%v=[runtime=%v match_fields=[%v] match_pids=[%v]]",
+		processorName, d.runtime, strings.Join(d.fields, ", "), strings.Join(d.pidFields, ", "))
 }
 
 // lookupContainerIDByPID finds the container ID based on PID fields contained
@@ -317,19 +325,100 @@ func (d *addDockerMetadata) getProcessCgroups(pid int) (map[string]string, error
 }
 
 // getContainerIDFromCgroups checks all of the processes' paths to see if any
-// of them are associated with Docker. Docker uses /docker/<CID> when
-// naming cgroups and we use this to determine the container ID. If no container
-// ID is found then an empty string is returned.
+// of them are associated with Docker or containerd. Docker uses /docker/<CID>
+// when naming cgroups, containerd uses cri-containerd-<CID>.scope with the
+// systemd driver and cri-containerd:<CID> otherwise, and we use this to
+// determine the container ID. If no container ID is found then an empty
+// string is returned.
 func getContainerIDFromCgroups(cgroups map[string]string) string {
 	for _, path := range cgroups {
 		if strings.HasPrefix(path, "/docker") {
 			return filepath.Base(path)
 		}
+		if base := filepath.Base(path); strings.Contains(base, "cri-containerd") {
+			base = strings.TrimSuffix(base, ".scope")
+			if idx := strings.LastIndexAny(base, ":-"); idx >= 0 {
+				return base[idx+1:]
+			}
+		}
 	}
 
 	return ""
 }
 
+const (
+	sourceEnv        = "env"
+	sourceLabel      = "label"
+	sourceAnnotation = "annotation"
+)
+
+// containerMetadata looks up a key in the envs, labels and annotations of a
+// container in the configured precedence. Values of the container runtime win
+// over the ones of the pod. Either the container or the pod may be nil.
+type containerMetadata struct {
+	precedence []string
+	container  *docker.Container
+	pod        *podInfo
+	name       string // container name in the pod spec
+}
+
+// lookup returns the value of key and the source it was found in, or an empty
+// source if the key is unknown.
+func (m containerMetadata) lookup(key string) (string, string) {
+	for _, source := range m.precedence {
+		switch source {
+		case sourceEnv:
+			if m.container != nil {
+				if v, ok := m.container.LookUpEnv(key); ok {
+					return v, source
+				}
+			}
+			if m.pod != nil {
+				if v, ok := m.pod.envs[m.name][key]; ok {
+					return v, source
+				}
+			}
+		case sourceLabel:
+			if m.container != nil {
+				if v, ok := m.container.LookUpLabel(key); ok {
+					return v, source
+				}
+			}
+			if m.pod != nil {
+				if v, ok := m.pod.labels[key]; ok {
+					return v, source
+				}
+			}
+		case sourceAnnotation:
+			if m.pod != nil {
+				if v, ok := m.pod.annotations[key]; ok {
+					return v, source
+				}
+			}
+		}
+	}
+	return "", ""
+}
+
+// defaultPrecedence is used when no precedence is configured. It is not part
+// of the default config, as a configured list would be merged into it.
+var defaultPrecedence = []string{sourceEnv, sourceLabel, sourceAnnotation}
+
+// defaultIDPrecedence is used for job_id_key and output_collector_key when no
+// precedence is configured, where the container label has always won.
+var defaultIDPrecedence = []string{sourceLabel, sourceEnv, sourceAnnotation}
+
+func validatePrecedence(precedence []string) error {
+	for _, source := range precedence {
+		switch source {
+		case sourceEnv, sourceLabel, sourceAnnotation:
+		default:
+			return fmt.Errorf("invalid precedence source %q, expected one of %s, %s, %s", source, sourceEnv, sourceLabel, sourceAnnotation)
+		}
+	}
+	return nil
+}
+
 func normalize(name string) string {
 	name = strings.Replace(name, ":", "_", -1)
 	name = strings.Replace(name, ".", "_", -1)
@@ -1 +1,42 @@
 package add_terminus_metadata
+
+import (
+	"github.com/elastic/beats/v7/libbeat/common/bus"
+	"github.com/elastic/beats/v7/libbeat/common/docker"
+	"github.com/elastic/beats/v7/libbeat/logp"
+)
+
+func MockWatcherFactory(containers map[string]*docker.Container) docker.WatcherConstructor {
+	if containers == nil {
+		containers = make(map[string]*docker.Container)
+	}
+	return func(_ *logp.Logger, host string, tls *docker.TLSConfig, shortID bool) (docker.Watcher, error) {
+		return &mockWatcher{containers: containers}, nil
+	}
+}
+
+type mockWatcher struct {
+	containers map[string]*docker.Container
+}
+
+func (m *mockWatcher) Start() error {
+	return nil
+}
+
+func (m *mockWatcher) Stop() {}
+
+func (m *mockWatcher) Container(ID string) *docker.Container {
+	return m.containers[ID]
+}
+
+func (m *mockWatcher) Containers() map[string]*docker.Container {
+	return m.containers
+}
+
+func (m *mockWatcher) ListenStart() bus.Listener {
+	return nil
+}
+
+func (m *mockWatcher) ListenStop() bus.Listener {
+	return nil
+}
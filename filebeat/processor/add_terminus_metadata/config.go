@@ -8,6 +8,10 @@ import (
 
 // Config for docker processor.
 type Config struct {
+	Runtime      string            `config:"runtime"`            // Container runtime: auto, docker or cri.
+	CRI          CRIConfig         `config:"cri"`                // CRI settings used by the cri runtime.
+	Kubernetes   KubernetesConfig  `config:"kubernetes"`         // Pod labels, annotations and envs from the Kubernetes API.
+	Precedence   []string          `config:"precedence"`         // Order of sources to look up keys in: env, label, annotation.
 	Host         string            `config:"host"`               // Docker socket (UNIX or TCP socket).
 	TLS          *docker.TLSConfig `config:"ssl"`                // TLS settings for connecting to Docker.
 	Fields       []string          `config:"match_fields"`       // A list of fields to match a container ID.
@@ -30,9 +34,32 @@ type Config struct {
 	MonitorLogCollectorAddr string `config:"monitor_log_collector_addr"`
 }
 
+// CRIConfig for connecting to the CRI runtime service of containerd or cri-o.
+type CRIConfig struct {
+	Endpoint string        `config:"endpoint"` // CRI socket (UNIX socket).
+	Timeout  time.Duration `config:"timeout"`  // Timeout of each CRI request.
+	MissTTL  time.Duration `config:"miss_ttl"` // Time before a failed lookup of a container is tried again.
+}
+
+func (c *Config) Validate() error {
+	if err := validateRuntime(c.Runtime); err != nil {
+		return err
+	}
+	return validatePrecedence(c.Precedence)
+}
+
 func defaultConfig() Config {
 	return Config{
-		Host: "unix:///var/run/docker.sock",
+		Runtime: runtimeAuto,
+		CRI: CRIConfig{
+			Endpoint: "unix:///run/containerd/containerd.sock",
+			Timeout:  5 * time.Second,
+			MissTTL:  30 * time.Second,
+		},
+		Kubernetes: KubernetesConfig{
+			SyncPeriod: 10 * time.Minute,
+		},
+		Host:        "unix:///var/run/docker.sock",
 		MatchSource: true,
 		SourceIndex: 4, // Use 4 to match the CID in /var/lib/docker/containers/<container_id>/*.log.
 		MatchPIDs:   []string{"process.pid", "process.ppid"},
@@ -0,0 +1,273 @@
+package add_terminus_metadata
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/common/docker"
+	"github.com/elastic/beats/v7/libbeat/logp"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
+)
+
+const (
+	podUIDLabel        = "io.kubernetes.pod.uid"
+	containerNameLabel = "io.kubernetes.container.name"
+)
+
+// containerLogName matches /var/log/containers/<pod>_<namespace>_<container>-<container_id>.log.
+var containerLogName = regexp.MustCompile(`^[^_]+_[^_]+_.+-([0-9a-f]{64})\.log`)
+
+// criRuntime looks up containers through the CRI RuntimeService, as served by
+// containerd or cri-o.
+type criRuntime struct {
+	log        *logp.Logger
+	conn       *grpc.ClientConn
+	client     runtimeapi.RuntimeServiceClient
+	timeout    time.Duration
+	containers *common.Cache // Cache of container ID (string) to *docker.Container.
+	paths      *common.Cache // Cache of pod log path (string) to container ID (string).
+	misses     *common.Cache // Keys of the failed lookups, not tried again before they expire.
+}
+
+func newCRIRuntime(log *logp.Logger, config Config) (containerRuntime, error) {
+	addr := strings.TrimPrefix(config.CRI.Endpoint, "unix://")
+	conn, err := grpc.Dial(addr,
+		grpc.WithInsecure(),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", addr)
+		}),
+	)
+	if err != nil {
+		return nil, errors.Wrapf(err, "fail to dial cri endpoint %s", config.CRI.Endpoint)
+	}
+
+	r := &criRuntime{
+		log:        log,
+		conn:       conn,
+		client:     runtimeapi.NewRuntimeServiceClient(conn),
+		timeout:    config.CRI.Timeout,
+		containers: common.NewCache(config.CleanupTimeout, 100),
+		paths:      common.NewCache(config.CleanupTimeout, 100),
+		misses:     common.NewCacheWithExpireOnAdd(config.CRI.MissTTL, 100),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+	version, err := r.client.Version(ctx, &runtimeapi.VersionRequest{})
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrapf(err, "fail to get version of cri endpoint %s", config.CRI.Endpoint)
+	}
+	log.Infof("%v: cri environment detected: %s %s", processorName, version.RuntimeName, version.RuntimeVersion)
+
+	r.containers.StartJanitor(5 * time.Second)
+	r.paths.StartJanitor(5 * time.Second)
+	r.misses.StartJanitor(5 * time.Second)
+	return r, nil
+}
+
+// podLogPath is a container log file in /var/log/pods/<namespace>_<pod>_<uid>/<container>/<attempt>.log.
+type podLogPath struct {
+	podUID    string
+	container string
+	attempt   uint32
+}
+
+// parsePodLogPath parses the kubelet pod log layout. Rotated files such as
+// 0.log.20210101-120000 or 0.log.20210101-120000.gz are accepted as well.
+func parsePodLogPath(path string) (podLogPath, bool) {
+	file := filepath.Base(path)
+	container := filepath.Base(filepath.Dir(path))
+	pod := strings.SplitN(filepath.Base(filepath.Dir(filepath.Dir(path))), "_", 3)
+	if len(pod) != 3 || container == "." || container == string(filepath.Separator) {
+		return podLogPath{}, false
+	}
+	idx := strings.Index(file, ".log")
+	if idx <= 0 {
+		return podLogPath{}, false
+	}
+	attempt, err := strconv.ParseUint(file[:idx], 10, 32)
+	if err != nil {
+		return podLogPath{}, false
+	}
+	return podLogPath{podUID: pod[2], container: container, attempt: uint32(attempt)}, true
+}
+
+func (r *criRuntime) ContainerID(path string) string {
+	if m := containerLogName.FindStringSubmatch(filepath.Base(path)); m != nil {
+		return m[1]
+	}
+	p, ok := parsePodLogPath(path)
+	if !ok {
+		return ""
+	}
+	key := filepath.Join(filepath.Dir(path), strconv.FormatUint(uint64(p.attempt), 10))
+	if cid, ok := r.paths.Get(key).(string); ok {
+		return cid
+	}
+	missKey := "path:" + key
+	if r.misses.Get(missKey) != nil {
+		return ""
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+	resp, err := r.client.ListContainers(ctx, &runtimeapi.ListContainersRequest{
+		Filter: &runtimeapi.ContainerFilter{
+			LabelSelector: map[string]string{
+				podUIDLabel:        p.podUID,
+				containerNameLabel: p.container,
+			},
+		},
+	})
+	if err != nil {
+		r.log.Debugf("fail to list containers of pod %s: %v", p.podUID, err)
+		r.misses.Put(missKey, true)
+		return ""
+	}
+
+	// Prefer the container of the attempt writing this file, otherwise the latest one.
+	var found *runtimeapi.Container
+	for _, c := range resp.Containers {
+		if c.Metadata != nil && c.Metadata.Attempt == p.attempt {
+			found = c
+			break
+		}
+		if found == nil || c.CreatedAt > found.CreatedAt {
+			found = c
+		}
+	}
+	if found == nil {
+		r.misses.Put(missKey, true)
+		return ""
+	}
+	r.paths.Put(key, found.Id)
+	return found.Id
+}
+
+func (r *criRuntime) Container(cid string) *docker.Container {
+	if c, ok := r.containers.Get(cid).(*docker.Container); ok {
+		return c
+	}
+	missKey := "container:" + cid
+	if r.misses.Get(missKey) != nil {
+		return nil
+	}
+	c, err := r.inspect(cid)
+	if err != nil {
+		r.log.Debugf("fail to inspect container %s: %v", cid, err)
+		r.misses.Put(missKey, true)
+		return nil
+	}
+	r.containers.Put(cid, c)
+	return c
+}
+
+// criContainerInfo is the verbose info of ContainerStatus. containerd reports
+// the envs in config.envs, cri-o only in the runtime spec.
+type criContainerInfo struct {
+	SandboxID string `json:"sandboxID"`
+	Config    struct {
+		Envs []struct {
+			Key   string `json:"key"`
+			Value string `json:"value"`
+		} `json:"envs"`
+	} `json:"config"`
+	RuntimeSpec struct {
+		Process struct {
+			Env []string `json:"env"`
+		} `json:"process"`
+	} `json:"runtimeSpec"`
+}
+
+func (r *criRuntime) inspect(cid string) (*docker.Container, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+
+	resp, err := r.client.ContainerStatus(ctx, &runtimeapi.ContainerStatusRequest{ContainerId: cid, Verbose: true})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Status == nil {
+		return nil, errors.New("empty container status")
+	}
+
+	c := &docker.Container{
+		ID:     resp.Status.Id,
+		Labels: make(map[string]string),
+		Envs:   make(map[string]string),
+	}
+	if resp.Status.Metadata != nil {
+		c.Name = resp.Status.Metadata.Name
+	}
+	if resp.Status.Image != nil {
+		c.Image = resp.Status.Image.Image
+	}
+	for k, v := range resp.Status.Labels {
+		c.Labels[k] = v
+	}
+
+	var info criContainerInfo
+	if raw, ok := resp.Info["info"]; ok {
+		if err := json.Unmarshal([]byte(raw), &info); err != nil {
+			r.log.Debugf("fail to decode info of container %s: %v", cid, err)
+		}
+	}
+	for _, env := range info.RuntimeSpec.Process.Env {
+		if kv := strings.SplitN(env, "=", 2); len(kv) == 2 {
+			c.Envs[kv[0]] = kv[1]
+		}
+	}
+	for _, env := range info.Config.Envs {
+		c.Envs[env.Key] = env.Value
+	}
+
+	// Pod labels don't override the labels of the container.
+	sandboxID := info.SandboxID
+	if sandboxID == "" {
+		sandboxID = r.sandboxID(ctx, cid)
+	}
+	if sandboxID != "" {
+		sandbox, err := r.client.PodSandboxStatus(ctx, &runtimeapi.PodSandboxStatusRequest{PodSandboxId: sandboxID})
+		if err != nil {
+			r.log.Debugf("fail to get status of pod sandbox %s: %v", sandboxID, err)
+		} else if sandbox.Status != nil {
+			for k, v := range sandbox.Status.Labels {
+				if _, ok := c.Labels[k]; !ok {
+					c.Labels[k] = v
+				}
+			}
+		}
+	}
+	return c, nil
+}
+
+func (r *criRuntime) sandboxID(ctx context.Context, cid string) string {
+	resp, err := r.client.ListContainers(ctx, &runtimeapi.ListContainersRequest{
+		Filter: &runtimeapi.ContainerFilter{Id: cid},
+	})
+	if err != nil || len(resp.Containers) == 0 {
+		return ""
+	}
+	return resp.Containers[0].PodSandboxId
+}
+
+func (r *criRuntime) Stop() {
+	r.containers.StopJanitor()
+	r.paths.StopJanitor()
+	r.misses.StopJanitor()
+	r.conn.Close()
+}
+
+func (r *criRuntime) String() string {
+	return runtimeCRI
+}
@@ -0,0 +1,237 @@
+package add_terminus_metadata
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/common/atomic"
+	"github.com/elastic/beats/v7/libbeat/common/docker"
+	"github.com/elastic/beats/v7/libbeat/logp"
+	"github.com/elastic/beats/v7/libbeat/processors"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
+)
+
+const (
+	testContainerID = "4c1a6c2a4f1a8c1bd3c1c4a0e1b7c33e6f5b2c7a1d9e8f0a1b2c3d4e5f6a7b8c"
+	testSandboxID   = "sandbox-1"
+	testPodUID      = "6f1f7f2c-1d9c-4a3e-9d2b-0c1e2f3a4b5c"
+)
+
+type fakeRuntimeService struct {
+	runtimeapi.UnimplementedRuntimeServiceServer
+	containers []*runtimeapi.Container
+	calls      atomic.Int // ListContainers and ContainerStatus requests
+}
+
+func (s *fakeRuntimeService) Version(context.Context, *runtimeapi.VersionRequest) (*runtimeapi.VersionResponse, error) {
+	return &runtimeapi.VersionResponse{RuntimeName: "containerd", RuntimeVersion: "v1.4.3"}, nil
+}
+
+func (s *fakeRuntimeService) ListContainers(_ context.Context, req *runtimeapi.ListContainersRequest) (*runtimeapi.ListContainersResponse, error) {
+	s.calls.Inc()
+	resp := &runtimeapi.ListContainersResponse{}
+	for _, c := range s.containers {
+		if req.Filter.Id != "" && req.Filter.Id != c.Id {
+			continue
+		}
+		match := true
+		for k, v := range req.Filter.LabelSelector {
+			if c.Labels[k] != v {
+				match = false
+			}
+		}
+		if match {
+			resp.Containers = append(resp.Containers, c)
+		}
+	}
+	return resp, nil
+}
+
+func (s *fakeRuntimeService) ContainerStatus(_ context.Context, req *runtimeapi.ContainerStatusRequest) (*runtimeapi.ContainerStatusResponse, error) {
+	s.calls.Inc()
+	for _, c := range s.containers {
+		if c.Id == req.ContainerId {
+			return &runtimeapi.ContainerStatusResponse{
+				Status: &runtimeapi.ContainerStatus{Id: c.Id, Metadata: c.Metadata, Labels: c.Labels},
+				Info: map[string]string{
+					"info": `{"sandboxID":"` + c.PodSandboxId + `","config":{"envs":[{"key":"DICE_ORG_NAME","value":"erda"},{"key":"TERMINUS_DEFINE_TAG","value":"job-1"}]}}`,
+				},
+			}, nil
+		}
+	}
+	return nil, errors.New("container not found")
+}
+
+func (s *fakeRuntimeService) PodSandboxStatus(_ context.Context, req *runtimeapi.PodSandboxStatusRequest) (*runtimeapi.PodSandboxStatusResponse, error) {
+	return &runtimeapi.PodSandboxStatusResponse{
+		Status: &runtimeapi.PodSandboxStatus{
+			Id:     req.PodSandboxId,
+			Labels: map[string]string{"app": "demo", containerNameLabel: "ignored"},
+		},
+	}, nil
+}
+
+func startFakeCRI(t *testing.T) (endpoint string, stop func()) {
+	endpoint, _, stop = startFakeCRIService(t)
+	return endpoint, stop
+}
+
+func startFakeCRIService(t *testing.T) (endpoint string, service *fakeRuntimeService, stop func()) {
+	dir, err := ioutil.TempDir("", "cri")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sock := filepath.Join(dir, "cri.sock")
+	lis, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer()
+	service = &fakeRuntimeService{
+		containers: []*runtimeapi.Container{
+			{
+				Id:           "previous",
+				PodSandboxId: testSandboxID,
+				Metadata:     &runtimeapi.ContainerMetadata{Name: "app", Attempt: 0},
+				Labels:       map[string]string{podUIDLabel: testPodUID, containerNameLabel: "app"},
+			},
+			{
+				Id:           testContainerID,
+				PodSandboxId: testSandboxID,
+				Metadata:     &runtimeapi.ContainerMetadata{Name: "app", Attempt: 1},
+				Labels: map[string]string{
+					podUIDLabel:                   testPodUID,
+					containerNameLabel:            "app",
+					"io.kubernetes.pod.name":      "demo-0",
+					"io.kubernetes.pod.namespace": "default",
+				},
+			},
+		},
+	}
+	runtimeapi.RegisterRuntimeServiceServer(srv, service)
+	go srv.Serve(lis)
+	return "unix://" + sock, service, func() {
+		srv.Stop()
+		os.RemoveAll(dir)
+	}
+}
+
+func noDocker(*logp.Logger, string, *docker.TLSConfig, bool) (docker.Watcher, error) {
+	return nil, errors.New("docker not available")
+}
+
+func TestParsePodLogPath(t *testing.T) {
+	p, ok := parsePodLogPath("/var/log/pods/default_demo-0_" + testPodUID + "/app/1.log")
+	assert.True(t, ok)
+	assert.Equal(t, podLogPath{podUID: testPodUID, container: "app", attempt: 1}, p)
+
+	p, ok = parsePodLogPath("/var/log/pods/default_demo-0_" + testPodUID + "/app/0.log.20210101-120000.gz")
+	assert.True(t, ok)
+	assert.Equal(t, uint32(0), p.attempt)
+
+	_, ok = parsePodLogPath("/var/lib/docker/containers/" + testContainerID + "/" + testContainerID + "-json.log")
+	assert.False(t, ok)
+}
+
+func TestCRIRuntime(t *testing.T) {
+	endpoint, stop := startFakeCRI(t)
+	defer stop()
+
+	p, err := buildDockerMetadataProcessor(logp.L(), common.MustNewConfigFrom(map[string]interface{}{
+		"runtime":      "auto",
+		"cri.endpoint": endpoint,
+		"tag_keys":     "DICE_ORG_NAME,io.kubernetes.pod.name",
+		"label_keys":   "app",
+	}), noDocker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer processors.Close(p)
+
+	for _, path := range []string{
+		"/var/log/pods/default_demo-0_" + testPodUID + "/app/1.log",
+		"/var/log/containers/demo-0_default_app-" + testContainerID + ".log",
+	} {
+		event, err := p.Run(&beat.Event{Fields: common.MapStr{"log": common.MapStr{"file": common.MapStr{"path": path}}}})
+		assert.NoError(t, err)
+
+		cid, _ := event.GetValue(dockerContainerIDKey)
+		assert.Equal(t, testContainerID, cid, path)
+		terminus, _ := event.GetValue("terminus")
+		assert.Equal(t, common.MapStr{
+			"source": "job",
+			"id":     "job-1",
+			"tags": common.MapStr{
+				"DICE_ORG_NAME": "erda",
+				"pod_name":      "demo-0",
+			},
+			"labels": common.MapStr{"app": "demo"},
+		}, terminus, path)
+	}
+}
+
+func TestCRIRuntimeCachesMisses(t *testing.T) {
+	endpoint, service, stop := startFakeCRIService(t)
+	defer stop()
+
+	config := defaultConfig()
+	config.CRI.Endpoint = endpoint
+	config.CRI.MissTTL = 50 * time.Millisecond
+	r, err := newCRIRuntime(logp.L(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	path := "/var/log/pods/default_gone-0_00000000-0000-0000-0000-000000000000/app/0.log"
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, "", r.ContainerID(path))
+		assert.Nil(t, r.Container("exited"))
+	}
+	assert.Equal(t, 2, service.calls.Load())
+
+	// The lookups are tried again once the misses expire.
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, "", r.ContainerID(path))
+	assert.Nil(t, r.Container("exited"))
+	assert.Equal(t, 4, service.calls.Load())
+}
+
+func TestCRIRuntimeUnavailable(t *testing.T) {
+	cfg := map[string]interface{}{
+		"cri.endpoint": "unix:///nonexistent/cri.sock",
+		"cri.timeout":  "100ms",
+	}
+	p, err := buildDockerMetadataProcessor(logp.L(), common.MustNewConfigFrom(cfg), noDocker)
+	assert.NoError(t, err)
+	event := &beat.Event{Fields: common.MapStr{"message": "foo"}}
+	out, err := p.Run(event)
+	assert.NoError(t, err)
+	assert.Equal(t, common.MapStr{"message": "foo"}, out.Fields)
+
+	cfg["runtime"] = "cri"
+	_, err = buildDockerMetadataProcessor(logp.L(), common.MustNewConfigFrom(cfg), noDocker)
+	assert.Error(t, err)
+}
+
+func TestGetContainerIDFromCgroups(t *testing.T) {
+	assert.Equal(t, testContainerID, getContainerIDFromCgroups(map[string]string{
+		"cpu": "/kubepods.slice/kubepods-burstable.slice/cri-containerd-" + testContainerID + ".scope",
+	}))
+	assert.Equal(t, testContainerID, getContainerIDFromCgroups(map[string]string{
+		"cpu": "/system.slice/containerd.service/kubepods-burstable:cri-containerd:" + testContainerID,
+	}))
+	assert.Equal(t, testContainerID, getContainerIDFromCgroups(map[string]string{
+		"cpu": "/docker/" + testContainerID,
+	}))
+}
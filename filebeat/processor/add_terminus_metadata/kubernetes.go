@@ -0,0 +1,299 @@
+package add_terminus_metadata
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/common/docker"
+	"github.com/elastic/beats/v7/libbeat/common/kubernetes"
+	"github.com/elastic/beats/v7/libbeat/logp"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8s "k8s.io/client-go/kubernetes"
+)
+
+// Virtual labels resolved from the owner references of a pod.
+const (
+	ownerKindLabel      = "io.kubernetes.pod.owner.kind"
+	ownerNameLabel      = "io.kubernetes.pod.owner.name"
+	deploymentNameLabel = "io.kubernetes.pod.deployment.name"
+	podTemplateHashKey  = "pod-template-hash"
+)
+
+// getKubernetesClient enables unit testing by allowing us to stub the client.
+var getKubernetesClient = kubernetes.GetKubernetesClient
+
+// KubernetesConfig for resolving pod metadata from the Kubernetes API.
+type KubernetesConfig struct {
+	Enabled           bool          `config:"enabled"`
+	KubeConfig        string        `config:"kube_config"`
+	Host              string        `config:"host"`                // Node to watch pods of, discovered if empty.
+	Namespace         string        `config:"namespace"`           // Namespace to watch pods of, all namespaces if empty.
+	SyncPeriod        time.Duration `config:"sync_period"`         // Timeout of the initial pod listing.
+	ResolveConfigMaps bool          `config:"resolve_config_maps"` // Resolve env values referencing config maps, secrets are never resolved.
+}
+
+// podMetadata keeps the pods of the node indexed by pod UID and container ID.
+type podMetadata struct {
+	log        *logp.Logger
+	client     k8s.Interface
+	watcher    kubernetes.Watcher
+	configMaps *common.Cache // Cache of namespace/name (string) to *configMapEntry.
+	resolveCM  bool
+	timeout    time.Duration
+
+	sync.RWMutex
+	pods    map[string]*podInfo
+	deleted map[string]time.Time // key -> when should this pod be deleted
+	done    chan struct{}
+}
+
+func newPodMetadata(log *logp.Logger, config KubernetesConfig, cleanupTimeout time.Duration) (*podMetadata, error) {
+	client, err := getKubernetesClient(config.KubeConfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to create kubernetes client")
+	}
+	node := kubernetes.DiscoverKubernetesNode(log, config.Host, kubernetes.IsInCluster(config.KubeConfig), client)
+	watcher, err := kubernetes.NewWatcher(client, &kubernetes.Pod{}, kubernetes.WatchOptions{
+		SyncTimeout: config.SyncPeriod,
+		Node:        node,
+		Namespace:   config.Namespace,
+	}, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to create kubernetes pod watcher")
+	}
+
+	m := &podMetadata{
+		log:        log,
+		client:     client,
+		watcher:    watcher,
+		configMaps: common.NewCache(cleanupTimeout, 100),
+		resolveCM:  config.ResolveConfigMaps,
+		timeout:    cleanupTimeout,
+		pods:       make(map[string]*podInfo),
+		deleted:    make(map[string]time.Time),
+		done:       make(chan struct{}),
+	}
+	watcher.AddEventHandler(kubernetes.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			m.addPod(obj.(*kubernetes.Pod))
+		},
+		UpdateFunc: func(obj interface{}) {
+			m.addPod(obj.(*kubernetes.Pod))
+		},
+		DeleteFunc: func(obj interface{}) {
+			m.removePod(obj.(*kubernetes.Pod))
+		},
+	})
+	if err := watcher.Start(); err != nil {
+		return nil, errors.Wrap(err, "fail to start kubernetes pod watcher")
+	}
+	m.configMaps.StartJanitor(5 * time.Second)
+	go m.cleanup()
+	return m, nil
+}
+
+func podKeys(pod *kubernetes.Pod) []string {
+	keys := []string{string(pod.UID)}
+	for _, statuses := range [][]kubernetes.PodContainerStatus{pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses} {
+		for _, s := range statuses {
+			if cid := kubernetes.ContainerID(s); cid != "" {
+				keys = append(keys, cid)
+			}
+		}
+	}
+	return keys
+}
+
+// podInfo is the metadata of a pod, resolved once per pod update.
+type podInfo struct {
+	labels      map[string]string
+	annotations map[string]string
+	envs        map[string]map[string]string // container name -> envs
+	ids         map[string]string            // container name -> container ID
+	names       map[string]string            // container ID -> container name
+}
+
+func (m *podMetadata) addPod(pod *kubernetes.Pod) {
+	m.log.Debugf("Adding kubernetes pod: %s/%s", pod.GetNamespace(), pod.GetName())
+	info := &podInfo{
+		labels:      m.labels(pod),
+		annotations: pod.Annotations,
+		envs:        make(map[string]map[string]string),
+		ids:         make(map[string]string),
+		names:       make(map[string]string),
+	}
+	for _, containers := range [][]kubernetes.Container{pod.Spec.InitContainers, pod.Spec.Containers} {
+		for _, c := range containers {
+			info.envs[c.Name] = m.envs(pod, c)
+		}
+	}
+	for _, statuses := range [][]kubernetes.PodContainerStatus{pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses} {
+		for _, s := range statuses {
+			if cid := kubernetes.ContainerID(s); cid != "" {
+				info.ids[s.Name] = cid
+				info.names[cid] = s.Name
+			}
+		}
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	for _, key := range podKeys(pod) {
+		delete(m.deleted, key)
+		m.pods[key] = info
+	}
+}
+
+// removePod keeps the pod for cleanup_timeout, so that the last lines of its
+// logs are still enriched.
+func (m *podMetadata) removePod(pod *kubernetes.Pod) {
+	m.log.Debugf("Removing kubernetes pod: %s/%s", pod.GetNamespace(), pod.GetName())
+	m.Lock()
+	defer m.Unlock()
+	for _, key := range podKeys(pod) {
+		m.deleted[key] = time.Now().Add(m.timeout)
+	}
+}
+
+func (m *podMetadata) cleanup() {
+	ticker := time.NewTicker(m.timeout)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.done:
+			return
+		case now := <-ticker.C:
+			m.Lock()
+			for key, t := range m.deleted {
+				if now.After(t) {
+					delete(m.deleted, key)
+					delete(m.pods, key)
+				}
+			}
+			m.Unlock()
+		}
+	}
+}
+
+// Pod returns the pod running the container, looked up by container ID first
+// and by the pod UID label of the container second.
+func (m *podMetadata) Pod(cid string, container *docker.Container) *podInfo {
+	m.RLock()
+	defer m.RUnlock()
+	if pod, ok := m.pods[cid]; ok {
+		return pod
+	}
+	if container != nil {
+		if uid, ok := container.LookUpLabel(podUIDLabel); ok {
+			return m.pods[uid]
+		}
+	}
+	return nil
+}
+
+// ContainerID returns the ID of the container writing the log file at path,
+// for the kubelet log layouts in /var/log/containers and /var/log/pods. It is
+// used when no container runtime is available.
+func (m *podMetadata) ContainerID(path string) string {
+	if match := containerLogName.FindStringSubmatch(filepath.Base(path)); match != nil {
+		return match[1]
+	}
+	p, ok := parsePodLogPath(path)
+	if !ok {
+		return ""
+	}
+	m.RLock()
+	defer m.RUnlock()
+	if pod, ok := m.pods[p.podUID]; ok {
+		return pod.ids[p.container]
+	}
+	return ""
+}
+
+// labels returns the pod labels together with the virtual owner labels.
+func (m *podMetadata) labels(pod *kubernetes.Pod) map[string]string {
+	labels := make(map[string]string, len(pod.Labels)+3)
+	for k, v := range pod.Labels {
+		labels[k] = v
+	}
+	if owner := metav1.GetControllerOf(pod); owner != nil {
+		labels[ownerKindLabel] = owner.Kind
+		labels[ownerNameLabel] = owner.Name
+		if hash, ok := pod.Labels[podTemplateHashKey]; ok && owner.Kind == "ReplicaSet" {
+			labels[deploymentNameLabel] = strings.TrimSuffix(owner.Name, "-"+hash)
+		}
+	}
+	return labels
+}
+
+// envs returns the env values of the container declared in the pod spec.
+func (m *podMetadata) envs(pod *kubernetes.Pod, c kubernetes.Container) map[string]string {
+	envs := make(map[string]string, len(c.Env))
+	for _, env := range c.Env {
+		if v, ok := m.envValue(pod, env); ok {
+			envs[env.Name] = v
+		}
+	}
+	return envs
+}
+
+func (m *podMetadata) envValue(pod *kubernetes.Pod, env v1.EnvVar) (string, bool) {
+	if env.ValueFrom == nil {
+		return env.Value, true
+	}
+	if ref := env.ValueFrom.FieldRef; ref != nil {
+		switch ref.FieldPath {
+		case "metadata.name":
+			return pod.Name, true
+		case "metadata.namespace":
+			return pod.Namespace, true
+		case "metadata.uid":
+			return string(pod.UID), true
+		case "spec.nodeName":
+			return pod.Spec.NodeName, true
+		case "spec.serviceAccountName":
+			return pod.Spec.ServiceAccountName, true
+		}
+		return "", false
+	}
+	if ref := env.ValueFrom.ConfigMapKeyRef; ref != nil && m.resolveCM {
+		v, ok := m.configMap(pod.Namespace, ref.Name)[ref.Key]
+		return v, ok
+	}
+	return "", false
+}
+
+type configMapEntry struct {
+	data    map[string]string
+	expires time.Time
+}
+
+// configMap returns the data of a config map. Both hits and misses are kept
+// for cleanup_timeout, so that pods sharing a config map don't query it each.
+func (m *podMetadata) configMap(namespace, name string) map[string]string {
+	key := namespace + "/" + name
+	if e, ok := m.configMaps.Get(key).(*configMapEntry); ok && time.Now().Before(e.expires) {
+		return e.data
+	}
+	e := &configMapEntry{expires: time.Now().Add(m.timeout)}
+	cm, err := m.client.CoreV1().ConfigMaps(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		m.log.Debugf("fail to get config map %s: %v", key, err)
+	} else {
+		e.data = cm.Data
+	}
+	m.configMaps.Put(key, e)
+	return e.data
+}
+
+func (m *podMetadata) Stop() {
+	m.watcher.Stop()
+	m.configMaps.StopJanitor()
+	close(m.done)
+}
@@ -0,0 +1,256 @@
+package add_terminus_metadata
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/common/docker"
+	"github.com/elastic/beats/v7/libbeat/logp"
+	"github.com/elastic/beats/v7/libbeat/processors"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8s "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func fakeKubernetesClient(t *testing.T) {
+	controller := true
+	client := fake.NewSimpleClientset(
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "web-abc-xyz",
+				Namespace: "default",
+				UID:       testPodUID,
+				Labels: map[string]string{
+					"DICE_APPLICATION_NAME": "web",
+					podTemplateHashKey:      "abc",
+				},
+				Annotations: map[string]string{
+					"DICE_ORG_NAME":      "erda-annotation",
+					"MONITOR_LOG_OUTPUT": "kafka",
+				},
+				OwnerReferences: []metav1.OwnerReference{
+					{Kind: "ReplicaSet", Name: "web-abc", Controller: &controller},
+				},
+			},
+			Spec: v1.PodSpec{
+				NodeName: "node-1",
+				Containers: []v1.Container{{
+					Name: "app",
+					Env: []v1.EnvVar{
+						{Name: "DICE_WORKSPACE", Value: "PROD"},
+						{Name: "DICE_PROJECT_NAME", ValueFrom: &v1.EnvVarSource{
+							ConfigMapKeyRef: &v1.ConfigMapKeySelector{
+								LocalObjectReference: v1.LocalObjectReference{Name: "dice"},
+								Key:                  "project",
+							},
+						}},
+						{Name: "POD_NAME", ValueFrom: &v1.EnvVarSource{
+							FieldRef: &v1.ObjectFieldSelector{FieldPath: "metadata.name"},
+						}},
+						{Name: "PASSWORD", ValueFrom: &v1.EnvVarSource{
+							SecretKeyRef: &v1.SecretKeySelector{
+								LocalObjectReference: v1.LocalObjectReference{Name: "dice"},
+								Key:                  "password",
+							},
+						}},
+					},
+				}},
+			},
+			Status: v1.PodStatus{
+				ContainerStatuses: []v1.ContainerStatus{{Name: "app", ContainerID: "containerd://" + testContainerID}},
+			},
+		},
+		&v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "dice", Namespace: "default"},
+			Data:       map[string]string{"project": "erda-project"},
+		},
+	)
+
+	orig := getKubernetesClient
+	getKubernetesClient = func(string) (k8s.Interface, error) { return client, nil }
+	t.Cleanup(func() { getKubernetesClient = orig })
+}
+
+func buildKubernetesProcessor(t *testing.T, settings map[string]interface{}) *addDockerMetadata {
+	fakeKubernetesClient(t)
+
+	cfg := map[string]interface{}{
+		"runtime":                        "docker",
+		"kubernetes.enabled":             true,
+		"kubernetes.host":                "node-1",
+		"kubernetes.resolve_config_maps": true,
+		"tag_keys":                       "DICE_ORG_NAME,DICE_APPLICATION_NAME,DICE_PROJECT_NAME,DICE_WORKSPACE,POD_NAME,PASSWORD,io.kubernetes.pod.deployment.name",
+		"label_keys":                     "MONITOR_LOG_OUTPUT",
+	}
+	for k, v := range settings {
+		cfg[k] = v
+	}
+	p, err := buildDockerMetadataProcessor(logp.L(), common.MustNewConfigFrom(cfg), MockWatcherFactory(map[string]*docker.Container{
+		testContainerID: {
+			ID:     testContainerID,
+			Labels: map[string]string{containerNameLabel: "app", podUIDLabel: testPodUID},
+			Envs:   map[string]string{"DICE_ORG_NAME": "erda"},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := p.(*addDockerMetadata)
+	t.Cleanup(func() { processors.Close(d) })
+
+	assert.NotNil(t, d.pods)
+	assert.Eventually(t, func() bool {
+		return d.pods.Pod(testContainerID, nil) != nil
+	}, 5*time.Second, 10*time.Millisecond)
+	return d
+}
+
+func runKubernetesProcessor(t *testing.T, d *addDockerMetadata) common.MapStr {
+	event, err := d.Run(&beat.Event{Fields: common.MapStr{
+		"log": common.MapStr{"file": common.MapStr{"path": "/var/lib/docker/containers/" + testContainerID + "/" + testContainerID + "-json.log"}},
+	}})
+	assert.NoError(t, err)
+	terminus, _ := event.GetValue("terminus")
+	return terminus.(common.MapStr)
+}
+
+func TestKubernetesMetadata(t *testing.T) {
+	d := buildKubernetesProcessor(t, nil)
+
+	terminus := runKubernetesProcessor(t, d)
+	assert.Equal(t, common.MapStr{
+		"DICE_ORG_NAME":         "erda",
+		"DICE_APPLICATION_NAME": "web",
+		"DICE_PROJECT_NAME":     "erda-project",
+		"DICE_WORKSPACE":        "PROD",
+		"POD_NAME":              "web-abc-xyz",
+		"pod_deployment_name":   "web",
+	}, terminus["tags"])
+	assert.Equal(t, common.MapStr{"MONITOR_LOG_OUTPUT": "kafka"}, terminus["labels"])
+}
+
+func TestKubernetesMetadataPrecedence(t *testing.T) {
+	d := buildKubernetesProcessor(t, map[string]interface{}{
+		"precedence": []string{"annotation", "label"},
+	})
+	assert.Equal(t, []string{sourceAnnotation, sourceLabel}, d.precedence)
+
+	tags := runKubernetesProcessor(t, d)["tags"]
+	assert.Equal(t, common.MapStr{
+		"DICE_ORG_NAME":         "erda-annotation",
+		"DICE_APPLICATION_NAME": "web",
+		"pod_deployment_name":   "web",
+	}, tags)
+}
+
+func TestKubernetesRemovedPodIsKept(t *testing.T) {
+	d := buildKubernetesProcessor(t, nil)
+
+	pod, err := d.pods.client.CoreV1().Pods("default").Get(context.TODO(), "web-abc-xyz", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.pods.removePod(pod)
+	assert.NotNil(t, d.pods.Pod(testContainerID, nil))
+	assert.NotNil(t, d.pods.Pod("", &docker.Container{Labels: map[string]string{podUIDLabel: testPodUID}}))
+}
+
+func TestIDLabelFirst(t *testing.T) {
+	container := &docker.Container{
+		ID: testContainerID,
+		Labels: map[string]string{
+			"TERMINUS_DEFINE_TAG":   "label-job",
+			"MONITOR_LOG_COLLECTOR": "http://label",
+			"DICE_ORG_NAME":         "label-org",
+		},
+		Envs: map[string]string{
+			"TERMINUS_DEFINE_TAG":   "env-job",
+			"MONITOR_LOG_COLLECTOR": "http://env",
+			"DICE_ORG_NAME":         "env-org",
+		},
+	}
+	run := func(settings map[string]interface{}) common.MapStr {
+		cfg := map[string]interface{}{"runtime": "docker", "tag_keys": "DICE_ORG_NAME"}
+		for k, v := range settings {
+			cfg[k] = v
+		}
+		p, err := buildDockerMetadataProcessor(logp.L(), common.MustNewConfigFrom(cfg), MockWatcherFactory(map[string]*docker.Container{
+			testContainerID: container,
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer processors.Close(p)
+		event, err := p.Run(&beat.Event{Fields: common.MapStr{
+			"log": common.MapStr{"file": common.MapStr{"path": "/var/lib/docker/containers/" + testContainerID + "/" + testContainerID + "-json.log"}},
+		}})
+		assert.NoError(t, err)
+		terminus, _ := event.GetValue("terminus")
+		return terminus.(common.MapStr)
+	}
+
+	// The label wins for the job ID and the output collector, the env for
+	// the other keys.
+	terminus := run(nil)
+	assert.Equal(t, "label-job", terminus["id"])
+	assert.Equal(t, common.MapStr{"collector": "http://label"}, terminus["output"])
+	assert.Equal(t, common.MapStr{"DICE_ORG_NAME": "env-org"}, terminus["tags"])
+
+	// A configured precedence applies to all keys.
+	terminus = run(map[string]interface{}{"precedence": []string{"env", "label"}})
+	assert.Equal(t, "env-job", terminus["id"])
+	assert.Equal(t, common.MapStr{"collector": "http://env"}, terminus["output"])
+}
+
+func TestKubernetesWithoutRuntime(t *testing.T) {
+	fakeKubernetesClient(t)
+
+	p, err := buildDockerMetadataProcessor(logp.L(), common.MustNewConfigFrom(map[string]interface{}{
+		"cri.endpoint":       "unix:///nonexistent/cri.sock",
+		"cri.timeout":        "100ms",
+		"kubernetes.enabled": true,
+		"kubernetes.host":    "node-1",
+		"tag_keys":           "DICE_ORG_NAME,DICE_WORKSPACE",
+	}), noDocker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := p.(*addDockerMetadata)
+	defer processors.Close(d)
+	assert.Nil(t, d.runtime)
+	assert.Eventually(t, func() bool {
+		return d.pods.Pod(testContainerID, nil) != nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	for _, path := range []string{
+		"/var/log/pods/default_web-abc-xyz_" + testPodUID + "/app/0.log",
+		"/var/log/containers/web-abc-xyz_default_app-" + testContainerID + ".log",
+	} {
+		event, err := d.Run(&beat.Event{Fields: common.MapStr{
+			"log": common.MapStr{"file": common.MapStr{"path": path}},
+		}})
+		assert.NoError(t, err)
+		terminus, _ := event.GetValue("terminus")
+		assert.Equal(t, common.MapStr{
+			"source": "container",
+			"id":     testContainerID,
+			"tags": common.MapStr{
+				"DICE_ORG_NAME":  "erda-annotation",
+				"DICE_WORKSPACE": "PROD",
+			},
+			"labels": common.MapStr{"MONITOR_LOG_OUTPUT": "kafka"},
+		}, terminus, path)
+	}
+}
+
+func TestInvalidPrecedence(t *testing.T) {
+	_, err := buildDockerMetadataProcessor(logp.L(), common.MustNewConfigFrom(map[string]interface{}{
+		"precedence": []string{"env", "secret"},
+	}), MockWatcherFactory(nil))
+	assert.Error(t, err)
+}
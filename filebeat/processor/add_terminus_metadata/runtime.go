@@ -0,0 +1,112 @@
+package add_terminus_metadata
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/elastic/beats/v7/libbeat/common/docker"
+	"github.com/elastic/beats/v7/libbeat/logp"
+	"github.com/pkg/errors"
+)
+
+const (
+	runtimeAuto   = "auto"
+	runtimeDocker = "docker"
+	runtimeCRI    = "cri"
+)
+
+// containerRuntime resolves containers and their envs/labels from the
+// container runtime of the node.
+type containerRuntime interface {
+	// ContainerID returns the ID of the container writing the log file at path,
+	// or an empty string if the path is not a container log of this runtime.
+	ContainerID(path string) string
+	// Container returns the container with the given ID, nil if it is unknown.
+	Container(cid string) *docker.Container
+	Stop()
+}
+
+// newRuntime creates the runtime selected by the configuration. In auto mode
+// docker is tried first and CRI second, nil is returned if neither is reachable.
+func newRuntime(log *logp.Logger, config Config, watcherConstructor docker.WatcherConstructor) (containerRuntime, error) {
+	switch config.Runtime {
+	case runtimeDocker:
+		return newDockerRuntime(log, config, watcherConstructor)
+	case runtimeCRI:
+		return newCRIRuntime(log, config)
+	}
+
+	r, err := newDockerRuntime(log, config, watcherConstructor)
+	if err == nil {
+		return r, nil
+	}
+	log.Infof("%v: docker environment not detected: %v", processorName, err)
+
+	r, err = newCRIRuntime(log, config)
+	if err == nil {
+		return r, nil
+	}
+	log.Errorf("%v: cri environment not detected: %v", processorName, err)
+	return nil, nil
+}
+
+type dockerRuntime struct {
+	watcher     docker.Watcher
+	matchSource bool
+	sourceIndex int
+}
+
+func newDockerRuntime(log *logp.Logger, config Config, watcherConstructor docker.WatcherConstructor) (containerRuntime, error) {
+	watcher, err := watcherConstructor(log, config.Host, config.TLS, config.MatchShortID)
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to create docker watcher")
+	}
+	if err = watcher.Start(); err != nil {
+		return nil, errors.Wrap(err, "failed to start watcher")
+	}
+	log.Infof("%v: docker environment detected", processorName)
+	return &dockerRuntime{
+		watcher:     watcher,
+		matchSource: config.MatchSource,
+		sourceIndex: config.SourceIndex,
+	}, nil
+}
+
+// ContainerID takes the path element at match_source_index, which is the
+// container ID in /var/lib/docker/containers/<container_id>/*.log.
+func (r *dockerRuntime) ContainerID(path string) string {
+	if !r.matchSource {
+		return ""
+	}
+	var parts []string
+	for _, part := range strings.Split(path, string(os.PathSeparator)) {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	if len(parts) < r.sourceIndex+1 {
+		return ""
+	}
+	return parts[r.sourceIndex]
+}
+
+func (r *dockerRuntime) Container(cid string) *docker.Container {
+	return r.watcher.Container(cid)
+}
+
+func (r *dockerRuntime) Stop() {
+	r.watcher.Stop()
+}
+
+func (r *dockerRuntime) String() string {
+	return runtimeDocker
+}
+
+func validateRuntime(name string) error {
+	switch name {
+	case runtimeAuto, runtimeDocker, runtimeCRI:
+		return nil
+	}
+	return fmt.Errorf("invalid runtime %q, expected one of %s, %s, %s", name, runtimeAuto, runtimeDocker, runtimeCRI)
+}
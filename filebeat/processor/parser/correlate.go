@@ -0,0 +1,336 @@
+package parser
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/conditions"
+	"github.com/elastic/beats/v7/libbeat/logp"
+	"github.com/elastic/beats/v7/libbeat/paths"
+	"github.com/elastic/beats/v7/libbeat/processors"
+)
+
+const correlateName = "correlate"
+
+// Actions of the correlation rules.
+const (
+	correlateStart  = "start"  // open a root key
+	correlateChild  = "child"  // bind a key to the root of its parent
+	correlateEnd    = "end"    // close a key, and everything bound to it for a root key
+	correlateLookup = "lookup" // find the root of a key
+)
+
+// correlatePresets are the built-in rules, selected by preset.
+var correlatePresets = map[string]string{
+	"spark": sparkPreset,
+}
+
+func init() {
+	processors.RegisterPlugin(correlateName, newCorrelate)
+}
+
+// correlateConfig correlates events to a root ID, such as the execution of
+// a spark job or the pipeline of an erda action. The first rule whose
+// condition matches an event applies, and the event is stamped with the
+// root ID in terminus.id and with source in terminus.source. If no rule
+// resolves a root, the ID is taken from the fallback.
+type correlateConfig struct {
+	Preset   string              `config:"preset"`
+	Source   string              `config:"source"`
+	Rules    []correlateRule     `config:"rules"`
+	Fallback *correlateFallback  `config:"fallback"`
+	Registry correlateRegistry   `config:"registry"`
+	TTL      map[string]duration `config:"ttl"`
+
+	DefaultTTL    time.Duration `config:"default_ttl" validate:"min=0,nonzero"`
+	CleanInterval time.Duration `config:"clean_interval" validate:"min=0,nonzero"`
+}
+
+type correlateRegistry struct {
+	Path        string      `config:"path"`
+	Permissions os.FileMode `config:"file_permissions"`
+}
+
+// correlateRule applies its action to the key of kind whose ID is the value
+// of the id field. A child rule binds the key to the parent key.
+type correlateRule struct {
+	When   conditions.Config `config:"when"`
+	Action string            `config:"action" validate:"required"`
+	Kind   string            `config:"kind" validate:"required"`
+	ID     string            `config:"id" validate:"required"`
+	Parent *struct {
+		Kind string `config:"kind" validate:"required"`
+		ID   string `config:"id" validate:"required"`
+	} `config:"parent"`
+}
+
+// correlateFallback takes the root ID from the first group of pattern in
+// the value of field.
+type correlateFallback struct {
+	Field   string         `config:"field" validate:"required"`
+	Pattern *regexp.Regexp `config:"pattern" validate:"required"`
+}
+
+// duration unpacks a time.Duration in a map, where ucfg leaves strings.
+type duration time.Duration
+
+func (d *duration) Unpack(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+func (r *correlateRule) Validate() error {
+	switch r.Action {
+	case correlateStart, correlateEnd, correlateLookup:
+	case correlateChild:
+		if r.Parent == nil {
+			return fmt.Errorf("child rule of kind '%v' requires a parent", r.Kind)
+		}
+	default:
+		return fmt.Errorf("unknown action '%v', must be one of start, child, end, lookup", r.Action)
+	}
+	if strings.Contains(r.Kind, "::") || (r.Parent != nil && strings.Contains(r.Parent.Kind, "::")) {
+		return fmt.Errorf("kind '%v' must not contain '::'", r.Kind)
+	}
+	return nil
+}
+
+func defaultCorrelateConfig() correlateConfig {
+	return correlateConfig{
+		Registry: correlateRegistry{
+			Path:        paths.Resolve(paths.Data, correlateName),
+			Permissions: 0600,
+		},
+		DefaultTTL:    time.Hour,
+		CleanInterval: time.Minute,
+	}
+}
+
+type correlate struct {
+	source   string
+	rules    []compiledRule
+	fallback *correlateFallback
+	state    *correlationState
+}
+
+type compiledRule struct {
+	correlateRule
+	cond conditions.Condition
+}
+
+func newCorrelate(c *common.Config) (processors.Processor, error) {
+	config := defaultCorrelateConfig()
+	if err := unpackCorrelateConfig(c, &config); err != nil {
+		return nil, err
+	}
+	return newCorrelateFromConfig(config)
+}
+
+// unpackCorrelateConfig unpacks the preset, if any, and then the config, so
+// that the config overrides the preset.
+func unpackCorrelateConfig(c *common.Config, config *correlateConfig) error {
+	if preset, err := c.String("preset", -1); err == nil && preset != "" {
+		if err := loadCorrelatePreset(preset, config); err != nil {
+			return err
+		}
+	}
+	if err := c.Unpack(config); err != nil {
+		return fmt.Errorf("fail to unpack the %s config: %s", correlateName, err)
+	}
+	return nil
+}
+
+func loadCorrelatePreset(name string, config *correlateConfig) error {
+	yml, ok := correlatePresets[name]
+	if !ok {
+		return fmt.Errorf("unknown %s preset '%v'", correlateName, name)
+	}
+	c, err := common.NewConfigWithYAML([]byte(yml), "preset "+name)
+	if err != nil {
+		return errors.Wrapf(err, "fail to load preset %s", name)
+	}
+	if err := c.Unpack(config); err != nil {
+		return errors.Wrapf(err, "fail to unpack preset %s", name)
+	}
+	return nil
+}
+
+func newCorrelateFromConfig(config correlateConfig) (*correlate, error) {
+	if len(config.Rules) == 0 && config.Fallback == nil {
+		return nil, fmt.Errorf("%s requires rules or a fallback", correlateName)
+	}
+
+	p := &correlate{source: config.Source, fallback: config.Fallback}
+	ttl := make(map[string]time.Duration)
+	for _, r := range config.Rules {
+		cond, err := conditions.NewCondition(&r.When)
+		if err != nil {
+			return nil, errors.Wrapf(err, "fail to create condition of %s rule for %s", r.Action, r.Kind)
+		}
+		p.rules = append(p.rules, compiledRule{correlateRule: r, cond: cond})
+		ttl[r.Kind] = config.DefaultTTL
+		if r.Parent != nil {
+			ttl[r.Parent.Kind] = config.DefaultTTL
+		}
+	}
+	for kind, d := range config.TTL {
+		ttl[kind] = time.Duration(d)
+	}
+
+	state, err := openCorrelationState(config.Registry.Path, config.Registry.Permissions, config.CleanInterval, ttl)
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to open correlation state")
+	}
+	p.state = state
+	return p, nil
+}
+
+func (p *correlate) Run(event *beat.Event) (*beat.Event, error) {
+	id := ""
+	for _, r := range p.rules {
+		if r.cond != nil && !r.cond.Check(event) {
+			continue
+		}
+		root, ok := p.apply(&r, event)
+		if ok {
+			_, id, _ = splitCorrelationKey(root)
+		}
+		break
+	}
+	if id == "" && p.fallback != nil {
+		id = p.fallbackID(event)
+	}
+	if id == "" {
+		return event, nil
+	}
+
+	event.PutValue("terminus.id", id)
+	if p.source != "" {
+		event.PutValue("terminus.source", p.source)
+	}
+	return event, nil
+}
+
+// apply applies a rule to an event and returns the root key.
+func (p *correlate) apply(r *compiledRule, event *beat.Event) (string, bool) {
+	id, ok := correlationID(event.Fields, r.ID)
+	if !ok {
+		return "", false
+	}
+	key := correlationKey(r.Kind, id)
+	now := time.Now()
+
+	switch r.Action {
+	case correlateStart:
+		if err := p.state.open(key, now); err != nil {
+			logp.Warn("fail to track %s: %s", key, err)
+		}
+		return key, true
+	case correlateChild:
+		parentID, ok := correlationID(event.Fields, r.Parent.ID)
+		if !ok {
+			return "", false
+		}
+		root, ok, err := p.state.bind(key, correlationKey(r.Parent.Kind, parentID), now)
+		if err != nil {
+			logp.Warn("fail to track %s: %s", key, err)
+		}
+		return root, ok
+	case correlateEnd:
+		root, ok, err := p.state.close(key)
+		if err != nil {
+			logp.Warn("fail to remove %s: %s", key, err)
+		}
+		return root, ok
+	default:
+		return p.state.lookup(key)
+	}
+}
+
+func (p *correlate) fallbackID(event *beat.Event) string {
+	v, err := event.GetValue(p.fallback.Field)
+	if err != nil {
+		return ""
+	}
+	s, ok := v.(string)
+	if !ok {
+		return ""
+	}
+	m := p.fallback.Pattern.FindStringSubmatch(s)
+	if len(m) < 2 {
+		return ""
+	}
+	return m[1]
+}
+
+// correlationID returns the value of a field as an ID. Keys containing
+// dots, such as spark.sql.execution.id, are matched as a whole.
+func correlationID(m common.MapStr, field string) (string, bool) {
+	v, ok := lookupField(m, field)
+	if !ok {
+		return "", false
+	}
+	return correlationValue(v)
+}
+
+// correlationValue returns a string or number as an ID.
+func correlationValue(v interface{}) (string, bool) {
+	switch val := v.(type) {
+	case string:
+		return val, val != ""
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64), true
+	case float32:
+		return strconv.FormatFloat(float64(val), 'f', -1, 32), true
+	}
+	if n, ok := convertInt64(v); ok {
+		return strconv.FormatInt(n, 10), true
+	}
+	return "", false
+}
+
+func lookupField(m map[string]interface{}, field string) (interface{}, bool) {
+	if v, ok := m[field]; ok {
+		return v, true
+	}
+	for i := 0; i < len(field); i++ {
+		if field[i] != '.' {
+			continue
+		}
+		var sub map[string]interface{}
+		switch v := m[field[:i]].(type) {
+		case map[string]interface{}:
+			sub = v
+		case common.MapStr:
+			sub = v
+		default:
+			continue
+		}
+		if v, ok := lookupField(sub, field[i+1:]); ok {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// Close releases the correlation state, which is closed with its last
+// processor.
+func (p *correlate) Close() error {
+	return p.state.release()
+}
+
+func (p *correlate) String() string {
+	return fmt.Sprintf("%s=[source=%s, rules=%d]", correlateName, p.source, len(p.rules))
+}
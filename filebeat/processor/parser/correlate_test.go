@@ -0,0 +1,236 @@
+package parser
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/monitoring"
+)
+
+const pipelineRules = `
+source: pipeline
+rules:
+  - when.equals.event: pipeline_start
+    action: start
+    kind: pipeline
+    id: pipeline.id
+  - when.equals.event: pipeline_end
+    action: end
+    kind: pipeline
+    id: pipeline.id
+  - when.equals.event: task_start
+    action: child
+    kind: task
+    id: task.id
+    parent:
+      kind: pipeline
+      id: pipeline.id
+  - when.equals.event: task_end
+    action: end
+    kind: task
+    id: task.id
+  - when.has_fields: [task.id]
+    action: lookup
+    kind: task
+    id: task.id
+fallback:
+  field: log.file.path
+  pattern: '/pipelines/([^/]+)/'
+`
+
+func newTestCorrelate(t *testing.T, yml string) *correlate {
+	dir, err := ioutil.TempDir("", "correlate")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	c, err := common.NewConfigWithYAML([]byte(yml), "test")
+	require.NoError(t, err)
+	require.NoError(t, c.SetString("registry.path", -1, dir))
+	p, err := newCorrelate(c)
+	require.NoError(t, err)
+	t.Cleanup(func() { p.(*correlate).Close() })
+	return p.(*correlate)
+}
+
+func TestCorrelateConfig(t *testing.T) {
+	cases := map[string]string{
+		"no rules":        `source: x`,
+		"unknown preset":  `preset: flink`,
+		"unknown action":  `rules: [{action: open, kind: a, id: a.id}]`,
+		"child no parent": `rules: [{action: child, kind: a, id: a.id}]`,
+		"no id":           `rules: [{action: start, kind: a}]`,
+		"kind separator":  `rules: [{action: start, kind: "a::b", id: a.id}]`,
+		"no pattern":      `fallback: {field: source}`,
+	}
+	for name, yml := range cases {
+		t.Run(name, func(t *testing.T) {
+			c, err := common.NewConfigWithYAML([]byte(yml), "test")
+			require.NoError(t, err)
+			_, err = newCorrelate(c)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestCorrelateRules(t *testing.T) {
+	p := newTestCorrelate(t, pipelineRules)
+
+	steps := []struct {
+		name   string
+		fields common.MapStr
+		id     interface{}
+	}{
+		{"task of unknown pipeline", common.MapStr{"event": "task_start", "task": common.MapStr{"id": 1}, "pipeline": common.MapStr{"id": 9}}, nil},
+		{"start", common.MapStr{"event": "pipeline_start", "pipeline": common.MapStr{"id": 9}}, "9"},
+		{"child", common.MapStr{"event": "task_start", "task": common.MapStr{"id": 1}, "pipeline": common.MapStr{"id": 9}}, "9"},
+		{"float ids", common.MapStr{"event": "task_start", "task": common.MapStr{"id": 2.0}, "pipeline": common.MapStr{"id": 9.0}}, "9"},
+		{"lookup", common.MapStr{"task": common.MapStr{"id": "1"}}, "9"},
+		{"end child", common.MapStr{"event": "task_end", "task": common.MapStr{"id": 1}}, "9"},
+		{"lookup ended child", common.MapStr{"task": common.MapStr{"id": 1}}, nil},
+		{"lookup other child", common.MapStr{"task": common.MapStr{"id": 2}}, "9"},
+		{"end root", common.MapStr{"event": "pipeline_end", "pipeline": common.MapStr{"id": 9}}, "9"},
+		{"lookup child of ended root", common.MapStr{"task": common.MapStr{"id": 2}}, nil},
+		{"fallback", common.MapStr{"task": common.MapStr{"id": 2}, "log": common.MapStr{"file": common.MapStr{"path": "/data/pipelines/42/task.log"}}}, "42"},
+		{"no match", common.MapStr{"message": "foo"}, nil},
+	}
+	for _, step := range steps {
+		event, err := p.Run(&beat.Event{Fields: step.fields})
+		require.NoError(t, err)
+		id, _ := event.GetValue("terminus.id")
+		assert.Equal(t, step.id, id, step.name)
+		if step.id != nil {
+			source, _ := event.GetValue("terminus.source")
+			assert.Equal(t, "pipeline", source, step.name)
+		}
+	}
+	assert.Equal(t, int64(0), p.state.gauge("pipeline").Get())
+	assert.Equal(t, int64(0), p.state.gauge("task").Get())
+}
+
+func TestCorrelatePreset(t *testing.T) {
+	p := newTestCorrelate(t, `
+preset: spark
+source: spark-sql
+ttl:
+  stage: 5m
+`)
+	assert.Equal(t, "spark-sql", p.source)
+	assert.Len(t, p.rules, 7)
+
+	event, err := p.Run(sparkEvent(sparkExecutionEvent("SparkListenerSQLExecutionStart", 3)))
+	require.NoError(t, err)
+	id, _ := event.GetValue("terminus.id")
+	assert.Equal(t, "3", id)
+	assert.Equal(t, int64(1), p.state.gauge("execution").Get())
+}
+
+func TestCorrelationID(t *testing.T) {
+	fields := common.MapStr{
+		"a":     common.MapStr{"b.c": map[string]interface{}{"d": int64(7)}},
+		"a.b":   "top",
+		"f":     1.5,
+		"e":     "",
+		"other": []string{"x"},
+	}
+	cases := []struct {
+		field string
+		id    string
+		ok    bool
+	}{
+		{"a.b.c.d", "7", true},
+		{"a.b", "top", true},
+		{"f", "1.5", true},
+		{"e", "", false},
+		{"other", "", false},
+		{"missing", "", false},
+	}
+	for _, c := range cases {
+		id, ok := correlationID(fields, c.field)
+		assert.Equal(t, c.ok, ok, c.field)
+		assert.Equal(t, c.id, id, c.field)
+	}
+}
+
+func TestCorrelationIndex(t *testing.T) {
+	p := newTestCorrelate(t, pipelineRules)
+	s := p.state
+	now := time.Now()
+
+	require.NoError(t, s.open("pipeline::1", now))
+	require.NoError(t, s.open("pipeline::2", now))
+	for _, key := range []string{"task::a", "task::b", "task::c"} {
+		_, ok, err := s.bind(key, "pipeline::1", now)
+		require.NoError(t, err)
+		require.True(t, ok)
+	}
+	// Updating the keys does not index them again.
+	_, _, err := s.bind("task::a", "pipeline::1", now)
+	require.NoError(t, err)
+	require.NoError(t, s.open("pipeline::1", now))
+	_, _, err = s.bind("task::c", "pipeline::2", now)
+	require.NoError(t, err)
+	_, _, err = s.close("task::b")
+	require.NoError(t, err)
+	root, _ := s.get("pipeline::1")
+	keys, _ := s.linked("pipeline::1", root)
+	assert.Equal(t, []string{"task::a", "task::b", "task::c"}, keys)
+
+	s.clean(now)
+	root, _ = s.get("pipeline::1")
+	keys, _ = s.linked("pipeline::1", root)
+	assert.Equal(t, []string{"task::a"}, keys)
+
+	// The keys bound to another root since are kept.
+	_, _, err = s.close("pipeline::1")
+	require.NoError(t, err)
+	_, ok := s.lookup("task::a")
+	assert.False(t, ok)
+	key, ok := s.lookup("task::c")
+	assert.True(t, ok)
+	assert.Equal(t, "pipeline::2", key)
+	has, err := s.store.Has(linkKey("pipeline::1", 0))
+	require.NoError(t, err)
+	assert.False(t, has)
+}
+
+func TestCorrelationLinksOlderState(t *testing.T) {
+	p := newTestCorrelate(t, pipelineRules)
+	s := p.state
+	now := time.Now()
+
+	// Older versions kept no links.
+	require.NoError(t, s.store.Set("pipeline::1", correlationEntry{Root: "pipeline::1", Updated: now}))
+	require.NoError(t, s.store.Set("task::a", correlationEntry{Root: "pipeline::1", Updated: now}))
+	s.clean(now)
+	root, _ := s.get("pipeline::1")
+	keys, _ := s.linked("pipeline::1", root)
+	assert.Equal(t, []string{"task::a"}, keys)
+
+	_, _, err := s.close("pipeline::1")
+	require.NoError(t, err)
+	_, ok := s.lookup("task::a")
+	assert.False(t, ok)
+}
+
+func TestCorrelationReleaseRemovesMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "correlate")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c, err := common.NewConfigWithYAML([]byte(pipelineRules), "test")
+	require.NoError(t, err)
+	require.NoError(t, c.SetString("registry.path", -1, dir))
+	p, err := newCorrelate(c)
+	require.NoError(t, err)
+	name := p.(*correlate).state.mname
+	require.NotNil(t, monitoring.Default.Get(name))
+	require.NoError(t, p.(*correlate).Close())
+	assert.Nil(t, monitoring.Default.Get(name))
+}
@@ -0,0 +1,458 @@
+package parser
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/elastic/beats/v7/libbeat/common/atomic"
+	"github.com/elastic/beats/v7/libbeat/logp"
+	"github.com/elastic/beats/v7/libbeat/monitoring"
+	"github.com/elastic/beats/v7/libbeat/statestore"
+	"github.com/elastic/beats/v7/libbeat/statestore/backend/memlog"
+)
+
+const correlationStoreName = "correlation"
+
+var correlationStateID atomic.Uint32
+
+// correlationStates holds the open states by registry path. Processors using
+// the same path share a state, so that their updates do not race.
+var correlationStates = struct {
+	sync.Mutex
+	m map[string]*correlationState
+}{m: make(map[string]*correlationState)}
+
+// correlationState keeps which root key, such as a spark execution, the keys
+// of other kinds, such as its jobs and stages, belong to. Keys are written
+// to a statestore as they change, and keys not updated within the TTL of
+// their kind are removed every clean interval.
+type correlationState struct {
+	log  *logp.Logger
+	root string
+	refs int
+	reg  *statestore.Registry
+
+	// mu serializes the updates reading the store before writing it.
+	mu     sync.Mutex
+	store  *statestore.Store
+	ttl    map[string]time.Duration
+	gauges map[string]*monitoring.Int
+	mreg   *monitoring.Registry
+	mname  string
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// correlationEntry is stored for every key. Root is the key of the root it
+// belongs to, a root key refers to itself. Links counts the links written
+// for a root key.
+type correlationEntry struct {
+	Root    string    `struct:"root"`
+	Updated time.Time `struct:"updated"`
+	Links   int       `struct:"links"`
+}
+
+// correlationLink is stored under a link key for every key bound to a root,
+// so that closing the root does not read the whole store, and binding a key
+// does not rewrite an index growing with the keys bound. A link may refer
+// to a key already closed, which clean prunes.
+type correlationLink struct {
+	Key string `struct:"key"`
+}
+
+// linkPrefix starts the link keys. Kinds are never empty, so link keys do
+// not collide with correlation keys.
+const linkPrefix = "::link::"
+
+func correlationKey(kind, id string) string {
+	return kind + "::" + id
+}
+
+// linkKey returns the key of the nth link of a root.
+func linkKey(root string, n int) string {
+	return linkPrefix + strconv.Itoa(n) + "::" + root
+}
+
+// splitLinkKey returns the root of a link key.
+func splitLinkKey(key string) (root string, ok bool) {
+	if !strings.HasPrefix(key, linkPrefix) {
+		return "", false
+	}
+	parts := strings.SplitN(key[len(linkPrefix):], "::", 2)
+	if len(parts) != 2 {
+		return "", false
+	}
+	return parts[1], true
+}
+
+func splitCorrelationKey(key string) (kind, id string, ok bool) {
+	parts := strings.SplitN(key, "::", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// openCorrelationState opens the state at path, or returns the state already
+// opened there. The clean interval of the first processor opening a path
+// applies, the TTLs of kinds already known are kept.
+func openCorrelationState(path string, perm os.FileMode, cleanInterval time.Duration, ttl map[string]time.Duration) (*correlationState, error) {
+	root, err := filepath.Abs(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "fail to resolve registry path %s", path)
+	}
+
+	correlationStates.Lock()
+	defer correlationStates.Unlock()
+	if s, ok := correlationStates.m[root]; ok {
+		s.mu.Lock()
+		for kind, d := range ttl {
+			if _, ok := s.ttl[kind]; !ok {
+				s.ttl[kind] = d
+			}
+		}
+		s.mu.Unlock()
+		s.refs++
+		return s, nil
+	}
+
+	log := logp.NewLogger(correlationStoreName).With("path", root)
+	backend, err := memlog.New(log, memlog.Settings{
+		Root:     root,
+		FileMode: perm,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to create correlation registry")
+	}
+	reg := statestore.NewRegistry(backend)
+	store, err := reg.Get(correlationStoreName)
+	if err != nil {
+		reg.Close()
+		return nil, errors.Wrap(err, "fail to open correlation store")
+	}
+
+	mname := "processor.correlate." + strconv.Itoa(int(correlationStateID.Inc())) + ".tracked"
+	s := &correlationState{
+		log:    log,
+		root:   root,
+		refs:   1,
+		reg:    reg,
+		store:  store,
+		ttl:    make(map[string]time.Duration, len(ttl)),
+		gauges: make(map[string]*monitoring.Int),
+		mreg:   monitoring.Default.NewRegistry(mname, monitoring.DoNotReport),
+		mname:  mname,
+		done:   make(chan struct{}),
+	}
+	for kind, d := range ttl {
+		s.ttl[kind] = d
+	}
+	s.clean(time.Now())
+
+	s.wg.Add(1)
+	go s.run(cleanInterval)
+	correlationStates.m[root] = s
+	return s, nil
+}
+
+// release closes the state when the last processor using it is closed.
+func (s *correlationState) release() error {
+	correlationStates.Lock()
+	defer correlationStates.Unlock()
+	s.refs--
+	if s.refs > 0 {
+		return nil
+	}
+	delete(correlationStates.m, s.root)
+
+	close(s.done)
+	s.wg.Wait()
+	monitoring.Default.Remove(s.mname)
+	if err := s.store.Close(); err != nil {
+		return errors.Wrap(err, "fail to close correlation store")
+	}
+	return s.reg.Close()
+}
+
+func (s *correlationState) run(interval time.Duration) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-ticker.C:
+			s.clean(now)
+		}
+	}
+}
+
+// gauge returns the number of tracked keys of a kind, reported under
+// processor.correlate.<id>.tracked.<kind>.
+func (s *correlationState) gauge(kind string) *monitoring.Int {
+	g, ok := s.gauges[kind]
+	if !ok {
+		g = monitoring.NewInt(s.mreg, kind)
+		s.gauges[kind] = g
+	}
+	return g
+}
+
+func (s *correlationState) get(key string) (correlationEntry, bool) {
+	var entry correlationEntry
+	if has, err := s.store.Has(key); err != nil || !has {
+		return entry, false
+	}
+	if err := s.store.Get(key, &entry); err != nil {
+		s.log.Warnf("fail to get correlation entry %s: %v", key, err)
+		return entry, false
+	}
+	return entry, true
+}
+
+func (s *correlationState) set(key string, entry correlationEntry) error {
+	has, err := s.store.Has(key)
+	if err != nil {
+		return err
+	}
+	if err := s.store.Set(key, entry); err != nil {
+		return err
+	}
+	if !has {
+		kind, _, _ := splitCorrelationKey(key)
+		s.gauge(kind).Inc()
+	}
+	return nil
+}
+
+func (s *correlationState) remove(key string) error {
+	has, err := s.store.Has(key)
+	if err != nil || !has {
+		return err
+	}
+	if err := s.store.Remove(key); err != nil {
+		return err
+	}
+	kind, _, _ := splitCorrelationKey(key)
+	s.gauge(kind).Dec()
+	return nil
+}
+
+// resolve returns the root of a tracked key whose root is still tracked.
+func (s *correlationState) resolve(key string) (string, bool) {
+	entry, ok := s.get(key)
+	if !ok {
+		return "", false
+	}
+	if entry.Root != key {
+		if _, ok := s.get(entry.Root); !ok {
+			return "", false
+		}
+	}
+	return entry.Root, true
+}
+
+// index writes a link from a root to a key bound to it.
+func (s *correlationState) index(root, key string) error {
+	entry, ok := s.get(root)
+	if !ok {
+		return nil
+	}
+	if err := s.store.Set(linkKey(root, entry.Links), correlationLink{Key: key}); err != nil {
+		return err
+	}
+	entry.Links++
+	return s.store.Set(root, entry)
+}
+
+// linked returns the keys linked to a root, with the link keys.
+func (s *correlationState) linked(root string, entry correlationEntry) (keys, links []string) {
+	for n := 0; n < entry.Links; n++ {
+		lk := linkKey(root, n)
+		if has, err := s.store.Has(lk); err != nil || !has {
+			continue
+		}
+		var link correlationLink
+		if err := s.store.Get(lk, &link); err != nil {
+			s.log.Warnf("fail to get correlation link %s: %v", lk, err)
+			continue
+		}
+		keys = append(keys, link.Key)
+		links = append(links, lk)
+	}
+	return keys, links
+}
+
+// update stores an entry, keeping the links of a root key and linking a key
+// newly bound to a root.
+func (s *correlationState) update(key string, entry correlationEntry) error {
+	prev, ok := s.get(key)
+	if entry.Root == key {
+		if ok && prev.Root == key {
+			entry.Links = prev.Links
+		}
+	} else if !ok || prev.Root != entry.Root {
+		if err := s.index(entry.Root, key); err != nil {
+			return err
+		}
+	}
+	return s.set(key, entry)
+}
+
+// open tracks a root key.
+func (s *correlationState) open(key string, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.update(key, correlationEntry{Root: key, Updated: now})
+}
+
+// bind tracks a key under the root of its parent and returns the root. It
+// returns false if the parent is not tracked.
+func (s *correlationState) bind(key, parent string, now time.Time) (string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	root, ok := s.resolve(parent)
+	if !ok {
+		return "", false, nil
+	}
+	return root, true, s.update(key, correlationEntry{Root: root, Updated: now})
+}
+
+// close stops tracking a key and returns its root. Closing a root key stops
+// tracking all keys bound to it.
+func (s *correlationState) close(key string) (string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.get(key)
+	if !ok {
+		return "", false, nil
+	}
+	if entry.Root != key {
+		return entry.Root, true, s.remove(key)
+	}
+
+	keys, links := s.linked(key, entry)
+	for i, k := range keys {
+		// The key may have been closed, or bound to another root since.
+		if e, ok := s.get(k); ok && e.Root == key {
+			if err := s.remove(k); err != nil {
+				return key, true, err
+			}
+		}
+		if err := s.store.Remove(links[i]); err != nil {
+			return key, true, err
+		}
+	}
+	return key, true, s.remove(key)
+}
+
+// lookup returns the root of a tracked key.
+func (s *correlationState) lookup(key string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.resolve(key)
+}
+
+// restore stores an entry, for importing older state. The root of a bound
+// key is restored first.
+func (s *correlationState) restore(key string, entry correlationEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.update(key, entry)
+}
+
+// clean removes the keys older than the TTL of their kind, the keys bound to
+// roots no longer tracked, and the links to keys no longer bound. It
+// recounts the tracked keys and links the bound keys missing a link, as
+// stored by older versions.
+func (s *correlationState) clean(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	roots := map[string]correlationEntry{}
+	bound := map[string]string{}
+	links := map[string]correlationLink{}
+	var expired []string
+	counts := map[string]int64{}
+	err := s.store.Each(func(key string, dec statestore.ValueDecoder) (bool, error) {
+		if _, ok := splitLinkKey(key); ok {
+			var link correlationLink
+			if err := dec.Decode(&link); err != nil {
+				expired = append(expired, key)
+			} else {
+				links[key] = link
+			}
+			return true, nil
+		}
+		kind, _, ok := splitCorrelationKey(key)
+		if !ok {
+			return true, nil
+		}
+		var entry correlationEntry
+		ttl, known := s.ttl[kind]
+		if err := dec.Decode(&entry); err != nil || (known && now.Sub(entry.Updated) > ttl) {
+			expired = append(expired, key)
+			return true, nil
+		}
+		if entry.Root == key {
+			roots[key] = entry
+		} else {
+			bound[key] = entry.Root
+		}
+		counts[kind]++
+		return true, nil
+	})
+	if err != nil {
+		s.log.Warnf("fail to iterate correlation store: %v", err)
+		return
+	}
+	for key, root := range bound {
+		if _, ok := roots[root]; !ok {
+			kind, _, _ := splitCorrelationKey(key)
+			counts[kind]--
+			expired = append(expired, key)
+			delete(bound, key)
+		}
+	}
+	linked := map[string]bool{}
+	for lk, link := range links {
+		root, _ := splitLinkKey(lk)
+		if bound[link.Key] != root {
+			expired = append(expired, lk)
+			continue
+		}
+		linked[link.Key] = true
+	}
+	for _, key := range expired {
+		if err := s.store.Remove(key); err != nil {
+			s.log.Warnf("fail to remove expired correlation entry %s: %v", key, err)
+		}
+	}
+	for key, root := range bound {
+		if linked[key] {
+			continue
+		}
+		if err := s.index(root, key); err != nil {
+			s.log.Warnf("fail to link correlation entry %s: %v", key, err)
+		}
+	}
+	for kind := range s.gauges {
+		s.gauge(kind).Set(counts[kind])
+	}
+	for kind, n := range counts {
+		s.gauge(kind).Set(n)
+	}
+	if len(expired) > 0 {
+		s.log.Debugf("removed %d expired correlation entries", len(expired))
+	}
+}
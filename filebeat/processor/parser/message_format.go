@@ -0,0 +1,329 @@
+package parser
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Types of the message formats.
+const (
+	formatRegex  = "regex"
+	formatJSON   = "json"
+	formatLogfmt = "logfmt"
+)
+
+// parsedMessage is what a format extracts from a message.
+type parsedMessage struct {
+	message   string
+	level     string
+	traceID   string
+	spanID    string
+	timestamp time.Time
+	tags      map[string]interface{}
+}
+
+// messageFormat parses the messages of one layout, it returns false for
+// messages of another layout.
+type messageFormat interface {
+	parse(message string) (*parsedMessage, bool)
+}
+
+// messageFormatConfig configures a format. A builtin format is referenced
+// by its name, the settings given override the builtin ones.
+type messageFormatConfig struct {
+	Name string `config:"name" validate:"required"`
+	Type string `config:"type"`
+	// Pattern of a regex format. The named groups time, level, trace_id,
+	// span_id are extracted, the comma separated items of ext_info are
+	// extracted as the erda format does.
+	Pattern     string              `config:"pattern"`
+	TimeLayouts []string            `config:"time_layouts"`
+	Fields      messageFieldsConfig `config:"fields"`
+}
+
+// messageFieldsConfig are the keys looked up in a json or logfmt message,
+// the first key present is used.
+type messageFieldsConfig struct {
+	Time    []string `config:"time"`
+	Level   []string `config:"level"`
+	TraceID []string `config:"trace_id"`
+	SpanID  []string `config:"span_id"`
+}
+
+const levelPattern = `[Aa]lert|ALERT|[Tt]race|TRACE|[Dd]ebug|DEBUG|[Nn]otice|NOTICE|[Ii]nfo|INFO|[Ww]arn(?:ing)?|WARN(?:ING)?|[Ee]rr(?:or)?|ERR(?:OR)?|[Cc]rit(?:ical)?|CRIT(?:ICAL)?|[Ff]atal|FATAL|[Ss]evere|SEVERE|[Ee]merg(?:ency)?|EMERG(?:ENCY)`
+
+var defaultTimeLayouts = []string{
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05Z07:00",
+	"2006-01-02 15:04:05Z07:00",
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04:05Z0700",
+}
+
+var defaultMessageFields = messageFieldsConfig{
+	Time:    []string{"time", "ts", "timestamp", "@timestamp"},
+	Level:   []string{"level", "severity", "lvl"},
+	TraceID: []string{"trace_id", "traceId", "traceID", "X-B3-TraceId", "request_id", "requestId", "request-id"},
+	SpanID:  []string{"span_id", "spanId", "spanID", "X-B3-SpanId"},
+}
+
+// builtinMessageFormats are tried in this order when no formats are set.
+var builtinMessageFormats = []messageFormatConfig{
+	{
+		// 2018-11-22 11:02:35.541  INFO [app,trace,span,true] 1 --- [main] logger : content
+		Name:    "spring_boot",
+		Type:    formatRegex,
+		Pattern: `^(?P<time>\d{4}-\d{2}-\d{2}[ T]\d{2}:\d{2}:\d{2}(?:[.,]\d+)?(?:Z|[+-]\d{2}:?\d{2})?)\s+(?P<level>TRACE|DEBUG|INFO|WARN|ERROR|FATAL)\s+(?:\[[^,\]]*,(?P<trace_id>[^,\]]*),(?P<span_id>[^,\]]*)[^\]]*\]\s+)?\d+\s+---\s+\[`,
+	},
+	{
+		// 2018-11-22 11:02:35.541 INFO [pmp,request-id,key=value] content
+		Name:    "erda",
+		Type:    formatRegex,
+		Pattern: `(?P<time>^\d{4}-\d{2}-\d{2} \d{1,2}:\d{1,2}:\d{1,2}(\.\d+)*)\s+(?P<level>` + levelPattern + `)\s+\[(?P<ext_info>.*?)\](?P<content>.*?$)`,
+	},
+	{Name: "json", Type: formatJSON},
+	{Name: "logfmt", Type: formatLogfmt},
+}
+
+func builtinMessageFormat(name string) (messageFormatConfig, bool) {
+	for _, f := range builtinMessageFormats {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	return messageFormatConfig{}, false
+}
+
+// newMessageFormat creates a format, filling unset settings from the builtin
+// format of the same name and from the defaults.
+func newMessageFormat(config messageFormatConfig, loc *time.Location) (messageFormat, error) {
+	if builtin, ok := builtinMessageFormat(config.Name); ok {
+		if config.Type == "" {
+			config.Type = builtin.Type
+		}
+		if config.Pattern == "" {
+			config.Pattern = builtin.Pattern
+		}
+	}
+	if len(config.TimeLayouts) == 0 {
+		config.TimeLayouts = defaultTimeLayouts
+	}
+	fields := &config.Fields
+	for _, f := range []struct{ set, def *[]string }{
+		{&fields.Time, &defaultMessageFields.Time},
+		{&fields.Level, &defaultMessageFields.Level},
+		{&fields.TraceID, &defaultMessageFields.TraceID},
+		{&fields.SpanID, &defaultMessageFields.SpanID},
+	} {
+		if len(*f.set) == 0 {
+			*f.set = *f.def
+		}
+	}
+	times := timeParser{layouts: config.TimeLayouts, loc: loc}
+
+	switch config.Type {
+	case formatRegex:
+		if config.Pattern == "" {
+			return nil, fmt.Errorf("regex format '%v' requires a pattern", config.Name)
+		}
+		regex, err := regexp.Compile(config.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("fail to compile pattern of format '%v': %s", config.Name, err)
+		}
+		return &regexFormat{regex: regex, times: times}, nil
+	case formatJSON:
+		return &jsonFormat{fields: config.Fields, times: times}, nil
+	case formatLogfmt:
+		return &logfmtFormat{fields: config.Fields, times: times}, nil
+	default:
+		return nil, fmt.Errorf("unknown type '%v' of format '%v', must be one of regex, json, logfmt", config.Type, config.Name)
+	}
+}
+
+type timeParser struct {
+	layouts []string
+	loc     *time.Location
+}
+
+func (t timeParser) parse(v interface{}) (time.Time, bool) {
+	switch val := v.(type) {
+	case string:
+		val = strings.Replace(val, ",", ".", 1)
+		for _, layout := range t.layouts {
+			if ts, err := time.ParseInLocation(layout, val, t.loc); err == nil {
+				return ts, true
+			}
+		}
+	case float64:
+		// epoch seconds of zap, or epoch milliseconds, to the microsecond.
+		if val < 1e11 {
+			val *= 1e3
+		}
+		return time.Unix(0, int64(math.Round(val*1e3))*int64(time.Microsecond)), true
+	}
+	return time.Time{}, false
+}
+
+type regexFormat struct {
+	regex *regexp.Regexp
+	times timeParser
+}
+
+func (f *regexFormat) parse(message string) (*parsedMessage, bool) {
+	matches := f.regex.FindStringSubmatch(message)
+	if matches == nil {
+		return nil, false
+	}
+
+	out := &parsedMessage{message: message, tags: make(map[string]interface{})}
+	for idx, name := range f.regex.SubexpNames() {
+		value := matches[idx]
+		switch name {
+		case "time":
+			out.timestamp, _ = f.times.parse(value)
+		case "level":
+			out.level = value
+		case "trace_id":
+			out.traceID = value
+		case "span_id":
+			out.spanID = value
+		case "ext_info":
+			newTagstr, tags := extractTags(value)
+			for k, v := range tags {
+				out.tags[k] = v
+			}
+			if id, ok := tags["request-id"].(string); ok {
+				out.traceID = id
+				delete(out.tags, "request-id")
+			}
+			out.message = strings.ReplaceAll(message, value, newTagstr)
+		}
+	}
+	return out, true
+}
+
+type jsonFormat struct {
+	fields messageFieldsConfig
+	times  timeParser
+}
+
+func (f *jsonFormat) parse(message string) (*parsedMessage, bool) {
+	trimmed := strings.TrimSpace(message)
+	if !strings.HasPrefix(trimmed, "{") {
+		return nil, false
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal([]byte(trimmed), &m); err != nil {
+		return nil, false
+	}
+	return parseMessageFields(message, m, f.fields, f.times), true
+}
+
+type logfmtFormat struct {
+	fields messageFieldsConfig
+	times  timeParser
+}
+
+func (f *logfmtFormat) parse(message string) (*parsedMessage, bool) {
+	m, ok := parseLogfmt(message)
+	if !ok || len(m) < 2 {
+		return nil, false
+	}
+	return parseMessageFields(message, m, f.fields, f.times), true
+}
+
+func parseMessageFields(message string, m map[string]interface{}, fields messageFieldsConfig, times timeParser) *parsedMessage {
+	out := &parsedMessage{message: message}
+	if v, ok := firstField(m, fields.Time); ok {
+		out.timestamp, _ = times.parse(v)
+	}
+	if v, ok := firstField(m, fields.Level); ok {
+		out.level, _ = v.(string)
+	}
+	if v, ok := firstField(m, fields.TraceID); ok {
+		out.traceID, _ = correlationValue(v)
+	}
+	if v, ok := firstField(m, fields.SpanID); ok {
+		out.spanID, _ = correlationValue(v)
+	}
+	return out
+}
+
+func firstField(m map[string]interface{}, keys []string) (interface{}, bool) {
+	for _, key := range keys {
+		if v, ok := lookupField(m, key); ok {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// parseLogfmt parses key=value pairs separated by spaces, values may be
+// double quoted. It returns false if the message is not made of pairs only.
+func parseLogfmt(message string) (map[string]interface{}, bool) {
+	m := make(map[string]interface{})
+	s := strings.TrimSpace(message)
+	for len(s) > 0 {
+		eq := strings.IndexByte(s, '=')
+		if eq <= 0 {
+			return nil, false
+		}
+		key := s[:eq]
+		if strings.ContainsAny(key, " \t\"") {
+			return nil, false
+		}
+		s = s[eq+1:]
+
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			end := 1
+			for ; end < len(s); end++ {
+				if s[end] == '\\' {
+					end++
+				} else if s[end] == '"' {
+					break
+				}
+			}
+			if end >= len(s) {
+				return nil, false
+			}
+			v, err := strconv.Unquote(s[:end+1])
+			if err != nil {
+				return nil, false
+			}
+			value, s = v, s[end+1:]
+			if len(s) > 0 && s[0] != ' ' && s[0] != '\t' {
+				return nil, false
+			}
+		} else if end := strings.IndexAny(s, " \t"); end >= 0 {
+			value, s = s[:end], s[end:]
+		} else {
+			value, s = s, ""
+		}
+		m[key] = value
+		s = strings.TrimLeft(s, " \t")
+	}
+	return m, true
+}
+
+// normalizeLevel upper cases a level, so that the levels of all formats
+// compare equal.
+func normalizeLevel(level string) string {
+	level = strings.ToUpper(level)
+	switch level {
+	case "WARNING":
+		return "WARN"
+	case "ERR":
+		return "ERROR"
+	case "CRITICAL":
+		return "CRIT"
+	case "EMERGENCY":
+		return "EMERG"
+	}
+	return level
+}
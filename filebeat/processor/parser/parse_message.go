@@ -1,31 +1,93 @@
 package parser
 
 import (
-	"regexp"
+	"fmt"
+	"strconv"
 	"strings"
-	"unsafe"
+	"time"
 
 	"github.com/elastic/beats/v7/libbeat/beat"
 	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/common/atomic"
+	"github.com/elastic/beats/v7/libbeat/logp"
+	"github.com/elastic/beats/v7/libbeat/monitoring"
 	"github.com/elastic/beats/v7/libbeat/processors"
 	"github.com/pkg/errors"
 )
 
+const parseMessageName = "parse_message"
+
+var parseMessageID atomic.Uint32
+
+// parseMessage tries the formats in order and extracts the level, trace ID,
+// span ID and time of the first format matching a message into
+// terminus.tags.
 type parseMessage struct {
-	regex *regexp.Regexp
+	log            *logp.Logger
+	names          []string
+	formats        []messageFormat
+	setTimestamp   bool
+	normalizeLevel bool
+	regName        string
+
+	metrics struct {
+		formats  []*monitoring.Int
+		unparsed *monitoring.Int
+	}
+}
+
+type parseMessageConfig struct {
+	// Formats are tried in order, all builtin formats when not set.
+	Formats []messageFormatConfig `config:"formats"`
+	// Timezone of the times without a zone.
+	Timezone string `config:"timezone"`
+	// SetTimestamp sets @timestamp to the time parsed.
+	SetTimestamp bool `config:"set_timestamp"`
+	// NormalizeLevel upper cases the levels and maps their aliases, such as
+	// warning to WARN, instead of keeping them as logged.
+	NormalizeLevel bool `config:"normalize_level"`
 }
 
 func init() {
-	processors.RegisterPlugin("parse_message", newParseMessage)
+	processors.RegisterPlugin(parseMessageName, newParseMessage)
 }
 
 func newParseMessage(c *common.Config) (processors.Processor, error) {
-	regex, err := regexp.Compile("(?P<timedate>^\\d{4}-\\d{2}-\\d{2} \\d{1,2}:\\d{1,2}:\\d{1,2}(\\.\\d+)*)\\s+(?P<log_level>[Aa]lert|ALERT|[Tt]race|TRACE|[Dd]ebug|DEBUG|[Nn]otice|NOTICE|[Ii]nfo|INFO|[Ww]arn(?:ing)?|WARN(?:ING)?|[Ee]rr(?:or)?|ERR(?:OR)?|[Cc]rit(?:ical)?|CRIT(?:ICAL)?|[Ff]atal|FATAL|[Ss]evere|SEVERE|[Ee]merg(?:ency)?|EMERG(?:ENCY))\\s+\\[(?P<ext_info>.*?)\\](?P<content>.*?$)")
+	config := parseMessageConfig{Timezone: "Local"}
+	if c != nil {
+		if err := c.Unpack(&config); err != nil {
+			return nil, fmt.Errorf("fail to unpack the %s config: %s", parseMessageName, err)
+		}
+	}
+	if len(config.Formats) == 0 {
+		config.Formats = builtinMessageFormats
+	}
+	loc, err := time.LoadLocation(config.Timezone)
 	if err != nil {
-		return nil, errors.Wrap(err, "parse failed")
+		return nil, errors.Wrapf(err, "fail to load timezone %s", config.Timezone)
 	}
 
-	return &parseMessage{regex: regex}, nil
+	regName := "processor." + parseMessageName + "." + strconv.Itoa(int(parseMessageID.Inc()))
+	reg := monitoring.Default.NewRegistry(regName, monitoring.DoNotReport)
+	p := &parseMessage{
+		log:            logp.NewLogger(parseMessageName),
+		setTimestamp:   config.SetTimestamp,
+		normalizeLevel: config.NormalizeLevel,
+		regName:        regName,
+	}
+	p.metrics.unparsed = monitoring.NewInt(reg, "unparsed")
+	formats := reg.NewRegistry("formats")
+	for _, fc := range config.Formats {
+		f, err := newMessageFormat(fc, loc)
+		if err != nil {
+			monitoring.Default.Remove(regName)
+			return nil, err
+		}
+		p.names = append(p.names, fc.Name)
+		p.formats = append(p.formats, f)
+		p.metrics.formats = append(p.metrics.formats, monitoring.NewInt(formats, fc.Name))
+	}
+	return p, nil
 }
 
 func (p *parseMessage) Run(event *beat.Event) (*beat.Event, error) {
@@ -33,12 +95,62 @@ func (p *parseMessage) Run(event *beat.Event) (*beat.Event, error) {
 	if err != nil {
 		return event, errors.Wrap(err, "fail to get message value")
 	}
-	out, tags := p.parseV2(message.(string))
-	event.PutValue("message", out)
-	common.MergeFieldsDeep(event.Fields, common.MapStr{"terminus": common.MapStr{"tags": tags}}, true)
+	s, ok := message.(string)
+	if !ok {
+		p.metrics.unparsed.Inc()
+		p.log.Debugf("message of type %T is not a string", message)
+		return event, nil
+	}
+
+	parsed, ok := p.parse(s)
+	if !ok {
+		p.metrics.unparsed.Inc()
+		return event, nil
+	}
+	event.PutValue("message", parsed.message)
+	common.MergeFieldsDeep(event.Fields, common.MapStr{"terminus": common.MapStr{"tags": messageTags(parsed, p.normalizeLevel)}}, true)
+	if p.setTimestamp && !parsed.timestamp.IsZero() {
+		event.Timestamp = parsed.timestamp
+	}
 	return event, nil
 }
 
+// parse returns the message parsed by the first matching format.
+func (p *parseMessage) parse(message string) (*parsedMessage, bool) {
+	for i, f := range p.formats {
+		if parsed, ok := f.parse(message); ok {
+			p.metrics.formats[i].Inc()
+			return parsed, true
+		}
+	}
+	return nil, false
+}
+
+// messageTags are the tags of a parsed message, named the same for all
+// formats. The level is kept as logged unless normalized.
+func messageTags(parsed *parsedMessage, normalize bool) map[string]interface{} {
+	tags := make(map[string]interface{}, len(parsed.tags)+4)
+	for k, v := range parsed.tags {
+		tags[k] = v
+	}
+	if parsed.level != "" {
+		tags["level"] = parsed.level
+		if normalize {
+			tags["level"] = normalizeLevel(parsed.level)
+		}
+	}
+	if parsed.traceID != "" {
+		tags["request-id"] = parsed.traceID
+	}
+	if parsed.spanID != "" {
+		tags["span-id"] = parsed.spanID
+	}
+	if !parsed.timestamp.IsZero() {
+		tags["timestamp"] = parsed.timestamp.Format(time.RFC3339Nano)
+	}
+	return tags
+}
+
 func extractTags(raw string) (tagstr string, tags map[string]interface{}) {
 	tagstr, tags = "", make(map[string]interface{})
 	for idx, item := range strings.Split(raw, ",") {
@@ -63,60 +175,12 @@ func extractTags(raw string) (tagstr string, tags map[string]interface{}) {
 	return
 }
 
-// https://yuque.antfin.com/spot/develop-docs/gkfxgl
-func (p *parseMessage) parseV2(message string) (string, map[string]interface{}) {
-	if !p.regex.Match(stringToBytes(message)) {
-		return message, map[string]interface{}{}
-	}
-
-	groupNames := p.regex.SubexpNames()
-	level, tagstr := "", ""
-	for _, matches := range p.regex.FindAllStringSubmatch(message, -1) {
-		for idx, name := range groupNames {
-			switch name {
-			case "log_level":
-				level = matches[idx]
-			case "ext_info":
-				tagstr = matches[idx]
-			}
-		}
-	}
-
-	newTagstr, tags := extractTags(tagstr)
-	tags["level"] = level
-	return strings.ReplaceAll(message, tagstr, newTagstr), tags
-}
-
-func (p *parseMessage) parse(message string) (string, map[string]interface{}) {
-	matches := p.regex.FindStringSubmatch(message)
-	if len(matches) < 4 {
-		return message, nil
-	}
-
-	m := make(map[string]interface{})
-	m["level"] = strings.ToUpper(matches[2])
-	replace := "$1"
-
-	attrs := strings.Split(matches[3], ",")
-	if len(attrs) < 3 {
-		return message, m
-	}
-	m["request-id"] = attrs[1]
-	replace += " - [" + strings.Join(attrs[0:3], ",") + "]"
-
-	for i := 2; i < len(attrs); i++ {
-		kv := strings.Split(attrs[i], ":")
-		if len(kv) == 2 {
-			m[kv[0]] = kv[1]
-		}
-	}
-	return p.regex.ReplaceAllString(message, replace), m
-}
-
-func (*parseMessage) String() string {
-	return "parse_message"
+// Close removes the metrics of the processor.
+func (p *parseMessage) Close() error {
+	monitoring.Default.Remove(p.regName)
+	return nil
 }
 
-func stringToBytes(s string) []byte {
-	return *(*[]byte)(unsafe.Pointer(&s))
+func (p *parseMessage) String() string {
+	return fmt.Sprintf("%s=[formats=%s]", parseMessageName, strings.Join(p.names, ","))
 }
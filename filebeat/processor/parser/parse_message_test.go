@@ -3,14 +3,28 @@ package parser
 import (
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/monitoring"
 )
 
-func Test_parseMessage_parseV2(t *testing.T) {
-	pro, err := newParseMessage(nil)
-	assert.Nil(t, err)
-	p := pro.(*parseMessage)
+func newTestParseMessage(t *testing.T, settings map[string]interface{}) *parseMessage {
+	cfg := map[string]interface{}{"timezone": "UTC"}
+	for k, v := range settings {
+		cfg[k] = v
+	}
+	pro, err := newParseMessage(common.MustNewConfigFrom(cfg))
+	require.NoError(t, err)
+	return pro.(*parseMessage)
+}
+
+func Test_parseMessage_parse(t *testing.T) {
+	p := newTestParseMessage(t, nil)
 
 	type args struct {
 		message string
@@ -30,6 +44,7 @@ func Test_parseMessage_parseV2(t *testing.T) {
 				"userid":     "1",
 				"orderid":    "xyz",
 				"level":      "INFO",
+				"timestamp":  "2018-11-22T11:02:35.541Z",
 			},
 		},
 		{
@@ -39,6 +54,7 @@ func Test_parseMessage_parseV2(t *testing.T) {
 			map[string]interface{}{
 				"request-id": "07409b69-2595-4e38-b895-5846cf1e0d8b",
 				"level":      "INFO",
+				"timestamp":  "2018-11-22T11:02:35.541Z",
 			},
 		},
 		{
@@ -48,6 +64,7 @@ func Test_parseMessage_parseV2(t *testing.T) {
 			map[string]interface{}{
 				"request-id": "07409b69-2595-4e38-b895-5846cf1e0d8b",
 				"level":      "INFO",
+				"timestamp":  "2018-11-22T11:02:35.541Z",
 			},
 		},
 		{
@@ -55,26 +72,172 @@ func Test_parseMessage_parseV2(t *testing.T) {
 			args{message: "2018-11-22 11:02:35.541 INFO [07409b69-2595-4e38-b895-5846cf1e0d8b] - [main] o.s.j.e.a.AnnotationMBeanExporter        : Registering beans for JMX exposure on start"},
 			"2018-11-22 11:02:35.541 INFO [07409b69-2595-4e38-b895-5846cf1e0d8b] - [main] o.s.j.e.a.AnnotationMBeanExporter        : Registering beans for JMX exposure on start",
 			map[string]interface{}{
+				"level":     "INFO",
+				"timestamp": "2018-11-22T11:02:35.541Z",
+			},
+		},
+		{
+			"spring boot",
+			args{message: "2018-11-22 11:02:35.541  WARN [pmp,5f1e2d,6a7b8c,true] 1 --- [           main] o.s.b.w.e.tomcat.TomcatWebServer         : Tomcat started"},
+			"2018-11-22 11:02:35.541  WARN [pmp,5f1e2d,6a7b8c,true] 1 --- [           main] o.s.b.w.e.tomcat.TomcatWebServer         : Tomcat started",
+			map[string]interface{}{
+				"request-id": "5f1e2d",
+				"span-id":    "6a7b8c",
+				"level":      "WARN",
+				"timestamp":  "2018-11-22T11:02:35.541Z",
+			},
+		},
+		{
+			"spring boot 3",
+			args{message: "2018-11-22T11:02:35.541+08:00 ERROR 1 --- [main] o.s.boot.SpringApplication : Application run failed"},
+			"2018-11-22T11:02:35.541+08:00 ERROR 1 --- [main] o.s.boot.SpringApplication : Application run failed",
+			map[string]interface{}{
+				"level":     "ERROR",
+				"timestamp": "2018-11-22T11:02:35.541+08:00",
+			},
+		},
+		{
+			"zap",
+			args{message: `{"level":"warn","ts":1542884555.541,"msg":"slow request","trace_id":"abc","span_id":"def"}`},
+			`{"level":"warn","ts":1542884555.541,"msg":"slow request","trace_id":"abc","span_id":"def"}`,
+			map[string]interface{}{
+				"request-id": "abc",
+				"span-id":    "def",
+				"level":      "warn",
+				"timestamp":  "2018-11-22T11:02:35.541Z",
+			},
+		},
+		{
+			"logback",
+			args{message: `{"@timestamp":"2018-11-22T11:02:35.541+00:00","level":"INFO","message":"started","traceId":"abc","spanId":"def"}`},
+			`{"@timestamp":"2018-11-22T11:02:35.541+00:00","level":"INFO","message":"started","traceId":"abc","spanId":"def"}`,
+			map[string]interface{}{
+				"request-id": "abc",
+				"span-id":    "def",
 				"level":      "INFO",
+				"timestamp":  "2018-11-22T11:02:35.541Z",
+			},
+		},
+		{
+			"logrus",
+			args{message: `{"level":"warning","msg":"retry","time":"2018-11-22T11:02:35Z"}`},
+			`{"level":"warning","msg":"retry","time":"2018-11-22T11:02:35Z"}`,
+			map[string]interface{}{
+				"level":     "warning",
+				"timestamp": "2018-11-22T11:02:35Z",
 			},
 		},
 		{
-			"4",
+			"logfmt",
+			args{message: `time=2018-11-22T11:02:35Z level=error msg="fail to connect" request_id=abc`},
+			`time=2018-11-22T11:02:35Z level=error msg="fail to connect" request_id=abc`,
+			map[string]interface{}{
+				"request-id": "abc",
+				"level":      "error",
+				"timestamp":  "2018-11-22T11:02:35Z",
+			},
+		},
+		{
+			"unparsed",
 			args{message: "2018-11-22 11:02:35.541 INFO xxx - xxx o.s.j.e.a.AnnotationMBeanExporter        : Registering beans for JMX exposure on start"},
-			"2018-11-22 11:02:35.541 INFO xxx - xxx o.s.j.e.a.AnnotationMBeanExporter        : Registering beans for JMX exposure on start",
-			map[string]interface{}{},
+			"",
+			nil,
+		},
+		{
+			"not logfmt",
+			args{message: `a=1 b="unterminated`},
+			"",
+			nil,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, got1 := p.parseV2(tt.args.message)
-			if got != tt.want {
-				t.Errorf("parseV2() got = %v, want %v", got, tt.want)
+			parsed, ok := p.parse(tt.args.message)
+			if tt.want1 == nil {
+				assert.False(t, ok)
+				return
 			}
-			if !reflect.DeepEqual(got1, tt.want1) {
-				t.Errorf("parseV2() got1 = %v, want %v", got1, tt.want1)
+			require.True(t, ok)
+			if parsed.message != tt.want {
+				t.Errorf("parse() got = %v, want %v", parsed.message, tt.want)
 			}
+			if got1 := messageTags(parsed, false); !reflect.DeepEqual(got1, tt.want1) {
+				t.Errorf("parse() got1 = %v, want %v", got1, tt.want1)
+			}
+		})
+	}
+}
+
+func TestParseMessageFormats(t *testing.T) {
+	p := newTestParseMessage(t, map[string]interface{}{
+		"formats": []map[string]interface{}{
+			{"name": "json", "fields.trace_id": []string{"ctx.trace"}},
+			{"name": "nginx", "type": "regex", "pattern": `^(?P<trace_id>\w+) \[(?P<time>[^\]]+)\]`, "time_layouts": []string{"02/Jan/2006:15:04:05 -0700"}},
+		},
+		"set_timestamp": true,
+	})
+	assert.Equal(t, []string{"json", "nginx"}, p.names)
 
+	event, err := p.Run(&beat.Event{Fields: common.MapStr{"message": `{"level":"info","ctx":{"trace":"abc"}}`}})
+	require.NoError(t, err)
+	id, _ := event.GetValue("terminus.tags.request-id")
+	assert.Equal(t, "abc", id)
+
+	event, err = p.Run(&beat.Event{Fields: common.MapStr{"message": `def [22/Nov/2018:11:02:35 +0000] "GET / HTTP/1.1" 200`}})
+	require.NoError(t, err)
+	id, _ = event.GetValue("terminus.tags.request-id")
+	assert.Equal(t, "def", id)
+	assert.Equal(t, time.Date(2018, 11, 22, 11, 2, 35, 0, time.UTC), event.Timestamp.UTC())
+
+	// The spring boot format is not configured.
+	_, err = p.Run(&beat.Event{Fields: common.MapStr{"message": "2018-11-22 11:02:35.541  INFO 1 --- [main] o.s.Foo : bar"}})
+	require.NoError(t, err)
+	_, err = p.Run(&beat.Event{Fields: common.MapStr{"message": 42}})
+	require.NoError(t, err)
+
+	assert.Equal(t, int64(1), p.metrics.formats[0].Get())
+	assert.Equal(t, int64(1), p.metrics.formats[1].Get())
+	assert.Equal(t, int64(2), p.metrics.unparsed.Get())
+}
+
+func TestParseMessageNormalizeLevel(t *testing.T) {
+	// The levels as logged and normalized.
+	messages := map[string][2]string{
+		`{"level":"Info","msg":"started"}`:    {"Info", "INFO"},
+		`{"level":"warning","msg":"retry"}`:   {"warning", "WARN"},
+		`level=err msg="fail to connect"`:     {"err", "ERROR"},
+		`{"level":"critical","msg":"failed"}`: {"critical", "CRIT"},
+	}
+	for i, normalize := range []bool{false, true} {
+		p := newTestParseMessage(t, map[string]interface{}{"normalize_level": normalize})
+		for message, levels := range messages {
+			event, err := p.Run(&beat.Event{Fields: common.MapStr{"message": message}})
+			require.NoError(t, err)
+			level, _ := event.GetValue("terminus.tags.level")
+			assert.Equal(t, levels[i], level, message)
+		}
+		require.NoError(t, p.Close())
+	}
+}
+
+func TestParseMessageClose(t *testing.T) {
+	p := newTestParseMessage(t, nil)
+	require.NotNil(t, monitoring.Default.Get(p.regName))
+	require.NoError(t, p.Close())
+	assert.Nil(t, monitoring.Default.Get(p.regName))
+}
+
+func TestParseMessageConfig(t *testing.T) {
+	cases := map[string]map[string]interface{}{
+		"unknown type":     {"formats": []map[string]interface{}{{"name": "custom", "type": "xml"}}},
+		"no pattern":       {"formats": []map[string]interface{}{{"name": "custom", "type": "regex"}}},
+		"invalid pattern":  {"formats": []map[string]interface{}{{"name": "custom", "type": "regex", "pattern": "("}}},
+		"unknown timezone": {"timezone": "Mars/Olympus"},
+	}
+	for name, cfg := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := newParseMessage(common.MustNewConfigFrom(cfg))
+			assert.Error(t, err)
 		})
 	}
 }
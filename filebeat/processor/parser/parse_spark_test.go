@@ -0,0 +1,136 @@
+package parser
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/common"
+)
+
+func newTestParseSpark(t *testing.T, dir string, settings map[string]interface{}) *parseSpark {
+	cfg := map[string]interface{}{"registry.path": dir}
+	for k, v := range settings {
+		cfg[k] = v
+	}
+	p, err := newParseSpark(common.MustNewConfigFrom(cfg))
+	require.NoError(t, err)
+	return p.(*parseSpark)
+}
+
+func sparkEvent(m map[string]interface{}) *beat.Event {
+	return &beat.Event{Fields: common.MapStr{"spark": m, "source": "/data/spark-app.log"}}
+}
+
+func runSpark(t *testing.T, p *parseSpark, m map[string]interface{}) interface{} {
+	event, err := p.Run(sparkEvent(m))
+	require.NoError(t, err)
+	id, _ := event.GetValue("terminus.id")
+	return id
+}
+
+func sparkExecutionEvent(name string, id int64) map[string]interface{} {
+	return map[string]interface{}{"Event": "org.apache.spark.sql.execution.ui." + name, "executionId": id}
+}
+
+func sparkJobStart(job int64, execution string) map[string]interface{} {
+	return map[string]interface{}{
+		"Event":      "SparkListenerJobStart",
+		"Job ID":     job,
+		"Properties": map[string]interface{}{"spark.sql.execution.id": execution},
+	}
+}
+
+func sparkStageSubmitted(stage int64, execution string) map[string]interface{} {
+	return map[string]interface{}{
+		"Event":      "SparkListenerStageSubmitted",
+		"Stage Info": map[string]interface{}{"Stage ID": stage},
+		"Properties": map[string]interface{}{"spark.sql.execution.id": execution},
+	}
+}
+
+func sparkTask(stage int64) map[string]interface{} {
+	return map[string]interface{}{"Event": "SparkListenerTaskStart", "Stage ID": stage}
+}
+
+func TestParseSparkRelations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "parse_spark")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	p := newTestParseSpark(t, dir, nil)
+	assert.Equal(t, "7", runSpark(t, p, sparkExecutionEvent("SparkListenerSQLExecutionStart", 7)))
+	assert.Equal(t, "7", runSpark(t, p, sparkJobStart(1, "7")))
+	assert.Equal(t, "7", runSpark(t, p, sparkStageSubmitted(2, "7")))
+	assert.Equal(t, "app", runSpark(t, p, sparkJobStart(3, "8")), "unknown execution falls back to the path")
+	assert.Equal(t, int64(1), p.state.gauge("execution").Get())
+	assert.Equal(t, int64(1), p.state.gauge("job").Get())
+	assert.Equal(t, int64(1), p.state.gauge("stage").Get())
+
+	// A second processor on the same path shares the state, which survives
+	// closing the first one.
+	other := newTestParseSpark(t, dir, nil)
+	assert.Equal(t, p.state, other.state)
+	require.NoError(t, p.Close())
+	assert.Equal(t, "7", runSpark(t, other, sparkTask(2)))
+	require.NoError(t, other.Close())
+
+	// Every change is persisted without waiting for a flush.
+	p = newTestParseSpark(t, dir, nil)
+	assert.Equal(t, "7", runSpark(t, p, sparkTask(2)))
+	assert.Equal(t, "7", runSpark(t, p, sparkExecutionEvent("SparkListenerSQLExecutionEnd", 7)))
+	assert.Equal(t, "app", runSpark(t, p, sparkTask(2)))
+	assert.Equal(t, int64(0), p.state.gauge("execution").Get())
+	assert.Equal(t, int64(0), p.state.gauge("job").Get())
+	assert.Equal(t, int64(0), p.state.gauge("stage").Get())
+	require.NoError(t, p.Close())
+}
+
+func TestParseSparkExpire(t *testing.T) {
+	dir, err := ioutil.TempDir("", "parse_spark")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	p := newTestParseSpark(t, dir, map[string]interface{}{"stage_expire": "1m"})
+	defer p.Close()
+	runSpark(t, p, sparkExecutionEvent("SparkListenerSQLExecutionStart", 7))
+	runSpark(t, p, sparkStageSubmitted(2, "7"))
+
+	p.state.clean(time.Now().Add(2 * time.Minute))
+	assert.Equal(t, int64(1), p.state.gauge("execution").Get())
+	assert.Equal(t, int64(0), p.state.gauge("stage").Get())
+	assert.Equal(t, "app", runSpark(t, p, sparkTask(2)))
+
+	p.state.clean(time.Now().Add(2 * time.Hour))
+	assert.Equal(t, int64(0), p.state.gauge("execution").Get())
+}
+
+func TestParseSparkImportFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "parse_spark")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	data, err := json.Marshal(legacySparkRel{
+		ExecutionRel:       map[int64]time.Time{7: now},
+		ExecutionJobsRel:   map[int64]map[int64]time.Time{7: {1: now}},
+		ExecutionStagesRel: map[int64]map[int64]time.Time{7: {2: now}},
+	})
+	require.NoError(t, err)
+	file := filepath.Join(dir, "spark.json")
+	require.NoError(t, ioutil.WriteFile(file, data, 0600))
+
+	p := newTestParseSpark(t, filepath.Join(dir, "registry"), map[string]interface{}{"path": file})
+	defer p.Close()
+	assert.Equal(t, "7", runSpark(t, p, sparkTask(2)))
+	assert.Equal(t, int64(1), p.state.gauge("job").Get())
+	assert.FileExists(t, file+".imported")
+	assert.NoFileExists(t, file)
+}
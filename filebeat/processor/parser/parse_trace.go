@@ -0,0 +1,307 @@
+package parser
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/common/atomic"
+	"github.com/elastic/beats/v7/libbeat/logp"
+	"github.com/elastic/beats/v7/libbeat/monitoring"
+	"github.com/elastic/beats/v7/libbeat/processors"
+)
+
+const parseTraceName = "parse_trace"
+
+// Formats of the trace context.
+const (
+	traceW3C        = "w3c"
+	traceB3         = "b3"
+	traceOTel       = "otel"
+	traceSkyWalking = "skywalking"
+)
+
+var parseTraceID atomic.Uint32
+
+var (
+	// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+	traceparentRegex = regexp.MustCompile(`(?i)\b([0-9a-f]{2})-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})\b`)
+	// X-B3-TraceId=463ac35c9f6413ad X-B3-SpanId=a2fb4a1d1a96d312 X-B3-Sampled=1
+	b3TraceIDRegex = regexp.MustCompile(`(?i)X-B3-TraceId["']?\s*[=:]\s*["']?([0-9a-z]+)`)
+	b3SpanIDRegex  = regexp.MustCompile(`(?i)X-B3-SpanId["']?\s*[=:]\s*["']?([0-9a-z]+)`)
+	b3SampledRegex = regexp.MustCompile(`(?i)X-B3-Sampled["']?\s*[=:]\s*["']?(0|1|true|false|d)`)
+	// b3=463ac35c9f6413ad-a2fb4a1d1a96d312-1
+	b3SingleRegex = regexp.MustCompile(`(?i)\bb3["']?\s*[=:]\s*["']?([0-9a-z]+)-([0-9a-z]+)(?:-(0|1|d))?`)
+	// [TID:2a1b3c4d5e6f.42.16409875938470001]
+	skyWalkingRegex   = regexp.MustCompile(`TID:\s*([^\s\[\],]+)`)
+	skyWalkingIDRegex = regexp.MustCompile(`^[0-9A-Za-z._-]{1,128}$`)
+)
+
+var otelTraceIDKeys = []string{"trace_id", "traceId", "traceid"}
+var otelSpanIDKeys = []string{"span_id", "spanId", "spanid"}
+var otelFlagsKeys = []string{"trace_flags", "traceFlags", "flags"}
+
+// traceContext is the trace context found in an event. sampled is nil if
+// the format carries no sampling flag.
+type traceContext struct {
+	traceID string
+	spanID  string
+	sampled *bool
+}
+
+// traceDetector finds a trace context in a message. It returns false if the
+// message has none, and an error if the context found is invalid.
+type traceDetector func(message string) (*traceContext, bool, error)
+
+var traceDetectors = map[string]traceDetector{
+	traceW3C:        detectW3C,
+	traceB3:         detectB3,
+	traceOTel:       detectOTel,
+	traceSkyWalking: detectSkyWalking,
+}
+
+type parseTraceConfig struct {
+	Field string `config:"field"`
+	// Formats are tried in order, all formats when not set.
+	Formats []string `config:"formats"`
+	// DropUnsampled drops the events whose trace is not sampled.
+	DropUnsampled bool `config:"drop_unsampled"`
+	// Overwrite replaces a trace.id already set on the event.
+	Overwrite bool `config:"overwrite"`
+}
+
+type parseTrace struct {
+	config    parseTraceConfig
+	log       *logp.Logger
+	detectors []traceDetector
+	regName   string
+
+	metrics struct {
+		formats []*monitoring.Int
+		invalid *monitoring.Int
+		dropped *monitoring.Int
+	}
+}
+
+func init() {
+	processors.RegisterPlugin(parseTraceName, newParseTrace)
+}
+
+func newParseTrace(c *common.Config) (processors.Processor, error) {
+	config := parseTraceConfig{Field: "message"}
+	if err := c.Unpack(&config); err != nil {
+		return nil, fmt.Errorf("fail to unpack the %s config: %s", parseTraceName, err)
+	}
+	if len(config.Formats) == 0 {
+		config.Formats = []string{traceW3C, traceB3, traceOTel, traceSkyWalking}
+	}
+
+	regName := "processor." + parseTraceName + "." + strconv.Itoa(int(parseTraceID.Inc()))
+	reg := monitoring.Default.NewRegistry(regName, monitoring.DoNotReport)
+	p := &parseTrace{config: config, log: logp.NewLogger(parseTraceName), regName: regName}
+	p.metrics.invalid = monitoring.NewInt(reg, "invalid")
+	p.metrics.dropped = monitoring.NewInt(reg, "dropped")
+	formats := reg.NewRegistry("formats")
+	for _, name := range config.Formats {
+		detector, ok := traceDetectors[name]
+		if !ok {
+			monitoring.Default.Remove(regName)
+			return nil, fmt.Errorf("unknown trace format '%v', must be one of w3c, b3, otel, skywalking", name)
+		}
+		p.detectors = append(p.detectors, detector)
+		p.metrics.formats = append(p.metrics.formats, monitoring.NewInt(formats, name))
+	}
+	return p, nil
+}
+
+func (p *parseTrace) Run(event *beat.Event) (*beat.Event, error) {
+	if !p.config.Overwrite {
+		if has, _ := event.Fields.HasKey("trace.id"); has {
+			return event, nil
+		}
+	}
+	v, err := event.GetValue(p.config.Field)
+	if err != nil {
+		return event, nil
+	}
+	message, ok := v.(string)
+	if !ok {
+		return event, nil
+	}
+
+	for i, detect := range p.detectors {
+		tc, found, err := detect(message)
+		if err != nil {
+			p.metrics.invalid.Inc()
+			p.log.Debugf("invalid %s trace context: %v", p.config.Formats[i], err)
+			continue
+		}
+		if !found {
+			continue
+		}
+		p.metrics.formats[i].Inc()
+		if p.config.DropUnsampled && tc.sampled != nil && !*tc.sampled {
+			p.metrics.dropped.Inc()
+			return nil, nil
+		}
+		event.PutValue("trace.id", tc.traceID)
+		event.PutValue("terminus.tags.trace_id", tc.traceID)
+		if tc.spanID != "" {
+			event.PutValue("span.id", tc.spanID)
+		}
+		return event, nil
+	}
+	return event, nil
+}
+
+func detectW3C(message string) (*traceContext, bool, error) {
+	m := traceparentRegex.FindStringSubmatch(message)
+	if m == nil {
+		return nil, false, nil
+	}
+	version, traceID, spanID, flags := m[1], m[2], m[3], m[4]
+	if strings.ToLower(m[0]) != m[0] {
+		return nil, false, fmt.Errorf("traceparent %s is not lower case", m[0])
+	}
+	if version == "ff" {
+		return nil, false, fmt.Errorf("traceparent %s has invalid version", m[0])
+	}
+	if err := checkHexID(traceID, 32); err != nil {
+		return nil, false, err
+	}
+	if err := checkHexID(spanID, 16); err != nil {
+		return nil, false, err
+	}
+	f, _ := strconv.ParseUint(flags, 16, 8)
+	sampled := f&1 == 1
+	return &traceContext{traceID: traceID, spanID: spanID, sampled: &sampled}, true, nil
+}
+
+func detectB3(message string) (*traceContext, bool, error) {
+	var tc traceContext
+	var sampling string
+	if m := b3SingleRegex.FindStringSubmatch(message); m != nil {
+		tc.traceID, tc.spanID, sampling = strings.ToLower(m[1]), strings.ToLower(m[2]), m[3]
+	} else if m := b3TraceIDRegex.FindStringSubmatch(message); m != nil {
+		tc.traceID = strings.ToLower(m[1])
+		if m := b3SpanIDRegex.FindStringSubmatch(message); m != nil {
+			tc.spanID = strings.ToLower(m[1])
+		}
+		if m := b3SampledRegex.FindStringSubmatch(message); m != nil {
+			sampling = strings.ToLower(m[1])
+		}
+	} else {
+		return nil, false, nil
+	}
+
+	if err := checkHexID(tc.traceID, 16, 32); err != nil {
+		return nil, false, err
+	}
+	if tc.spanID != "" {
+		if err := checkHexID(tc.spanID, 16); err != nil {
+			return nil, false, err
+		}
+	}
+	switch sampling {
+	case "1", "true", "d":
+		sampled := true
+		tc.sampled = &sampled
+	case "0", "false":
+		sampled := false
+		tc.sampled = &sampled
+	}
+	return &tc, true, nil
+}
+
+// detectOTel finds the trace context of an OpenTelemetry json log.
+func detectOTel(message string) (*traceContext, bool, error) {
+	trimmed := strings.TrimSpace(message)
+	if !strings.HasPrefix(trimmed, "{") {
+		return nil, false, nil
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal([]byte(trimmed), &m); err != nil {
+		return nil, false, nil
+	}
+	v, ok := firstField(m, otelTraceIDKeys)
+	if !ok {
+		return nil, false, nil
+	}
+
+	var tc traceContext
+	tc.traceID, _ = v.(string)
+	if err := checkHexID(tc.traceID, 32); err != nil {
+		return nil, false, err
+	}
+	if v, ok := firstField(m, otelSpanIDKeys); ok {
+		tc.spanID, _ = v.(string)
+		if err := checkHexID(tc.spanID, 16); err != nil {
+			return nil, false, err
+		}
+	}
+	if v, ok := firstField(m, otelFlagsKeys); ok {
+		var flags uint64
+		switch val := v.(type) {
+		case float64:
+			flags = uint64(val)
+		case string:
+			flags, _ = strconv.ParseUint(val, 16, 8)
+		}
+		sampled := flags&1 == 1
+		tc.sampled = &sampled
+	}
+	return &tc, true, nil
+}
+
+func detectSkyWalking(message string) (*traceContext, bool, error) {
+	m := skyWalkingRegex.FindStringSubmatch(message)
+	if m == nil {
+		return nil, false, nil
+	}
+	id := m[1]
+	switch id {
+	case "N/A", "Ignored_Trace":
+		return nil, false, nil
+	}
+	if !skyWalkingIDRegex.MatchString(id) {
+		return nil, false, fmt.Errorf("skywalking trace id %s is invalid", id)
+	}
+	return &traceContext{traceID: id}, true, nil
+}
+
+// checkHexID checks that an ID is lower case hex of one of the lengths, and
+// not all zeros.
+func checkHexID(id string, lengths ...int) error {
+	valid := false
+	for _, n := range lengths {
+		valid = valid || len(id) == n
+	}
+	if !valid {
+		return fmt.Errorf("id %s has invalid length %d", id, len(id))
+	}
+	zero := true
+	for _, c := range id {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return fmt.Errorf("id %s is not lower case hex", id)
+		}
+		zero = zero && c == '0'
+	}
+	if zero {
+		return fmt.Errorf("id %s is all zeros", id)
+	}
+	return nil
+}
+
+// Close removes the metrics of the processor.
+func (p *parseTrace) Close() error {
+	monitoring.Default.Remove(p.regName)
+	return nil
+}
+
+func (p *parseTrace) String() string {
+	return fmt.Sprintf("%s=[field=%s, formats=%s]", parseTraceName, p.config.Field, strings.Join(p.config.Formats, ","))
+}
@@ -0,0 +1,116 @@
+package parser
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/monitoring"
+)
+
+func newTestParseTrace(t *testing.T, settings map[string]interface{}) *parseTrace {
+	p, err := newParseTrace(common.MustNewConfigFrom(settings))
+	require.NoError(t, err)
+	return p.(*parseTrace)
+}
+
+func TestParseTrace(t *testing.T) {
+	p := newTestParseTrace(t, map[string]interface{}{})
+
+	tests := []struct {
+		name    string
+		message string
+		traceID string
+		spanID  string
+	}{
+		{"w3c", "GET /api traceparent=00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01 200", "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"},
+		{"b3 headers", "X-B3-TraceId=463AC35C9F6413AD X-B3-SpanId: a2fb4a1d1a96d312 X-B3-Sampled=1", "463ac35c9f6413ad", "a2fb4a1d1a96d312"},
+		{"b3 128 bit", `{"X-B3-TraceId":"80f198ee56343ba864fe8b2a57d3eff7"}`, "80f198ee56343ba864fe8b2a57d3eff7", ""},
+		{"b3 single", "b3: 80f198ee56343ba864fe8b2a57d3eff7-e457b5a2e4d86bd1-1 done", "80f198ee56343ba864fe8b2a57d3eff7", "e457b5a2e4d86bd1"},
+		{"otel", `{"body":"done","trace_id":"5b8efff798038103d269b633813fc60c","span_id":"eee19b7ec3c1b174","trace_flags":1}`, "5b8efff798038103d269b633813fc60c", "eee19b7ec3c1b174"},
+		{"otel camel case", `{"traceId":"5b8efff798038103d269b633813fc60c","spanId":"eee19b7ec3c1b174","flags":"01"}`, "5b8efff798038103d269b633813fc60c", "eee19b7ec3c1b174"},
+		{"skywalking", "2021-01-01 12:00:00.000 [TID:2a1b3c4d5e6f.42.16409875938470001] INFO done", "2a1b3c4d5e6f.42.16409875938470001", ""},
+		{"skywalking none", "2021-01-01 12:00:00.000 [TID:N/A] INFO done", "", ""},
+		{"w3c zero trace", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", "", ""},
+		{"w3c upper case", "00-4BF92F3577B34DA6A3CE929D0E0E4736-00F067AA0BA902B7-01", "", ""},
+		{"w3c invalid version", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "", ""},
+		{"b3 short trace", "X-B3-TraceId=463ac35c", "", ""},
+		{"otel base64", `{"trace_id":"W47/95gDgQPSabYzgT/GDA==","span_id":"7uGbfsPBsXQ="}`, "", ""},
+		{"no trace", "nothing here", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event, err := p.Run(&beat.Event{Fields: common.MapStr{"message": tt.message}})
+			require.NoError(t, err)
+			require.NotNil(t, event)
+			traceID, _ := event.GetValue("trace.id")
+			tagID, _ := event.GetValue("terminus.tags.trace_id")
+			spanID, _ := event.GetValue("span.id")
+			if tt.traceID == "" {
+				assert.Nil(t, traceID)
+				assert.Nil(t, tagID)
+				return
+			}
+			assert.Equal(t, tt.traceID, traceID)
+			assert.Equal(t, tt.traceID, tagID)
+			if tt.spanID == "" {
+				assert.Nil(t, spanID)
+			} else {
+				assert.Equal(t, tt.spanID, spanID)
+			}
+		})
+	}
+	assert.Equal(t, int64(5), p.metrics.invalid.Get())
+	assert.Equal(t, int64(1), p.metrics.formats[0].Get())
+	assert.Equal(t, int64(3), p.metrics.formats[1].Get())
+	assert.Equal(t, int64(2), p.metrics.formats[2].Get())
+	assert.Equal(t, int64(1), p.metrics.formats[3].Get())
+}
+
+func TestParseTraceDropUnsampled(t *testing.T) {
+	p := newTestParseTrace(t, map[string]interface{}{"drop_unsampled": true})
+
+	cases := map[string]bool{
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00": false,
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01": true,
+		"X-B3-TraceId=463ac35c9f6413ad X-B3-Sampled=false":        false,
+		"X-B3-TraceId=463ac35c9f6413ad":                           true,
+		"[TID:2a1b3c4d5e6f.42.16409875938470001]":                 true,
+		"no trace": true,
+	}
+	for message, kept := range cases {
+		event, err := p.Run(&beat.Event{Fields: common.MapStr{"message": message}})
+		require.NoError(t, err)
+		assert.Equal(t, kept, event != nil, message)
+	}
+	assert.Equal(t, int64(2), p.metrics.dropped.Get())
+}
+
+func TestParseTraceConfig(t *testing.T) {
+	p := newTestParseTrace(t, map[string]interface{}{"field": "log", "formats": []string{"skywalking"}})
+	event, err := p.Run(&beat.Event{Fields: common.MapStr{
+		"log": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01 [TID:abc.1.2]",
+	}})
+	require.NoError(t, err)
+	traceID, _ := event.GetValue("trace.id")
+	assert.Equal(t, "abc.1.2", traceID)
+
+	// A trace.id already set is kept unless overwrite is set.
+	event, err = p.Run(&beat.Event{Fields: common.MapStr{"log": "[TID:abc.1.2]", "trace": common.MapStr{"id": "set"}}})
+	require.NoError(t, err)
+	traceID, _ = event.GetValue("trace.id")
+	assert.Equal(t, "set", traceID)
+
+	_, err = newParseTrace(common.MustNewConfigFrom(map[string]interface{}{"formats": []string{"jaeger"}}))
+	assert.Error(t, err)
+}
+
+func TestParseTraceClose(t *testing.T) {
+	p := newTestParseTrace(t, map[string]interface{}{})
+	require.NotNil(t, monitoring.Default.Get(p.regName))
+	require.NoError(t, p.Close())
+	assert.Nil(t, monitoring.Default.Get(p.regName))
+}
@@ -79,7 +79,11 @@ func New(
 	separator string,
 	maxBytes int,
 	config *Config,
-) (*Reader, error) {
+) (reader.Reader, error) {
+	if config.Preset != "" {
+		return newPresetReader(r, separator, maxBytes, config)
+	}
+
 	types := map[string]func([]match.Matcher) (matcher, error){
 		"before": beforeMatcher,
 		"after":  afterMatcher,
@@ -27,15 +27,26 @@ import (
 // Config holds the options of multiline readers.
 type Config struct {
 	Negate       bool            `config:"negate"`
-	Match        string          `config:"match" validate:"required"`
+	Match        string          `config:"match"`
 	MaxLines     *int            `config:"max_lines"`
-	Patterns     []match.Matcher `config:"patterns" validate:"required"`
+	Patterns     []match.Matcher `config:"patterns"`
 	Timeout      *time.Duration  `config:"timeout" validate:"positive"`
 	FlushPattern *match.Matcher  `config:"flush_pattern"`
+
+	// Preset names the language whose stack traces are combined, it replaces
+	// match, negate and patterns.
+	Preset string `config:"preset"`
 }
 
 // Validate validates the Config option for multiline reader.
 func (c *Config) Validate() error {
+	if c.Preset != "" {
+		_, err := lookupPreset(c.Preset)
+		return err
+	}
+	if len(c.Patterns) == 0 {
+		return fmt.Errorf("multiline requires patterns or a preset")
+	}
 	if c.Match != "after" && c.Match != "before" {
 		return fmt.Errorf("unknown matcher type: %s", c.Match)
 	}
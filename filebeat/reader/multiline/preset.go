@@ -0,0 +1,134 @@
+package multiline
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// continuation reports whether current continues the event whose last line
+// is last, such as the frames of a stack trace.
+type continuation func(last, current []byte) bool
+
+var (
+	javaExceptionHeader = regexp.MustCompile(`^([a-zA-Z_$][\w$]*\.)+[\w$]*(Exception|Error|Throwable)(: .*)?$`)
+	javaContinuation    = regexp.MustCompile(`^(Caused by: |Suppressed: |\.\.\. \d+ (more|common frames omitted))`)
+
+	pythonException    = regexp.MustCompile(`^([a-zA-Z_][\w]*\.)*[a-zA-Z_]\w*(Error|Exception|Warning|Exit|Interrupt|Iteration)(: .*)?$`)
+	pythonChained      = regexp.MustCompile(`^(During handling of the above exception, another exception occurred:|The above exception was the direct cause of the following exception:)$`)
+	pythonTracebackRow = []byte("Traceback (most recent call last):")
+
+	goGoroutine = regexp.MustCompile(`^goroutine \d+ \[.*\]:$`)
+	goFunction  = regexp.MustCompile(`^([\w./\-*()%]+\(.*\)|created by .*)$`)
+	goPanic     = regexp.MustCompile(`^(panic: |fatal error: |\[signal )`)
+
+	nodeFrame = regexp.MustCompile(`^\s+at `)
+
+	rubyFrame = regexp.MustCompile(`^\s+from `)
+
+	dotnetException = regexp.MustCompile(`^([a-zA-Z_]\w*\.)+\w*Exception(: .*)?$`)
+	dotnetInner     = regexp.MustCompile(`^\s*(---> |--- End of )`)
+)
+
+// presets are the continuations of the multiline presets by name.
+var presets = map[string]continuation{
+	"java":   javaContinues,
+	"python": pythonContinues,
+	"go":     goContinues,
+	"nodejs": nodeContinues,
+	"ruby":   rubyContinues,
+	"dotnet": dotnetContinues,
+	// none keeps every line as an event, to turn off the multiline patterns
+	// of the input for a container.
+	"none": func(last, current []byte) bool { return false },
+}
+
+// PresetNames returns the names of the multiline presets.
+func PresetNames() []string {
+	names := make([]string, 0, len(presets))
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func lookupPreset(name string) (continuation, error) {
+	c, ok := presets[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("unknown multiline preset '%v', must be one of %s", name, strings.Join(PresetNames(), ", "))
+	}
+	return c, nil
+}
+
+func indented(line []byte) bool {
+	return len(line) > 0 && (line[0] == ' ' || line[0] == '\t')
+}
+
+func blank(line []byte) bool {
+	return len(bytes.TrimSpace(line)) == 0
+}
+
+// java: the at frames, Caused by:, ... n more, and the exception header
+// logged after the message. An uncaught exception starts an event.
+func javaContinues(last, current []byte) bool {
+	return indented(current) && !blank(current) ||
+		javaContinuation.Match(current) ||
+		javaExceptionHeader.Match(current)
+}
+
+// python: the traceback, its indented frames, the exception ending it and
+// the chained tracebacks.
+func pythonContinues(last, current []byte) bool {
+	switch {
+	case bytes.Equal(bytes.TrimSpace(current), pythonTracebackRow):
+		return true
+	case indented(current) && !blank(current):
+		return true
+	case pythonChained.Match(current):
+		return true
+	case blank(current):
+		return pythonException.Match(last) || pythonChained.Match(last)
+	case pythonException.Match(current):
+		return indented(last)
+	}
+	return false
+}
+
+// go: the goroutines of a panic, their function and file lines.
+func goContinues(last, current []byte) bool {
+	switch {
+	case indented(current) && !blank(current):
+		return true
+	case goGoroutine.Match(current):
+		return true
+	case blank(current):
+		return goPanic.Match(last) || indented(last)
+	case goFunction.Match(current):
+		return goGoroutine.Match(last) || indented(last)
+	case goPanic.Match(current):
+		// [signal ...] follows the panic message.
+		return bytes.HasPrefix(current, []byte("[signal ")) && goPanic.Match(last)
+	}
+	return false
+}
+
+// nodejs: the at frames of an error.
+func nodeContinues(last, current []byte) bool {
+	return nodeFrame.Match(current) || indented(current) && !blank(current)
+}
+
+// ruby: the from frames of a backtrace.
+func rubyContinues(last, current []byte) bool {
+	return rubyFrame.Match(current) || indented(current) && !blank(current)
+}
+
+// dotnet: the at frames, the inner exceptions and the exception header
+// logged after the message.
+func dotnetContinues(last, current []byte) bool {
+	return indented(current) && !blank(current) ||
+		dotnetInner.Match(current) ||
+		dotnetException.Match(current)
+}
@@ -0,0 +1,197 @@
+package multiline
+
+import (
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/logp"
+	"github.com/elastic/beats/v7/libbeat/reader"
+	"github.com/elastic/beats/v7/libbeat/reader/readfile"
+)
+
+// presetReader combines lines into events with the continuation of a
+// preset. Lines of the stdout and stderr streams of a container interleave,
+// so one event is pending per stream.
+//
+// Events are returned in the order of their first line, and the bytes of an
+// event are the bytes up to the first line of the next pending event, so
+// that the offset of the registry always points to the start of a line not
+// yet published.
+type presetReader struct {
+	reader    reader.Reader
+	continues continuation
+	maxBytes  int
+	maxLines  int
+	timeout   time.Duration
+	separator []byte
+	now       func() time.Time
+
+	events   []*presetEvent // ordered by first line
+	pending  map[string]*presetEvent
+	read     int // bytes read
+	returned int // bytes returned
+	err      error
+}
+
+type presetEvent struct {
+	message   reader.Message
+	start     int // bytes read before the first line
+	started   time.Time
+	last      []byte
+	numLines  int
+	truncated int
+	done      bool
+}
+
+func newPresetReader(r reader.Reader, separator string, maxBytes int, config *Config) (reader.Reader, error) {
+	continues, err := lookupPreset(config.Preset)
+	if err != nil {
+		return nil, err
+	}
+
+	maxLines := defaultMaxLines
+	if config.MaxLines != nil {
+		maxLines = *config.MaxLines
+	}
+	timeout := defaultMultilineTimeout
+	if config.Timeout != nil {
+		timeout = *config.Timeout
+	}
+	if timeout > 0 {
+		r = readfile.NewTimeoutReader(r, sigMultilineTimeout, timeout)
+	}
+
+	return &presetReader{
+		reader:    r,
+		continues: continues,
+		maxBytes:  maxBytes,
+		maxLines:  maxLines,
+		timeout:   timeout,
+		separator: []byte(separator),
+		now:       time.Now,
+		pending:   make(map[string]*presetEvent),
+	}, nil
+}
+
+func (pr *presetReader) Close() error {
+	return pr.reader.Close()
+}
+
+// Next returns the next event.
+func (pr *presetReader) Next() (reader.Message, error) {
+	for {
+		if msg, ok := pr.pop(); ok {
+			return msg, nil
+		}
+		if pr.err != nil {
+			err := pr.err
+			pr.err = nil
+			return reader.Message{}, err
+		}
+
+		message, err := pr.reader.Next()
+		if err == sigMultilineTimeout {
+			if len(pr.events) > 0 {
+				logp.Debug("multiline", "Multiline event flushed because timeout reached.")
+				pr.finishAll()
+			}
+			continue
+		}
+		if message.Bytes > 0 {
+			pr.add(message)
+		}
+		if err != nil {
+			// return the pending events first, the error on the next call.
+			pr.finishAll()
+			pr.err = err
+		}
+	}
+}
+
+// add adds a line to the pending event of its stream, or starts an event.
+func (pr *presetReader) add(message reader.Message) {
+	stream := getStream(message.Fields)
+	event := pr.pending[stream]
+	if event != nil && !pr.continues(event.last, message.Content) {
+		pr.finish(stream)
+		event = nil
+	}
+	if event == nil {
+		event = &presetEvent{start: pr.read, started: pr.now()}
+		event.message.Ts = message.Ts
+		pr.pending[stream] = event
+		pr.events = append(pr.events, event)
+	}
+	pr.addLine(event, message)
+	pr.read += message.Bytes
+
+	// events of a stream interleaving with a busy one are finished by their
+	// age, the timeout reader only fires when no line is read.
+	if pr.timeout > 0 {
+		for s, e := range pr.pending {
+			if s != stream && pr.now().Sub(e.started) >= pr.timeout {
+				pr.finish(s)
+			}
+		}
+	}
+}
+
+func (pr *presetReader) addLine(event *presetEvent, m reader.Message) {
+	content := event.message.Content
+	addSeparator := len(content) > 0 && len(pr.separator) > 0
+	space := pr.maxBytes - len(content)
+	if addSeparator {
+		space -= len(pr.separator)
+	}
+
+	if (pr.maxBytes <= 0 || space > 0) && (pr.maxLines <= 0 || event.numLines < pr.maxLines) {
+		if pr.maxBytes <= 0 || space > len(m.Content) {
+			space = len(m.Content)
+		}
+		if addSeparator {
+			content = append(content, pr.separator...)
+		}
+		event.message.Content = append(content, m.Content[:space]...)
+		event.numLines++
+		event.truncated += len(m.Content) - space
+	} else {
+		event.truncated += len(m.Content)
+	}
+	event.last = m.Content
+	event.message.AddFields(m.Fields)
+}
+
+func (pr *presetReader) finish(stream string) {
+	event := pr.pending[stream]
+	delete(pr.pending, stream)
+	event.done = true
+	if event.truncated > 0 {
+		event.message.AddFlagsWithKey("log.flags", "truncated")
+	}
+	if event.numLines > 1 {
+		event.message.AddFlagsWithKey("log.flags", "multiline")
+	}
+}
+
+func (pr *presetReader) finishAll() {
+	for stream := range pr.pending {
+		pr.finish(stream)
+	}
+}
+
+// pop returns the first event if it is done.
+func (pr *presetReader) pop() (reader.Message, bool) {
+	if len(pr.events) == 0 || !pr.events[0].done {
+		return reader.Message{}, false
+	}
+	event := pr.events[0]
+	pr.events[0] = nil
+	pr.events = pr.events[1:]
+
+	end := pr.read
+	if len(pr.events) > 0 {
+		end = pr.events[0].start
+	}
+	event.message.Bytes = end - pr.returned
+	pr.returned = end
+	return event.message, true
+}
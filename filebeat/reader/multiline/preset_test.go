@@ -0,0 +1,201 @@
+// +build !integration
+
+package multiline
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/reader"
+)
+
+// linesReader returns lines of the stream given before a '|', such as
+// "stderr|line", with the newline counted in the bytes.
+type linesReader struct {
+	lines []string
+}
+
+func (r *linesReader) Next() (reader.Message, error) {
+	if len(r.lines) == 0 {
+		return reader.Message{}, io.EOF
+	}
+	line := r.lines[0]
+	r.lines = r.lines[1:]
+	m := reader.Message{Ts: time.Now()}
+	if i := strings.Index(line, "|"); i >= 0 {
+		m.Fields = common.MapStr{"stream": line[:i]}
+		line = line[i+1:]
+	}
+	m.Content = []byte(line)
+	m.Bytes = len(line) + 1
+	return m, nil
+}
+
+func (r *linesReader) Close() error { return nil }
+
+func readPreset(t *testing.T, preset string, lines []string) []reader.Message {
+	timeout := time.Duration(0)
+	r, err := New(&linesReader{lines: lines}, "\n", 1<<20, &Config{Preset: preset, Timeout: &timeout})
+	require.NoError(t, err)
+
+	var messages []reader.Message
+	for {
+		m, err := r.Next()
+		if err == io.EOF {
+			return messages
+		}
+		require.NoError(t, err)
+		messages = append(messages, m)
+	}
+}
+
+func TestPresets(t *testing.T) {
+	tests := []struct {
+		preset string
+		events []string
+	}{
+		{"java", []string{
+			"2021-01-01 12:00:00.000 ERROR [main] c.e.App : request failed\n" +
+				"java.lang.IllegalStateException: boom\n" +
+				"\tat com.example.App.run(App.java:10)\n" +
+				"\tat com.example.App.main(App.java:5)\n" +
+				"Caused by: java.io.IOException: closed\n" +
+				"\tat com.example.Io.read(Io.java:3)\n" +
+				"\t... 2 more",
+			"2021-01-01 12:00:01.000 INFO [main] c.e.App : retry",
+			"Exception in thread \"main\" java.lang.NullPointerException\n" +
+				"\tat com.example.App.main(App.java:7)",
+		}},
+		{"python", []string{
+			"ERROR:root:request failed\n" +
+				"Traceback (most recent call last):\n" +
+				"  File \"app.py\", line 3, in <module>\n" +
+				"    run()\n" +
+				"KeyError: 'a'\n" +
+				"\n" +
+				"During handling of the above exception, another exception occurred:\n" +
+				"\n" +
+				"Traceback (most recent call last):\n" +
+				"  File \"app.py\", line 5, in <module>\n" +
+				"    fail()\n" +
+				"ValueError: bad value",
+			"INFO:root:done",
+		}},
+		{"go", []string{
+			"panic: runtime error: invalid memory address or nil pointer dereference\n" +
+				"[signal SIGSEGV: segmentation violation code=0x1 addr=0x0 pc=0x48f5a6]\n" +
+				"\n" +
+				"goroutine 1 [running]:\n" +
+				"main.(*server).run(0x0)\n" +
+				"\t/app/main.go:12 +0x26\n" +
+				"main.main()\n" +
+				"\t/app/main.go:7 +0x1d\n" +
+				"\n" +
+				"goroutine 6 [chan receive]:\n" +
+				"created by main.main in goroutine 1\n" +
+				"\t/app/main.go:6 +0x3e",
+			"exit status 2",
+		}},
+		{"nodejs", []string{
+			"TypeError: Cannot read property 'x' of undefined\n" +
+				"    at Object.<anonymous> (/app/index.js:1:3)\n" +
+				"    at Module._compile (internal/modules/cjs/loader.js:999:30)",
+			"listening on 3000",
+		}},
+		{"ruby", []string{
+			"app.rb:3:in `foo': boom (RuntimeError)\n" +
+				"\tfrom app.rb:7:in `<main>'",
+			"I, [2021-01-01T12:00:00] INFO -- : started",
+		}},
+		{"dotnet", []string{
+			"fail: Microsoft.AspNetCore.Server.Kestrel[13]\n" +
+				"System.InvalidOperationException: boom\n" +
+				" ---> System.Exception: inner\n" +
+				"   at App.Service.Run() in /src/Service.cs:line 10\n" +
+				"   --- End of inner exception stack trace ---\n" +
+				"   at App.Program.Main() in /src/Program.cs:line 5",
+			"info: Microsoft.Hosting.Lifetime[0]",
+		}},
+		{"none", []string{"line1", "  line2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.preset, func(t *testing.T) {
+			var lines []string
+			for _, event := range tt.events {
+				lines = append(lines, strings.Split(event, "\n")...)
+			}
+			var events []string
+			for _, m := range readPreset(t, tt.preset, lines) {
+				events = append(events, string(m.Content))
+			}
+			assert.Equal(t, tt.events, events)
+		})
+	}
+}
+
+func TestPresetInterleavedStreams(t *testing.T) {
+	lines := []string{
+		"stderr|java.lang.IllegalStateException: boom",
+		"stdout|2021-01-01 12:00:00.000 INFO started",
+		"stderr|\tat com.example.App.run(App.java:10)",
+		"stdout|2021-01-01 12:00:01.000 INFO ready",
+		"stderr|\tat com.example.App.main(App.java:5)",
+		"stdout|2021-01-01 12:00:02.000 INFO done",
+	}
+	messages := readPreset(t, "java", lines)
+
+	var events []string
+	offset := 0
+	for _, m := range messages {
+		events = append(events, getStream(m.Fields)+"|"+string(m.Content))
+		assert.True(t, m.Bytes > 0)
+		offset += m.Bytes
+	}
+	assert.Equal(t, []string{
+		"stderr|java.lang.IllegalStateException: boom\n\tat com.example.App.run(App.java:10)\n\tat com.example.App.main(App.java:5)",
+		"stdout|2021-01-01 12:00:00.000 INFO started",
+		"stdout|2021-01-01 12:00:01.000 INFO ready",
+		"stdout|2021-01-01 12:00:02.000 INFO done",
+	}, events)
+
+	// The stderr event is returned first, the bytes of its lines after the
+	// first stdout line are counted with the stdout events.
+	assert.Equal(t, len(lines[0])-len("stderr|")+1, messages[0].Bytes)
+	total := 0
+	for _, line := range lines {
+		total += len(line) - len("stdxxx|") + 1
+	}
+	assert.Equal(t, total, offset)
+}
+
+func TestPresetTimeoutInterleaved(t *testing.T) {
+	r, err := New(&linesReader{lines: []string{
+		"stderr|java.lang.IllegalStateException: boom",
+		"stdout|one",
+		"stdout|two",
+	}}, "\n", 1<<20, &Config{Preset: "java"})
+	require.NoError(t, err)
+	pr := r.(*presetReader)
+	now := time.Now()
+	pr.now = func() time.Time {
+		now = now.Add(3 * time.Second)
+		return now
+	}
+
+	// The stderr event is finished by its age while stdout lines are read.
+	m, err := pr.Next()
+	require.NoError(t, err)
+	assert.Equal(t, "java.lang.IllegalStateException: boom", string(m.Content))
+}
+
+func TestPresetConfig(t *testing.T) {
+	assert.Error(t, (&Config{Preset: "cobol"}).Validate())
+	assert.NoError(t, (&Config{Preset: "Java"}).Validate())
+	assert.Error(t, (&Config{Match: "after"}).Validate())
+}
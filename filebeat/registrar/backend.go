@@ -0,0 +1,28 @@
+package registrar
+
+import (
+	"github.com/elastic/beats/v7/filebeat/config"
+	"github.com/elastic/beats/v7/libbeat/logp"
+	"github.com/elastic/beats/v7/libbeat/statestore/backend"
+	"github.com/elastic/beats/v7/libbeat/statestore/backend/kvstore"
+	"github.com/elastic/beats/v7/libbeat/statestore/backend/memlog"
+)
+
+const kvBackend = "kv"
+
+// NewBackend creates the statestore backend of filebeat.registry.type in the
+// registry directory dataPath.
+func NewBackend(log *logp.Logger, dataPath string, cfg config.Registry) (backend.Registry, error) {
+	if cfg.Type == kvBackend {
+		return kvstore.New(log, kvstore.Settings{
+			Root:       dataPath,
+			SyncWrites: cfg.KV.SyncWrites,
+			GCInterval: cfg.KV.GCInterval,
+			CacheSize:  int64(cfg.KV.CacheSize),
+		})
+	}
+	return memlog.New(log, memlog.Settings{
+		Root:     dataPath,
+		FileMode: cfg.Permissions,
+	})
+}
@@ -0,0 +1,224 @@
+package registrar
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/elastic/beats/v7/filebeat/input/file"
+	"github.com/elastic/beats/v7/libbeat/common"
+	helper "github.com/elastic/beats/v7/libbeat/common/file"
+	"github.com/elastic/beats/v7/libbeat/statestore/backend"
+)
+
+const filestreamPrefix = "filestream::"
+
+// Status of the file of an entry.
+const (
+	StatusOK       = "ok"       // the offset is at the end of the file
+	StatusBehind   = "behind"   // the file has bytes not yet read
+	StatusAhead    = "ahead"    // the offset is after the end, the file was truncated
+	StatusOrphaned = "orphaned" // the file is removed or replaced
+)
+
+// Entry is the state of a file in the registry, of a log input or of a
+// filestream input.
+type Entry struct {
+	Key      string        `json:"key"`
+	Input    string        `json:"input"` // type of the log input or ID of the filestream input
+	Source   string        `json:"source"`
+	Identity string        `json:"identity"` // inode-device of the file
+	Offset   int64         `json:"offset"`
+	Size     int64         `json:"size"` // -1 if the file is missing
+	Status   string        `json:"status"`
+	Updated  time.Time     `json:"updated"`
+	TTL      time.Duration `json:"ttl"`
+}
+
+// EntryFilter selects entries, empty fields match all.
+type EntryFilter struct {
+	Path     string // glob pattern of the source
+	Inode    string
+	Input    string
+	Orphaned bool
+}
+
+// entryStore is implemented by backend.Store and statestore.Store.
+type entryStore interface {
+	Each(fn func(string, backend.ValueDecoder) (bool, error)) error
+}
+
+// ListEntries returns the entries of the log and filestream inputs sorted
+// by source.
+func ListEntries(store entryStore, filter EntryFilter) ([]Entry, error) {
+	var entries []Entry
+	err := store.Each(func(key string, dec backend.ValueDecoder) (bool, error) {
+		entry, ok := decodeEntry(key, dec)
+		if ok && filter.match(entry) {
+			entries = append(entries, entry)
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Source != entries[j].Source {
+			return entries[i].Source < entries[j].Source
+		}
+		return entries[i].Key < entries[j].Key
+	})
+	return entries, nil
+}
+
+func decodeEntry(key string, dec backend.ValueDecoder) (Entry, bool) {
+	entry := Entry{Key: key}
+	switch {
+	case strings.HasPrefix(key, fileStatePrefix):
+		var st file.State
+		if err := dec.Decode(&st); err != nil {
+			return entry, false
+		}
+		entry.Input = st.Type
+		entry.Source = st.Source
+		entry.Identity = st.FileStateOS.String()
+		entry.Offset = st.Offset
+		entry.Updated = st.Timestamp
+		entry.TTL = st.TTL
+
+	case strings.HasPrefix(key, filestreamPrefix):
+		var st filestreamState
+		if err := dec.Decode(&st); err != nil {
+			return entry, false
+		}
+		parts := strings.SplitN(key[len(filestreamPrefix):], "::", 3)
+		if len(parts) != 3 {
+			return entry, false
+		}
+		entry.Input = parts[0]
+		entry.Source = st.Meta.Source
+		if parts[1] == "native" {
+			entry.Identity = parts[2]
+		}
+		entry.Offset = st.Cursor.Offset
+		entry.Updated = st.Updated
+		entry.TTL = st.TTL
+
+	default:
+		return entry, false
+	}
+
+	fi, err := os.Stat(entry.Source)
+	if err != nil || (entry.Identity != "" && helper.GetOSState(fi).String() != entry.Identity) {
+		entry.Size = -1
+		entry.Status = StatusOrphaned
+		return entry, true
+	}
+	entry.Size = fi.Size()
+	switch {
+	case entry.Offset < entry.Size:
+		entry.Status = StatusBehind
+	case entry.Offset > entry.Size:
+		entry.Status = StatusAhead
+	default:
+		entry.Status = StatusOK
+	}
+	return entry, true
+}
+
+func (f EntryFilter) match(entry Entry) bool {
+	if f.Path != "" {
+		if ok, _ := filepath.Match(f.Path, entry.Source); !ok && !strings.Contains(entry.Source, f.Path) {
+			return false
+		}
+	}
+	if f.Inode != "" && !strings.HasPrefix(entry.Identity, f.Inode+"-") {
+		return false
+	}
+	if f.Input != "" && f.Input != entry.Input {
+		return false
+	}
+	if f.Orphaned && entry.Status != StatusOrphaned {
+		return false
+	}
+	return true
+}
+
+// SetOffsets sets the offset of the entries, to the size of their files if
+// offset is negative. Entries of missing files are not changed with a
+// negative offset.
+func SetOffsets(store backend.Store, entries []Entry, offset int64) (int, error) {
+	updated := 0
+	for _, entry := range entries {
+		to := offset
+		if to < 0 {
+			if entry.Size < 0 {
+				continue
+			}
+			to = entry.Size
+		}
+
+		var err error
+		if strings.HasPrefix(entry.Key, fileStatePrefix) {
+			var st file.State
+			if err = store.Get(entry.Key, &st); err == nil {
+				st.Offset = to
+				err = store.Set(entry.Key, st)
+			}
+		} else {
+			var st filestreamState
+			if err = store.Get(entry.Key, &st); err == nil {
+				st.Cursor.Offset = to
+				err = store.Set(entry.Key, st)
+			}
+		}
+		if err != nil {
+			return updated, fmt.Errorf("fail to set offset of %s: %v", entry.Key, err)
+		}
+		updated++
+	}
+	return updated, nil
+}
+
+// Export writes all entries of the store as a json object of keys to values.
+func Export(store entryStore, w io.Writer) error {
+	values := map[string]common.MapStr{}
+	err := store.Each(func(key string, dec backend.ValueDecoder) (bool, error) {
+		var value common.MapStr
+		if err := dec.Decode(&value); err != nil {
+			return false, fmt.Errorf("fail to decode %s: %v", key, err)
+		}
+		values[key] = value
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(values)
+}
+
+// Import sets the entries of a json object written by Export.
+func Import(store backend.Store, r io.Reader) (int, error) {
+	var values map[string]common.MapStr
+	if err := json.NewDecoder(r).Decode(&values); err != nil {
+		return 0, fmt.Errorf("fail to decode registry entries: %v", err)
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for i, key := range keys {
+		if err := store.Set(key, values[key]); err != nil {
+			return i, fmt.Errorf("fail to set %s: %v", key, err)
+		}
+	}
+	return len(keys), nil
+}
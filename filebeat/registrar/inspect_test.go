@@ -0,0 +1,88 @@
+// +build linux darwin
+
+package registrar
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/beats/v7/filebeat/input/file"
+	libfile "github.com/elastic/beats/v7/libbeat/common/file"
+	"github.com/elastic/beats/v7/libbeat/statestore/backend"
+)
+
+func TestInspectEntries(t *testing.T) {
+	dataHome := tempDir(t)
+	logs := tempDir(t)
+
+	app := filepath.Join(logs, "app.log")
+	writeFile(t, app, []byte("0123456789"))
+	fi, err := os.Stat(app)
+	require.NoError(t, err)
+	appOS := libfile.GetOSState(fi)
+
+	states := []file.State{
+		{Source: app, Offset: 4, Type: "log", FileStateOS: appOS},
+		{Source: filepath.Join(logs, "removed.log"), Offset: 20, Type: "container", FileStateOS: libfile.StateOS{Inode: appOS.Inode + 1, Device: appOS.Device}},
+	}
+	streamKey := "filestream::containers::native::" + appOS.String()
+
+	withStore(t, dataHome, func(store backend.Store) {
+		require.NoError(t, writeStates(store, fixStates(states)))
+		require.NoError(t, store.Set(streamKey, filestreamState{
+			Cursor: filestreamCursor{Offset: 12},
+			Meta:   filestreamMeta{Source: app, IdentifierName: "native"},
+		}))
+
+		entries, err := ListEntries(store, EntryFilter{})
+		require.NoError(t, err)
+		require.Len(t, entries, 3)
+		status := map[string]string{}
+		for _, entry := range entries {
+			status[entry.Input] = entry.Status
+		}
+		assert.Equal(t, map[string]string{"log": StatusBehind, "containers": StatusAhead, "container": StatusOrphaned}, status)
+
+		entries, err = ListEntries(store, EntryFilter{Orphaned: true})
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+		assert.Equal(t, int64(-1), entries[0].Size)
+
+		entries, err = ListEntries(store, EntryFilter{Path: filepath.Join(logs, "*.log"), Inode: strconv.FormatUint(appOS.Inode, 10)})
+		require.NoError(t, err)
+		require.Len(t, entries, 2)
+
+		// the offsets are moved to the end of the files
+		updated, err := SetOffsets(store, entries, -1)
+		require.NoError(t, err)
+		assert.Equal(t, 2, updated)
+		entries, err = ListEntries(store, EntryFilter{Input: "containers"})
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+		assert.Equal(t, int64(10), entries[0].Offset)
+		assert.Equal(t, StatusOK, entries[0].Status)
+	})
+
+	var exported bytes.Buffer
+	withStore(t, dataHome, func(store backend.Store) {
+		require.NoError(t, Export(store, &exported))
+	})
+
+	importHome := tempDir(t)
+	withStore(t, importHome, func(store backend.Store) {
+		imported, err := Import(store, bytes.NewReader(exported.Bytes()))
+		require.NoError(t, err)
+		assert.Equal(t, 3, imported)
+
+		var st filestreamState
+		require.NoError(t, store.Get(streamKey, &st))
+		assert.Equal(t, int64(10), st.Cursor.Offset)
+		assert.Equal(t, app, st.Meta.Source)
+	})
+}
@@ -49,6 +49,8 @@ type Migrator struct {
 	dataPath    string
 	migrateFile string
 	permissions os.FileMode
+	filestream  *config.FilestreamMigration
+	registry    config.Registry
 }
 
 func NewMigrator(cfg config.Registry) *Migrator {
@@ -62,6 +64,8 @@ func NewMigrator(cfg config.Registry) *Migrator {
 		dataPath:    path,
 		migrateFile: migrateFile,
 		permissions: cfg.Permissions,
+		filestream:  cfg.MigrateToFilestream,
+		registry:    cfg,
 	}
 }
 
@@ -92,10 +96,13 @@ func (m *Migrator) Run() error {
 			}
 			fallthrough
 		case version0:
-			return m.updateToVersion1(fbRegHome)
+			if err := m.updateToVersion1(fbRegHome); err != nil {
+				return err
+			}
+			return m.migrateStores()
 
 		case currentVersion:
-			return nil
+			return m.migrateStores()
 
 		case noRegistry:
 			// check if we've been in the middle of a migration from the legacy
@@ -109,6 +116,9 @@ func (m *Migrator) Run() error {
 			}
 
 			// postpone registry creation, until we open and configure it.
+			if m.registry.Type == kvBackend {
+				return m.migrateToFilestream()
+			}
 			return nil
 		default:
 			return fmt.Errorf("registry file version %v not supported", version)
@@ -0,0 +1,190 @@
+package registrar
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/elastic/beats/v7/filebeat/input/file"
+	"github.com/elastic/beats/v7/libbeat/logp"
+	"github.com/elastic/beats/v7/libbeat/statestore/backend"
+)
+
+const (
+	filestreamMigrationPrefix = "filebeat::migrations::filestream::"
+
+	// filestreamCleanTimeout is the default clean_timeout of filestream, the
+	// migrated states not collected by the input are removed after it.
+	filestreamCleanTimeout = 30 * time.Minute
+)
+
+var defaultFilestreamMigrationTypes = []string{"log", "container"}
+
+// filestreamState is the state of the input-logfile store of filestream.
+type filestreamState struct {
+	TTL     time.Duration
+	Updated time.Time
+	Cursor  filestreamCursor
+	Meta    filestreamMeta
+}
+
+type filestreamCursor struct {
+	Offset int64 `json:"offset" struct:"offset"`
+}
+
+type filestreamMeta struct {
+	Source         string `json:"source" struct:"source"`
+	IdentifierName string `json:"identifier_name" struct:"identifier_name"`
+}
+
+// registryMigration marks a migration done in the store.
+type registryMigration struct {
+	Migrated time.Time `json:"migrated" struct:"migrated"`
+	States   int       `json:"states" struct:"states"`
+}
+
+// migrateToFilestream copies the offsets of the log and container inputs to
+// cursors of the filestream input, once per filestream input ID. The states
+// of the log inputs are kept to roll back.
+func (m *Migrator) migrateToFilestream() error {
+	if m.filestream == nil || m.filestream.ID == "" {
+		return nil
+	}
+
+	registryBackend, err := NewBackend(logp.NewLogger("migration"), m.dataPath, m.registry)
+	if err != nil {
+		return errors.Wrap(err, "failed to create new registry backend")
+	}
+	defer registryBackend.Close()
+
+	store, err := registryBackend.Access("filebeat")
+	if err != nil {
+		return errors.Wrap(err, "failed to open filebeat registry store")
+	}
+	defer store.Close()
+
+	migrated, err := migrateStatesToFilestream(store, m.filestream.ID, m.filestream.Types, m.filestream.Paths, time.Now())
+	if err != nil {
+		return errors.Wrap(err, "failed to migrate registry states to filestream")
+	}
+	if migrated < 0 {
+		return nil
+	}
+	logp.Info("Migrated %d registry states to filestream input %s", migrated, m.filestream.ID)
+
+	if checkpointer, ok := store.(interface{ Checkpoint() error }); ok {
+		err := checkpointer.Checkpoint()
+		if err != nil {
+			return fmt.Errorf("failed to fsync filebeat storage state: %w", err)
+		}
+	}
+	return nil
+}
+
+// migrateStatesToFilestream returns the number of states migrated, -1 if
+// the states were migrated before. Existing cursors of the filestream input
+// are not overwritten.
+func migrateStatesToFilestream(store backend.Store, id string, types, paths []string, now time.Time) (int, error) {
+	doneKey := filestreamMigrationPrefix + id
+	done, err := store.Has(doneKey)
+	if err != nil {
+		return 0, err
+	}
+	if done {
+		return -1, nil
+	}
+	if len(types) == 0 {
+		types = defaultFilestreamMigrationTypes
+	}
+
+	var states []file.State
+	err = store.Each(func(key string, dec backend.ValueDecoder) (bool, error) {
+		if !strings.HasPrefix(key, fileStatePrefix) {
+			return true, nil
+		}
+		var st file.State
+		if err := dec.Decode(&st); err != nil {
+			return true, nil
+		}
+		st.Id = key[len(fileStatePrefix):]
+		states = append(states, st)
+		return true, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	migrated := 0
+	prefix := "filestream::" + id + "::"
+	for _, st := range fixStates(states) {
+		if (st.Type != "" && !stringInSlice(st.Type, types)) || !matchPaths(paths, st.Source) {
+			continue
+		}
+		name, ok := filestreamSourceName(st)
+		if !ok {
+			logp.Warn("Registry state of %s with file identity %s is not migrated to filestream", st.Source, st.IdentifierName)
+			continue
+		}
+
+		key := prefix + name
+		exists, err := store.Has(key)
+		if err != nil {
+			return migrated, err
+		}
+		if exists {
+			continue
+		}
+		err = store.Set(key, filestreamState{
+			TTL:     filestreamCleanTimeout,
+			Updated: now,
+			Cursor:  filestreamCursor{Offset: st.Offset},
+			Meta:    filestreamMeta{Source: st.Source, IdentifierName: st.IdentifierName},
+		})
+		if err != nil {
+			return migrated, err
+		}
+		migrated++
+	}
+
+	err = store.Set(doneKey, registryMigration{Migrated: now, States: migrated})
+	return migrated, err
+}
+
+// filestreamSourceName returns the name of the file in filestream, the
+// hash of the meta of the log input is not part of it.
+func filestreamSourceName(st file.State) (string, bool) {
+	if len(st.Meta) == 0 {
+		return st.Id, st.Id != ""
+	}
+	switch st.IdentifierName {
+	case "native", "":
+		return "native::" + st.FileStateOS.String(), true
+	case "path":
+		return "path::" + st.Source, true
+	}
+	return "", false
+}
+
+func matchPaths(patterns []string, source string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, source); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func stringInSlice(str string, list []string) bool {
+	for _, v := range list {
+		if v == str {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,92 @@
+// +build linux darwin
+
+package registrar
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/beats/v7/filebeat/config"
+	"github.com/elastic/beats/v7/filebeat/input/file"
+	libfile "github.com/elastic/beats/v7/libbeat/common/file"
+	"github.com/elastic/beats/v7/libbeat/logp"
+	"github.com/elastic/beats/v7/libbeat/statestore/backend"
+	"github.com/elastic/beats/v7/libbeat/statestore/backend/memlog"
+)
+
+func TestMigrationToFilestream(t *testing.T) {
+	dataHome := tempDir(t)
+	registryHome := filepath.Join(dataHome, "filebeat")
+	mkDir(t, registryHome)
+	writeFile(t, filepath.Join(registryHome, "meta.json"), []byte(`{"version": "1"}`))
+
+	states := []file.State{
+		{Source: "/var/lib/docker/containers/a/a-json.log", Offset: 100, Type: "container", FileStateOS: libfile.StateOS{Inode: 1, Device: 2}},
+		{Source: "/var/log/app.log", Offset: 200, Type: "log", FileStateOS: libfile.StateOS{Inode: 3, Device: 2}, Meta: map[string]string{"source": "app"}},
+		{Source: "/var/log/kube-audit.log", Offset: 300, Type: "kube_audit", FileStateOS: libfile.StateOS{Inode: 4, Device: 2}},
+		{Source: "/tmp/other.log", Offset: 400, Type: "log", FileStateOS: libfile.StateOS{Inode: 5, Device: 2}},
+	}
+	withStore(t, dataHome, func(store backend.Store) {
+		require.NoError(t, writeStates(store, fixStates(states)))
+		// a cursor of filestream is not overwritten
+		require.NoError(t, store.Set("filestream::containers::native::1-2", filestreamState{Cursor: filestreamCursor{Offset: 150}}))
+	})
+
+	migrator := NewMigrator(config.Registry{
+		Path:        dataHome,
+		Permissions: 0600,
+		MigrateToFilestream: &config.FilestreamMigration{
+			ID:    "containers",
+			Paths: []string{"/var/lib/docker/containers/*/*.log", "/var/log/*.log"},
+		},
+	})
+	require.NoError(t, migrator.Run())
+
+	cursors := func() map[string]filestreamState {
+		cursors := map[string]filestreamState{}
+		withStore(t, dataHome, func(store backend.Store) {
+			require.NoError(t, store.Each(func(key string, dec backend.ValueDecoder) (bool, error) {
+				if strings.HasPrefix(key, "filestream::") {
+					var st filestreamState
+					require.NoError(t, dec.Decode(&st))
+					cursors[key] = st
+				}
+				return true, nil
+			}))
+		})
+		return cursors
+	}
+
+	migrated := cursors()
+	assert.Len(t, migrated, 2)
+	assert.Equal(t, int64(150), migrated["filestream::containers::native::1-2"].Cursor.Offset)
+	app := migrated["filestream::containers::native::3-2"]
+	assert.Equal(t, int64(200), app.Cursor.Offset)
+	assert.Equal(t, filestreamMeta{Source: "/var/log/app.log", IdentifierName: "native"}, app.Meta)
+	assert.Equal(t, filestreamCleanTimeout, app.TTL)
+
+	// the migration runs once
+	withStore(t, dataHome, func(store backend.Store) {
+		require.NoError(t, store.Remove("filestream::containers::native::3-2"))
+	})
+	require.NoError(t, migrator.Run())
+	assert.Len(t, cursors(), 1)
+}
+
+func withStore(t *testing.T, dataHome string, fn func(store backend.Store)) {
+	registryBackend, err := memlog.New(logp.NewLogger("test"), memlog.Settings{
+		Root:     dataHome,
+		FileMode: 0600,
+	})
+	require.NoError(t, err)
+	defer registryBackend.Close()
+
+	store, err := registryBackend.Access("filebeat")
+	require.NoError(t, err)
+	defer store.Close()
+	fn(store)
+}
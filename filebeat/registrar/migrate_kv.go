@@ -0,0 +1,95 @@
+package registrar
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/elastic/beats/v7/libbeat/logp"
+	"github.com/elastic/beats/v7/libbeat/statestore/backend"
+	"github.com/elastic/beats/v7/libbeat/statestore/backend/memlog"
+)
+
+const kvMigrationKey = "filebeat::migrations::kv"
+
+// migrateStores migrates the memlog store to the kv store and the states of
+// the log inputs to filestream.
+func (m *Migrator) migrateStores() error {
+	if err := m.migrateToKV(); err != nil {
+		return err
+	}
+	return m.migrateToFilestream()
+}
+
+// migrateToKV copies all entries of the memlog store to the kv store once.
+// The memlog store is kept to roll back, the updates after the migration
+// are not copied back.
+func (m *Migrator) migrateToKV() error {
+	if m.registry.Type != kvBackend || !isFile(filepath.Join(m.dataPath, "filebeat", "meta.json")) {
+		return nil
+	}
+
+	kvRegistry, err := NewBackend(logp.NewLogger("migration"), m.dataPath, m.registry)
+	if err != nil {
+		return errors.Wrap(err, "failed to create kv registry backend")
+	}
+	defer kvRegistry.Close()
+
+	kvStore, err := kvRegistry.Access("filebeat")
+	if err != nil {
+		return errors.Wrap(err, "failed to open filebeat kv store")
+	}
+	defer kvStore.Close()
+
+	done, err := kvStore.Has(kvMigrationKey)
+	if err != nil || done {
+		return err
+	}
+
+	registryBackend, err := memlog.New(logp.NewLogger("migration"), memlog.Settings{
+		Root:       m.dataPath,
+		FileMode:   m.permissions,
+		Checkpoint: func(sz uint64) bool { return false },
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to create new registry backend")
+	}
+	defer registryBackend.Close()
+
+	store, err := registryBackend.Access("filebeat")
+	if err != nil {
+		return errors.Wrap(err, "failed to open filebeat registry store")
+	}
+	defer store.Close()
+
+	migrated, err := copyStore(store, kvStore)
+	if err != nil {
+		return errors.Wrap(err, "failed to migrate registry to kv store")
+	}
+	if err := kvStore.Set(kvMigrationKey, registryMigration{Migrated: time.Now(), States: migrated}); err != nil {
+		return err
+	}
+	logp.Info("Migrated %d registry entries to kv store", migrated)
+
+	if checkpointer, ok := kvStore.(interface{ Checkpoint() error }); ok {
+		return checkpointer.Checkpoint()
+	}
+	return nil
+}
+
+func copyStore(from, to backend.Store) (int, error) {
+	copied := 0
+	err := from.Each(func(key string, dec backend.ValueDecoder) (bool, error) {
+		var value map[string]interface{}
+		if err := dec.Decode(&value); err != nil {
+			return false, err
+		}
+		if err := to.Set(key, value); err != nil {
+			return false, err
+		}
+		copied++
+		return true, nil
+	})
+	return copied, err
+}
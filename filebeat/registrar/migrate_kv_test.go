@@ -0,0 +1,74 @@
+// +build linux darwin
+
+package registrar
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/beats/v7/filebeat/config"
+	"github.com/elastic/beats/v7/filebeat/input/file"
+	libfile "github.com/elastic/beats/v7/libbeat/common/file"
+	"github.com/elastic/beats/v7/libbeat/logp"
+	"github.com/elastic/beats/v7/libbeat/statestore/backend"
+)
+
+func TestMigrationToKV(t *testing.T) {
+	dataHome := tempDir(t)
+	registryHome := filepath.Join(dataHome, "filebeat")
+	mkDir(t, registryHome)
+	writeFile(t, filepath.Join(registryHome, "meta.json"), []byte(`{"version": "1"}`))
+
+	states := []file.State{
+		{Source: "/var/log/app.log", Offset: 100, Type: "log", FileStateOS: libfile.StateOS{Inode: 1, Device: 2}},
+		{Source: "/var/log/db.log", Offset: 200, Type: "log", FileStateOS: libfile.StateOS{Inode: 3, Device: 2}},
+	}
+	withStore(t, dataHome, func(store backend.Store) {
+		require.NoError(t, writeStates(store, fixStates(states)))
+	})
+
+	cfg := config.Registry{
+		Path:        dataHome,
+		Permissions: 0600,
+		Type:        "kv",
+		MigrateToFilestream: &config.FilestreamMigration{
+			ID: "logs",
+		},
+	}
+	withKVStore := func(fn func(store backend.Store)) {
+		reg, err := NewBackend(logp.NewLogger("test"), dataHome, cfg)
+		require.NoError(t, err)
+		defer reg.Close()
+		store, err := reg.Access("filebeat")
+		require.NoError(t, err)
+		defer store.Close()
+		fn(store)
+	}
+
+	require.NoError(t, NewMigrator(cfg).Run())
+
+	withKVStore(func(store backend.Store) {
+		var st file.State
+		require.NoError(t, store.Get("filebeat::logs::native::1-2", &st))
+		assert.Equal(t, int64(100), st.Offset)
+		assert.Equal(t, "/var/log/app.log", st.Source)
+
+		// the states are migrated to filestream in the kv store
+		var cursor filestreamState
+		require.NoError(t, store.Get("filestream::logs::native::3-2", &cursor))
+		assert.Equal(t, int64(200), cursor.Cursor.Offset)
+
+		require.NoError(t, store.Set("filebeat::logs::native::1-2", file.State{Source: "/var/log/app.log", Offset: 150}))
+	})
+
+	// the migration runs once
+	require.NoError(t, NewMigrator(cfg).Run())
+	withKVStore(func(store backend.Store) {
+		var st file.State
+		require.NoError(t, store.Get("filebeat::logs::native::1-2", &st))
+		assert.Equal(t, int64(150), st.Offset)
+	})
+}
@@ -246,6 +246,20 @@ func GenerateHints(annotations common.MapStr, container, prefix string) common.M
 		}
 	}
 
+	// Prefixes ending with a domain, such as erda.io, are followed by a '/' and
+	// the hint, erda.io/logs.multiline.pattern is the hint logs.multiline.pattern.
+	if i := strings.LastIndex(prefix, "."); i > 0 {
+		if rawEntries, err := annotations.GetValue(prefix[:i]); err == nil {
+			if entries, ok := rawEntries.(common.MapStr); ok {
+				for key, rawValue := range entries {
+					if hintKey := strings.TrimPrefix(key, prefix[i+1:]+"/"); hintKey != key && hintKey != "" {
+						hints.DeepUpdateNoOverwrite(common.MapStr{hintKey: rawValue})
+					}
+				}
+			}
+		}
+	}
+
 	return hints
 }
 
@@ -23,6 +23,7 @@ import (
 	"github.com/stretchr/testify/assert"
 
 	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/common/safemapstr"
 )
 
 func TestGetProcessors(t *testing.T) {
@@ -218,6 +219,24 @@ func TestGenerateHints(t *testing.T) {
 		}
 		assert.Equal(t, test.result, GenerateHints(annMap, "foobar", "co.elastic"))
 	}
+
+	// Hints after a prefix ending with a domain
+	annMap := common.MapStr{}
+	for k, v := range map[string]string{
+		"erda.io/log.multiline.pattern": "^test",
+		"erda.io/log.format":            "json",
+		"erda.com/log.format":           "raw",
+	} {
+		safemapstr.Put(annMap, k, v)
+	}
+	assert.Equal(t, common.MapStr{
+		"log": common.MapStr{
+			"multiline": common.MapStr{
+				"pattern": "^test",
+			},
+			"format": "json",
+		},
+	}, GenerateHints(annMap, "foobar", "erda.io"))
 }
 func TestGetHintsAsList(t *testing.T) {
 	tests := []struct {
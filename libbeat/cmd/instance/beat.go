@@ -108,6 +108,14 @@ type beatConfig struct {
 	// output/publishing related configurations
 	Pipeline pipeline.Config `config:",inline"`
 
+	// named outputs used instead of output, and the routing of the events
+	// between them
+	Outputs []*common.Config `config:"outputs"`
+	Routing *common.Config   `config:"routing"`
+
+	// keeps the events the outputs permanently reject
+	DeadLetter *common.Config `config:"dead_letter"`
+
 	// monitoring settings
 	MonitoringBeatConfig monitoring.BeatConfig `config:",inline"`
 
@@ -327,8 +335,12 @@ func (b *Beat) createBeater(bt beat.Creator) (beat.Beater, error) {
 	monitoring.NewBool(mgmt, "enabled").Set(b.Manager.Enabled())
 
 	debugf("Initializing output plugins")
+	multiOutput := len(b.Config.Outputs) > 0
 	outputEnabled := b.Config.Output.IsSet() && b.Config.Output.Config().Enabled()
-	if !outputEnabled {
+	if multiOutput && outputEnabled {
+		return nil, errors.New("output and outputs can not be configured together")
+	}
+	if !outputEnabled && !multiOutput {
 		if b.Manager.Enabled() {
 			logp.Info("Output is configured through Central Management")
 		} else {
@@ -338,36 +350,32 @@ func (b *Beat) createBeater(bt beat.Creator) (beat.Beater, error) {
 		}
 	}
 
-	var publisher *pipeline.Pipeline
 	monitors := pipeline.Monitors{
 		Metrics:   reg,
 		Telemetry: monitoring.GetNamespace("state").GetRegistry(),
 		Logger:    logp.L().Named("publisher"),
 		Tracer:    b.Instrumentation.Tracer(),
 	}
-	outputFactory := b.makeOutputFactory(b.Config.Output)
 	settings := pipeline.Settings{
 		WaitClose:      0,
 		WaitCloseMode:  pipeline.NoWaitOnClose,
 		Processors:     b.processing,
 		InputQueueSize: b.InputQueueSize,
 	}
-	if settings.InputQueueSize > 0 {
-		publisher, err = pipeline.LoadWithSettings(b.Info, monitors, b.Config.Pipeline, outputFactory, settings)
-	} else {
-		publisher, err = pipeline.Load(b.Info, monitors, b.Config.Pipeline, b.processing, outputFactory)
-	}
+	publisher, _, err := b.createPublisher(monitors, settings)
 	if err != nil {
 		return nil, fmt.Errorf("error initializing publisher: %+v", err)
 	}
-
-	reload.Register.MustRegister("output", b.makeOutputReloader(publisher.OutputReloader()))
+	if p, ok := publisher.(*pipeline.Pipeline); ok {
+		reload.Register.MustRegister("output", b.makeOutputReloader(p.OutputReloader()))
+	}
 
 	// TODO: some beats race on shutdown with publisher.Stop -> do not call Stop yet,
 	//       but refine publisher to disconnect clients on stop automatically
 	// defer pipeline.Close()
 
 	b.Publisher = publisher
+
 	beater, err := bt(&b.Beat, sub)
 	if err != nil {
 		return nil, err
@@ -376,6 +384,70 @@ func (b *Beat) createBeater(bt beat.Creator) (beat.Beater, error) {
 	return beater, nil
 }
 
+// createPublisher creates the pipeline of the output, or the router of the
+// outputs, with the dead letter queue configured in dead_letter.
+func (b *Beat) createPublisher(
+	monitors pipeline.Monitors,
+	settings pipeline.Settings,
+) (beat.Pipeline, *pipeline.DeadLetterQueue, error) {
+	dlq, err := pipeline.LoadDeadLetterQueue(b.Info, monitors, b.Config.DeadLetter, b.createOutput)
+	if err != nil {
+		return nil, nil, err
+	}
+	settings.DeadLetter = dlq
+
+	var publisher beat.Pipeline
+	if len(b.Config.Outputs) > 0 {
+		publisher, err = pipeline.LoadRouter(b.Info, monitors, b.Config.Pipeline, b.Config.Outputs, b.Config.Routing, b.createOutput, settings)
+	} else {
+		publisher, err = pipeline.LoadWithSettings(b.Info, monitors, b.Config.Pipeline, b.makeOutputFactory(b.Config.Output), settings)
+	}
+	if err != nil {
+		if dlq != nil {
+			dlq.Close()
+		}
+		return nil, nil, err
+	}
+	return publisher, dlq, nil
+}
+
+// NewReplayPublisher creates a publisher of the configured outputs for
+// replaying the events of the dead letter queue. The events are published
+// as they were received by the outputs, without the processors, and the
+// events rejected again are kept in a new dead letter file. The returned
+// function closes the publisher.
+func (b *Beat) NewReplayPublisher() (beat.Pipeline, func(), error) {
+	if len(b.Config.Outputs) == 0 && !b.Config.Output.IsSet() {
+		return nil, nil, errors.New("no outputs are defined")
+	}
+
+	reg := monitoring.Default.GetRegistry("libbeat")
+	if reg == nil {
+		reg = monitoring.Default.NewRegistry("libbeat")
+	}
+	monitors := pipeline.Monitors{
+		Metrics: reg,
+		Logger:  logp.L().Named("publisher"),
+	}
+	settings := pipeline.Settings{
+		WaitClose:     0,
+		WaitCloseMode: pipeline.NoWaitOnClose,
+	}
+	publisher, dlq, err := b.createPublisher(monitors, settings)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error initializing publisher: %+v", err)
+	}
+	closePublisher := func() {
+		if closer, ok := publisher.(io.Closer); ok {
+			closer.Close()
+		}
+		if dlq != nil {
+			dlq.Close()
+		}
+	}
+	return publisher, closePublisher, nil
+}
+
 func (b *Beat) launch(settings Settings, bt beat.Creator) error {
 	defer logp.Sync()
 	defer logp.Info("%s stopped.", b.Info.Beat)
@@ -74,3 +74,14 @@ func (l *locker) unlock() error {
 
 	return nil
 }
+
+// LockDataPath acquires the lock on the data path the beat holds while it
+// runs, for commands changing the data of a stopped beat. ErrAlreadyLocked
+// is returned if the beat is running. The returned function releases the lock.
+func (b *Beat) LockDataPath() (func() error, error) {
+	bl := newLocker(b)
+	if err := bl.lock(); err != nil {
+		return nil, err
+	}
+	return bl.unlock, nil
+}
@@ -65,3 +65,32 @@ func TestLocker(t *testing.T) {
 	err = bl2.lock()
 	assert.EqualError(t, err, ErrAlreadyLocked.Error())
 }
+
+func TestLockDataPath(t *testing.T) {
+	tmpDataDir, err := ioutil.TempDir("", "data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDataDir)
+
+	origDataPath := paths.Paths.Data
+	defer func() {
+		paths.Paths.Data = origDataPath
+	}()
+	paths.Paths.Data = tmpDataDir
+
+	running := &Beat{}
+	running.Info.Beat = "testbeat"
+	bl := newLocker(running)
+	assert.NoError(t, bl.lock())
+
+	b := &Beat{}
+	b.Info.Beat = "testbeat"
+	_, err = b.LockDataPath()
+	assert.Equal(t, ErrAlreadyLocked, err)
+
+	assert.NoError(t, bl.unlock())
+	unlock, err := b.LockDataPath()
+	assert.NoError(t, err)
+	assert.NoError(t, unlock())
+}
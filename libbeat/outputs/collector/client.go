@@ -1,6 +1,7 @@
 package collector
 
 import (
+	"bytes"
 	"context"
 	"io"
 	"io/ioutil"
@@ -9,61 +10,71 @@ import (
 	netUrl "net/url"
 	"time"
 
+	"github.com/elastic/beats/v7/libbeat/beat"
 	"github.com/elastic/beats/v7/libbeat/common/transport"
 	"github.com/elastic/beats/v7/libbeat/common/transport/tlscommon"
 	"github.com/elastic/beats/v7/libbeat/logp"
 	"github.com/elastic/beats/v7/libbeat/outputs"
+	"github.com/elastic/beats/v7/libbeat/outputs/collector/wire"
 	"github.com/elastic/beats/v7/libbeat/publisher"
 	"github.com/gofrs/uuid"
 	"github.com/pkg/errors"
 )
 
 type client struct {
-	enc encoder
-	lmtr *limiter
+	name  string
+	trans *transformer
+	enc   wire.Encoder
+	lmtr  *limiter
 
-	client       *http.Client
-	jobReq       *http.Request
-	containerReq *http.Request
+	client *http.Client
+	routes []*route
 
-	outputCompressLevel int
-	outputClient        *http.Client
-	outputParams        map[string]string
-	outputHeaders       map[string]string
-	outputMethod        string
+	fwd *forwarder
 
 	observer outputs.Observer
 }
 
-func newClient(host string, cfg config, observer outputs.Observer) (*client, error) {
-	var (
-		enc encoder
-		err error
-	)
-	if cfg.CompressLevel == 0 {
-		enc, err = newJSONEncoder()
-	} else {
-		enc, err = newGzipEncoder(cfg.CompressLevel)
-	}
-	if err != nil {
-		return nil, errors.Wrap(err, "fail to create encoder")
-	}
+// route is a compiled routeConfig.
+type route struct {
+	sources map[string]bool // nil matches every source
+	req     *http.Request
+}
 
-	jobReq, err := newRequest(host, cfg.JobPath, cfg.Method, cfg.Params, cfg.Headers)
+func newClient(
+	name string,
+	host string,
+	info beat.Info,
+	cfg config,
+	fwd *forwarder,
+	lmtr *limiter,
+	observer outputs.Observer,
+) (*client, error) {
+	trans := newTransformer(cfg, observer)
+	enc, err := wire.NewEncoder(info, cfg.Wire, trans.transform)
 	if err != nil {
-		return nil, errors.Wrap(err, "fail to create job request")
+		return nil, errors.Wrap(err, "fail to create encoder")
 	}
-	enc.addHeader(&jobReq.Header)
 
-	containerReq, err := newRequest(host, cfg.ContainerPath, cfg.Method, cfg.Params, cfg.Headers)
-	if err != nil {
-		return nil, errors.Wrap(err, "fail to create container request")
-	}
-	enc.addHeader(&containerReq.Header)
+	var routes []*route
+	for _, rc := range cfg.routes() {
+		req, err := newRequest(host, rc.Path, cfg.Method, mergeMaps(cfg.Params, rc.Params), mergeMaps(cfg.Headers, rc.Headers))
+		if err != nil {
+			return nil, errors.Wrapf(err, "fail to create request for path %s", rc.Path)
+		}
+		enc.AddHeader(&req.Header)
+		if cfg.AuthUsername != "" || cfg.AuthPassword != "" {
+			req.SetBasicAuth(cfg.AuthUsername, cfg.AuthPassword)
+		}
 
-	if cfg.AuthUsername != "" || cfg.AuthPassword != "" {
-		jobReq.SetBasicAuth(cfg.AuthUsername, cfg.AuthPassword)
-		containerReq.SetBasicAuth(cfg.AuthUsername, cfg.AuthPassword)
+		r := &route{req: req}
+		if len(rc.Sources) > 0 {
+			r.sources = make(map[string]bool, len(rc.Sources))
+			for _, source := range rc.Sources {
+				r.sources[source] = true
+			}
+		}
+		routes = append(routes, r)
 	}
 
 	tls, err := tlscommon.LoadTLSConfig(cfg.TLS)
@@ -75,40 +86,44 @@ func newClient(host string, cfg config, observer outputs.Observer) (*client, err
 		return nil, errors.Wrap(err, "fail to create http client")
 	}
 
-	outputTLS, err := tlscommon.LoadTLSConfig(cfg.Output.TLS)
-	if err != nil {
-		return nil, errors.Wrap(err, "fail to load output tls")
-	}
-	outputClient, err := newHTTPClient(cfg.Output.Timeout, cfg.Output.KeepAlive, outputTLS, observer)
-	if err != nil {
-		return nil, errors.Wrap(err, "fail to create output client")
-	}
-
-	lmtr := newLimiter(cfg.Limiter.Quantity, cfg.Limiter.Threshold, cfg.Limiter.Timeout)
-
 	return &client{
-		enc:                 enc,
-		lmtr:                lmtr,
-		client:              httpClient,
-		jobReq:              jobReq,
-		containerReq:        containerReq,
-		outputCompressLevel: cfg.Output.CompressLevel,
-		outputClient:        outputClient,
-		outputMethod:        cfg.Output.Method,
-		outputParams:        cfg.Output.Params,
-		outputHeaders:       cfg.Output.Headers,
-		observer:            observer,
+		name:     name,
+		trans:    trans,
+		enc:      enc,
+		lmtr:     lmtr,
+		client:   httpClient,
+		routes:   routes,
+		fwd:      fwd,
+		observer: observer,
 	}, nil
 }
 
+func mergeMaps(base, override map[string]string) map[string]string {
+	if len(override) == 0 {
+		return base
+	}
+	m := make(map[string]string, len(base)+len(override))
+	for k, v := range base {
+		m[k] = v
+	}
+	for k, v := range override {
+		m[k] = v
+	}
+	return m
+}
+
+// newRequest creates the request of a route. The params are appended after a
+// '?', which older versions of the collector output omitted, so that its
+// params were appended to the path.
 func newRequest(host, path, method string, params, headers map[string]string) (*http.Request, error) {
 	values := netUrl.Values{}
 	for key, value := range params {
 		values.Add(key, value)
 	}
-	v := values.Encode()
 	url := host + path
-	url += v
+	if v := values.Encode(); v != "" {
+		url += "?" + v
+	}
 
 	req, err := http.NewRequest(method, url, nil)
 	if err != nil {
@@ -159,13 +174,19 @@ func (c *client) Connect() error {
 	return nil
 }
 
+// Close only drops the idle connections, the client is connected again
+// after a failed publish. The forwarder and the limiter shared by the
+// clients are closed by groupClient.
 func (c *client) Close() error {
+	c.client.CloseIdleConnections()
 	return nil
 }
 
 func (c *client) Publish(_ context.Context, batch publisher.Batch) error {
 	events := batch.Events()
-	rest, err := c.publishEvents(events)
+	rest, err := c.publishEvents(events, func(event publisher.Event, reason string) {
+		publisher.DeadLetter(batch, event, reason)
+	})
 	c.observer.NewBatch(len(events))
 	if len(rest) == 0 {
 		batch.ACK()
@@ -176,52 +197,39 @@ func (c *client) Publish(_ context.Context, batch publisher.Batch) error {
 	return err
 }
 
-func (c *client) publishEvents(events []publisher.Event) ([]publisher.Event, error) {
+func (c *client) publishEvents(events []publisher.Event, deadLetter func(publisher.Event, string)) ([]publisher.Event, error) {
+	events = c.trans.filter(events, deadLetter)
 	if len(events) == 0 {
 		return nil, nil
 	}
 
-	jobs, containers, err := c.splitEvents(events)
-	if err != nil {
-		return events, errors.Wrap(err, "fail to split events")
-	}
-
-	jobRest, err := c.sendEvents(jobs, true)
-	if err != nil {
-		return events, errors.Wrap(err, "fail to send job events")
-	}
-	if len(jobRest) > 0 {
-		jobRest = append(jobRest, containers...)
-		return jobRest, nil
-	}
-
-	containerRest, err := c.sendEvents(containers, false)
-	if err != nil {
-		return events, errors.Wrap(err, "fail to send container events")
+	// The groups sent before a failure are not retried, the groups after it
+	// are not sent.
+	groups := c.splitEvents(events)
+	for i, group := range groups {
+		if len(group) == 0 {
+			continue
+		}
+		rest, err := c.sendEvents(group, c.routes[i].req)
+		if err != nil {
+			err = errors.Wrapf(err, "fail to send events to %s", c.routes[i].req.URL.Path)
+		}
+		if len(rest) > 0 {
+			for _, later := range groups[i+1:] {
+				rest = append(rest, later...)
+			}
+			return rest, err
+		}
 	}
-	return containerRest, nil
+	return nil, nil
 }
 
-func (c *client) sendEvents(events []publisher.Event, isJob bool) ([]publisher.Event, error) {
-	send, rest, err := c.pickSendEvents(events)
+func (c *client) sendEvents(events []publisher.Event, req *http.Request) ([]publisher.Event, error) {
+	send, rest, body, err := c.pickSendEvents(events)
 	if err != nil {
 		return events, errors.Wrap(err, "fail to pick send events")
 	}
-	if len(send) == 0 {
-		return events, nil
-	}
 
-	body, err := c.enc.encode(send)
-	if err != nil {
-		return events, errors.Wrap(err, "fail to encode send events")
-	}
-
-	var req *http.Request
-	if isJob {
-		req = c.jobReq
-	} else {
-		req = c.containerReq
-	}
 	var requestID string
 	if key, err := uuid.NewV4(); err == nil {
 		requestID = key.String()
@@ -235,149 +243,82 @@ func (c *client) sendEvents(events []publisher.Event, isJob bool) ([]publisher.E
 	}
 	defer closeResponseBody(resp.Body)
 
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable:
+		retryAfter := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		c.lmtr.throttle(retryAfter)
+		return events, errors.Errorf("request %s is throttled with status code %v, retry after %v", requestID, resp.StatusCode, retryAfter)
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
 		return events, errors.Errorf("request %s response status code %v is not success", requestID, resp.StatusCode)
 	}
-	// TODO need refactor
-	go func() {
-		c.sendOutputEvents(send)
-	}()
-	return rest, nil
-}
-
-func (c *client) sendOutputEvents(events []publisher.Event) {
-	sendMap := make(map[string][]publisher.Event)
-	for _, event := range events {
-		if v, err := event.Content.GetValue("terminus.output.collector"); err == nil {
-			if addr, ok := v.(string); ok && addr != "" {
-				sendMap[addr] = append(sendMap[addr], event)
-			}
+	c.lmtr.succeeded()
+	if err := c.fwd.forward(send); err != nil {
+		// With the at_least_once guarantee the events are not ACKed before
+		// they are forwarded, so they are retried and sent again.
+		if c.fwd.config.Guarantee == guaranteeAtLeastOnce {
+			return events, errors.Wrapf(err, "request %s fail to forward output events", requestID)
 		}
+		logp.Err("%s: request %s fail to forward output events: %s", c.name, requestID, err)
 	}
-	if len(sendMap) == 0 {
-		return
-	}
-
-	// 根据collector地址全部发送
-	for addr, send := range sendMap {
-		c.sendOutputAddrEvents(addr, send)
-	}
-	return
+	return rest, nil
 }
 
-func (c *client) sendOutputAddrEvents(addr string, events []publisher.Event) {
-	var (
-		enc encoder
-		err error
-	)
-	if c.outputCompressLevel == 0 {
-		enc, err = newJSONEncoder()
-	} else {
-		enc, err = newGzipEncoder(c.outputCompressLevel)
-	}
+// pickSendEvents encodes the events once and takes limiter tokens for the
+// longest prefix fitting the limits, based on the estimated size of each
+// event. Only if the prefix is shorter than the batch it is encoded again.
+func (c *client) pickSendEvents(events []publisher.Event) (send, rest []publisher.Event, body *bytes.Buffer, err error) {
+	body, err = c.enc.Encode(events)
 	if err != nil {
-		logp.Err("fail to create encoder: %s", err)
+		return nil, events, nil, errors.Wrap(err, "fail to encode events")
 	}
-
-	body, err := enc.encode(events)
-	if err != nil {
-		logp.Err("fail to encode output %s events: %s", addr, err)
-		return
+	if c.lmtr == nil {
+		return events, nil, body, nil
 	}
-	now := time.Now().UnixNano()
 
-	req, err := newRequest(addr, "", c.outputMethod, c.outputParams, c.outputHeaders)
-	if err != nil {
-		logp.Err("fail to create output request %s", addr)
-		return
+	sizes := estimateSizes(events, int64(body.Len()))
+	n := c.lmtr.acquire(sizes)
+	if n >= len(events) {
+		return events, nil, body, nil
 	}
-	enc.addHeader(&req.Header)
-	var requestID string
-	if key, err := uuid.NewV4(); err == nil {
-		requestID = key.String()
-	}
-	req.Header.Set("terminus-request-id", requestID)
 
-	req.Body = ioutil.NopCloser(body)
-	resp, err := c.outputClient.Do(req)
-	if err != nil {
-		logp.Err("fail to send %s output: %s", addr, err)
-		return
+	var estimated int64
+	for _, size := range sizes[:n] {
+		estimated += size
 	}
-	defer closeResponseBody(resp.Body)
-
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		logp.Err("output %s response status is not success, code is %v", addr, resp.StatusCode)
-		return
-	}
-
-	logp.Info("send output %s request %s success, count: %v, cost: %.3fs",
-		addr, requestID, len(events), float64(time.Now().UnixNano()-now)/float64(time.Second))
-}
-
-func (c *client) pickSendEvents(events []publisher.Event) (send, rest []publisher.Event, errs error) {
-	// 先尝试发送全部events
-	body, err := c.enc.encode(events)
+	send, rest = events[:n], events[n:]
+	body, err = c.enc.Encode(send)
 	if err != nil {
-		rest, errs = events, errors.Wrap(err, "fail to encode events")
-		return
-	}
-	if c.lmtr.assign(int64(body.Len())) {
-		send = events
-		return
+		c.lmtr.adjust(-estimated)
+		return nil, events, nil, errors.Wrap(err, "fail to encode send events")
 	}
-
-	// 后尝试减少发送的events数
-	send, rest, err = c.balanceEvents(events, rest)
-	if err != nil {
-		errs = errors.Wrap(err, "fail to balance events")
-	}
-	return
+	c.lmtr.adjust(int64(body.Len()) - estimated)
+	return send, rest, body, nil
 }
 
-func (c *client) splitEvents(events []publisher.Event) (jobs, containers []publisher.Event, err error) {
+// splitEvents groups the events by the first route matching their
+// terminus.source. Events matching no route are dropped.
+func (c *client) splitEvents(events []publisher.Event) [][]publisher.Event {
+	groups := make([][]publisher.Event, len(c.routes))
+	dropped := 0
 	for _, e := range events {
-		source, err := e.Content.GetValue("terminus.source")
-		if err != nil || source == "container" {
-			containers = append(containers, e)
-		} else {
-			jobs = append(jobs, e)
+		source := eventSource(e)
+		matched := false
+		for i, r := range c.routes {
+			if r.sources == nil || r.sources[source] {
+				groups[i] = append(groups[i], e)
+				matched = true
+				break
+			}
 		}
-	}
-	return
-}
-
-func (c *client) balanceEvents(send, rest []publisher.Event) (newSend, newRest []publisher.Event, errs error) {
-	if len(send) <= 1 {
-		newRest = append(newRest, send...)
-		newRest = append(newRest, rest...)
-		return
-	}
-
-	half := len(send) / 2
-	for i, e := range send {
-		if i < half {
-			newSend = append(newSend, e)
-		} else {
-			newRest = append(newRest, e)
+		if !matched {
+			dropped++
 		}
 	}
-	newRest = append(newRest, rest...)
-
-	body, err := c.enc.encode(newSend)
-	if err != nil {
-		errs = errors.Wrap(err, "fail to encode new send events")
-		return
-	}
-	if c.lmtr.assign(int64(body.Len())) {
-		return
-	}
-
-	newSend, newRest, err = c.balanceEvents(newSend, newRest)
-	if err != nil {
-		errs = errors.Wrap(err, "fail to balance events")
+	if dropped > 0 {
+		logp.Warn("%s: drop %v events matching no route", c.name, dropped)
+		c.observer.DroppedWithReason("no_route", dropped)
 	}
-	return
+	return groups
 }
 
 func closeResponseBody(body io.ReadCloser) {
@@ -387,5 +328,5 @@ func closeResponseBody(body io.ReadCloser) {
 }
 
 func (c *client) String() string {
-	return selector
+	return c.name
 }
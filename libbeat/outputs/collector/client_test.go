@@ -0,0 +1,220 @@
+// Copyright (c) 2021 Terminus, Inc.
+
+// This program is free software: you can use, redistribute, and/or modify
+// it under the terms of the GNU Affero General Public License, version 3
+// or later ("AGPL"), as published by the Free Software Foundation.
+
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package collector
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/outputs"
+	"github.com/elastic/beats/v7/libbeat/publisher"
+)
+
+type pathRecorder struct {
+	sync.Mutex
+	paths []string
+	query []string
+}
+
+func (p *pathRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.Lock()
+	defer p.Unlock()
+	p.paths = append(p.paths, r.URL.Path)
+	p.query = append(p.query, r.URL.RawQuery)
+	w.WriteHeader(http.StatusOK)
+}
+
+func sourceEvent(source string) publisher.Event {
+	e := mockEvent()[0]
+	e.Content.Fields = e.Content.Fields.Clone()
+	if source == "" {
+		e.Content.Fields.Delete("terminus.source")
+	} else {
+		e.Content.Fields.Put("terminus.source", source)
+	}
+	return e
+}
+
+func testClient(t *testing.T, defaults config, settings map[string]interface{}, host string) *client {
+	cfg := defaults
+	require.NoError(t, common.MustNewConfigFrom(settings).Unpack(&cfg))
+	fwd, err := newForwarder(beat.Info{}, cfg.Output, newTransformer(cfg, outputs.NewNilObserver()).transform, outputs.NewNilObserver())
+	require.NoError(t, err)
+	t.Cleanup(func() { fwd.Close() })
+
+	lmtr := newLimiter(cfg.Limiter)
+	t.Cleanup(func() { lmtr.Close() })
+
+	c, err := newClient(outputName, host, beat.Info{}, cfg, fwd, lmtr, outputs.NewNilObserver())
+	require.NoError(t, err)
+	return c
+}
+
+func TestDefaultRoutes(t *testing.T) {
+	rec := &pathRecorder{}
+	srv := httptest.NewServer(rec)
+	defer srv.Close()
+
+	c := testClient(t, defaultConfig, map[string]interface{}{}, srv.URL)
+	rest, err := c.publishEvents([]publisher.Event{
+		sourceEvent("job"),
+		sourceEvent("container"),
+		sourceEvent(""),
+	}, nil)
+	require.NoError(t, err)
+	assert.Empty(t, rest)
+	// The container events are sent first, older versions sent the job
+	// events first.
+	assert.Equal(t, []string{"/collect/logs/container", "/collect/logs/job"}, rec.paths)
+}
+
+func TestNewRequestQuery(t *testing.T) {
+	req, err := newRequest("http://collector:7076", "/collect/logs/job", "POST", map[string]string{"source": "container"}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "http://collector:7076/collect/logs/job?source=container", req.URL.String())
+
+	// Without params the URL is the host and path, as before.
+	req, err = newRequest("http://collector:7076", "/collect/logs/job", "POST", nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "http://collector:7076/collect/logs/job", req.URL.String())
+}
+
+func TestConfiguredRoutes(t *testing.T) {
+	rec := &pathRecorder{}
+	srv := httptest.NewServer(rec)
+	defer srv.Close()
+
+	c := testClient(t, defaultConfig, map[string]interface{}{
+		"params": map[string]interface{}{"cluster": "dev"},
+		"routes": []map[string]interface{}{
+			{"path": "/collect/logs/kafka", "sources": []string{"kafka-connector"}},
+			{"path": "/collect/audit", "sources": []string{"kube-apiserver-audit"}, "params": map[string]interface{}{"type": "audit"}},
+			{"path": "/collect/logs/container", "sources": []string{"container"}},
+		},
+	}, srv.URL)
+	rest, err := c.publishEvents([]publisher.Event{
+		sourceEvent("kube-apiserver-audit"),
+		sourceEvent("kafka-connector"),
+		sourceEvent("container"),
+		sourceEvent("job"), // no route, dropped
+	}, nil)
+	require.NoError(t, err)
+	assert.Empty(t, rest)
+	assert.Equal(t, []string{"/collect/logs/kafka", "/collect/audit", "/collect/logs/container"}, rec.paths)
+	assert.Equal(t, []string{"cluster=dev", "cluster=dev&type=audit", "cluster=dev"}, rec.query)
+}
+
+func TestFailedRouteRetried(t *testing.T) {
+	rec := &pathRecorder{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/collect/logs/job" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		rec.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	c := testClient(t, defaultConfig, map[string]interface{}{
+		"routes": []map[string]interface{}{
+			{"path": "/collect/logs/container", "sources": []string{"container"}},
+			{"path": "/collect/logs/job", "sources": []string{"job"}},
+			{"path": "/collect/logs/other"},
+		},
+	}, srv.URL)
+	rest, err := c.publishEvents([]publisher.Event{
+		sourceEvent("container"),
+		sourceEvent("job"),
+		sourceEvent("kafka-connector"),
+	}, nil)
+	assert.Error(t, err)
+	// The container events were sent, the events of the later routes are
+	// retried.
+	var sources []string
+	for _, e := range rest {
+		sources = append(sources, eventSource(e))
+	}
+	assert.Equal(t, []string{"job", "kafka-connector"}, sources)
+	assert.Equal(t, []string{"/collect/logs/container"}, rec.paths)
+}
+
+func TestForwardFailureRetriesBatch(t *testing.T) {
+	rec := &pathRecorder{}
+	srv := httptest.NewServer(rec)
+	defer srv.Close()
+	dest := httptest.NewServer(&mockCollector{failures: 1 << 20})
+	defer dest.Close()
+
+	// The events are not ACKed before they are forwarded.
+	c := testClient(t, defaultConfig, map[string]interface{}{
+		"output.guarantee":   "at_least_once",
+		"output.ack_timeout": "50ms",
+	}, srv.URL)
+	events := forwardEvents(dest.URL, 2)
+	rest, err := c.publishEvents(events, nil)
+	assert.Error(t, err)
+	assert.Len(t, rest, 2)
+	assert.Len(t, rec.paths, 1)
+}
+
+func TestForwardFailureKeepsSentEvents(t *testing.T) {
+	rec := &pathRecorder{}
+	srv := httptest.NewServer(rec)
+	defer srv.Close()
+
+	// Without a guarantee the failed forwards are only logged.
+	c := testClient(t, defaultConfig, map[string]interface{}{}, srv.URL)
+	require.NoError(t, c.fwd.Close())
+	events := forwardEvents("http://localhost:1", 2)
+	rest, err := c.publishEvents(events, nil)
+	require.NoError(t, err)
+	assert.Empty(t, rest)
+	assert.Len(t, rec.paths, 1)
+}
+
+func TestExportAliasDefaults(t *testing.T) {
+	rec := &pathRecorder{}
+	srv := httptest.NewServer(rec)
+	defer srv.Close()
+
+	c := testClient(t, exportDefaultConfig, map[string]interface{}{
+		"params": map[string]interface{}{"source": "container"},
+	}, srv.URL+"/collect/logs/container")
+
+	e := sourceEvent("job")
+	e.Content.Fields.Delete("terminus.id")
+	rest, err := c.publishEvents([]publisher.Event{e}, nil)
+	require.NoError(t, err)
+	assert.Empty(t, rest)
+	assert.Equal(t, []string{"/collect/logs/container"}, rec.paths)
+	assert.Equal(t, []string{"source=container"}, rec.query)
+	assert.Nil(t, c.lmtr)
+
+	m, err := newTransformer(exportDefaultConfig, outputs.NewNilObserver()).transform(e)
+	require.NoError(t, err)
+	assert.Equal(t, "unknown", m["id"])
+}
+
+func TestOutputAliasesRegistered(t *testing.T) {
+	for _, name := range []string{outputName, collectorAlias, exportAlias} {
+		assert.NotNil(t, outputs.FindFactory(name), name)
+	}
+}
@@ -1,44 +1,116 @@
 package collector
 
 import (
+	"sync"
+
 	"github.com/elastic/beats/v7/libbeat/beat"
 	"github.com/elastic/beats/v7/libbeat/common"
 	"github.com/elastic/beats/v7/libbeat/outputs"
 )
 
+// selector is the logging selector of the output.
 const selector = "collector"
 
+const outputName = "terminus"
+
+// The collector (daemonset) and terminus_export (sidecar) outputs used to be
+// separate copies of this output. They are kept as aliases, each with the
+// defaults of its deployment shape.
+const (
+	collectorAlias = "collector"
+	exportAlias    = "terminus_export"
+)
+
 func init() {
-	outputs.RegisterType( selector, makeClient)
+	outputs.RegisterType(outputName, makeFactory(outputName, defaultConfig))
+	outputs.RegisterType(collectorAlias, makeFactory(collectorAlias, defaultConfig))
+	outputs.RegisterType(exportAlias, makeFactory(exportAlias, exportDefaultConfig))
 }
 
-func makeClient(
-	_ outputs.IndexManager,
-	_ beat.Info,
-	observer outputs.Observer,
-	cfg *common.Config,
-) (outputs.Group, error) {
-	config := defaultConfig
-	if err := cfg.Unpack(&config); err != nil {
-		return outputs.Fail(err)
-	}
+func makeFactory(name string, defaults config) outputs.Factory {
+	return func(
+		_ outputs.IndexManager,
+		info beat.Info,
+		observer outputs.Observer,
+		cfg *common.Config,
+	) (outputs.Group, error) {
+		config := defaults
+		if err := cfg.Unpack(&config); err != nil {
+			return outputs.Fail(err)
+		}
 
-	hosts, err := outputs.ReadHostList(cfg)
-	if err != nil {
-		return outputs.Fail(err)
-	}
+		hosts, err := outputs.ReadHostList(cfg)
+		if err != nil {
+			return outputs.Fail(err)
+		}
 
-	clients := make([]outputs.NetworkClient, len(hosts))
-	for i, host := range hosts {
-		var client outputs.NetworkClient
-		client, err = newClient(host, config, observer)
+		fwd, err := newForwarder(info, config.Output, newTransformer(config, observer).transform, observer)
 		if err != nil {
 			return outputs.Fail(err)
 		}
 
-		client = outputs.WithBackoff(client, config.Backoff.Init, config.Backoff.Max)
-		clients[i] = client
+		// The limiter is shared, so the limits apply to the output as a whole
+		// and not to every host or worker.
+		lmtr := newLimiter(config.Limiter)
+		closeShared := func() {
+			fwd.Close()
+			lmtr.Close()
+		}
+
+		clients := make([]outputs.NetworkClient, len(hosts))
+		for i, host := range hosts {
+			var client outputs.NetworkClient
+			client, err = newClient(name, host, info, config, fwd, lmtr, observer)
+			if err != nil {
+				closeShared()
+				return outputs.Fail(err)
+			}
+
+			client = outputs.WithBackoff(client, config.Backoff.Init, config.Backoff.Max)
+			clients[i] = client
+		}
+
+		group, err := outputs.SuccessNet(config.LoadBalance, config.BulkMaxSize, config.MaxRetries, clients)
+		if err != nil {
+			closeShared()
+			return group, err
+		}
+		refs := &sharedRefs{count: len(group.Clients), close: closeShared}
+		for i, client := range group.Clients {
+			group.Clients[i] = &groupClient{NetworkClient: client.(outputs.NetworkClient), refs: refs}
+		}
+		return group, nil
 	}
+}
+
+// sharedRefs counts the clients of an output using its forwarder and
+// limiter, they are closed with the last client.
+type sharedRefs struct {
+	mu    sync.Mutex
+	count int
+	close func()
+}
+
+func (r *sharedRefs) release() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.count--
+	if r.count == 0 {
+		r.close()
+	}
+}
+
+// groupClient is a client of the output as given to the pipeline, it is
+// only closed when the output is replaced or the pipeline stops. The
+// clients it wraps are also closed before they reconnect.
+type groupClient struct {
+	outputs.NetworkClient
+	refs *sharedRefs
+	once sync.Once
+}
 
-	return outputs.SuccessNet(config.LoadBalance, config.BulkMaxSize, config.MaxRetries, clients)
+func (c *groupClient) Close() error {
+	err := c.NetworkClient.Close()
+	c.once.Do(c.refs.release)
+	return err
 }
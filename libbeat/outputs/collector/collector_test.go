@@ -0,0 +1,96 @@
+// Copyright (c) 2021 Terminus, Inc.
+
+// This program is free software: you can use, redistribute, and/or modify
+// it under the terms of the GNU Affero General Public License, version 3
+// or later ("AGPL"), as published by the Free Software Foundation.
+
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package collector
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/monitoring"
+	"github.com/elastic/beats/v7/libbeat/outputs"
+	"github.com/elastic/beats/v7/libbeat/outputs/outest"
+)
+
+func TestReloadReleasesForwarder(t *testing.T) {
+	srv := httptest.NewServer(&mockCollector{})
+	defer srv.Close()
+	spool, err := ioutil.TempDir("", "collector")
+	require.NoError(t, err)
+	defer os.RemoveAll(spool)
+
+	var events []beat.Event
+	for _, e := range forwardEvents(srv.URL, 3) {
+		events = append(events, e.Content)
+	}
+	baseline := runtime.NumGoroutine()
+
+	// Every reload creates the clients of the output and closes the
+	// previous ones.
+	for _, loadBalance := range []bool{true, false, true} {
+		cfg := common.MustNewConfigFrom(map[string]interface{}{
+			"hosts":                 []string{srv.URL, srv.URL},
+			"loadbalance":           loadBalance,
+			"output.guarantee":      "at_least_once",
+			"output.spool.path":     spool,
+			"output.spool.max_size": "10MB",
+		})
+		group, err := outputs.FindFactory(outputName)(nil, beat.Info{}, outputs.NewNilObserver(), cfg)
+		require.NoError(t, err)
+
+		var registries []string
+		for _, out := range group.Clients {
+			require.NoError(t, out.(outputs.NetworkClient).Connect())
+			batch := outest.NewBatch(events...)
+			require.NoError(t, out.Publish(context.Background(), batch))
+			assert.Equal(t, outest.BatchACK, batch.Signals[0].Tag)
+
+			inner := out.(*groupClient).NetworkClient
+			if backoff, ok := inner.(interface{ Client() outputs.NetworkClient }); ok {
+				inner = backoff.Client()
+			}
+			if c, ok := inner.(*client); ok {
+				registries = append(registries, c.fwd.regName, c.lmtr.regName)
+			}
+		}
+		for _, name := range registries {
+			assert.NotNil(t, monitoring.Default.Get(name), name)
+		}
+
+		for _, out := range group.Clients {
+			require.NoError(t, out.Close())
+		}
+		for _, name := range registries {
+			assert.Nil(t, monitoring.Default.Get(name), name)
+		}
+	}
+
+	// Not polled with assert.Eventually, which runs the condition in its
+	// own goroutine.
+	for deadline := time.Now().Add(5 * time.Second); runtime.NumGoroutine() > baseline; {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines leaked after the reloads", runtime.NumGoroutine()-baseline)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -1,14 +1,21 @@
 package collector
 
 import (
+	"fmt"
+	"math"
 	"time"
 
+	"github.com/elastic/beats/v7/libbeat/common"
 	"github.com/elastic/beats/v7/libbeat/common/transport/tlscommon"
+	"github.com/elastic/beats/v7/libbeat/outputs/collector/wire"
 )
 
 type config struct {
 	JobPath       string            `config:"job_path"`
 	ContainerPath string            `config:"container_path"`
+	Routes        []routeConfig     `config:"routes"`
+	Mapping       []fieldMapping    `config:"mapping"`
+	DefaultID     string            `config:"default_id"`
 	Params        map[string]string `config:"params"`
 	Headers       map[string]string `config:"headers"`
 	AuthUsername  string            `config:"auth_username"`
@@ -21,32 +28,119 @@ type config struct {
 	MaxRetries    int               `config:"max_retries"`
 	Backoff       backoff           `config:"backoff"`
 	LoadBalance   bool              `config:"load_balance"`
-	CompressLevel int               `config:"compress_level" validate:"min=0, max=9"`
+	Wire          wire.Config       `config:",inline"`
 	Limiter       limiterConfig     `config:"limiter"`
 	Output        outputConfig      `config:"output"`
 }
 
+// routeConfig sends the events whose terminus.source is one of Sources
+// to Path. A route without sources matches every event.
+type routeConfig struct {
+	Path    string            `config:"path"`
+	Sources []string          `config:"sources"`
+	Params  map[string]string `config:"params"`
+	Headers map[string]string `config:"headers"`
+}
+
 type backoff struct {
 	Init time.Duration `config:"init"`
 	Max  time.Duration `config:"max"`
 }
 
+// limiterConfig limits the events and encoded bytes sent per second by all
+// clients of the output together. The bursts default to one second of rate.
 type limiterConfig struct {
+	EventsPerSecond float64        `config:"events_per_second" validate:"min=0"`
+	EventsBurst     int64          `config:"events_burst" validate:"min=0"`
+	BytesPerSecond  float64        `config:"bytes_per_second" validate:"min=0"`
+	BytesBurst      int64          `config:"bytes_burst" validate:"min=0"`
+	Adaptive        adaptiveConfig `config:"adaptive"`
+
+	// Deprecated: quantity bytes are added every timeout, up to threshold.
+	// Used unless bytes_per_second is set.
 	Quantity  int64         `config:"quantity"`
 	Threshold int64         `config:"threshold"`
 	Timeout   time.Duration `config:"timeout"`
 }
 
+// adaptiveConfig controls how the limiter backs off on 429 and 503.
+type adaptiveConfig struct {
+	MinRatio      float64       `config:"min_ratio"`
+	RecoverStep   float64       `config:"recover_step"`
+	RecoverPeriod time.Duration `config:"recover_period" validate:"min=0,nonzero"`
+}
+
+var defaultAdaptiveConfig = adaptiveConfig{
+	MinRatio:      0.1,
+	RecoverStep:   0.1,
+	RecoverPeriod: 10 * time.Second,
+}
+
+func (c *adaptiveConfig) Validate() error {
+	if c.MinRatio <= 0 || c.MinRatio > 1 {
+		return fmt.Errorf("min_ratio must be in (0, 1], got %v", c.MinRatio)
+	}
+	if c.RecoverStep <= 0 {
+		return fmt.Errorf("recover_step must be positive, got %v", c.RecoverStep)
+	}
+	return nil
+}
+
+// rates returns the events and bytes rates with their bursts. A rate of 0
+// is unlimited.
+func (c *limiterConfig) rates() (eventsRate, eventsBurst, bytesRate, bytesBurst float64) {
+	eventsRate, eventsBurst = c.EventsPerSecond, float64(c.EventsBurst)
+	bytesRate, bytesBurst = c.BytesPerSecond, float64(c.BytesBurst)
+	if bytesRate <= 0 && c.Quantity > 0 && c.Threshold > 0 && c.Timeout > 0 {
+		bytesRate = float64(c.Quantity) / c.Timeout.Seconds()
+		bytesBurst = float64(c.Threshold)
+	}
+	if eventsBurst <= 0 {
+		eventsBurst = math.Max(1, eventsRate)
+	}
+	if bytesBurst <= 0 {
+		bytesBurst = math.Max(1, bytesRate)
+	}
+	return
+}
+
 type outputConfig struct {
-	Params        map[string]string `config:"params"`
-	Headers       map[string]string `config:"headers"`
-	Method        string            `config:"method"`
-	TLS           *tlscommon.Config `config:"ssl"`
-	KeepAlive     time.Duration     `config:"keep_alive"`
-	Timeout       time.Duration     `config:"timeout"`
-	CompressLevel int               `config:"compress_level" validate:"min=0, max=9"`
+	Params    map[string]string `config:"params"`
+	Headers   map[string]string `config:"headers"`
+	Method    string            `config:"method"`
+	TLS       *tlscommon.Config `config:"ssl"`
+	KeepAlive time.Duration     `config:"keep_alive"`
+	Timeout   time.Duration     `config:"timeout"`
+	Wire      wire.Config       `config:",inline"`
+
+	// Delivery settings of the per-destination queues.
+	Guarantee   deliveryGuarantee `config:"guarantee"`
+	QueueSize   int               `config:"queue_size" validate:"min=1"`
+	BulkMaxSize int               `config:"bulk_max_size" validate:"min=1"`
+	MaxRetries  int               `config:"max_retries"`
+	Backoff     backoff           `config:"backoff"`
+	ACKTimeout  time.Duration     `config:"ack_timeout"`
+	Spool       *common.Config    `config:"spool"`
+}
+
+var defaultOutputConfig = outputConfig{
+	Method:      "POST",
+	KeepAlive:   30 * time.Second,
+	Timeout:     60 * time.Second,
+	Wire:        wire.DefaultConfig,
+	Guarantee:   guaranteeNone,
+	QueueSize:   4096,
+	BulkMaxSize: 512,
+	MaxRetries:  3,
+	Backoff: backoff{
+		Init: 1 * time.Second,
+		Max:  60 * time.Second,
+	},
+	ACKTimeout: 60 * time.Second,
 }
 
+// defaultConfig is the daemonset shape: job and container logs of the
+// whole node are sent to the central collector, with rate limiting.
 var defaultConfig = config{
 	JobPath:       "/collect/logs/job",
 	ContainerPath: "/collect/logs/container",
@@ -58,21 +152,54 @@ var defaultConfig = config{
 		Init: 1 * time.Second,
 		Max:  60 * time.Second,
 	},
-	LoadBalance:   true,
-	CompressLevel: 9,
+	LoadBalance: true,
+	Wire:        wire.DefaultConfig,
 	Limiter: limiterConfig{
+		Adaptive:  defaultAdaptiveConfig,
 		Quantity:  1024 * 10,
 		Threshold: 1024 * 100,
 		Timeout:   50 * time.Millisecond,
 	},
-	Output: outputConfig{
-		Method:        "POST",
-		KeepAlive:     30 * time.Second,
-		Timeout:       60 * time.Second,
-		CompressLevel: 9,
+	Output: defaultOutputConfig,
+}
+
+// exportDefaultConfig is the sidecar shape: hosts hold the full collector
+// URL and there is no rate limiting unless configured.
+var exportDefaultConfig = config{
+	DefaultID:   "unknown",
+	Method:      "POST",
+	KeepAlive:   30 * time.Second,
+	Timeout:     60 * time.Second,
+	BulkMaxSize: 1024,
+	MaxRetries:  -1,
+	Backoff: backoff{
+		Init: 1 * time.Second,
+		Max:  60 * time.Second,
 	},
+	Wire:    wire.DefaultConfig,
+	Limiter: limiterConfig{Adaptive: defaultAdaptiveConfig},
+	Output:  defaultOutputConfig,
 }
 
 func (c *config) Validate() error {
 	return nil
 }
+
+// routes returns the configured routes. Without explicit routes, container
+// logs (or events without terminus.source) go to container_path and all
+// other events to job_path; if neither is set, everything goes to the host.
+// The routes are sent in order, so unlike older versions, which sent the job
+// events first, the container events of a batch are sent before its job
+// events.
+func (c *config) routes() []routeConfig {
+	if len(c.Routes) > 0 {
+		return c.Routes
+	}
+	if c.JobPath == "" && c.ContainerPath == "" {
+		return []routeConfig{{}}
+	}
+	return []routeConfig{
+		{Path: c.ContainerPath, Sources: []string{defaultSource}},
+		{Path: c.JobPath},
+	}
+}
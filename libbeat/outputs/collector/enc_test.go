@@ -23,15 +23,17 @@ import (
 
 	"github.com/elastic/beats/v7/libbeat/beat"
 	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/outputs"
+	"github.com/elastic/beats/v7/libbeat/outputs/collector/wire"
 	"github.com/elastic/beats/v7/libbeat/publisher"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestGzipEncode(t *testing.T) {
-	genc, err := newGzipEncoder(9)
+	genc, err := wire.NewEncoder(beat.Info{}, wire.DefaultConfig, newTransformer(defaultConfig, outputs.NewNilObserver()).transform)
 	assert.Nil(t, err)
 
-	b, err := genc.encode(mockEvent())
+	b, err := genc.Encode(mockEvent())
 
 	assert.Nil(t, err)
 	gr, err := gzip.NewReader(bytes.NewReader(b.Bytes()))
@@ -68,7 +70,7 @@ func mockEvent() []publisher.Event {
 						},
 					},
 					"message": "\u001b[37mDEBU\u001b[0m[2021-04-22 14:18:52.265950181] finished handle request GET /health (took 107.411µs) ",
-					"stream": "stdout",
+					"stream":  "stdout",
 				},
 				Private:    nil,
 				TimeSeries: false,
@@ -79,5 +81,3 @@ func mockEvent() []publisher.Event {
 	}
 	return res
 }
-
-
@@ -0,0 +1,594 @@
+package collector
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/common/atomic"
+	b "github.com/elastic/beats/v7/libbeat/common/backoff"
+	"github.com/elastic/beats/v7/libbeat/common/transport/tlscommon"
+	"github.com/elastic/beats/v7/libbeat/logp"
+	"github.com/elastic/beats/v7/libbeat/monitoring"
+	"github.com/elastic/beats/v7/libbeat/outputs"
+	"github.com/elastic/beats/v7/libbeat/outputs/collector/wire"
+	"github.com/elastic/beats/v7/libbeat/paths"
+	"github.com/elastic/beats/v7/libbeat/publisher"
+	"github.com/elastic/beats/v7/libbeat/publisher/queue"
+	"github.com/elastic/beats/v7/libbeat/publisher/queue/diskqueue"
+	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+)
+
+// outputAddrField holds the address of the tenant collector an event
+// should additionally be delivered to.
+const outputAddrField = "terminus.output.collector"
+
+var (
+	errForwarderClosed = errors.New("forwarder closed")
+	errForwardTimeout  = errors.New("timeout waiting for output delivery")
+
+	forwarderID atomic.Uint32
+
+	unsafePathChars = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+)
+
+// deliveryGuarantee selects when a batch forwarded to the output
+// destinations is considered done.
+type deliveryGuarantee uint8
+
+const (
+	// guaranteeNone hands events to the destination queues without waiting,
+	// dropping them if the queue is full.
+	guaranteeNone deliveryGuarantee = iota
+	// guaranteeAtLeastOnce waits until every event has been delivered or
+	// persisted to the destination spool before the batch is ACKed. The
+	// events are retried until delivered, ignoring max_retries, and the batch
+	// is retried if they are not delivered within ack_timeout.
+	guaranteeAtLeastOnce
+)
+
+func (g *deliveryGuarantee) Unpack(s string) error {
+	switch s {
+	case "", "none":
+		*g = guaranteeNone
+	case "at_least_once", "at-least-once":
+		*g = guaranteeAtLeastOnce
+	default:
+		return fmt.Errorf("unknown delivery guarantee '%v'", s)
+	}
+	return nil
+}
+
+func (g deliveryGuarantee) String() string {
+	if g == guaranteeAtLeastOnce {
+		return "at_least_once"
+	}
+	return "none"
+}
+
+// forwarder fans events out to the collectors named in terminus.output.collector.
+// Every destination gets its own bounded memory queue, an optional disk spool
+// and a worker that retries with backoff, so a slow or unreachable tenant
+// collector never blocks the others.
+//
+// The forwarder is shared by all clients of the output and outlives their
+// connections: clients are closed and reconnected after every failed publish.
+// It is closed once the clients of the output are closed for good.
+type forwarder struct {
+	info      beat.Info
+	transform wire.TransformFunc
+	log       *logp.Logger
+	config    outputConfig
+	client    *http.Client
+	spool     *diskqueue.Settings
+
+	mu    sync.Mutex
+	dests map[string]*destination
+
+	metrics forwardMetrics
+	regName string
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+type forwardMetrics struct {
+	destinations *monitoring.Uint // gauge
+	queued       *monitoring.Uint // events accepted into a memory queue
+	spooled      *monitoring.Uint // events written to a disk spool
+	acked        *monitoring.Uint // events delivered successfully
+	failed       *monitoring.Uint // events given up after max_retries or failing to open their destination
+	dropped      *monitoring.Uint // events dropped because the queue was full
+	retries      *monitoring.Uint // failed delivery attempts that were retried
+}
+
+func newForwarder(
+	info beat.Info,
+	cfg outputConfig,
+	transform wire.TransformFunc,
+	observer outputs.Observer,
+) (*forwarder, error) {
+	tls, err := tlscommon.LoadTLSConfig(cfg.TLS)
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to load output tls")
+	}
+	client, err := newHTTPClient(cfg.Timeout, cfg.KeepAlive, tls, observer)
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to create output client")
+	}
+
+	var spool *diskqueue.Settings
+	if cfg.Spool.Enabled() {
+		settings, err := diskqueue.SettingsForUserConfig(cfg.Spool)
+		if err != nil {
+			return nil, errors.Wrap(err, "fail to load output spool settings")
+		}
+		if settings.Path == "" {
+			settings.Path = paths.Resolve(paths.Data, "collector-output")
+		}
+		spool = &settings
+	}
+
+	id := int(forwarderID.Inc())
+	regName := selector + ".output." + strconv.Itoa(id)
+	reg := monitoring.Default.NewRegistry(regName, monitoring.DoNotReport)
+	return &forwarder{
+		info:      info,
+		transform: transform,
+		log:       logp.NewLogger(selector).With("forwarder_id", id),
+		config:    cfg,
+		client:    client,
+		spool:     spool,
+		dests:     make(map[string]*destination),
+		metrics: forwardMetrics{
+			destinations: monitoring.NewUint(reg, "destinations"),
+			queued:       monitoring.NewUint(reg, "events.queued"),
+			spooled:      monitoring.NewUint(reg, "events.spooled"),
+			acked:        monitoring.NewUint(reg, "events.acked"),
+			failed:       monitoring.NewUint(reg, "events.failed"),
+			dropped:      monitoring.NewUint(reg, "events.dropped"),
+			retries:      monitoring.NewUint(reg, "retries"),
+		},
+		regName: regName,
+		done:    make(chan struct{}),
+	}, nil
+}
+
+// forward hands the events carrying an output address to their destination
+// queues. With the at_least_once guarantee it blocks until all of them have
+// been delivered or spooled to disk, and returns an error otherwise.
+func (f *forwarder) forward(events []publisher.Event) error {
+	groups := make(map[string][]publisher.Event)
+	total := 0
+	for _, event := range events {
+		if v, err := event.Content.GetValue(outputAddrField); err == nil {
+			if addr, ok := v.(string); ok && addr != "" {
+				groups[addr] = append(groups[addr], event)
+				total++
+			}
+		}
+	}
+	if total == 0 {
+		return nil
+	}
+
+	var ack *forwardACK
+	if f.config.Guarantee == guaranteeAtLeastOnce {
+		ack = newForwardACK(total)
+	}
+	for addr, group := range groups {
+		d, err := f.destination(addr)
+		if err != nil {
+			f.log.Errorf("fail to open output %s: %s", addr, err)
+			f.metrics.failed.Add(uint64(len(group)))
+			ack.done(len(group), err)
+			continue
+		}
+		d.enqueue(group, ack)
+	}
+	if ack == nil {
+		return nil
+	}
+	return ack.wait(f.config.ACKTimeout, f.done)
+}
+
+func (f *forwarder) destination(addr string) (*destination, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	select {
+	case <-f.done:
+		return nil, errForwarderClosed
+	default:
+	}
+
+	if d, ok := f.dests[addr]; ok {
+		return d, nil
+	}
+	d, err := newDestination(f, addr)
+	if err != nil {
+		return nil, err
+	}
+	f.dests[addr] = d
+	f.metrics.destinations.Inc()
+	d.start()
+	return d, nil
+}
+
+// Close stops all destination workers. Events still in memory are
+// reported as failed, spooled events stay on disk for the next start.
+func (f *forwarder) Close() error {
+	f.mu.Lock()
+	select {
+	case <-f.done:
+		f.mu.Unlock()
+		return nil
+	default:
+	}
+	close(f.done)
+	f.mu.Unlock()
+
+	// Closing the spools unblocks their readers and any producer
+	// still waiting for disk space.
+	for _, d := range f.dests {
+		d.closeSpool()
+	}
+	f.wg.Wait()
+	for _, d := range f.dests {
+		d.drain()
+	}
+	f.client.CloseIdleConnections()
+	monitoring.Default.Remove(f.regName)
+	return nil
+}
+
+// destination is the delivery path to a single output address.
+type destination struct {
+	f    *forwarder
+	addr string
+	log  *logp.Logger
+	enc  wire.Encoder // only used by the destination worker
+
+	mem chan forwardEvent
+
+	// spool is nil unless output.spool is enabled. Events overflowing the
+	// memory queue are written to it and drained once the memory queue is empty.
+	spool       queue.Queue
+	spoolMu     sync.Mutex // serializes writes through producer
+	producer    queue.Producer
+	ackMu       sync.Mutex
+	pendingACKs []*forwardACK // ACK handle of every event not yet written to disk
+	diskBatches chan queue.Batch
+}
+
+type forwardEvent struct {
+	event publisher.Event
+	ack   *forwardACK
+}
+
+func newDestination(f *forwarder, addr string) (*destination, error) {
+	enc, err := wire.NewEncoder(f.info, f.config.Wire, f.transform)
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to create encoder")
+	}
+	d := &destination{
+		f:    f,
+		addr: addr,
+		log:  f.log.With("output", addr),
+		enc:  enc,
+		mem:  make(chan forwardEvent, f.config.QueueSize),
+	}
+	if f.spool == nil {
+		return d, nil
+	}
+
+	settings := *f.spool
+	settings.Path = filepath.Join(f.spool.Path, unsafePathChars.ReplaceAllString(addr, "_"))
+	spool, err := diskqueue.NewQueue(d.log, settings)
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to open output spool")
+	}
+	d.spool = spool
+	d.producer = spool.Producer(queue.ProducerConfig{ACK: d.onSpooled})
+	d.diskBatches = make(chan queue.Batch)
+	return d, nil
+}
+
+func (d *destination) start() {
+	d.f.wg.Add(1)
+	go func() {
+		defer d.f.wg.Done()
+		d.run()
+	}()
+
+	if d.spool == nil {
+		return
+	}
+	d.f.wg.Add(1)
+	go func() {
+		defer d.f.wg.Done()
+		d.readSpool()
+	}()
+}
+
+func (d *destination) closeSpool() {
+	if d.spool == nil {
+		return
+	}
+	if err := d.spool.Close(); err != nil {
+		d.log.Errorf("fail to close output spool: %s", err)
+	}
+}
+
+func (d *destination) drain() {
+	for {
+		select {
+		case fe := <-d.mem:
+			fe.ack.done(1, errForwarderClosed)
+		default:
+			return
+		}
+	}
+}
+
+func (d *destination) enqueue(events []publisher.Event, ack *forwardACK) {
+	metrics := &d.f.metrics
+	block := ack != nil && d.spool == nil
+	for _, event := range events {
+		fe := forwardEvent{event: event, ack: ack}
+		select {
+		case d.mem <- fe:
+			metrics.queued.Inc()
+			continue
+		default:
+		}
+
+		if d.spool != nil {
+			if d.writeSpool(fe) {
+				metrics.spooled.Inc()
+				continue
+			}
+		} else if block {
+			select {
+			case d.mem <- fe:
+				metrics.queued.Inc()
+				continue
+			case <-d.f.done:
+			}
+		}
+		metrics.dropped.Inc()
+		ack.done(1, errors.Errorf("output %s queue is full", d.addr))
+	}
+}
+
+func (d *destination) writeSpool(fe forwardEvent) bool {
+	d.spoolMu.Lock()
+	defer d.spoolMu.Unlock()
+
+	d.ackMu.Lock()
+	d.pendingACKs = append(d.pendingACKs, fe.ack)
+	d.ackMu.Unlock()
+
+	var ok bool
+	if fe.ack == nil {
+		ok = d.producer.TryPublish(fe.event)
+	} else {
+		ok = d.producer.Publish(fe.event)
+	}
+	if !ok {
+		// The event was not written, so no ACK will ever arrive for it.
+		d.ackMu.Lock()
+		d.pendingACKs = d.pendingACKs[:len(d.pendingACKs)-1]
+		d.ackMu.Unlock()
+	}
+	return ok
+}
+
+// onSpooled is called by the disk queue once count events have been
+// written, in the order they were published.
+func (d *destination) onSpooled(count int) {
+	d.ackMu.Lock()
+	if count > len(d.pendingACKs) {
+		count = len(d.pendingACKs)
+	}
+	acks := d.pendingACKs[:count]
+	d.pendingACKs = d.pendingACKs[count:]
+	d.ackMu.Unlock()
+
+	for _, ack := range acks {
+		ack.done(1, nil)
+	}
+}
+
+func (d *destination) readSpool() {
+	consumer := d.spool.Consumer()
+	defer consumer.Close()
+
+	for {
+		batch, err := consumer.Get(d.f.config.BulkMaxSize)
+		if err != nil {
+			return
+		}
+		select {
+		case d.diskBatches <- batch:
+		case <-d.f.done:
+			return
+		}
+	}
+}
+
+func (d *destination) run() {
+	for {
+		// Memory events are always sent first; the spool only takes
+		// the overflow and is drained when the memory queue is idle.
+		select {
+		case <-d.f.done:
+			return
+		case fe := <-d.mem:
+			d.sendMemory(fe)
+			continue
+		default:
+		}
+
+		select {
+		case <-d.f.done:
+			return
+		case fe := <-d.mem:
+			d.sendMemory(fe)
+		case batch := <-d.diskBatches:
+			// The spooled events are retried until delivered. The batch is
+			// left unacked if the forwarder is closed first, so it is read
+			// again on restart.
+			if err := d.deliver(batch.Events(), -1); err != nil {
+				return
+			}
+			batch.ACK()
+		}
+	}
+}
+
+func (d *destination) sendMemory(first forwardEvent) {
+	pending := []forwardEvent{first}
+collect:
+	for len(pending) < d.f.config.BulkMaxSize {
+		select {
+		case fe := <-d.mem:
+			pending = append(pending, fe)
+		default:
+			break collect
+		}
+	}
+
+	events := make([]publisher.Event, len(pending))
+	for i, fe := range pending {
+		events[i] = fe.event
+	}
+	maxRetries := d.f.config.MaxRetries
+	if d.f.config.Guarantee == guaranteeAtLeastOnce {
+		maxRetries = -1
+	}
+	err := d.deliver(events, maxRetries)
+	for _, fe := range pending {
+		fe.ack.done(1, err)
+	}
+}
+
+// deliver sends events to the destination, retrying with backoff until
+// it succeeds, maxRetries is exceeded or the forwarder is closed. A negative
+// maxRetries retries until the forwarder is closed.
+func (d *destination) deliver(events []publisher.Event, maxRetries int) error {
+	metrics := &d.f.metrics
+	retry := b.NewEqualJitterBackoff(d.f.done, d.f.config.Backoff.Init, d.f.config.Backoff.Max)
+	for attempt := 0; ; attempt++ {
+		err := d.send(events)
+		if err == nil {
+			metrics.acked.Add(uint64(len(events)))
+			return nil
+		}
+
+		if maxRetries >= 0 && attempt >= maxRetries {
+			d.log.Errorf("drop %v events after %v attempts: %s", len(events), attempt+1, err)
+			metrics.failed.Add(uint64(len(events)))
+			return err
+		}
+		d.log.Warnf("fail to send %v events, retrying: %s", len(events), err)
+		metrics.retries.Inc()
+		if !retry.Wait() {
+			return errForwarderClosed
+		}
+	}
+}
+
+func (d *destination) send(events []publisher.Event) error {
+	cfg := d.f.config
+	body, err := d.enc.Encode(events)
+	if err != nil {
+		return errors.Wrap(err, "fail to encode events")
+	}
+	now := time.Now().UnixNano()
+
+	req, err := newRequest(d.addr, "", cfg.Method, cfg.Params, cfg.Headers)
+	if err != nil {
+		return errors.Wrap(err, "fail to create request")
+	}
+	d.enc.AddHeader(&req.Header)
+	var requestID string
+	if key, err := uuid.NewV4(); err == nil {
+		requestID = key.String()
+	}
+	req.Header.Set("terminus-request-id", requestID)
+	req.Body = ioutil.NopCloser(body)
+
+	resp, err := d.f.client.Do(req)
+	if err != nil {
+		return errors.Errorf("fail to send request %s: %s", requestID, err)
+	}
+	defer closeResponseBody(resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.Errorf("request %s response status code %v is not success", requestID, resp.StatusCode)
+	}
+
+	d.log.Debugf("send request %s success, count: %v, cost: %.3fs",
+		requestID, len(events), float64(time.Now().UnixNano()-now)/float64(time.Second))
+	return nil
+}
+
+// forwardACK tracks the outstanding events of one forwarded batch.
+// A nil *forwardACK is valid and ignores all calls.
+type forwardACK struct {
+	mu      sync.Mutex
+	pending int
+	err     error
+	ch      chan struct{}
+}
+
+func newForwardACK(count int) *forwardACK {
+	return &forwardACK{pending: count, ch: make(chan struct{})}
+}
+
+func (a *forwardACK) done(count int, err error) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.pending <= 0 {
+		return
+	}
+	if err != nil && a.err == nil {
+		a.err = err
+	}
+	a.pending -= count
+	if a.pending <= 0 {
+		close(a.ch)
+	}
+}
+
+func (a *forwardACK) wait(timeout time.Duration, done <-chan struct{}) error {
+	var timer <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		timer = t.C
+	}
+
+	select {
+	case <-a.ch:
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		return a.err
+	case <-timer:
+		return errForwardTimeout
+	case <-done:
+		return errForwarderClosed
+	}
+}
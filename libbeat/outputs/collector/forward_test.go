@@ -0,0 +1,241 @@
+// Copyright (c) 2021 Terminus, Inc.
+
+// This program is free software: you can use, redistribute, and/or modify
+// it under the terms of the GNU Affero General Public License, version 3
+// or later ("AGPL"), as published by the Free Software Foundation.
+
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package collector
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/outputs"
+	"github.com/elastic/beats/v7/libbeat/publisher"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockCollector struct {
+	sync.Mutex
+	failures int // number of requests to reject before accepting
+	requests int
+	accepted int
+}
+
+func (m *mockCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.Lock()
+	defer m.Unlock()
+	m.requests++
+	if m.failures > 0 {
+		m.failures--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	m.accepted++
+	w.WriteHeader(http.StatusOK)
+}
+
+func (m *mockCollector) counts() (requests, accepted int) {
+	m.Lock()
+	defer m.Unlock()
+	return m.requests, m.accepted
+}
+
+func forwardEvents(addr string, n int) []publisher.Event {
+	var events []publisher.Event
+	for i := 0; i < n; i++ {
+		e := mockEvent()[0]
+		e.Content.Fields = e.Content.Fields.Clone()
+		e.Content.Fields.Put(outputAddrField, addr)
+		events = append(events, e)
+	}
+	return events
+}
+
+func testForwarder(t *testing.T, settings map[string]interface{}) *forwarder {
+	cfg := defaultConfig.Output
+	cfg.Backoff = backoff{Init: time.Millisecond, Max: 10 * time.Millisecond}
+	if err := common.MustNewConfigFrom(settings).Unpack(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	fwd, err := newForwarder(beat.Info{}, cfg, newTransformer(defaultConfig, outputs.NewNilObserver()).transform, outputs.NewNilObserver())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fwd
+}
+
+func TestForwardAtLeastOnce(t *testing.T) {
+	mock := &mockCollector{failures: 2}
+	srv := httptest.NewServer(mock)
+	defer srv.Close()
+
+	fwd := testForwarder(t, map[string]interface{}{
+		"guarantee":   "at_least_once",
+		"max_retries": 3,
+	})
+	defer fwd.Close()
+
+	err := fwd.forward(forwardEvents(srv.URL, 3))
+	assert.NoError(t, err)
+
+	requests, accepted := mock.counts()
+	assert.Equal(t, 3, requests)
+	assert.Equal(t, 1, accepted)
+	assert.Equal(t, uint64(3), fwd.metrics.acked.Get())
+	assert.Equal(t, uint64(2), fwd.metrics.retries.Get())
+}
+
+func TestForwardAtLeastOnceIgnoresMaxRetries(t *testing.T) {
+	mock := &mockCollector{failures: 5}
+	srv := httptest.NewServer(mock)
+	defer srv.Close()
+
+	fwd := testForwarder(t, map[string]interface{}{
+		"guarantee":   "at_least_once",
+		"max_retries": 1,
+	})
+	defer fwd.Close()
+
+	assert.NoError(t, fwd.forward(forwardEvents(srv.URL, 2)))
+	assert.Equal(t, uint64(2), fwd.metrics.acked.Get())
+	assert.Equal(t, uint64(0), fwd.metrics.failed.Get())
+}
+
+func TestForwardAtLeastOnceTimeout(t *testing.T) {
+	mock := &mockCollector{failures: 1 << 20}
+	srv := httptest.NewServer(mock)
+	defer srv.Close()
+
+	fwd := testForwarder(t, map[string]interface{}{
+		"guarantee":   "at_least_once",
+		"max_retries": 1,
+		"ack_timeout": "50ms",
+	})
+	defer fwd.Close()
+
+	assert.Equal(t, errForwardTimeout, fwd.forward(forwardEvents(srv.URL, 2)))
+	// The events are still retried.
+	assert.Equal(t, uint64(0), fwd.metrics.failed.Get())
+	assert.Eventually(t, func() bool {
+		return fwd.metrics.retries.Get() > 1
+	}, time.Second, time.Millisecond)
+}
+
+func TestForwardIgnoresEventsWithoutAddress(t *testing.T) {
+	fwd := testForwarder(t, map[string]interface{}{"guarantee": "at_least_once"})
+	defer fwd.Close()
+
+	assert.NoError(t, fwd.forward(mockEvent()))
+	assert.Equal(t, uint64(0), fwd.metrics.destinations.Get())
+}
+
+func TestForwardNoneDropsWhenQueueFull(t *testing.T) {
+	block := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer srv.Close()
+
+	fwd := testForwarder(t, map[string]interface{}{
+		"queue_size":    1,
+		"bulk_max_size": 1,
+	})
+	defer fwd.Close()
+	defer close(block)
+
+	// The first event is taken by the worker, the second fills the queue.
+	assert.NoError(t, fwd.forward(forwardEvents(srv.URL, 1)))
+	assert.Eventually(t, func() bool {
+		return len(fwd.dests[srv.URL].mem) == 0
+	}, time.Second, time.Millisecond)
+	assert.NoError(t, fwd.forward(forwardEvents(srv.URL, 3)))
+
+	assert.Equal(t, uint64(2), fwd.metrics.queued.Get())
+	assert.Equal(t, uint64(2), fwd.metrics.dropped.Get())
+}
+
+func TestForwardSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "collector-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mock := &mockCollector{}
+	srv := httptest.NewServer(mock)
+	defer srv.Close()
+
+	fwd := testForwarder(t, map[string]interface{}{
+		"guarantee":  "at_least_once",
+		"queue_size": 1,
+		"spool": map[string]interface{}{
+			"path":     dir,
+			"max_size": "10MB",
+		},
+	})
+	defer fwd.Close()
+
+	assert.NoError(t, fwd.forward(forwardEvents(srv.URL, 10)))
+	assert.True(t, fwd.metrics.spooled.Get() > 0)
+	assert.Eventually(t, func() bool {
+		return fwd.metrics.acked.Get() == 10
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestForwardSpoolKeepsFailedBatches(t *testing.T) {
+	dir, err := ioutil.TempDir("", "collector-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mock := &mockCollector{failures: 1 << 20}
+	srv := httptest.NewServer(mock)
+	defer srv.Close()
+
+	settings := map[string]interface{}{
+		"queue_size":  1,
+		"max_retries": 0,
+		"spool": map[string]interface{}{
+			"path":     dir,
+			"max_size": "10MB",
+		},
+	}
+	fwd := testForwarder(t, settings)
+
+	// The spooled events are retried beyond max_retries and stay on disk
+	// when the forwarder is closed.
+	assert.NoError(t, fwd.forward(forwardEvents(srv.URL, 10)))
+	assert.Eventually(t, func() bool {
+		return fwd.metrics.retries.Get() > 2
+	}, 5*time.Second, time.Millisecond)
+	assert.NoError(t, fwd.Close())
+	spooled := fwd.metrics.spooled.Get()
+	assert.True(t, spooled > 0)
+
+	mock.Lock()
+	mock.failures = 0
+	mock.Unlock()
+	fwd = testForwarder(t, settings)
+	defer fwd.Close()
+	_, err = fwd.destination(srv.URL)
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return fwd.metrics.acked.Get() == spooled
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -1,60 +1,314 @@
 package collector
 
 import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/elastic/beats/v7/libbeat/common/atomic"
+	"github.com/elastic/beats/v7/libbeat/monitoring"
+	"github.com/elastic/beats/v7/libbeat/publisher"
 )
 
+var limiterID atomic.Uint32
+
+// limiter is a token bucket over events and encoded bytes, shared by all
+// clients of an output. Tokens are refilled from the elapsed time when they
+// are taken, so no goroutine runs in the background. A nil limiter never
+// limits.
+//
+// When the collector answers 429 or 503 the rates are scaled down by half,
+// down to min_ratio, and sending pauses for its Retry-After. The rates
+// recover by recover_step every recover_period while requests succeed.
 type limiter struct {
-	lock sync.Mutex
+	mu     sync.Mutex
+	events bucket
+	bytes  bucket
 
-	quantity  int64
-	capacity  int64
-	threshold int64
-	timeout   time.Duration
+	factor        float64
+	minFactor     float64
+	recoverStep   float64
+	recoverPeriod time.Duration
+	changed       time.Time // last change of factor
+	pausedUntil   time.Time
+
+	now     func() time.Time
+	done    chan struct{}
+	once    sync.Once
+	metrics limiterMetrics
+	regName string
 }
 
-func newLimiter(quantity, threshold int64, timeout time.Duration) *limiter {
-	l := &limiter{
-		quantity:  quantity,
-		capacity:  threshold,
-		threshold: threshold,
-		timeout:   timeout,
+type limiterMetrics struct {
+	events    *monitoring.Uint  // events granted
+	bytes     *monitoring.Uint  // estimated encoded bytes granted
+	waits     *monitoring.Uint  // times a client waited for tokens
+	throttled *monitoring.Uint  // 429 and 503 responses
+	factor    *monitoring.Float // current fraction of the configured rates
+}
+
+// bucket holds tokens for one unit. A bucket without rate is unlimited.
+type bucket struct {
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func (b *bucket) refill(now time.Time, factor float64) {
+	if b.rate <= 0 {
+		return
+	}
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed*b.rate*factor)
+	}
+	b.last = now
+}
+
+func (b *bucket) has(n float64) bool {
+	return b.rate <= 0 || b.tokens >= n
+}
+
+func (b *bucket) full() bool {
+	return b.rate <= 0 || b.tokens >= b.burst
+}
+
+// wait returns how long it takes until the bucket holds n tokens, or is
+// full if n exceeds the burst.
+func (b *bucket) wait(n, factor float64) time.Duration {
+	n = math.Min(n, b.burst)
+	if b.has(n) {
+		return 0
+	}
+	return time.Duration((n - b.tokens) / (b.rate * factor) * float64(time.Second))
+}
+
+func (b *bucket) take(n float64) {
+	if b.rate > 0 {
+		b.tokens -= n
+	}
+}
+
+// newLimiter returns nil, which never limits, if neither an events nor a
+// bytes rate is configured.
+func newLimiter(cfg limiterConfig) *limiter {
+	eventsRate, eventsBurst, bytesRate, bytesBurst := cfg.rates()
+	if eventsRate <= 0 && bytesRate <= 0 {
+		return nil
 	}
 
-	go l.supplement()
+	now := time.Now()
+	id := int(limiterID.Inc())
+	regName := selector + ".limiter." + strconv.Itoa(id)
+	reg := monitoring.Default.NewRegistry(regName, monitoring.DoNotReport)
+	l := &limiter{
+		events:        bucket{rate: eventsRate, burst: eventsBurst, tokens: eventsBurst, last: now},
+		bytes:         bucket{rate: bytesRate, burst: bytesBurst, tokens: bytesBurst, last: now},
+		factor:        1,
+		minFactor:     cfg.Adaptive.MinRatio,
+		recoverStep:   cfg.Adaptive.RecoverStep,
+		recoverPeriod: cfg.Adaptive.RecoverPeriod,
+		now:           time.Now,
+		done:          make(chan struct{}),
+		metrics: limiterMetrics{
+			events:    monitoring.NewUint(reg, "events"),
+			bytes:     monitoring.NewUint(reg, "bytes"),
+			waits:     monitoring.NewUint(reg, "waits"),
+			throttled: monitoring.NewUint(reg, "throttled"),
+			factor:    monitoring.NewFloat(reg, "rate_factor"),
+		},
+		regName: regName,
+	}
+	l.metrics.factor.Set(1)
 	return l
 }
 
-func (l *limiter) assign(size int64) bool {
-	l.lock.Lock()
-	defer l.lock.Unlock()
+// acquire blocks until tokens for at least the first event are available
+// and returns the number of leading events granted, given their estimated
+// encoded sizes. It grants everything once the limiter is closed.
+func (l *limiter) acquire(sizes []int64) int {
+	if l == nil {
+		return len(sizes)
+	}
+	for {
+		n, wait := l.take(sizes)
+		if n > 0 || len(sizes) == 0 {
+			return n
+		}
+		if wait < time.Millisecond {
+			wait = time.Millisecond
+		}
+		l.metrics.waits.Inc()
+		timer := time.NewTimer(wait)
+		select {
+		case <-l.done:
+			timer.Stop()
+			return len(sizes)
+		case <-timer.C:
+		}
+	}
+}
 
-	if l.capacity <= 0 {
-		return false
+// take grants the longest prefix of the events fitting the available
+// tokens. If no event fits, it returns how long to wait before trying again.
+func (l *limiter) take(sizes []int64) (int, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	select {
+	case <-l.done:
+		return len(sizes), 0
+	default:
+	}
+	if len(sizes) == 0 {
+		return 0, 0
 	}
-	if size > l.capacity {
-		return false
+
+	now := l.now()
+	if now.Before(l.pausedUntil) {
+		return 0, l.pausedUntil.Sub(now)
 	}
+	l.events.refill(now, l.factor)
+	l.bytes.refill(now, l.factor)
+
+	n, total := 0, float64(0)
+	for n < len(sizes) {
+		next := total + float64(sizes[n])
+		if !l.events.has(float64(n+1)) || !l.bytes.has(next) {
+			break
+		}
+		n, total = n+1, next
+	}
+	if n == 0 {
+		// An event larger than the burst would never fit. It is let through
+		// once the buckets are full, leaving them in debt.
+		if !l.events.full() || !l.bytes.full() {
+			wait := l.events.wait(1, l.factor)
+			if w := l.bytes.wait(float64(sizes[0]), l.factor); w > wait {
+				wait = w
+			}
+			return 0, wait
+		}
+		n, total = 1, float64(sizes[0])
+	}
+
+	l.events.take(float64(n))
+	l.bytes.take(total)
+	l.metrics.events.Add(uint64(n))
+	l.metrics.bytes.Add(uint64(total))
+	return n, 0
+}
 
-	l.capacity -= size
-	return true
+// adjust corrects the bytes taken by the difference between the actual and
+// the estimated encoded size.
+func (l *limiter) adjust(delta int64) {
+	if l == nil || delta == 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.bytes.take(float64(delta))
 }
 
-func (l *limiter) fill(size int64) {
-	l.lock.Lock()
-	defer l.lock.Unlock()
+// throttle slows down after the collector rejected a request as overloaded,
+// and pauses sending for retryAfter if it is positive.
+func (l *limiter) throttle(retryAfter time.Duration) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
 
-	l.capacity += size
-	if l.capacity >= l.threshold {
-		l.capacity = l.threshold
+	now := l.now()
+	l.setFactor(now, math.Max(l.minFactor, l.factor/2))
+	if until := now.Add(retryAfter); retryAfter > 0 && until.After(l.pausedUntil) {
+		l.pausedUntil = until
 	}
+	l.metrics.throttled.Inc()
 }
 
-func (l *limiter) supplement() {
-	for {
-		time.Sleep(l.timeout)
+// succeeded recovers the rates step by step after a throttle.
+func (l *limiter) succeeded() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if l.factor < 1 && now.Sub(l.changed) >= l.recoverPeriod {
+		l.setFactor(now, math.Min(1, l.factor+l.recoverStep))
+	}
+}
+
+func (l *limiter) setFactor(now time.Time, factor float64) {
+	// Tokens earned so far accrue at the previous rate.
+	l.events.refill(now, l.factor)
+	l.bytes.refill(now, l.factor)
+	l.factor = factor
+	l.changed = now
+	l.metrics.factor.Set(factor)
+}
+
+// Close stops limiting, releases the clients waiting for tokens and removes
+// the metrics of the limiter.
+func (l *limiter) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.once.Do(func() {
+		close(l.done)
+		monitoring.Default.Remove(l.regName)
+	})
+	return nil
+}
+
+// parseRetryAfter parses a Retry-After header given in seconds or as an
+// HTTP date. It returns 0 if the header is missing or invalid.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds <= 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+// estimateSizes splits the encoded size of a batch between its events in
+// proportion to their message sizes, so that the limiter can pick a prefix
+// without encoding the batch again for every candidate.
+func estimateSizes(events []publisher.Event, total int64) []int64 {
+	weights := make([]int64, len(events))
+	var sum int64
+	for i, e := range events {
+		w := int64(1)
+		if msg, err := e.Content.Fields.GetValue("message"); err == nil {
+			if s, ok := msg.(string); ok {
+				w += int64(len(s))
+			}
+		}
+		weights[i] = w
+		sum += w
+	}
 
-		l.fill(l.quantity)
+	sizes := make([]int64, len(events))
+	var cum, prev int64
+	for i, w := range weights {
+		cum += w
+		next := total * cum / sum
+		sizes[i] = next - prev
+		prev = next
 	}
+	return sizes
 }
@@ -0,0 +1,252 @@
+// Copyright (c) 2021 Terminus, Inc.
+
+// This program is free software: you can use, redistribute, and/or modify
+// it under the terms of the GNU Affero General Public License, version 3
+// or later ("AGPL"), as published by the Free Software Foundation.
+
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package collector
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/publisher"
+)
+
+type fakeClock struct {
+	sync.Mutex
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.t = c.t.Add(d)
+}
+
+func testLimiter(t *testing.T, settings map[string]interface{}) (*limiter, *fakeClock) {
+	cfg := limiterConfig{Adaptive: defaultAdaptiveConfig}
+	require.NoError(t, common.MustNewConfigFrom(settings).Unpack(&cfg))
+	l := newLimiter(cfg)
+	require.NotNil(t, l)
+	t.Cleanup(func() { l.Close() })
+
+	clock := &fakeClock{t: time.Unix(0, 0)}
+	l.now = clock.now
+	l.events.last, l.bytes.last = clock.t, clock.t
+	return l, clock
+}
+
+func TestLimiterRates(t *testing.T) {
+	cases := map[string]struct {
+		cfg                                            limiterConfig
+		eventsRate, eventsBurst, bytesRate, bytesBurst float64
+	}{
+		"deprecated": {
+			cfg:       limiterConfig{Quantity: 10240, Threshold: 102400, Timeout: 50 * time.Millisecond},
+			bytesRate: 204800, bytesBurst: 102400, eventsBurst: 1,
+		},
+		"bytes override deprecated": {
+			cfg:       limiterConfig{BytesPerSecond: 1000, Quantity: 10240, Threshold: 102400, Timeout: 50 * time.Millisecond},
+			bytesRate: 1000, bytesBurst: 1000, eventsBurst: 1,
+		},
+		"events": {
+			cfg:        limiterConfig{EventsPerSecond: 100, EventsBurst: 500},
+			eventsRate: 100, eventsBurst: 500, bytesBurst: 1,
+		},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			eventsRate, eventsBurst, bytesRate, bytesBurst := c.cfg.rates()
+			assert.Equal(t, c.eventsRate, eventsRate)
+			assert.Equal(t, c.eventsBurst, eventsBurst)
+			assert.Equal(t, c.bytesRate, bytesRate)
+			assert.Equal(t, c.bytesBurst, bytesBurst)
+		})
+	}
+
+	assert.Nil(t, newLimiter(exportDefaultConfig.Limiter))
+	assert.NotNil(t, newLimiter(defaultConfig.Limiter))
+}
+
+func TestLimiterTake(t *testing.T) {
+	l, clock := testLimiter(t, map[string]interface{}{
+		"events_per_second": 10,
+		"bytes_per_second":  1000,
+	})
+
+	n, wait := l.take([]int64{400, 400, 400})
+	assert.Equal(t, 2, n)
+	assert.Zero(t, wait)
+
+	n, wait = l.take([]int64{400})
+	assert.Equal(t, 0, n)
+	assert.Equal(t, 200*time.Millisecond, wait)
+
+	clock.advance(200 * time.Millisecond)
+	n, _ = l.take([]int64{400, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1})
+	assert.Equal(t, 1, n)
+
+	// The events bucket limits as well.
+	clock.advance(time.Second)
+	n, _ = l.take(make([]int64, 20))
+	assert.Equal(t, 10, n)
+}
+
+func TestLimiterOversizedEvent(t *testing.T) {
+	l, clock := testLimiter(t, map[string]interface{}{"bytes_per_second": 1000})
+
+	n, _ := l.take([]int64{100})
+	assert.Equal(t, 1, n)
+
+	// Larger than the burst: waits until the bucket is full again.
+	n, wait := l.take([]int64{5000})
+	assert.Equal(t, 0, n)
+	assert.Equal(t, 100*time.Millisecond, wait)
+
+	clock.advance(wait)
+	n, _ = l.take([]int64{5000})
+	assert.Equal(t, 1, n)
+	assert.Equal(t, float64(-4000), l.bytes.tokens)
+}
+
+func TestLimiterThrottle(t *testing.T) {
+	l, clock := testLimiter(t, map[string]interface{}{
+		"bytes_per_second":        1000,
+		"adaptive.min_ratio":      0.25,
+		"adaptive.recover_period": "1s",
+		"adaptive.recover_step":   0.5,
+	})
+	n, _ := l.take([]int64{1000})
+	assert.Equal(t, 1, n)
+
+	l.throttle(2 * time.Second)
+	assert.Equal(t, 0.5, l.factor)
+	n, wait := l.take([]int64{100})
+	assert.Equal(t, 0, n)
+	assert.Equal(t, 2*time.Second, wait)
+
+	clock.advance(2 * time.Second)
+	l.throttle(0)
+	l.throttle(0)
+	assert.Equal(t, 0.25, l.factor)
+	// Tokens earned before the throttles accrue at the previous rate.
+	assert.Equal(t, float64(1000), l.bytes.tokens)
+
+	l.take([]int64{1000})
+	clock.advance(time.Second)
+	n, _ = l.take([]int64{300})
+	assert.Equal(t, 0, n)
+
+	l.succeeded()
+	assert.Equal(t, 0.75, l.factor)
+	l.succeeded()
+	assert.Equal(t, 0.75, l.factor, "recovers once per period")
+	clock.advance(time.Second)
+	l.succeeded()
+	assert.Equal(t, float64(1), l.factor)
+}
+
+func TestLimiterClose(t *testing.T) {
+	l, _ := testLimiter(t, map[string]interface{}{"events_per_second": 1})
+	assert.Equal(t, 1, l.acquire([]int64{1, 1}))
+
+	done := make(chan int)
+	go func() { done <- l.acquire([]int64{1, 1}) }()
+	l.Close()
+	select {
+	case n := <-done:
+		assert.Equal(t, 2, n)
+	case <-time.After(5 * time.Second):
+		t.Fatal("acquire is not released by Close")
+	}
+	assert.Equal(t, 3, l.acquire([]int64{1, 1, 1}))
+}
+
+func TestEstimateSizes(t *testing.T) {
+	event := func(msg string) publisher.Event {
+		e := mockEvent()[0]
+		e.Content.Fields = common.MapStr{"message": msg}
+		return e
+	}
+	sizes := estimateSizes([]publisher.Event{event("a"), event("bbb"), event(""), event("cccccc")}, 100)
+	assert.Equal(t, []int64{14, 28, 8, 50}, sizes)
+
+	var sum int64
+	for _, size := range estimateSizes([]publisher.Event{event("x"), event("y"), event("z")}, 100) {
+		sum += size
+	}
+	assert.Equal(t, int64(100), sum)
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	assert.Equal(t, 3*time.Second, parseRetryAfter("3", now))
+	assert.Equal(t, 90*time.Second, parseRetryAfter("Tue, 01 Jun 2021 00:01:30 GMT", now))
+	assert.Zero(t, parseRetryAfter("Mon, 31 May 2021 00:00:00 GMT", now))
+	assert.Zero(t, parseRetryAfter("", now))
+	assert.Zero(t, parseRetryAfter("-1", now))
+	assert.Zero(t, parseRetryAfter("soon", now))
+}
+
+func TestClientThrottled(t *testing.T) {
+	var mu sync.Mutex
+	status := http.StatusTooManyRequests
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	c := testClient(t, defaultConfig, map[string]interface{}{}, srv.URL)
+	events := []publisher.Event{sourceEvent("container")}
+	rest, err := c.publishEvents(events, nil)
+	assert.Error(t, err)
+	assert.Equal(t, events, rest)
+	assert.Equal(t, 0.5, c.lmtr.factor)
+	assert.True(t, c.lmtr.pausedUntil.After(time.Now()))
+
+	mu.Lock()
+	status = http.StatusOK
+	mu.Unlock()
+	rest, err = c.publishEvents(events, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, rest)
+}
+
+func TestClientSplitsBatch(t *testing.T) {
+	rec := &pathRecorder{}
+	srv := httptest.NewServer(rec)
+	defer srv.Close()
+
+	c := testClient(t, defaultConfig, map[string]interface{}{
+		"limiter": map[string]interface{}{"events_per_second": 2, "events_burst": 2},
+	}, srv.URL)
+	events := []publisher.Event{sourceEvent("container"), sourceEvent("container"), sourceEvent("container")}
+	rest, err := c.publishEvents(events, nil)
+	require.NoError(t, err)
+	assert.Equal(t, events[2:], rest)
+	assert.Len(t, rec.paths, 1)
+}
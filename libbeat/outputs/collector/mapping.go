@@ -0,0 +1,217 @@
+package collector
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/logp"
+	"github.com/elastic/beats/v7/libbeat/outputs"
+	"github.com/elastic/beats/v7/libbeat/publisher"
+	"github.com/pkg/errors"
+)
+
+// timestampField maps to the event timestamp instead of a field.
+const timestampField = "@timestamp"
+
+// Types a mapped value can be converted to.
+const (
+	typeAny       = ""
+	typeString    = "string"
+	typeInt       = "int"
+	typeStringMap = "string_map"
+	typeUnixNano  = "unix_nano"
+)
+
+// envelopeCacheKey caches the envelope of an event in publisher.EventCache,
+// so the batch is only transformed once however often it is encoded.
+const envelopeCacheKey = "collector_envelope"
+
+// fieldMapping maps the event field Field to the payload key Key.
+type fieldMapping struct {
+	Key      string      `config:"key" validate:"required"`
+	Field    string      `config:"field" validate:"required"`
+	Type     string      `config:"type"`
+	Default  interface{} `config:"default"`
+	Required bool        `config:"required"`
+}
+
+func (m *fieldMapping) Validate() error {
+	switch m.Type {
+	case typeAny, typeString, typeInt, typeStringMap, typeUnixNano:
+		return nil
+	default:
+		return fmt.Errorf("unknown type '%v' of mapping key '%v'", m.Type, m.Key)
+	}
+}
+
+// defaultMapping is the log envelope the collector has always received.
+var defaultMapping = []fieldMapping{
+	{Key: "source", Field: "terminus.source", Default: defaultSource},
+	{Key: "id", Field: "terminus.id", Required: true},
+	{Key: "offset", Field: "log.offset", Required: true},
+	{Key: "timestamp", Field: timestampField, Type: typeUnixNano},
+	{Key: "stream", Field: "stream", Default: "stdout"},
+	{Key: "content", Field: "message", Required: true},
+	{Key: "tags", Field: "terminus.tags", Type: typeStringMap},
+	{Key: "labels", Field: "terminus.labels", Type: typeStringMap},
+}
+
+// mappingError is returned for events that can not be mapped. Its reason
+// is reported to the observer.
+type mappingError struct {
+	reason string
+	err    error
+}
+
+func (e *mappingError) Error() string {
+	return e.err.Error()
+}
+
+// transformer converts events into the log envelope sent to the collector.
+type transformer struct {
+	mapping  []fieldMapping
+	observer outputs.Observer
+}
+
+func newTransformer(cfg config, observer outputs.Observer) *transformer {
+	mapping := cfg.Mapping
+	if len(mapping) == 0 {
+		mapping = defaultMapping
+	}
+	mapping = append([]fieldMapping(nil), mapping...)
+
+	// default_id predates the mapping and still applies to the id key.
+	if cfg.DefaultID != "" {
+		for i := range mapping {
+			if mapping[i].Key == "id" && mapping[i].Default == nil {
+				mapping[i].Default = cfg.DefaultID
+				mapping[i].Required = false
+			}
+		}
+	}
+	return &transformer{mapping: mapping, observer: observer}
+}
+
+// filter removes the events that can not be mapped, reporting them as
+// dropped and passing them to deadLetter if not nil, and caches the envelope
+// of the others.
+func (t *transformer) filter(events []publisher.Event, deadLetter func(publisher.Event, string)) []publisher.Event {
+	valid := make([]publisher.Event, 0, len(events))
+	for i := range events {
+		m, err := t.envelope(events[i])
+		if err != nil {
+			reason := "invalid"
+			if merr, ok := err.(*mappingError); ok {
+				reason = merr.reason
+			}
+			logp.Err("Fail to transform map with err: %s;\nEvent.Content: %s", err, marshalMap(events[i].Content))
+			t.observer.DroppedWithReason(reason, 1)
+			if deadLetter != nil {
+				deadLetter(events[i], err.Error())
+			}
+			continue
+		}
+		events[i].Cache.Put(envelopeCacheKey, m)
+		valid = append(valid, events[i])
+	}
+	return valid
+}
+
+func (t *transformer) transform(event publisher.Event) (map[string]interface{}, error) {
+	if v, err := event.Cache.GetValue(envelopeCacheKey); err == nil {
+		if m, ok := v.(map[string]interface{}); ok {
+			return m, nil
+		}
+	}
+	return t.envelope(event)
+}
+
+func (t *transformer) envelope(event publisher.Event) (map[string]interface{}, error) {
+	m := make(map[string]interface{}, len(t.mapping))
+	for _, fm := range t.mapping {
+		v, err := lookupField(event, fm.Field)
+		if err != nil {
+			v = fm.Default
+		}
+		if v == nil {
+			if fm.Required {
+				return nil, &mappingError{
+					reason: "missing_" + fm.Key,
+					err:    errors.Errorf("fail to get %s value from %s", fm.Key, fm.Field),
+				}
+			}
+			if fm.Type == typeStringMap {
+				m[fm.Key] = map[string]string{}
+			}
+			continue
+		}
+
+		v, err = convertValue(v, fm.Type)
+		if err != nil {
+			if fm.Required {
+				return nil, &mappingError{
+					reason: "invalid_" + fm.Key,
+					err:    errors.Wrapf(err, "fail to convert %s value from %s", fm.Key, fm.Field),
+				}
+			}
+			if fm.Type == typeStringMap {
+				m[fm.Key] = map[string]string{}
+			}
+			continue
+		}
+		m[fm.Key] = v
+	}
+	logp.Debug(selector, "transform get final message: %+v", marshalMap(m))
+	return m, nil
+}
+
+func lookupField(event publisher.Event, field string) (interface{}, error) {
+	if field == timestampField {
+		return event.Content.Timestamp, nil
+	}
+	return event.Content.GetValue(field)
+}
+
+func convertValue(v interface{}, typ string) (interface{}, error) {
+	switch typ {
+	case typeString:
+		if s, ok := v.(string); ok {
+			return s, nil
+		}
+		return fmt.Sprint(v), nil
+	case typeInt:
+		switch val := v.(type) {
+		case int, int32, int64, uint, uint32, uint64:
+			return val, nil
+		case float64:
+			return int64(val), nil
+		case string:
+			return strconv.ParseInt(val, 10, 64)
+		default:
+			return nil, errors.Errorf("no supported type: %T", v)
+		}
+	case typeStringMap:
+		return convert(v)
+	case typeUnixNano:
+		switch val := v.(type) {
+		case time.Time:
+			return val.UnixNano(), nil
+		case common.Time:
+			return time.Time(val).UnixNano(), nil
+		case int64:
+			return val, nil
+		case string:
+			t, err := time.Parse(time.RFC3339Nano, val)
+			if err != nil {
+				return nil, err
+			}
+			return t.UnixNano(), nil
+		default:
+			return nil, errors.Errorf("no supported type: %T", v)
+		}
+	default:
+		return v, nil
+	}
+}
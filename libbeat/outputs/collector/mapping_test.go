@@ -0,0 +1,124 @@
+// Copyright (c) 2021 Terminus, Inc.
+
+// This program is free software: you can use, redistribute, and/or modify
+// it under the terms of the GNU Affero General Public License, version 3
+// or later ("AGPL"), as published by the Free Software Foundation.
+
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package collector
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/monitoring"
+	"github.com/elastic/beats/v7/libbeat/outputs"
+	"github.com/elastic/beats/v7/libbeat/publisher"
+)
+
+func syslogEvent() publisher.Event {
+	return publisher.Event{Content: beat.Event{
+		Timestamp: time.Unix(0, 1000),
+		Fields: common.MapStr{
+			"message": "sshd[42]: session opened",
+			"host":    common.MapStr{"name": "node-1"},
+			"input":   common.MapStr{"type": "syslog"},
+		},
+	}}
+}
+
+func TestDefaultMapping(t *testing.T) {
+	trans := newTransformer(defaultConfig, outputs.NewNilObserver())
+	m, err := trans.transform(mockEvent()[0])
+	require.NoError(t, err)
+
+	assert.Equal(t, "container", m["source"])
+	assert.Equal(t, 17420730, m["offset"])
+	assert.Equal(t, int64(1415792726371000000), m["timestamp"])
+	assert.Equal(t, "stdout", m["stream"])
+	assert.Equal(t, map[string]string{}, m["labels"])
+	assert.Equal(t, "qa", m["tags"].(map[string]string)["dice_component"])
+}
+
+func TestCustomMapping(t *testing.T) {
+	cfg := defaultConfig
+	require.NoError(t, common.MustNewConfigFrom(map[string]interface{}{
+		"mapping": []map[string]interface{}{
+			{"key": "source", "field": "input.type"},
+			{"key": "id", "field": "host.name", "required": true},
+			{"key": "offset", "field": "log.offset", "type": "int", "default": 0},
+			{"key": "timestamp", "field": "@timestamp", "type": "unix_nano"},
+			{"key": "content", "field": "message", "required": true},
+			{"key": "tags", "field": "terminus.tags", "type": "string_map"},
+		},
+	}).Unpack(&cfg))
+
+	trans := newTransformer(cfg, outputs.NewNilObserver())
+	m, err := trans.transform(syslogEvent())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"source":    "syslog",
+		"id":        "node-1",
+		"offset":    int64(0),
+		"timestamp": int64(1000),
+		"content":   "sshd[42]: session opened",
+		"tags":      map[string]string{},
+	}, m)
+}
+
+func TestInvalidMappingType(t *testing.T) {
+	cfg := defaultConfig
+	err := common.MustNewConfigFrom(map[string]interface{}{
+		"mapping": []map[string]interface{}{
+			{"key": "id", "field": "host.name", "type": "uuid"},
+		},
+	}).Unpack(&cfg)
+	assert.Error(t, err)
+}
+
+func TestFilterCountsDropReasons(t *testing.T) {
+	reg := monitoring.NewRegistry()
+	trans := newTransformer(defaultConfig, outputs.NewStats(reg))
+
+	noOffset := mockEvent()[0]
+	noOffset.Content.Fields = noOffset.Content.Fields.Clone()
+	noOffset.Content.Fields.Delete("log.offset")
+
+	var reasons []string
+	events := trans.filter([]publisher.Event{mockEvent()[0], syslogEvent(), noOffset}, func(_ publisher.Event, reason string) {
+		reasons = append(reasons, reason)
+	})
+	assert.Len(t, events, 1)
+	assert.Len(t, reasons, 2)
+
+	snapshot := monitoring.CollectFlatSnapshot(reg, monitoring.Full, false)
+	assert.Equal(t, int64(2), snapshot.Ints["events.dropped"])
+	assert.Equal(t, int64(1), snapshot.Ints["events.dropped_reasons.missing_id"])
+	assert.Equal(t, int64(1), snapshot.Ints["events.dropped_reasons.missing_offset"])
+
+	// the envelope is cached for the encoders
+	_, err := events[0].Cache.GetValue(envelopeCacheKey)
+	assert.NoError(t, err)
+}
+
+func TestDefaultIDAppliesToMapping(t *testing.T) {
+	trans := newTransformer(exportDefaultConfig, outputs.NewNilObserver())
+	e := mockEvent()[0]
+	e.Content.Fields = e.Content.Fields.Clone()
+	e.Content.Fields.Delete("terminus.id")
+
+	m, err := trans.transform(e)
+	require.NoError(t, err)
+	assert.Equal(t, "unknown", m["id"])
+}
@@ -0,0 +1,73 @@
+package wire
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// compressor compresses a complete request body. Implementations reuse
+// their writer and are not safe for concurrent use.
+type compressor interface {
+	contentEncoding() string
+	compress(dst *bytes.Buffer, src []byte) error
+}
+
+func newCompressor(name string, level int) (compressor, error) {
+	switch name {
+	case CompressionNone:
+		return nil, nil
+	case CompressionGzip:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		w, err := gzip.NewWriterLevel(nil, level)
+		if err != nil {
+			return nil, errors.Wrapf(err, "fail to create gzip level %v writer", level)
+		}
+		return &streamCompressor{encoding: "gzip", w: w}, nil
+	case CompressionZstd:
+		opts := []zstd.EOption{zstd.WithEncoderConcurrency(1)}
+		if level > 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		}
+		w, err := zstd.NewWriter(nil, opts...)
+		if err != nil {
+			return nil, errors.Wrapf(err, "fail to create zstd level %v writer", level)
+		}
+		return &streamCompressor{encoding: "zstd", w: w}, nil
+	case CompressionSnappy:
+		return &streamCompressor{encoding: "snappy", w: snappy.NewBufferedWriter(nil)}, nil
+	default:
+		return nil, errors.Errorf("unknown compression '%v'", name)
+	}
+}
+
+type resetWriter interface {
+	io.WriteCloser
+	Reset(io.Writer)
+}
+
+type streamCompressor struct {
+	encoding string
+	w        resetWriter
+}
+
+func (c *streamCompressor) contentEncoding() string {
+	return c.encoding
+}
+
+func (c *streamCompressor) compress(dst *bytes.Buffer, src []byte) error {
+	c.w.Reset(dst)
+	if _, err := c.w.Write(src); err != nil {
+		return errors.Wrapf(err, "fail to %s write data", c.encoding)
+	}
+	if err := c.w.Close(); err != nil {
+		return errors.Wrapf(err, "fail to %s close", c.encoding)
+	}
+	return nil
+}
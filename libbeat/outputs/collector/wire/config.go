@@ -0,0 +1,71 @@
+package wire
+
+import (
+	"fmt"
+
+	"github.com/elastic/beats/v7/libbeat/outputs/codec"
+)
+
+// Supported values of the format option.
+const (
+	// FormatEnvelope is a JSON array of log envelopes, base64-encoded.
+	// It is the format the collector has always accepted and stays the default.
+	FormatEnvelope = "envelope"
+	// FormatNDJSON writes one JSON log envelope per line.
+	FormatNDJSON = "ndjson"
+	// FormatProtobuf writes the envelopes as a protobuf LogBatch message.
+	FormatProtobuf = "protobuf"
+	// FormatCodec writes the raw events, one per line, using the configured
+	// libbeat/outputs/codec codec.
+	FormatCodec = "codec"
+)
+
+// Supported values of the compression option.
+const (
+	CompressionNone   = "none"
+	CompressionGzip   = "gzip"
+	CompressionZstd   = "zstd"
+	CompressionSnappy = "snappy"
+)
+
+// Config holds the wire format settings of an output. It is meant to be
+// inlined into the output configuration.
+type Config struct {
+	Format string       `config:"format"`
+	Codec  codec.Config `config:"codec"`
+
+	// Compression selects the compression algorithm. If it is not set,
+	// gzip is used unless compress_level is 0.
+	Compression   string `config:"compression"`
+	CompressLevel int    `config:"compress_level" validate:"min=0, max=9"`
+}
+
+// DefaultConfig keeps the envelope format with gzip level 9.
+var DefaultConfig = Config{
+	Format:        FormatEnvelope,
+	CompressLevel: 9,
+}
+
+func (c *Config) Validate() error {
+	switch c.Format {
+	case "", FormatEnvelope, FormatNDJSON, FormatProtobuf, FormatCodec:
+	default:
+		return fmt.Errorf("unknown format '%v'", c.Format)
+	}
+	switch c.Compression {
+	case "", CompressionNone, CompressionGzip, CompressionZstd, CompressionSnappy:
+	default:
+		return fmt.Errorf("unknown compression '%v'", c.Compression)
+	}
+	return nil
+}
+
+func (c *Config) compression() string {
+	if c.Compression != "" {
+		return c.Compression
+	}
+	if c.CompressLevel == 0 {
+		return CompressionNone
+	}
+	return CompressionGzip
+}
@@ -0,0 +1,156 @@
+// Package wire implements the request body formats shared by the HTTP log
+// outputs: how events are serialized and how the body is compressed.
+package wire
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/logp"
+	"github.com/elastic/beats/v7/libbeat/outputs/codec"
+	"github.com/elastic/beats/v7/libbeat/publisher"
+	"github.com/pkg/errors"
+)
+
+// Encoder serializes a batch of events into a request body.
+// Encoders are not safe for concurrent use.
+type Encoder interface {
+	AddHeader(*http.Header)
+	Encode([]publisher.Event) (*bytes.Buffer, error)
+}
+
+// TransformFunc converts an event into the log envelope sent to the
+// collector. A nil map without error skips the event.
+type TransformFunc func(publisher.Event) (map[string]interface{}, error)
+
+type encoder struct {
+	format    string
+	transform TransformFunc
+
+	codec codec.Codec
+	index string
+
+	compressor compressor
+}
+
+// NewEncoder creates the encoder for the configured format and compression.
+// transform is used by every format but codec, which sends the raw events.
+func NewEncoder(info beat.Info, cfg Config, transform TransformFunc) (Encoder, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	e := &encoder{
+		format:    cfg.Format,
+		transform: transform,
+		index:     info.Beat,
+	}
+	if e.format == "" {
+		e.format = FormatEnvelope
+	}
+	if e.format == FormatCodec {
+		c, err := codec.CreateEncoder(info, cfg.Codec)
+		if err != nil {
+			return nil, errors.Wrap(err, "fail to create codec")
+		}
+		e.codec = c
+	}
+
+	c, err := newCompressor(cfg.compression(), cfg.CompressLevel)
+	if err != nil {
+		return nil, err
+	}
+	e.compressor = c
+	return e, nil
+}
+
+func (e *encoder) AddHeader(header *http.Header) {
+	switch e.format {
+	case FormatEnvelope:
+		header.Add("Content-Type", "application/json; charset=UTF-8")
+	case FormatNDJSON, FormatCodec:
+		header.Add("Content-Type", "application/x-ndjson; charset=UTF-8")
+	case FormatProtobuf:
+		header.Add("Content-Type", "application/x-protobuf")
+	}
+	if e.compressor != nil {
+		header.Add("Content-Encoding", e.compressor.contentEncoding())
+	}
+	if e.format == FormatEnvelope {
+		header.Add("Custom-Content-Encoding", "base64")
+	}
+}
+
+func (e *encoder) Encode(events []publisher.Event) (*bytes.Buffer, error) {
+	data, err := e.serialize(events)
+	if err != nil {
+		return nil, err
+	}
+	if e.compressor == nil {
+		return bytes.NewBuffer(data), nil
+	}
+
+	buf := &bytes.Buffer{}
+	if err := e.compressor.compress(buf, data); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (e *encoder) serialize(events []publisher.Event) ([]byte, error) {
+	if e.format == FormatCodec {
+		var buf bytes.Buffer
+		for i := range events {
+			data, err := e.codec.Encode(e.index, &events[i].Content)
+			if err != nil {
+				logp.Err("Fail to encode event with err: %s", err)
+				continue
+			}
+			buf.Write(data)
+			buf.WriteByte('\n')
+		}
+		return buf.Bytes(), nil
+	}
+
+	envelopes := e.envelopes(events)
+	switch e.format {
+	case FormatNDJSON:
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		for _, m := range envelopes {
+			if err := enc.Encode(m); err != nil {
+				return nil, errors.Wrap(err, "fail to json marshal event")
+			}
+		}
+		return buf.Bytes(), nil
+	case FormatProtobuf:
+		return appendLogBatch(nil, envelopes), nil
+	default:
+		data, err := json.Marshal(envelopes)
+		if err != nil {
+			return nil, errors.Wrap(err, "fail to json marshal events")
+		}
+		out := make([]byte, base64.StdEncoding.EncodedLen(len(data)))
+		base64.StdEncoding.Encode(out, data)
+		return out, nil
+	}
+}
+
+func (e *encoder) envelopes(events []publisher.Event) []map[string]interface{} {
+	envelopes := make([]map[string]interface{}, 0, len(events))
+	for _, event := range events {
+		m, err := e.transform(event)
+		if err != nil {
+			logp.Err("Fail to transform map with err: %s", err)
+			continue
+		}
+		if m == nil { // ignore
+			continue
+		}
+		envelopes = append(envelopes, m)
+	}
+	return envelopes
+}
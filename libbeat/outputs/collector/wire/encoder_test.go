@@ -0,0 +1,182 @@
+// Copyright (c) 2021 Terminus, Inc.
+
+// This program is free software: you can use, redistribute, and/or modify
+// it under the terms of the GNU Affero General Public License, version 3
+// or later ("AGPL"), as published by the Free Software Foundation.
+
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package wire
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/common"
+	_ "github.com/elastic/beats/v7/libbeat/outputs/codec/json"
+	"github.com/elastic/beats/v7/libbeat/publisher"
+)
+
+func testTransform(event publisher.Event) (map[string]interface{}, error) {
+	msg, _ := event.Content.GetValue("message")
+	return map[string]interface{}{
+		"source":    "container",
+		"id":        "abc",
+		"offset":    42,
+		"timestamp": event.Content.Timestamp.UnixNano(),
+		"content":   msg,
+		"tags":      map[string]string{"pod_name": "qa"},
+	}, nil
+}
+
+func testEvents() []publisher.Event {
+	ts := time.Date(2021, 4, 22, 14, 18, 52, 0, time.UTC)
+	return []publisher.Event{
+		{Content: beat.Event{Timestamp: ts, Fields: common.MapStr{"message": "first"}}},
+		{Content: beat.Event{Timestamp: ts, Fields: common.MapStr{"message": "second"}}},
+	}
+}
+
+func encode(t *testing.T, cfg Config) ([]byte, http.Header) {
+	enc, err := NewEncoder(beat.Info{Beat: "filebeat"}, cfg, testTransform)
+	require.NoError(t, err)
+
+	buf, err := enc.Encode(testEvents())
+	require.NoError(t, err)
+
+	header := http.Header{}
+	enc.AddHeader(&header)
+
+	var r io.Reader = buf
+	switch header.Get("Content-Encoding") {
+	case "gzip":
+		r, err = gzip.NewReader(r)
+		require.NoError(t, err)
+	case "zstd":
+		d, err := zstd.NewReader(r)
+		require.NoError(t, err)
+		defer d.Close()
+		r = d
+	case "snappy":
+		r = snappy.NewReader(r)
+	}
+	data, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	return data, header
+}
+
+func TestEnvelopeFormat(t *testing.T) {
+	for _, compression := range []string{"", CompressionNone, CompressionGzip, CompressionZstd, CompressionSnappy} {
+		t.Run("compression="+compression, func(t *testing.T) {
+			data, header := encode(t, Config{Compression: compression, CompressLevel: 9})
+			assert.Equal(t, "base64", header.Get("Custom-Content-Encoding"))
+
+			raw, err := base64.StdEncoding.DecodeString(string(data))
+			require.NoError(t, err)
+			var envelopes []map[string]interface{}
+			require.NoError(t, json.Unmarshal(raw, &envelopes))
+			require.Len(t, envelopes, 2)
+			assert.Equal(t, "first", envelopes[0]["content"])
+		})
+	}
+}
+
+func TestCompressLevelZeroDisablesCompression(t *testing.T) {
+	_, header := encode(t, Config{CompressLevel: 0})
+	assert.Empty(t, header.Get("Content-Encoding"))
+
+	_, header = encode(t, Config{CompressLevel: 5})
+	assert.Equal(t, "gzip", header.Get("Content-Encoding"))
+}
+
+func TestNDJSONFormat(t *testing.T) {
+	data, header := encode(t, Config{Format: FormatNDJSON, Compression: CompressionZstd})
+	assert.Empty(t, header.Get("Custom-Content-Encoding"))
+	assert.Equal(t, "zstd", header.Get("Content-Encoding"))
+
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.Len(t, lines, 2)
+	var m map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &m))
+	assert.Equal(t, "second", m["content"])
+	assert.Equal(t, float64(42), m["offset"])
+}
+
+func TestProtobufFormat(t *testing.T) {
+	data, header := encode(t, Config{Format: FormatProtobuf, Compression: CompressionSnappy})
+	assert.Equal(t, "application/x-protobuf", header.Get("Content-Type"))
+
+	var contents []string
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		require.True(t, n > 0)
+		require.Equal(t, batchLogs, num)
+		require.Equal(t, protowire.BytesType, typ)
+		data = data[n:]
+
+		msg, n := protowire.ConsumeBytes(data)
+		require.True(t, n > 0)
+		data = data[n:]
+
+		for len(msg) > 0 {
+			num, typ, n := protowire.ConsumeTag(msg)
+			require.True(t, n > 0)
+			msg = msg[n:]
+			switch {
+			case num == logContent:
+				v, n := protowire.ConsumeString(msg)
+				contents = append(contents, v)
+				msg = msg[n:]
+			case num == logOffset:
+				v, n := protowire.ConsumeVarint(msg)
+				assert.Equal(t, uint64(42), v)
+				msg = msg[n:]
+			default:
+				n := protowire.ConsumeFieldValue(num, typ, msg)
+				require.True(t, n >= 0)
+				msg = msg[n:]
+			}
+		}
+	}
+	assert.Equal(t, []string{"first", "second"}, contents)
+}
+
+func TestCodecFormat(t *testing.T) {
+	data, header := encode(t, Config{Format: FormatCodec})
+	assert.Contains(t, header.Get("Content-Type"), "ndjson")
+
+	lines := bytes.Split(bytes.TrimSpace(data), []byte("\n"))
+	require.Len(t, lines, 2)
+	var m map[string]interface{}
+	require.NoError(t, json.Unmarshal(lines[0], &m))
+	assert.Equal(t, "first", m["message"])
+	assert.Equal(t, "2021-04-22T14:18:52.000Z", m["@timestamp"])
+}
+
+func TestInvalidConfig(t *testing.T) {
+	_, err := NewEncoder(beat.Info{}, Config{Format: "xml"}, testTransform)
+	assert.Error(t, err)
+
+	_, err = NewEncoder(beat.Info{}, Config{Compression: "lzma"}, testTransform)
+	assert.Error(t, err)
+}
@@ -0,0 +1,126 @@
+package wire
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Field numbers of the Log message in log.proto.
+const (
+	logSource    protowire.Number = 1
+	logID        protowire.Number = 2
+	logOffset    protowire.Number = 3
+	logTimestamp protowire.Number = 4
+	logStream    protowire.Number = 5
+	logContent   protowire.Number = 6
+	logTags      protowire.Number = 7
+	logLabels    protowire.Number = 8
+
+	batchLogs protowire.Number = 1
+)
+
+// appendLogBatch appends the LogBatch message holding the envelopes to b.
+func appendLogBatch(b []byte, envelopes []map[string]interface{}) []byte {
+	var msg []byte
+	for _, m := range envelopes {
+		msg = appendLog(msg[:0], m)
+		b = protowire.AppendTag(b, batchLogs, protowire.BytesType)
+		b = protowire.AppendBytes(b, msg)
+	}
+	return b
+}
+
+func appendLog(b []byte, m map[string]interface{}) []byte {
+	b = appendString(b, logSource, m["source"])
+	b = appendString(b, logID, m["id"])
+	b = appendInt64(b, logOffset, m["offset"])
+	b = appendInt64(b, logTimestamp, m["timestamp"])
+	b = appendString(b, logStream, m["stream"])
+	b = appendString(b, logContent, m["content"])
+	b = appendStringMap(b, logTags, m["tags"])
+	b = appendStringMap(b, logLabels, m["labels"])
+	return b
+}
+
+func appendString(b []byte, num protowire.Number, v interface{}) []byte {
+	s := toString(v)
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendInt64(b []byte, num protowire.Number, v interface{}) []byte {
+	i := toInt64(v)
+	if i == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(i))
+}
+
+func appendStringMap(b []byte, num protowire.Number, v interface{}) []byte {
+	m, ok := v.(map[string]string)
+	if !ok || len(m) == 0 {
+		return b
+	}
+
+	// Sort the keys, so equal maps always encode to the same bytes.
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var entry []byte
+	for _, k := range keys {
+		entry = appendString(entry[:0], 1, k)
+		entry = appendString(entry, 2, m[k])
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	return b
+}
+
+func toString(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return val
+	case []byte:
+		return string(val)
+	default:
+		return fmt.Sprint(val)
+	}
+}
+
+func toInt64(v interface{}) int64 {
+	switch val := v.(type) {
+	case int:
+		return int64(val)
+	case int32:
+		return int64(val)
+	case int64:
+		return val
+	case uint:
+		return int64(val)
+	case uint32:
+		return int64(val)
+	case uint64:
+		return int64(val)
+	case float32:
+		return int64(val)
+	case float64:
+		return int64(val)
+	case string:
+		i, _ := strconv.ParseInt(val, 10, 64)
+		return i
+	default:
+		return 0
+	}
+}
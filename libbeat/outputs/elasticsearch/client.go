@@ -64,6 +64,14 @@ type bulkResultStats struct {
 	fails        int // number of failed events (can be retried)
 	nonIndexable int // number of failed events (not indexable -> must be dropped)
 	tooMany      int // number of events receiving HTTP 429 Too Many Requests
+
+	rejected []rejectedEvent // the not indexable events
+}
+
+// rejectedEvent is an event Elasticsearch permanently rejects.
+type rejectedEvent struct {
+	event  publisher.Event
+	reason string
 }
 
 const (
@@ -177,7 +185,9 @@ func (client *Client) Clone() *Client {
 
 func (client *Client) Publish(ctx context.Context, batch publisher.Batch) error {
 	events := batch.Events()
-	rest, err := client.publishEvents(ctx, events)
+	rest, err := client.publishEvents(ctx, events, func(event publisher.Event, reason string) {
+		publisher.DeadLetter(batch, event, reason)
+	})
 	if len(rest) == 0 {
 		batch.ACK()
 	} else {
@@ -189,7 +199,12 @@ func (client *Client) Publish(ctx context.Context, batch publisher.Batch) error
 // PublishEvents sends all events to elasticsearch. On error a slice with all
 // events not published or confirmed to be processed by elasticsearch will be
 // returned. The input slice backing memory will be reused by return the value.
-func (client *Client) publishEvents(ctx context.Context, data []publisher.Event) ([]publisher.Event, error) {
+// The events Elasticsearch permanently rejects are passed to deadLetter.
+func (client *Client) publishEvents(
+	ctx context.Context,
+	data []publisher.Event,
+	deadLetter func(publisher.Event, string),
+) ([]publisher.Event, error) {
 	span, ctx := apm.StartSpan(ctx, "publishEvents", "output")
 	defer span.End()
 	begin := time.Now()
@@ -239,6 +254,9 @@ func (client *Client) publishEvents(ctx context.Context, data []publisher.Event)
 		stats.fails = len(failedEvents)
 	} else {
 		failedEvents, stats = bulkCollectPublishFails(client.log, result, data)
+		for _, rejected := range stats.rejected {
+			deadLetter(rejected.event, rejected.reason)
+		}
 	}
 
 	failed := len(failedEvents)
@@ -407,6 +425,10 @@ func bulkCollectPublishFails(
 				// hard failure, don't collect
 				log.Warnf("Cannot index event %#v (status=%v): %s", data[i], status, msg)
 				stats.nonIndexable++
+				stats.rejected = append(stats.rejected, rejectedEvent{
+					event:  data[i],
+					reason: fmt.Sprintf("status=%v: %s", status, msg),
+				})
 				continue
 			}
 		}
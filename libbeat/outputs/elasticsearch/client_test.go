@@ -97,6 +97,29 @@ func TestCollectPublishFailAll(t *testing.T) {
 	assert.Equal(t, stats, bulkResultStats{fails: 3, tooMany: 3})
 }
 
+func TestCollectPublishFailRejected(t *testing.T) {
+	response := []byte(`
+    { "items": [
+      {"create": {"status": 200}},
+      {"create": {"status": 400, "error": "mapper_parsing_exception"}},
+      {"create": {"status": 429, "error": "ups"}}
+    ]}
+  `)
+
+	event := publisher.Event{Content: beat.Event{Fields: common.MapStr{"field": 1}}}
+	eventRejected := publisher.Event{Content: beat.Event{Fields: common.MapStr{"field": 2}}}
+	eventFail := publisher.Event{Content: beat.Event{Fields: common.MapStr{"field": 3}}}
+	events := []publisher.Event{event, eventRejected, eventFail}
+
+	res, stats := bulkCollectPublishFails(logp.L(), response, events)
+	assert.Equal(t, []publisher.Event{eventFail}, res)
+	assert.Equal(t, 1, stats.nonIndexable)
+	if assert.Len(t, stats.rejected, 1) {
+		assert.Equal(t, eventRejected, stats.rejected[0].event)
+		assert.Equal(t, "status=400: \"mapper_parsing_exception\"", stats.rejected[0].reason)
+	}
+}
+
 func TestCollectPipelinePublishFail(t *testing.T) {
 	logp.TestingSetup(logp.WithSelectors("elasticsearch"))
 
@@ -17,7 +17,11 @@
 
 package outputs
 
-import "github.com/elastic/beats/v7/libbeat/monitoring"
+import (
+	"sync"
+
+	"github.com/elastic/beats/v7/libbeat/monitoring"
+)
 
 // Stats implements the Observer interface, for collecting metrics on common
 // outputs events.
@@ -35,6 +39,10 @@ type Stats struct {
 	dropped    *monitoring.Uint // total number of invalid events dropped by the output
 	tooMany    *monitoring.Uint // total number of too many requests replies from output
 
+	droppedReasons *monitoring.Registry // dropped events by reason, created on first drop
+	reasonsMutex   sync.Mutex
+	reasons        map[string]*monitoring.Uint
+
 	//
 	// Output network connection stats
 	//
@@ -59,6 +67,9 @@ func NewStats(reg *monitoring.Registry) *Stats {
 		active:     monitoring.NewUint(reg, "events.active"),
 		tooMany:    monitoring.NewUint(reg, "events.toomany"),
 
+		droppedReasons: reg.NewRegistry("events.dropped_reasons"),
+		reasons:        map[string]*monitoring.Uint{},
+
 		writeBytes:  monitoring.NewUint(reg, "write.bytes"),
 		writeErrors: monitoring.NewUint(reg, "write.errors"),
 
@@ -112,6 +123,24 @@ func (s *Stats) Dropped(n int) {
 	}
 }
 
+// DroppedWithReason updates the event drop metrics like Dropped, and also
+// counts the drops per reason.
+func (s *Stats) DroppedWithReason(reason string, n int) {
+	if s == nil {
+		return
+	}
+	s.Dropped(n)
+
+	s.reasonsMutex.Lock()
+	counter, ok := s.reasons[reason]
+	if !ok {
+		counter = monitoring.NewUint(s.droppedReasons, reason)
+		s.reasons[reason] = counter
+	}
+	s.reasonsMutex.Unlock()
+	counter.Add(uint64(n))
+}
+
 // Cancelled updates the active event metrics.
 func (s *Stats) Cancelled(n int) {
 	if s != nil {
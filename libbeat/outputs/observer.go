@@ -20,17 +20,18 @@ package outputs
 // Observer provides an interface used by outputs to report common events on
 // documents/events being published and I/O workload.
 type Observer interface {
-	NewBatch(int)     // report new batch being processed with number of events
-	Acked(int)        // report number of acked events
-	Failed(int)       // report number of failed events
-	Dropped(int)      // report number of dropped events
-	Duplicate(int)    // report number of events detected as duplicates (e.g. on resends)
-	Cancelled(int)    // report number of cancelled events
-	WriteError(error) // report an I/O error on write
-	WriteBytes(int)   // report number of bytes being written
-	ReadError(error)  // report an I/O error on read
-	ReadBytes(int)    // report number of bytes being read
-	ErrTooMany(int)   // report too many requests response
+	NewBatch(int)                  // report new batch being processed with number of events
+	Acked(int)                     // report number of acked events
+	Failed(int)                    // report number of failed events
+	Dropped(int)                   // report number of dropped events
+	DroppedWithReason(string, int) // report number of events dropped for the given reason
+	Duplicate(int)                 // report number of events detected as duplicates (e.g. on resends)
+	Cancelled(int)                 // report number of cancelled events
+	WriteError(error)              // report an I/O error on write
+	WriteBytes(int)                // report number of bytes being written
+	ReadError(error)               // report an I/O error on read
+	ReadBytes(int)                 // report number of bytes being read
+	ErrTooMany(int)                // report too many requests response
 }
 
 type emptyObserver struct{}
@@ -42,14 +43,15 @@ func NewNilObserver() Observer {
 	return nilObserver
 }
 
-func (*emptyObserver) NewBatch(int)     {}
-func (*emptyObserver) Acked(int)        {}
-func (*emptyObserver) Duplicate(int)    {}
-func (*emptyObserver) Failed(int)       {}
-func (*emptyObserver) Dropped(int)      {}
-func (*emptyObserver) Cancelled(int)    {}
-func (*emptyObserver) WriteError(error) {}
-func (*emptyObserver) WriteBytes(int)   {}
-func (*emptyObserver) ReadError(error)  {}
-func (*emptyObserver) ReadBytes(int)    {}
-func (*emptyObserver) ErrTooMany(int)   {}
+func (*emptyObserver) NewBatch(int)                  {}
+func (*emptyObserver) Acked(int)                     {}
+func (*emptyObserver) Duplicate(int)                 {}
+func (*emptyObserver) Failed(int)                    {}
+func (*emptyObserver) Dropped(int)                   {}
+func (*emptyObserver) DroppedWithReason(string, int) {}
+func (*emptyObserver) Cancelled(int)                 {}
+func (*emptyObserver) WriteError(error)              {}
+func (*emptyObserver) WriteBytes(int)                {}
+func (*emptyObserver) ReadError(error)               {}
+func (*emptyObserver) ReadBytes(int)                 {}
+func (*emptyObserver) ErrTooMany(int)                {}
@@ -0,0 +1,103 @@
+package actions
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/processors"
+	"github.com/elastic/beats/v7/libbeat/processors/checks"
+)
+
+const terminusAddFieldsName = "terminus_add_fields"
+
+// terminusAddFields is add_fields for sidecars: with ignore_empty, fields
+// resolving to empty values, such as `${VAR:}` references to unset
+// environment variables, are skipped.
+type terminusAddFields struct {
+	fields    common.MapStr
+	overwrite bool
+}
+
+type terminusAddFieldsConfig struct {
+	Fields      common.MapStr `config:"fields" validate:"required"`
+	Target      *string       `config:"target"`
+	IgnoreEmpty bool          `config:"ignore_empty"`
+	Overwrite   bool          `config:"overwrite"`
+}
+
+func init() {
+	processors.RegisterPlugin(terminusAddFieldsName,
+		checks.ConfigChecked(CreateTerminusAddFields,
+			checks.RequireFields(FieldsKey),
+			checks.AllowedFields(FieldsKey, "target", "ignore_empty", "overwrite", "when")))
+}
+
+// CreateTerminusAddFields constructs a terminus_add_fields processor from config.
+func CreateTerminusAddFields(c *common.Config) (processors.Processor, error) {
+	config := terminusAddFieldsConfig{Overwrite: true}
+	if err := c.Unpack(&config); err != nil {
+		return nil, fmt.Errorf("fail to unpack the %s configuration: %s", terminusAddFieldsName, err)
+	}
+
+	fields := config.Fields
+	if config.IgnoreEmpty {
+		fields = dropEmptyFields(fields)
+	}
+	// Unlike add_fields, a dotted target such as terminus.tags is merged into
+	// the nested map instead of adding a key containing dots.
+	if target := optTarget(config.Target, FieldsKey); target != "" && len(fields) > 0 {
+		nested := common.MapStr{}
+		nested.Put(target, fields)
+		fields = nested
+	}
+	return &terminusAddFields{fields: fields, overwrite: config.Overwrite}, nil
+}
+
+// dropEmptyFields returns a copy of fields without empty strings, nil values
+// and maps left empty by that.
+func dropEmptyFields(fields common.MapStr) common.MapStr {
+	out := common.MapStr{}
+	for k, v := range fields {
+		switch val := v.(type) {
+		case nil:
+			continue
+		case string:
+			if val == "" {
+				continue
+			}
+		case common.MapStr:
+			val = dropEmptyFields(val)
+			if len(val) == 0 {
+				continue
+			}
+			v = val
+		case map[string]interface{}:
+			m := dropEmptyFields(val)
+			if len(m) == 0 {
+				continue
+			}
+			v = m
+		}
+		out[k] = v
+	}
+	return out
+}
+
+func (p *terminusAddFields) Run(event *beat.Event) (*beat.Event, error) {
+	if len(p.fields) == 0 {
+		return event, nil
+	}
+	if p.overwrite {
+		event.Fields.DeepUpdate(p.fields.Clone())
+	} else {
+		event.Fields.DeepUpdateNoOverwrite(p.fields.Clone())
+	}
+	return event, nil
+}
+
+func (p *terminusAddFields) String() string {
+	s, _ := json.Marshal(p.fields)
+	return fmt.Sprintf("%s=%s", terminusAddFieldsName, s)
+}
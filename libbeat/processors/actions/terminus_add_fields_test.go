@@ -0,0 +1,78 @@
+package actions
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/common"
+)
+
+func TestTerminusAddFields(t *testing.T) {
+	testProcessors(t, map[string]testCase{
+		"skip empty fields": {
+			event: common.MapStr{},
+			want: common.MapStr{
+				"terminus": common.MapStr{"tags": common.MapStr{"DICE_ORG_NAME": "erda"}},
+			},
+			cfg: []string{`{terminus_add_fields: {ignore_empty: true, target: terminus.tags, fields: {DICE_ORG_ID: "", DICE_ORG_NAME: erda}}}`},
+		},
+		"keep empty fields": {
+			event: common.MapStr{},
+			want: common.MapStr{
+				"terminus": common.MapStr{"tags": common.MapStr{"DICE_ORG_ID": "", "DICE_ORG_NAME": "erda"}},
+			},
+			cfg: []string{`{terminus_add_fields: {target: terminus.tags, fields: {DICE_ORG_ID: "", DICE_ORG_NAME: erda}}}`},
+		},
+		"no target map for empty fields": {
+			event: common.MapStr{"message": "foo"},
+			want:  common.MapStr{"message": "foo"},
+			cfg:   []string{`{terminus_add_fields: {ignore_empty: true, target: terminus.labels, fields: {MONITOR_LOG_OUTPUT: "", nested: {key: ""}}}}`},
+		},
+		"merge into existing map": {
+			event: common.MapStr{
+				"terminus": common.MapStr{"tags": common.MapStr{"DICE_ORG_NAME": "old", "pod_name": "web"}},
+			},
+			want: common.MapStr{
+				"terminus": common.MapStr{"tags": common.MapStr{"DICE_ORG_NAME": "erda", "pod_name": "web"}},
+			},
+			cfg: []string{`{terminus_add_fields: {target: terminus.tags, fields: {DICE_ORG_NAME: erda}}}`},
+		},
+		"merge without overwrite": {
+			event: common.MapStr{
+				"terminus": common.MapStr{"tags": common.MapStr{"DICE_ORG_NAME": "old"}},
+			},
+			want: common.MapStr{
+				"terminus": common.MapStr{"tags": common.MapStr{"DICE_ORG_NAME": "old", "DICE_WORKSPACE": "PROD"}},
+			},
+			cfg: []string{`{terminus_add_fields: {overwrite: false, target: terminus.tags, fields: {DICE_ORG_NAME: erda, DICE_WORKSPACE: PROD}}}`},
+		},
+	})
+}
+
+func TestTerminusAddFieldsEnv(t *testing.T) {
+	os.Setenv("TEST_TERMINUS_ADD_FIELDS_ORG", "erda")
+	defer os.Unsetenv("TEST_TERMINUS_ADD_FIELDS_ORG")
+
+	config, err := common.NewConfigWithYAML([]byte(`
+ignore_empty: true
+target: terminus.tags
+fields:
+  DICE_ORG_NAME: ${TEST_TERMINUS_ADD_FIELDS_ORG:}
+  DICE_ORG_ID: ${TEST_TERMINUS_ADD_FIELDS_UNSET:}
+`), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := CreateTerminusAddFields(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event, _ := p.Run(&beat.Event{Fields: common.MapStr{}})
+	assert.Equal(t, common.MapStr{
+		"terminus": common.MapStr{"tags": common.MapStr{"DICE_ORG_NAME": "erda"}},
+	}, event.Fields)
+}
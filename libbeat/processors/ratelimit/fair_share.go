@@ -0,0 +1,348 @@
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/pkg/errors"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/logp"
+	"github.com/elastic/beats/v7/libbeat/monitoring"
+	"github.com/elastic/beats/v7/libbeat/processors"
+)
+
+const fairShareName = "fair_share"
+
+// unknownKey is the key of events which have none of the key fields.
+const unknownKey = "_unknown"
+
+func init() {
+	processors.RegisterPlugin(fairShareName, newFairShare)
+}
+
+type fairShareAction string
+
+const (
+	actionDrop   fairShareAction = "drop"
+	actionSample fairShareAction = "sample"
+	actionBlock  fairShareAction = "block"
+)
+
+func (a *fairShareAction) Unpack(s string) error {
+	switch fairShareAction(s) {
+	case actionDrop, actionSample, actionBlock:
+		*a = fairShareAction(s)
+		return nil
+	}
+	return fmt.Errorf("unknown action '%v', must be one of drop, sample, block", s)
+}
+
+// fairShareConfig splits limit between the keys made of the fields values,
+// such as terminus.tags.dice_project_id. Every key seen within active_window
+// gets a share of the limit in proportion to its weight, capped by its quota.
+//
+//	fair_share:
+//	  fields: ["terminus.tags.dice_project_id"]
+//	  limit: "2000/s"
+//	  keys:
+//	    - {key: "12", weight: 2}
+//	    - {key: "13", quota: "100/s"}
+//	  action: block
+type fairShareConfig struct {
+	Fields          []string         `config:"fields" validate:"required"`
+	Limit           rate             `config:"limit" validate:"required"`
+	BurstMultiplier float64          `config:"burst_multiplier"`
+	DefaultWeight   float64          `config:"default_weight"`
+	Keys            []keyShareConfig `config:"keys"`
+
+	// Action applies to the events of a key above its share: drop them,
+	// keep one in 1/sample_rate of them, or block the publisher, which is
+	// the harvester of the key, for at most max_wait before dropping.
+	Action     fairShareAction `config:"action"`
+	SampleRate float64         `config:"sample_rate"`
+	MaxWait    time.Duration   `config:"max_wait"`
+
+	ActiveWindow time.Duration `config:"active_window" validate:"min=0,nonzero"`
+	IdleTimeout  time.Duration `config:"idle_timeout" validate:"min=0,nonzero"`
+}
+
+// keyShareConfig overrides the weight or sets a quota for a key. Keys are
+// listed instead of being map keys, which must not be numeric in the config.
+type keyShareConfig struct {
+	Key    string  `config:"key" validate:"required"`
+	Weight float64 `config:"weight" validate:"min=0"`
+	Quota  *rate   `config:"quota"`
+}
+
+func defaultFairShareConfig() fairShareConfig {
+	return fairShareConfig{
+		BurstMultiplier: 1,
+		DefaultWeight:   1,
+		Action:          actionDrop,
+		SampleRate:      0.1,
+		MaxWait:         5 * time.Second,
+		ActiveWindow:    10 * time.Second,
+		IdleTimeout:     10 * time.Minute,
+	}
+}
+
+func (c *fairShareConfig) Validate() error {
+	if c.Limit.valuePerSecond() <= 0 {
+		return fmt.Errorf("limit must be positive, got %v", c.Limit.value)
+	}
+	if c.BurstMultiplier < 1 {
+		return fmt.Errorf("burst_multiplier must be at least 1, got %v", c.BurstMultiplier)
+	}
+	if c.DefaultWeight <= 0 {
+		return fmt.Errorf("default_weight must be positive, got %v", c.DefaultWeight)
+	}
+	for _, k := range c.Keys {
+		if k.Quota != nil && k.Quota.valuePerSecond() <= 0 {
+			return fmt.Errorf("quota of key '%v' must be positive, got %v", k.Key, k.Quota.value)
+		}
+	}
+	if c.SampleRate <= 0 || c.SampleRate > 1 {
+		return fmt.Errorf("sample_rate must be in (0, 1], got %v", c.SampleRate)
+	}
+	return nil
+}
+
+type fairShare struct {
+	config fairShareConfig
+	logger *logp.Logger
+	clock  clockwork.Clock
+	done   chan struct{}
+	once   sync.Once
+
+	regName string
+
+	mu        sync.Mutex
+	keys      map[string]*keyShare
+	refreshed time.Time // last computation of the shares
+
+	metrics struct {
+		throttled *monitoring.Int
+		dropped   *monitoring.Int
+	}
+}
+
+// keyShare is the bucket and the counters of one key.
+type keyShare struct {
+	bucket
+	weight   float64
+	quota    float64 // per second, 0 without quota
+	rate     float64 // current share per second
+	lastSeen time.Time
+
+	events    int64
+	throttled int64
+	dropped   int64
+}
+
+func newFairShare(cfg *common.Config) (processors.Processor, error) {
+	config := defaultFairShareConfig()
+	if err := cfg.Unpack(&config); err != nil {
+		return nil, errors.Wrap(err, "could not unpack processor configuration")
+	}
+	sort.Strings(config.Fields)
+
+	var (
+		id      = int(instanceID.Inc())
+		regName = "processor." + fairShareName + "." + strconv.Itoa(id)
+		reg     = monitoring.Default.NewRegistry(regName, monitoring.DoNotReport)
+	)
+	p := &fairShare{
+		config:  config,
+		logger:  logp.NewLogger("processor."+fairShareName).With("instance_id", id),
+		clock:   clockwork.NewRealClock(),
+		done:    make(chan struct{}),
+		regName: regName,
+		keys:    make(map[string]*keyShare),
+	}
+	p.metrics.throttled = monitoring.NewInt(reg, "throttled")
+	p.metrics.dropped = monitoring.NewInt(reg, "dropped")
+	monitoring.NewFunc(reg, "keys", p.report, monitoring.Report)
+	return p, nil
+}
+
+// Run lets the event pass if its key is within its share, and applies the
+// configured action otherwise.
+func (p *fairShare) Run(event *beat.Event) (*beat.Event, error) {
+	key := p.makeKey(event)
+	allowed, wait, sampled := p.take(key, true)
+	if allowed {
+		return event, nil
+	}
+	p.metrics.throttled.Inc()
+
+	switch p.config.Action {
+	case actionSample:
+		if sampled {
+			return event, nil
+		}
+	case actionBlock:
+		deadline := p.clock.Now().Add(p.config.MaxWait)
+		for !p.clock.Now().Add(wait).After(deadline) {
+			select {
+			case <-p.done:
+				return event, nil
+			case <-p.clock.After(wait):
+			}
+			if allowed, wait, _ = p.take(key, false); allowed {
+				return event, nil
+			}
+		}
+	}
+
+	p.drop(key)
+	return nil, nil
+}
+
+// take withdraws a token from the bucket of the key. If there is none, it
+// returns how long until there is one, and if a sample is due.
+func (p *fairShare) take(key string, count bool) (allowed bool, wait time.Duration, sampled bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.clock.Now()
+	s, ok := p.keys[key]
+	if !ok {
+		s = p.newKeyShare(key, now)
+		p.keys[key] = s
+	}
+	reactivated := now.Sub(s.lastSeen) > p.config.ActiveWindow
+	s.lastSeen = now
+	if !ok || reactivated || now.Sub(p.refreshed) >= time.Second {
+		p.refresh(now)
+	}
+	if !ok {
+		s.tokens = math.Max(s.rate*p.config.BurstMultiplier, 1)
+	}
+	if count {
+		s.events++
+	}
+
+	s.replenish(rate{value: s.rate, unit: unitPerSecond}, p.clock)
+	if depth := s.rate * p.config.BurstMultiplier; s.tokens > depth {
+		s.tokens = math.Max(depth, 1)
+	}
+	if s.withdraw() {
+		return true, 0, false
+	}
+
+	if count {
+		s.throttled++
+	}
+	every := int64(math.Round(1 / p.config.SampleRate))
+	wait = time.Duration((1 - s.tokens) / s.rate * float64(time.Second))
+	return false, wait, (s.throttled-1)%every == 0
+}
+
+func (p *fairShare) drop(key string) {
+	p.metrics.dropped.Inc()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if s, ok := p.keys[key]; ok {
+		s.dropped++
+	}
+}
+
+func (p *fairShare) newKeyShare(key string, now time.Time) *keyShare {
+	s := &keyShare{weight: p.config.DefaultWeight, lastSeen: now}
+	for _, k := range p.config.Keys {
+		if k.Key != key {
+			continue
+		}
+		if k.Weight > 0 {
+			s.weight = k.Weight
+		}
+		if k.Quota != nil {
+			s.quota = k.Quota.valuePerSecond()
+		}
+	}
+	s.lastReplenish = now
+	return s
+}
+
+// refresh recomputes the shares from the weights of the active keys and
+// forgets the keys idle for longer than idle_timeout.
+func (p *fairShare) refresh(now time.Time) {
+	total := 0.0
+	for key, s := range p.keys {
+		idle := now.Sub(s.lastSeen)
+		if idle > p.config.IdleTimeout {
+			delete(p.keys, key)
+			continue
+		}
+		if idle <= p.config.ActiveWindow {
+			total += s.weight
+		}
+	}
+
+	limit := p.config.Limit.valuePerSecond()
+	for _, s := range p.keys {
+		s.rate = limit * s.weight / total
+		if s.quota > 0 && s.quota < s.rate {
+			s.rate = s.quota
+		}
+	}
+	p.refreshed = now
+}
+
+func (p *fairShare) makeKey(event *beat.Event) string {
+	values := make([]string, 0, len(p.config.Fields))
+	found := false
+	for _, field := range p.config.Fields {
+		value, err := event.GetValue(field)
+		if err != nil {
+			values = append(values, "")
+			continue
+		}
+		found = true
+		values = append(values, fmt.Sprint(value))
+	}
+	if !found {
+		return unknownKey
+	}
+	return strings.Join(values, ",")
+}
+
+// report exposes the counters of every key in the /stats API.
+func (p *fairShare) report(_ monitoring.Mode, V monitoring.Visitor) {
+	V.OnRegistryStart()
+	defer V.OnRegistryFinished()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key, s := range p.keys {
+		s := s
+		monitoring.ReportNamespace(V, key, func() {
+			monitoring.ReportInt(V, "events", s.events)
+			monitoring.ReportInt(V, "throttled", s.throttled)
+			monitoring.ReportInt(V, "dropped", s.dropped)
+			monitoring.ReportFloat(V, "rate", s.rate)
+		})
+	}
+}
+
+// Close releases the publishers blocked by the processor.
+func (p *fairShare) Close() error {
+	p.once.Do(func() {
+		close(p.done)
+		monitoring.Default.Remove(p.regName)
+	})
+	return nil
+}
+
+func (p *fairShare) String() string {
+	return fmt.Sprintf("%v=[limit=[%v],fields=[%v],action=[%v]]",
+		fairShareName, p.config.Limit, p.config.Fields, p.config.Action)
+}
@@ -0,0 +1,152 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/monitoring"
+)
+
+func newTestFairShare(t *testing.T, settings common.MapStr) (*fairShare, clockwork.FakeClock) {
+	cfg := common.MapStr{"fields": []string{"terminus.tags.dice_project_id"}, "limit": "10/s"}
+	cfg.DeepUpdate(settings)
+	p, err := newFairShare(common.MustNewConfigFrom(cfg))
+	require.NoError(t, err)
+	fs := p.(*fairShare)
+	t.Cleanup(func() { fs.Close() })
+
+	clock := clockwork.NewFakeClock()
+	fs.clock = clock
+	return fs, clock
+}
+
+func projectEvent(id string) *beat.Event {
+	fields := common.MapStr{"message": "foo"}
+	if id != "" {
+		fields.Put("terminus.tags.dice_project_id", id)
+	}
+	return &beat.Event{Fields: fields}
+}
+
+func runEvents(p *fairShare, id string, n int) (kept int) {
+	for i := 0; i < n; i++ {
+		if event, _ := p.Run(projectEvent(id)); event != nil {
+			kept++
+		}
+	}
+	return kept
+}
+
+func TestFairShareConfig(t *testing.T) {
+	cases := map[string]common.MapStr{
+		"no fields":       {"limit": "10/s"},
+		"no limit":        {"fields": []string{"a"}},
+		"zero limit":      {"fields": []string{"a"}, "limit": "0/s"},
+		"unknown action":  {"fields": []string{"a"}, "limit": "10/s", "action": "queue"},
+		"negative weight": {"fields": []string{"a"}, "limit": "10/s", "keys": []common.MapStr{{"key": "1", "weight": -1}}},
+		"zero quota":      {"fields": []string{"a"}, "limit": "10/s", "keys": []common.MapStr{{"key": "1", "quota": "0/s"}}},
+		"sample rate":     {"fields": []string{"a"}, "limit": "10/s", "sample_rate": 2},
+	}
+	for name, cfg := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := newFairShare(common.MustNewConfigFrom(cfg))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestFairShareWeights(t *testing.T) {
+	p, clock := newTestFairShare(t, common.MapStr{
+		"limit": "30/s",
+		"keys":  []common.MapStr{{"key": "1", "weight": 2}},
+	})
+
+	// A single active key gets the whole limit.
+	assert.Equal(t, 30, runEvents(p, "1", 40))
+
+	// With a second key, the limit is split 2:1.
+	runEvents(p, "2", 1)
+	clock.Advance(time.Second)
+	assert.Equal(t, 20, runEvents(p, "1", 40))
+	assert.Equal(t, 10, runEvents(p, "2", 40))
+
+	// Key 2 becomes inactive, key 1 gets the whole limit again.
+	clock.Advance(11 * time.Second)
+	assert.Equal(t, 30, runEvents(p, "1", 40))
+}
+
+func TestFairShareQuota(t *testing.T) {
+	p, clock := newTestFairShare(t, common.MapStr{
+		"limit": "30/s",
+		"keys":  []common.MapStr{{"key": "noisy", "quota": "5/s"}},
+	})
+	runEvents(p, "noisy", 1)
+	clock.Advance(time.Second)
+	assert.Equal(t, 5, runEvents(p, "noisy", 20))
+	assert.Equal(t, 15, runEvents(p, "quiet", 20))
+	assert.Equal(t, 1, runEvents(p, "", 1))
+}
+
+func TestFairShareSample(t *testing.T) {
+	p, _ := newTestFairShare(t, common.MapStr{"action": "sample", "sample_rate": 0.25})
+	assert.Equal(t, 10+5, runEvents(p, "1", 10+20))
+	assert.Equal(t, int64(15), p.metrics.dropped.Get())
+	assert.Equal(t, int64(20), p.metrics.throttled.Get())
+}
+
+func TestFairShareBlock(t *testing.T) {
+	p, clock := newTestFairShare(t, common.MapStr{"action": "block", "max_wait": "1s"})
+	assert.Equal(t, 10, runEvents(p, "1", 10))
+
+	done := make(chan *beat.Event)
+	go func() {
+		event, _ := p.Run(projectEvent("1"))
+		done <- event
+	}()
+	clock.BlockUntil(1)
+	clock.Advance(100 * time.Millisecond)
+	assert.NotNil(t, <-done)
+
+	// Waiting longer than max_wait drops right away.
+	p.config.MaxWait = 10 * time.Millisecond
+	event, _ := p.Run(projectEvent("1"))
+	assert.Nil(t, event)
+
+	// Close releases blocked publishers.
+	p.config.MaxWait = time.Hour
+	go func() {
+		event, _ := p.Run(projectEvent("1"))
+		done <- event
+	}()
+	clock.BlockUntil(1)
+	p.Close()
+	assert.NotNil(t, <-done)
+}
+
+func TestFairShareStats(t *testing.T) {
+	p, _ := newTestFairShare(t, nil)
+	runEvents(p, "1", 12)
+	runEvents(p, "", 1)
+
+	reg := monitoring.NewRegistry()
+	monitoring.NewFunc(reg, "keys", p.report)
+	stats := monitoring.CollectStructSnapshot(reg, monitoring.Full, false)["keys"].(map[string]interface{})
+	one := stats["1"].(map[string]interface{})
+	assert.Equal(t, int64(12), one["events"])
+	assert.Equal(t, int64(2), one["throttled"])
+	assert.Equal(t, int64(2), one["dropped"])
+	assert.Contains(t, stats, unknownKey)
+}
+
+func TestFairShareClose(t *testing.T) {
+	p, _ := newTestFairShare(t, nil)
+	require.NotNil(t, monitoring.Default.Get(p.regName))
+	require.NoError(t, p.Close())
+	assert.Nil(t, monitoring.Default.Get(p.regName))
+}
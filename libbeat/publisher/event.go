@@ -37,6 +37,23 @@ type Batch interface {
 	CancelledEvents(events []Event)
 }
 
+// DeadLetterBatch is implemented by the batches keeping the events an output
+// permanently rejects, so they can be replayed later.
+type DeadLetterBatch interface {
+	Batch
+
+	// DeadLetter keeps the event, the batch must still be ACKed.
+	DeadLetter(event Event, reason string)
+}
+
+// DeadLetter passes an event the output permanently rejects to the batch, the
+// event is dropped if the batch does not keep them.
+func DeadLetter(batch Batch, event Event, reason string) {
+	if dl, ok := batch.(DeadLetterBatch); ok {
+		dl.DeadLetter(event, reason)
+	}
+}
+
 // Event is used by the publisher pipeline and broker to pass additional
 // meta-data to the consumers/outputs.
 type Event struct {
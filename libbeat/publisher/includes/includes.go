@@ -33,5 +33,5 @@ import (
 
 	// extend
 	_ "github.com/elastic/beats/v7/libbeat/outputs/collector"
-	_ "github.com/elastic/beats/v7/libbeat/outputs/export"
+	_ "github.com/elastic/beats/v7/libbeat/publisher/queue/hybridqueue"
 )
@@ -40,6 +40,10 @@ type batch struct {
 type batchContext struct {
 	observer outputObserver
 	retryer  *retryer
+
+	// deadLetter keeps the events the output rejects, nil if the pipeline has
+	// no dead letter queue.
+	deadLetter func(event publisher.Event, reason string)
 }
 
 var batchPool = sync.Pool{
@@ -85,6 +89,12 @@ func (b *batch) Drop() {
 	releaseBatch(b)
 }
 
+func (b *batch) DeadLetter(event publisher.Event, reason string) {
+	if b.ctx != nil && b.ctx.deadLetter != nil {
+		b.ctx.deadLetter(event, reason)
+	}
+}
+
 func (b *batch) Retry() {
 	b.ctx.retryer.retry(b)
 }
@@ -66,6 +66,7 @@ func newOutputController(
 	monitors Monitors,
 	observer outputObserver,
 	queue queue.Queue,
+	deadLetter func(publisher.Event, string),
 ) *outputController {
 	c := &outputController{
 		beat:      beat,
@@ -75,7 +76,7 @@ func newOutputController(
 		workQueue: makeWorkQueue(),
 	}
 
-	ctx := &batchContext{}
+	ctx := &batchContext{deadLetter: deadLetter}
 	c.consumer = newEventConsumer(monitors.Logger, queue, ctx)
 	c.retryer = newRetryer(monitors.Logger, observer, c.workQueue, c.consumer)
 	ctx.observer = observer
@@ -159,7 +160,7 @@ func (c *outputController) Reload(
 		}
 	}
 
-	output, err := loadOutput(c.monitors, func(stats outputs.Observer) (string, outputs.Group, error) {
+	_, output, err := loadOutput(c.monitors, func(stats outputs.Observer) (string, outputs.Group, error) {
 		name := outCfg.Name()
 		out, err := outFactory(stats, outCfg)
 		return name, out, err
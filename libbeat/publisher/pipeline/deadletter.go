@@ -0,0 +1,298 @@
+package pipeline
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/common/file"
+	"github.com/elastic/beats/v7/libbeat/common/jsontransform"
+	"github.com/elastic/beats/v7/libbeat/logp"
+	"github.com/elastic/beats/v7/libbeat/monitoring"
+	"github.com/elastic/beats/v7/libbeat/outputs"
+	"github.com/elastic/beats/v7/libbeat/paths"
+	"github.com/elastic/beats/v7/libbeat/publisher"
+)
+
+// DeadLetterQueue keeps the events the outputs permanently reject, with the
+// reason and the name of the output, in a rotating file or by publishing
+// them to a secondary output. The events of the file can be replayed with
+// ReplayDeadLetters once the problem is fixed.
+type DeadLetterQueue struct {
+	logger *logp.Logger
+	sink   deadLetterSink
+
+	events *monitoring.Uint // events kept
+	failed *monitoring.Uint // events failed to be kept
+}
+
+// DeadLetterConfig configures the dead letter queue, either file or output
+// is set.
+type DeadLetterConfig struct {
+	File   *DeadLetterFileConfig  `config:"file"`
+	Output common.ConfigNamespace `config:"output"`
+}
+
+// DeadLetterFileConfig configures the rotating file of the dead letter queue.
+type DeadLetterFileConfig struct {
+	Path          string `config:"path"`
+	Filename      string `config:"filename"`
+	RotateEveryKb uint   `config:"rotate_every_kb" validate:"min=1"`
+	NumberOfFiles uint   `config:"number_of_files"`
+	Permissions   uint32 `config:"permissions"`
+}
+
+// DeadLetterRecord is a line of the file of the dead letter queue.
+type DeadLetterRecord struct {
+	Time   time.Time       `json:"time"`
+	Output string          `json:"output"`
+	Reason string          `json:"reason"`
+	Event  DeadLetterEvent `json:"event"`
+}
+
+// DeadLetterEvent is the event as received by the output.
+type DeadLetterEvent struct {
+	Timestamp time.Time     `json:"@timestamp"`
+	Meta      common.MapStr `json:"@metadata,omitempty"`
+	Fields    common.MapStr `json:"fields"`
+}
+
+type deadLetterSink interface {
+	write(record *DeadLetterRecord) error
+	Close() error
+}
+
+const defaultDeadLetterFilename = "dead_letter.ndjson"
+
+func defaultDeadLetterFileConfig() DeadLetterFileConfig {
+	return DeadLetterFileConfig{
+		Filename:      defaultDeadLetterFilename,
+		RotateEveryKb: 10 * 1024,
+		NumberOfFiles: 7,
+		Permissions:   0600,
+	}
+}
+
+func (c *DeadLetterConfig) Validate() error {
+	if (c.File != nil) == c.Output.IsSet() {
+		return errors.New("exactly one of dead_letter.file and dead_letter.output is required")
+	}
+	return nil
+}
+
+func (c *DeadLetterFileConfig) Validate() error {
+	if c.NumberOfFiles < 2 || c.NumberOfFiles > file.MaxBackupsLimit {
+		return fmt.Errorf("number_of_files must be between 2 and %v", file.MaxBackupsLimit)
+	}
+	return nil
+}
+
+// dir returns the directory of the files, in the data path by default.
+func (c *DeadLetterFileConfig) dir() string {
+	if c.Path == "" {
+		return paths.Resolve(paths.Data, "dead_letter")
+	}
+	return c.Path
+}
+
+// DeadLetterFileDir returns the directory of the files of the dead letter
+// queue configured in cfg, or an empty string if cfg doesn't configure a
+// file.
+func DeadLetterFileDir(cfg *common.Config) (string, error) {
+	config, err := unpackDeadLetterConfig(cfg)
+	if err != nil || config.File == nil {
+		return "", err
+	}
+	return config.File.dir(), nil
+}
+
+func unpackDeadLetterConfig(cfg *common.Config) (DeadLetterConfig, error) {
+	var config DeadLetterConfig
+	if cfg.HasField("file") {
+		fileConfig := defaultDeadLetterFileConfig()
+		config.File = &fileConfig
+	}
+	if err := cfg.Unpack(&config); err != nil {
+		return config, fmt.Errorf("fail to unpack dead_letter config: %v", err)
+	}
+	return config, nil
+}
+
+// LoadDeadLetterQueue creates the dead letter queue configured in cfg, it
+// returns nil if cfg is nil. The secondary output is created by makeOutput.
+func LoadDeadLetterQueue(
+	beatInfo beat.Info,
+	monitors Monitors,
+	cfg *common.Config,
+	makeOutput RouterOutputFactory,
+) (*DeadLetterQueue, error) {
+	if cfg == nil || !cfg.Enabled() {
+		return nil, nil
+	}
+	config, err := unpackDeadLetterConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	log := monitors.Logger
+	if log == nil {
+		log = logp.L()
+	}
+	log = log.Named("dead_letter")
+
+	var sink deadLetterSink
+	if config.File != nil {
+		sink, err = newDeadLetterFile(config.File)
+	} else {
+		sink, err = newDeadLetterOutput(beatInfo, monitors, config.Output, makeOutput)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var reg *monitoring.Registry
+	if monitors.Metrics != nil {
+		reg = monitors.Metrics.GetRegistry("dead_letter")
+		if reg != nil {
+			reg.Clear()
+		} else {
+			reg = monitors.Metrics.NewRegistry("dead_letter")
+		}
+	} else {
+		reg = monitoring.NewRegistry()
+	}
+	return &DeadLetterQueue{
+		logger: log,
+		sink:   sink,
+		events: monitoring.NewUint(reg, "events"),
+		failed: monitoring.NewUint(reg, "failed"),
+	}, nil
+}
+
+// Add keeps an event the output permanently rejects for the given reason.
+// The event is only logged if it can't be kept.
+func (q *DeadLetterQueue) Add(output string, event publisher.Event, reason string) {
+	record := &DeadLetterRecord{
+		Time:   time.Now(),
+		Output: output,
+		Reason: reason,
+		Event: DeadLetterEvent{
+			Timestamp: event.Content.Timestamp,
+			Meta:      event.Content.Meta,
+			Fields:    event.Content.Fields,
+		},
+	}
+	if err := q.sink.write(record); err != nil {
+		q.failed.Inc()
+		q.logger.Errorf("fail to keep event rejected by output %s (%s): %v", output, reason, err)
+		return
+	}
+	q.events.Inc()
+}
+
+// Close closes the file or the pipeline of the secondary output.
+func (q *DeadLetterQueue) Close() error {
+	return q.sink.Close()
+}
+
+// deadLetterFile writes the records as json lines to a rotating file.
+type deadLetterFile struct {
+	rotator *file.Rotator
+}
+
+func newDeadLetterFile(config *DeadLetterFileConfig) (*deadLetterFile, error) {
+	rotator, err := file.NewFileRotator(
+		filepath.Join(config.dir(), config.Filename),
+		file.MaxSizeBytes(config.RotateEveryKb*1024),
+		file.MaxBackups(config.NumberOfFiles),
+		file.Permissions(os.FileMode(config.Permissions)),
+		file.WithLogger(logp.NewLogger("rotator").With(logp.Namespace("rotator"))),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("fail to create dead letter file: %v", err)
+	}
+	return &deadLetterFile{rotator: rotator}, nil
+}
+
+func (f *deadLetterFile) write(record *DeadLetterRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	// The rotator writes the line at once, so it is never split between
+	// two files.
+	_, err = f.rotator.Write(append(line, '\n'))
+	return err
+}
+
+func (f *deadLetterFile) Close() error {
+	return f.rotator.Close()
+}
+
+// deadLetterOutput publishes the events to a secondary output, with the
+// fields dead_letter.output and dead_letter.reason. The events are dropped
+// if its queue is full so the outputs are never blocked.
+type deadLetterOutput struct {
+	pipeline *Pipeline
+	client   beat.Client
+}
+
+func newDeadLetterOutput(
+	beatInfo beat.Info,
+	monitors Monitors,
+	ns common.ConfigNamespace,
+	makeOutput RouterOutputFactory,
+) (*deadLetterOutput, error) {
+	p, err := LoadWithSettings(beatInfo, monitors.forOutput("dead_letter"), Config{}, func(stats outputs.Observer) (string, outputs.Group, error) {
+		out, err := makeOutput(stats, ns)
+		return ns.Name(), out, err
+	}, Settings{})
+	if err != nil {
+		return nil, fmt.Errorf("fail to load dead letter output: %v", err)
+	}
+	client, err := p.ConnectWith(beat.ClientConfig{PublishMode: beat.DropIfFull})
+	if err != nil {
+		p.Close()
+		return nil, err
+	}
+	return &deadLetterOutput{pipeline: p, client: client}, nil
+}
+
+func (o *deadLetterOutput) write(record *DeadLetterRecord) error {
+	fields := record.Event.Fields.Clone()
+	fields["dead_letter"] = common.MapStr{
+		"output": record.Output,
+		"reason": record.Reason,
+	}
+	o.client.Publish(beat.Event{
+		Timestamp: record.Event.Timestamp,
+		Meta:      record.Event.Meta,
+		Fields:    fields,
+	})
+	return nil
+}
+
+func (o *deadLetterOutput) Close() error {
+	o.client.Close()
+	return o.pipeline.Close()
+}
+
+// decodeDeadLetterRecord decodes a line of the file, the numbers of the
+// event are decoded as int64 if possible.
+func decodeDeadLetterRecord(line []byte) (*DeadLetterRecord, error) {
+	dec := json.NewDecoder(bytes.NewReader(line))
+	dec.UseNumber()
+	var record DeadLetterRecord
+	if err := dec.Decode(&record); err != nil {
+		return nil, err
+	}
+	jsontransform.TransformNumbers(record.Event.Meta)
+	jsontransform.TransformNumbers(record.Event.Fields)
+	return &record, nil
+}
@@ -0,0 +1,221 @@
+package pipeline
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/common/acker"
+	"github.com/elastic/beats/v7/libbeat/common/atomic"
+	"github.com/elastic/beats/v7/libbeat/logp"
+	"github.com/elastic/beats/v7/libbeat/monitoring"
+	"github.com/elastic/beats/v7/libbeat/outputs"
+	"github.com/elastic/beats/v7/libbeat/publisher"
+)
+
+func TestDeadLetterConfig(t *testing.T) {
+	tests := map[string]struct {
+		cfg map[string]interface{}
+		ok  bool
+	}{
+		"file":          {map[string]interface{}{"file.path": "/tmp"}, true},
+		"output":        {map[string]interface{}{"output.console": map[string]interface{}{}}, true},
+		"none":          {map[string]interface{}{}, false},
+		"both":          {map[string]interface{}{"file.path": "/tmp", "output.console": map[string]interface{}{}}, false},
+		"too few files": {map[string]interface{}{"file.number_of_files": 1}, false},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := unpackDeadLetterConfig(common.MustNewConfigFrom(test.cfg))
+			assert.Equal(t, test.ok, err == nil, "%v", err)
+		})
+	}
+}
+
+func TestDeadLetterFile(t *testing.T) {
+	cfg := testDeadLetterConfig(t)
+	reg := monitoring.NewRegistry()
+	dlq, err := LoadDeadLetterQueue(beat.Info{}, Monitors{Metrics: reg}, cfg, nil)
+	require.NoError(t, err)
+
+	const events = 30
+	for i := 0; i < events; i++ {
+		dlq.Add("collector", testDeadLetterEvent(i), "invalid")
+	}
+	require.NoError(t, dlq.Close())
+
+	snapshot := monitoring.CollectFlatSnapshot(reg, monitoring.Full, false)
+	assert.Equal(t, int64(events), snapshot.Ints["dead_letter.events"])
+	assert.Equal(t, int64(0), snapshot.Ints["dead_letter.failed"])
+
+	var indexes []int64
+	stats, err := ReadDeadLetters(cfg, func(record *DeadLetterRecord) {
+		assert.Equal(t, "collector", record.Output)
+		assert.Equal(t, "invalid", record.Reason)
+		assert.Equal(t, "test", record.Event.Meta["index"])
+		index, _ := record.Event.Fields["index"].(int64)
+		indexes = append(indexes, index)
+	})
+	require.NoError(t, err)
+	assert.True(t, stats.Files > 1, "the file was not rotated")
+	assert.Equal(t, events, stats.Events)
+	require.Len(t, indexes, events)
+	for i, index := range indexes {
+		assert.Equal(t, int64(i), index)
+	}
+}
+
+func TestDeadLetterFileSkipsInvalidLines(t *testing.T) {
+	cfg := testDeadLetterConfig(t)
+	dir, err := DeadLetterFileDir(cfg)
+	require.NoError(t, err)
+	dlq, err := LoadDeadLetterQueue(beat.Info{}, Monitors{}, cfg, nil)
+	require.NoError(t, err)
+	dlq.Add("collector", testDeadLetterEvent(1), "invalid")
+	require.NoError(t, dlq.Close())
+
+	path := filepath.Join(dir, defaultDeadLetterFilename)
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"output": "collector", "event": {"fie`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	stats, err := ReadDeadLetters(cfg, func(*DeadLetterRecord) {})
+	require.NoError(t, err)
+	assert.Equal(t, ReplayStats{Files: 1, Events: 1, Invalid: 1}, stats)
+}
+
+func TestRotatedFiles(t *testing.T) {
+	dir := testDir(t)
+	for _, name := range []string{"dlq.ndjson", "dlq.ndjson.2", "dlq.ndjson.10", "dlq.ndjson.1", "dlq.ndjson.bak", "other"} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), nil, 0600))
+	}
+
+	files, err := rotatedFiles(dir, "dlq.ndjson")
+	require.NoError(t, err)
+	var names []string
+	for _, path := range files {
+		names = append(names, filepath.Base(path))
+	}
+	assert.Equal(t, []string{"dlq.ndjson.10", "dlq.ndjson.2", "dlq.ndjson.1", "dlq.ndjson"}, names)
+
+	files, err = rotatedFiles(filepath.Join(dir, "missing"), "dlq.ndjson")
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestDeadLetterReplay(t *testing.T) {
+	cfg := testDeadLetterConfig(t)
+
+	// The output rejects the events with the field reject until fixed.
+	var mu sync.Mutex
+	var received []int64
+	fixed := false
+	makeOutput := func(outputs.Observer) (string, outputs.Group, error) {
+		return "mock", outputs.Group{
+			Clients: []outputs.Client{newMockClient(func(batch publisher.Batch) error {
+				mu.Lock()
+				defer mu.Unlock()
+				for _, event := range batch.Events() {
+					if reject, _ := event.Content.Fields.HasKey("reject"); reject && !fixed {
+						publisher.DeadLetter(batch, event, "rejected")
+						continue
+					}
+					index, _ := event.Content.Fields["index"].(int64)
+					received = append(received, index)
+				}
+				batch.ACK()
+				return nil
+			})},
+			BatchSize: 10,
+		}, nil
+	}
+	runPipeline := func(fn func(p *Pipeline)) {
+		dlq, err := LoadDeadLetterQueue(beat.Info{}, Monitors{}, cfg, nil)
+		require.NoError(t, err)
+		defer dlq.Close()
+		p, err := LoadWithSettings(beat.Info{}, Monitors{Logger: logp.NewLogger("test")}, Config{}, makeOutput, Settings{DeadLetter: dlq})
+		require.NoError(t, err)
+		defer p.Close()
+		fn(p)
+	}
+
+	const events = 20
+	runPipeline(func(p *Pipeline) {
+		var acked atomic.Int
+		client, err := p.ConnectWith(beat.ClientConfig{
+			ACKHandler: acker.RawCounting(func(n int) { acked.Add(n) }),
+		})
+		require.NoError(t, err)
+		defer client.Close()
+		for i := 0; i < events; i++ {
+			fields := common.MapStr{"index": int64(i)}
+			if i%2 == 0 {
+				fields["reject"] = true
+			}
+			client.Publish(beat.Event{Timestamp: time.Now(), Fields: fields})
+		}
+		require.True(t, waitUntilTrue(5*time.Second, func() bool {
+			return acked.Load() == events
+		}))
+	})
+
+	stats, err := ReadDeadLetters(cfg, func(record *DeadLetterRecord) {
+		assert.Equal(t, "mock", record.Output)
+		assert.Equal(t, "rejected", record.Reason)
+	})
+	require.NoError(t, err)
+	assert.Equal(t, events/2, stats.Events)
+
+	mu.Lock()
+	received = nil
+	fixed = true
+	mu.Unlock()
+	runPipeline(func(p *Pipeline) {
+		stats, err := ReplayDeadLetters(p, cfg, 5*time.Second)
+		require.NoError(t, err)
+		assert.Equal(t, events/2, stats.Events)
+	})
+	mu.Lock()
+	assert.Equal(t, []int64{0, 2, 4, 6, 8, 10, 12, 14, 16, 18}, received)
+	mu.Unlock()
+
+	// The replayed files are removed.
+	stats, err = ReadDeadLetters(cfg, func(*DeadLetterRecord) {})
+	require.NoError(t, err)
+	assert.Equal(t, ReplayStats{}, stats)
+}
+
+func testDeadLetterConfig(t *testing.T) *common.Config {
+	return common.MustNewConfigFrom(map[string]interface{}{
+		"file.path":            testDir(t),
+		"file.rotate_every_kb": 1,
+	})
+}
+
+func testDeadLetterEvent(i int) publisher.Event {
+	return publisher.Event{Content: beat.Event{
+		Timestamp: time.Now(),
+		Meta:      common.MapStr{"index": "test"},
+		Fields: common.MapStr{
+			"index":   i,
+			"message": "a message long enough for the file to be rotated",
+		},
+	}}
+}
+
+func testDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "dead_letter")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
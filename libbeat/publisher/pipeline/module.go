@@ -100,10 +100,13 @@ func LoadWithSettings(
 		return nil, err
 	}
 
-	out, err := loadOutput(monitors, makeOutput)
+	outName, out, err := loadOutput(monitors, makeOutput)
 	if err != nil {
 		return nil, err
 	}
+	if settings.outputName == "" {
+		settings.outputName = outName
+	}
 
 	p, err := New(beatInfo, monitors, queueBuilder, out, settings)
 	if err != nil {
@@ -117,18 +120,18 @@ func LoadWithSettings(
 func loadOutput(
 	monitors Monitors,
 	makeOutput OutputFactory,
-) (outputs.Group, error) {
+) (string, outputs.Group, error) {
 	log := monitors.Logger
 	if log == nil {
 		log = logp.L()
 	}
 
 	if publishDisabled {
-		return outputs.Group{}, nil
+		return "", outputs.Group{}, nil
 	}
 
 	if makeOutput == nil {
-		return outputs.Group{}, nil
+		return "", outputs.Group{}, nil
 	}
 
 	var (
@@ -147,7 +150,8 @@ func loadOutput(
 
 	outName, out, err := makeOutput(outStats)
 	if err != nil {
-		return outputs.Fail(err)
+		out, err = outputs.Fail(err)
+		return outName, out, err
 	}
 
 	if metrics != nil {
@@ -163,7 +167,7 @@ func loadOutput(
 		monitoring.NewString(telemetry, "name").Set(outName)
 	}
 
-	return out, nil
+	return outName, out, nil
 }
 
 func createQueueBuilder(
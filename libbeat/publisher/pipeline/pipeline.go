@@ -91,6 +91,14 @@ type Settings struct {
 	Processors processing.Supporter
 
 	InputQueueSize int
+
+	// DeadLetter keeps the events the output permanently rejects, it is not
+	// closed by the pipeline.
+	DeadLetter *DeadLetterQueue
+
+	// outputName is the name of the output in the dead letter records, the
+	// output type by default.
+	outputName string
 }
 
 // WaitCloseMode enumerates the possible behaviors of WaitClose in a pipeline.
@@ -177,6 +185,9 @@ func New(
 	if err != nil {
 		return nil, err
 	}
+	if reporter, ok := p.queue.(queue.MetricsReporter); ok && monitors.Metrics != nil {
+		reporter.RegisterMetrics(monitors.Metrics.GetRegistry("pipeline"))
+	}
 
 	maxEvents := p.queue.BufferConfig().MaxEvents
 	if maxEvents <= 0 {
@@ -186,7 +197,13 @@ func New(
 	}
 	p.eventSema = newSema(maxEvents)
 
-	p.output = newOutputController(beat, monitors, p.observer, p.queue)
+	var deadLetter func(publisher.Event, string)
+	if dlq, output := settings.DeadLetter, settings.outputName; dlq != nil {
+		deadLetter = func(event publisher.Event, reason string) {
+			dlq.Add(output, event, reason)
+		}
+	}
+	p.output = newOutputController(beat, monitors, p.observer, p.queue, deadLetter)
 	p.output.Set(out)
 
 	return p, nil
@@ -0,0 +1,278 @@
+package pipeline
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/common/acker"
+	"github.com/elastic/beats/v7/libbeat/common/atomic"
+	"github.com/elastic/beats/v7/libbeat/logp"
+)
+
+// replayDir is the directory of the dead letter files being replayed. The
+// files are moved there before their events are published, and removed once
+// the events are ACKed, so a replay that was interrupted is resumed by the
+// next one.
+const replayDir = "replay"
+
+// maxDeadLetterLine bounds the lines read from the dead letter files, a line
+// is never longer than a file.
+const maxDeadLetterLine = 64 * 1024 * 1024
+
+// ReplayStats are the counts of a replay of the dead letter files.
+type ReplayStats struct {
+	Files   int
+	Events  int
+	Invalid int // lines that could not be decoded
+}
+
+// ReadDeadLetters reads the records of the dead letter files of the file
+// configured in cfg, the oldest first, without replaying them.
+func ReadDeadLetters(cfg *common.Config, fn func(record *DeadLetterRecord)) (ReplayStats, error) {
+	var stats ReplayStats
+	files, err := deadLetterFiles(cfg, false)
+	if err != nil {
+		return stats, err
+	}
+	for _, path := range files {
+		stats.Files++
+		if err := readDeadLetterFile(path, &stats, fn); err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
+
+// ReplayDeadLetters publishes the events of the dead letter files of the file
+// configured in cfg to the outputs that rejected them, the oldest first. The
+// outputs of a router missing in publisher receive the events matching their
+// routes. A file is removed once all its events are ACKed, timeout bounds the
+// wait for the ACKs of a file, 0 waits forever.
+//
+// The beat writing the files must be stopped, the events rejected again are
+// written to new dead letter files by the dead letter queue of publisher.
+func ReplayDeadLetters(publisher beat.Pipeline, cfg *common.Config, timeout time.Duration) (ReplayStats, error) {
+	var stats ReplayStats
+	files, err := deadLetterFiles(cfg, true)
+	if err != nil {
+		return stats, err
+	}
+	if len(files) == 0 {
+		return stats, nil
+	}
+
+	acks := &replayACKs{signal: make(chan struct{}, 1)}
+	clients := map[string]beat.Client{}
+	defer func() {
+		for _, client := range clients {
+			client.Close()
+		}
+	}()
+	clientOf := func(output string) (beat.Client, error) {
+		if client, ok := clients[output]; ok {
+			return client, nil
+		}
+		target := publisher
+		if router, ok := publisher.(*Router); ok {
+			if out := router.output(output); out != nil {
+				target = out.pipeline
+			}
+		}
+		client, err := target.ConnectWith(beat.ClientConfig{
+			PublishMode: beat.GuaranteedSend,
+			ACKHandler:  acker.Counting(acks.add),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("fail to connect to output %s: %v", output, err)
+		}
+		clients[output] = client
+		return client, nil
+	}
+
+	published := 0
+	for _, path := range files {
+		stats.Files++
+		var publishErr error
+		err := readDeadLetterFile(path, &stats, func(record *DeadLetterRecord) {
+			if publishErr != nil {
+				return
+			}
+			client, err := clientOf(record.Output)
+			if err != nil {
+				publishErr = err
+				return
+			}
+			client.Publish(beat.Event{
+				Timestamp: record.Event.Timestamp,
+				Meta:      record.Event.Meta,
+				Fields:    record.Event.Fields,
+			})
+			published++
+		})
+		if publishErr != nil {
+			return stats, publishErr
+		}
+		if err != nil {
+			return stats, err
+		}
+		if err := acks.wait(published, timeout); err != nil {
+			return stats, fmt.Errorf("fail to replay %s: %v", path, err)
+		}
+		if err := os.Remove(path); err != nil {
+			return stats, fmt.Errorf("fail to remove replayed file: %v", err)
+		}
+	}
+	return stats, nil
+}
+
+// replayACKs counts the events ACKed to the clients of a replay.
+type replayACKs struct {
+	acked  atomic.Int
+	signal chan struct{}
+}
+
+func (a *replayACKs) add(n int) {
+	a.acked.Add(n)
+	select {
+	case a.signal <- struct{}{}:
+	default:
+	}
+}
+
+// wait waits until the given number of events are ACKed.
+func (a *replayACKs) wait(events int, timeout time.Duration) error {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	for a.acked.Load() < events {
+		select {
+		case <-a.signal:
+		case <-expired:
+			return fmt.Errorf("timeout, %d of %d events ACKed", a.acked.Load(), events)
+		}
+	}
+	return nil
+}
+
+func readDeadLetterFile(path string, stats *ReplayStats, fn func(record *DeadLetterRecord)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("fail to open dead letter file: %v", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), maxDeadLetterLine)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		record, err := decodeDeadLetterRecord(scanner.Bytes())
+		if err != nil {
+			// A line may be truncated if the beat was killed while writing.
+			logp.L().Named("dead_letter").Warnf("skip invalid record at %s:%d: %v", path, line, err)
+			stats.Invalid++
+			continue
+		}
+		stats.Events++
+		fn(record)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("fail to read %s: %v", path, err)
+	}
+	return nil
+}
+
+// deadLetterFiles lists the dead letter files, the oldest first: the files
+// of an interrupted replay, then the rotated files. If claim is true, the
+// rotated files are moved to the replay directory.
+func deadLetterFiles(cfg *common.Config, claim bool) ([]string, error) {
+	config, err := unpackDeadLetterConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if config.File == nil {
+		return nil, fmt.Errorf("dead_letter.file is not configured")
+	}
+	dir := config.File.dir()
+
+	replaying, err := filepath.Glob(filepath.Join(dir, replayDir, "*.ndjson"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(replaying)
+
+	rotated, err := rotatedFiles(dir, config.File.Filename)
+	if err != nil {
+		return nil, err
+	}
+	if !claim {
+		return append(replaying, rotated...), nil
+	}
+
+	if len(rotated) > 0 {
+		if err := os.MkdirAll(filepath.Join(dir, replayDir), 0750); err != nil {
+			return nil, fmt.Errorf("fail to create replay directory: %v", err)
+		}
+	}
+	prefix := strconv.FormatInt(time.Now().UnixNano(), 10)
+	for i, path := range rotated {
+		claimed := filepath.Join(dir, replayDir, fmt.Sprintf("%s-%04d.ndjson", prefix, i))
+		if err := os.Rename(path, claimed); err != nil {
+			return nil, fmt.Errorf("fail to move %s to replay: %v", path, err)
+		}
+		replaying = append(replaying, claimed)
+	}
+	return replaying, nil
+}
+
+// rotatedFiles lists the files of the rotator, the oldest backup first.
+func rotatedFiles(dir, filename string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("fail to list dead letter files: %v", err)
+	}
+
+	backups := map[int]string{}
+	var indexes []int
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, filename) {
+			continue
+		}
+		index := 0
+		if suffix := strings.TrimPrefix(name, filename); suffix != "" {
+			n, err := strconv.Atoi(strings.TrimPrefix(suffix, "."))
+			if err != nil || !strings.HasPrefix(suffix, ".") {
+				continue
+			}
+			index = n
+		}
+		backups[index] = filepath.Join(dir, name)
+		indexes = append(indexes, index)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(indexes)))
+
+	files := make([]string, len(indexes))
+	for i, index := range indexes {
+		files[i] = backups[index]
+	}
+	return files, nil
+}
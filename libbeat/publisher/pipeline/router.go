@@ -0,0 +1,590 @@
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/common/acker"
+	"github.com/elastic/beats/v7/libbeat/common/atomic"
+	"github.com/elastic/beats/v7/libbeat/conditions"
+	"github.com/elastic/beats/v7/libbeat/logp"
+	"github.com/elastic/beats/v7/libbeat/monitoring"
+	"github.com/elastic/beats/v7/libbeat/outputs"
+	"github.com/elastic/beats/v7/libbeat/processors"
+	"github.com/elastic/beats/v7/libbeat/publisher/processing"
+)
+
+// Router publishes the events to several named outputs, each one with its
+// own pipeline, queue and retry policy. The processors are run once by the
+// client of the router, the routing table decides which outputs receive the
+// event.
+//
+// The ACKs of the outputs are tracked independently and merged in order. An
+// event is ACKed to the client once all required outputs receiving it have
+// ACKed it. Outputs not required drop the events if their queue is full and
+// never block the client.
+type Router struct {
+	outputs  []*routerOutput
+	routes   []route
+	defaults []int
+	mode     string
+
+	processors processing.Supporter
+	logger     *logp.Logger
+}
+
+type routerOutput struct {
+	name     string
+	required bool
+	pipeline *Pipeline
+}
+
+type route struct {
+	condition conditions.Condition
+	outputs   []int
+}
+
+const (
+	// RouteCopy sends an event to the outputs of all matching routes.
+	RouteCopy = "copy"
+	// RouteExclusive sends an event to the outputs of the first matching route.
+	RouteExclusive = "exclusive"
+)
+
+// RouterOutputConfig configures a named output of the router, the output is
+// the single namespace besides name, required and queue.
+type RouterOutputConfig struct {
+	Name string `config:"name" validate:"required"`
+
+	// Required outputs delay the ACK of the events until they are published.
+	// The first output is required by default, the others are not.
+	Required bool `config:"required"`
+
+	// Queue of the output, the queue of the pipeline by default.
+	Queue common.ConfigNamespace `config:"queue"`
+}
+
+// RoutingConfig configures the routing table.
+type RoutingConfig struct {
+	Mode   string        `config:"mode"`
+	Routes []RouteConfig `config:"routes"`
+
+	// Default are the outputs of the events not matching any route, the
+	// first output by default.
+	Default []string `config:"default"`
+}
+
+// RouteConfig sends the events matching the condition to the outputs.
+type RouteConfig struct {
+	When    *conditions.Config `config:"when"`
+	Outputs []string           `config:"outputs" validate:"required"`
+}
+
+var defaultRoutingConfig = RoutingConfig{
+	Mode: RouteCopy,
+}
+
+// RouterOutputFactory creates the output of a named output of the router.
+type RouterOutputFactory func(outputs.Observer, common.ConfigNamespace) (outputs.Group, error)
+
+// LoadRouter creates the pipelines of the outputs configured and the routing
+// table. The queue of the pipeline config is used by outputs without queue.
+func LoadRouter(
+	beatInfo beat.Info,
+	monitors Monitors,
+	config Config,
+	outputsConfig []*common.Config,
+	routingConfig *common.Config,
+	makeOutput RouterOutputFactory,
+	settings Settings,
+) (*Router, error) {
+	log := monitors.Logger
+	if log == nil {
+		log = logp.L()
+	}
+	if len(outputsConfig) == 0 {
+		return nil, errors.New("no outputs configured")
+	}
+
+	r := &Router{
+		mode:       RouteCopy,
+		processors: settings.Processors,
+		logger:     log,
+	}
+	names := map[string]int{}
+	for i, outCfg := range outputsConfig {
+		out, err := loadRouterOutput(beatInfo, monitors, config, outCfg, i == 0, makeOutput, settings)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		if _, exists := names[out.name]; exists {
+			out.pipeline.Close()
+			r.Close()
+			return nil, fmt.Errorf("output %v configured more than once", out.name)
+		}
+		names[out.name] = len(r.outputs)
+		r.outputs = append(r.outputs, out)
+	}
+
+	if err := r.configureRoutes(routingConfig, names); err != nil {
+		r.Close()
+		return nil, err
+	}
+	log.Infof("Publish to %d outputs with %d routes in %v mode", len(r.outputs), len(r.routes), r.mode)
+	return r, nil
+}
+
+func loadRouterOutput(
+	beatInfo beat.Info,
+	monitors Monitors,
+	config Config,
+	cfg *common.Config,
+	first bool,
+	makeOutput RouterOutputFactory,
+	settings Settings,
+) (*routerOutput, error) {
+	outConfig := RouterOutputConfig{Required: first}
+	if err := cfg.Unpack(&outConfig); err != nil {
+		return nil, err
+	}
+	if outConfig.Queue.IsSet() {
+		config.Queue = outConfig.Queue
+	}
+
+	// the queue is a namespace too
+	if _, err := cfg.Remove("queue", -1); err != nil && cfg.HasField("queue") {
+		return nil, err
+	}
+	var ns common.ConfigNamespace
+	if err := ns.Unpack(cfg); err != nil {
+		return nil, fmt.Errorf("fail to load output %v: %v", outConfig.Name, err)
+	}
+	if !ns.IsSet() {
+		return nil, fmt.Errorf("output %v has no output type", outConfig.Name)
+	}
+
+	outMonitors := monitors.forOutput(outConfig.Name)
+	settings.Processors = nil
+	settings.outputName = outConfig.Name
+	p, err := LoadWithSettings(beatInfo, outMonitors, config, func(stats outputs.Observer) (string, outputs.Group, error) {
+		out, err := makeOutput(stats, ns)
+		return ns.Name(), out, err
+	}, settings)
+	if err != nil {
+		return nil, fmt.Errorf("fail to load output %v: %v", outConfig.Name, err)
+	}
+	return &routerOutput{
+		name:     outConfig.Name,
+		required: outConfig.Required,
+		pipeline: p,
+	}, nil
+}
+
+// forOutput returns the monitors of the pipeline of a named output, the
+// metrics are in outputs.<name>.
+func (m Monitors) forOutput(name string) Monitors {
+	sub := func(reg *monitoring.Registry) *monitoring.Registry {
+		if reg == nil {
+			return nil
+		}
+		outputs := reg.GetRegistry("outputs")
+		if outputs == nil {
+			outputs = reg.NewRegistry("outputs")
+		}
+		if out := outputs.GetRegistry(name); out != nil {
+			out.Clear()
+			return out
+		}
+		return outputs.NewRegistry(name)
+	}
+
+	out := m
+	out.Metrics = sub(m.Metrics)
+	out.Telemetry = sub(m.Telemetry)
+	if m.Logger != nil {
+		out.Logger = m.Logger.With("output", name)
+	}
+	return out
+}
+
+func (r *Router) configureRoutes(cfg *common.Config, names map[string]int) error {
+	config := defaultRoutingConfig
+	if cfg != nil {
+		if err := cfg.Unpack(&config); err != nil {
+			return err
+		}
+	}
+
+	switch config.Mode {
+	case RouteCopy, RouteExclusive:
+		r.mode = config.Mode
+	default:
+		return fmt.Errorf("unknown routing mode %v, %v or %v", config.Mode, RouteCopy, RouteExclusive)
+	}
+
+	indexes := func(outputs []string) ([]int, error) {
+		var idx []int
+		for _, name := range outputs {
+			i, exists := names[name]
+			if !exists {
+				return nil, fmt.Errorf("route to unknown output %v", name)
+			}
+			idx = append(idx, i)
+		}
+		return idx, nil
+	}
+
+	for _, routeConfig := range config.Routes {
+		var rt route
+		var err error
+		if routeConfig.When != nil {
+			rt.condition, err = conditions.NewCondition(routeConfig.When)
+			if err != nil {
+				return err
+			}
+		}
+		if rt.outputs, err = indexes(routeConfig.Outputs); err != nil {
+			return err
+		}
+		r.routes = append(r.routes, rt)
+	}
+
+	if len(config.Default) == 0 {
+		r.defaults = []int{0}
+		return nil
+	}
+	var err error
+	r.defaults, err = indexes(config.Default)
+	return err
+}
+
+// targets returns the indexes of the outputs receiving the event.
+func (r *Router) targets(event *beat.Event) []int {
+	var matched []int
+	var seen []bool
+	for _, rt := range r.routes {
+		if rt.condition != nil && !rt.condition.Check(event) {
+			continue
+		}
+		if r.mode == RouteExclusive {
+			return rt.outputs
+		}
+		if seen == nil {
+			seen = make([]bool, len(r.outputs))
+		}
+		for _, i := range rt.outputs {
+			if !seen[i] {
+				seen[i] = true
+				matched = append(matched, i)
+			}
+		}
+	}
+	if len(matched) == 0 {
+		return r.defaults
+	}
+	return matched
+}
+
+// output returns the named output, or nil if it doesn't exist.
+func (r *Router) output(name string) *routerOutput {
+	for _, out := range r.outputs {
+		if out.name == name {
+			return out
+		}
+	}
+	return nil
+}
+
+// Close stops the pipelines of all outputs.
+func (r *Router) Close() error {
+	for _, out := range r.outputs {
+		out.pipeline.Close()
+	}
+	return nil
+}
+
+// Connect creates a new client with default settings.
+func (r *Router) Connect() (beat.Client, error) {
+	return r.ConnectWith(beat.ClientConfig{})
+}
+
+// ConnectWith creates a client connected to the pipelines of all outputs.
+func (r *Router) ConnectWith(cfg beat.ClientConfig) (beat.Client, error) {
+	if err := validateClientConfig(&cfg); err != nil {
+		return nil, err
+	}
+
+	var processor beat.Processor
+	if r.processors != nil {
+		var err error
+		processor, err = r.processors.Create(cfg.Processing, publishDisabled)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ackHandler := cfg.ACKHandler
+	if ackHandler == nil {
+		ackHandler = acker.Nil()
+	}
+	c := &routerClient{
+		router:     r,
+		processors: processor,
+		acker:      newRouterACK(ackHandler, len(r.outputs)),
+		eventer:    cfg.Events,
+		clients:    make([]beat.Client, len(r.outputs)),
+		isOpen:     atomic.MakeBool(true),
+		// Like the clients of a pipeline, the clients dropping events have
+		// no ACKs to wait for.
+		waitRequired: cfg.PublishMode != beat.DropIfFull,
+	}
+
+	for i, out := range r.outputs {
+		outCfg := beat.ClientConfig{
+			PublishMode: cfg.PublishMode,
+			CloseRef:    cfg.CloseRef,
+			WaitClose:   cfg.WaitClose,
+		}
+		if out.required && c.waitRequired {
+			i := i
+			outCfg.ACKHandler = acker.RawCounting(func(n int) { c.acker.ack(i, n) })
+			// The events dropped by the output are never ACKed by it.
+			outCfg.Events = &requiredEvents{acker: c.acker, output: i}
+		} else if !out.required {
+			outCfg.PublishMode = beat.DropIfFull
+		}
+
+		client, err := out.pipeline.ConnectWith(outCfg)
+		if err != nil {
+			c.Close()
+			return nil, fmt.Errorf("fail to connect to output %v: %v", out.name, err)
+		}
+		c.clients[i] = client
+	}
+	return c, nil
+}
+
+type routerClient struct {
+	router     *Router
+	processors beat.Processor
+	acker      *routerACK
+	eventer    beat.ClientEventer
+	clients    []beat.Client
+	// waitRequired is true if the events wait for the ACKs of the required
+	// outputs.
+	waitRequired bool
+
+	mutex     sync.Mutex
+	isOpen    atomic.Bool
+	closeOnce sync.Once
+}
+
+func (c *routerClient) PublishAll(events []beat.Event) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, e := range events {
+		c.publish(e)
+	}
+}
+
+func (c *routerClient) Publish(e beat.Event) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.publish(e)
+}
+
+func (c *routerClient) publish(e beat.Event) {
+	if !c.isOpen.Load() {
+		if c.eventer != nil {
+			c.eventer.DroppedOnPublish(e)
+		}
+		return
+	}
+
+	event := &e
+	if c.processors != nil {
+		var err error
+		event, err = c.processors.Run(event)
+		if err != nil {
+			c.router.logger.Errorf("Failed to publish event: %v", err)
+		}
+	}
+	if event == nil {
+		c.acker.addEvent(e, false, nil)
+		if c.eventer != nil {
+			c.eventer.FilteredOut(e)
+		}
+		return
+	}
+
+	targets := c.router.targets(event)
+	c.acker.addEvent(*event, true, c.required(targets))
+	for n, i := range targets {
+		out := *event
+		if n > 0 {
+			// the outputs must not share the fields
+			out.Fields = event.Fields.Clone()
+			if event.Meta != nil {
+				out.Meta = event.Meta.Clone()
+			}
+		}
+		c.clients[i].Publish(out)
+	}
+	if c.eventer != nil {
+		c.eventer.Published()
+	}
+}
+
+func (c *routerClient) required(targets []int) []int {
+	if !c.waitRequired {
+		return nil
+	}
+	var required []int
+	for _, i := range targets {
+		if c.router.outputs[i].required {
+			required = append(required, i)
+		}
+	}
+	return required
+}
+
+func (c *routerClient) Close() error {
+	c.closeOnce.Do(func() {
+		c.isOpen.Store(false)
+		if c.eventer != nil {
+			c.eventer.Closing()
+		}
+
+		for _, client := range c.clients {
+			if client != nil {
+				client.Close()
+			}
+		}
+		c.acker.close()
+
+		if c.processors != nil {
+			if err := processors.Close(c.processors); err != nil {
+				c.router.logger.Errorf("client: error closing processors: %v", err)
+			}
+		}
+		if c.eventer != nil {
+			c.eventer.Closed()
+		}
+	})
+	return nil
+}
+
+// requiredEvents reports the events dropped by a required output to the
+// routerACK. The output drops an event while it is published, so it is the
+// last event sent to the output.
+type requiredEvents struct {
+	acker  *routerACK
+	output int
+}
+
+func (e *requiredEvents) Closing()                    {}
+func (e *requiredEvents) Closed()                     {}
+func (e *requiredEvents) Published()                  {}
+func (e *requiredEvents) FilteredOut(beat.Event)      {}
+func (e *requiredEvents) DroppedOnPublish(beat.Event) { e.acker.dropped(e.output) }
+
+// routerACK merges the ACKs of the outputs. Each output ACKs its events in
+// order, the pending count of an event is decremented by the ACKs of the
+// required outputs it is sent to. The events are ACKed to the client in
+// publish order once their count is 0.
+type routerACK struct {
+	mu      sync.Mutex
+	handler beat.ACKer
+
+	// pending counts of the published events not ACKed yet, seq of the
+	// first one is base
+	pending []int
+	base    uint64
+	next    uint64
+
+	// seqs of the events sent to each output not ACKed yet
+	outputs [][]uint64
+}
+
+func newRouterACK(handler beat.ACKer, outputs int) *routerACK {
+	return &routerACK{
+		handler: handler,
+		outputs: make([][]uint64, outputs),
+	}
+}
+
+// addEvent adds a published event with the required outputs it is sent to,
+// or an event filtered out.
+func (a *routerACK) addEvent(event beat.Event, published bool, required []int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.handler.AddEvent(event, published)
+	if !published {
+		return
+	}
+
+	seq := a.next
+	a.next++
+	a.pending = append(a.pending, len(required))
+	for _, i := range required {
+		a.outputs[i] = append(a.outputs[i], seq)
+	}
+	a.flush()
+}
+
+func (a *routerACK) ack(output, n int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	seqs := a.outputs[output]
+	if n > len(seqs) {
+		n = len(seqs)
+	}
+	for _, seq := range seqs[:n] {
+		a.pending[seq-a.base]--
+	}
+	a.outputs[output] = seqs[n:]
+	a.flush()
+}
+
+// dropped stops waiting for the ACK of the last event sent to the output.
+func (a *routerACK) dropped(output int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	seqs := a.outputs[output]
+	if len(seqs) == 0 {
+		return
+	}
+	last := len(seqs) - 1
+	a.pending[seqs[last]-a.base]--
+	a.outputs[output] = seqs[:last]
+	a.flush()
+}
+
+// flush ACKs the events at the front with no pending ACKs.
+func (a *routerACK) flush() {
+	acked := 0
+	for acked < len(a.pending) && a.pending[acked] == 0 {
+		acked++
+	}
+	if acked == 0 {
+		return
+	}
+	a.pending = a.pending[acked:]
+	a.base += uint64(acked)
+	a.handler.ACKEvents(acked)
+}
+
+func (a *routerACK) close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.handler.Close()
+}
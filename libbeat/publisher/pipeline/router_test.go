@@ -0,0 +1,219 @@
+package pipeline
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/common/acker"
+	"github.com/elastic/beats/v7/libbeat/common/atomic"
+	"github.com/elastic/beats/v7/libbeat/logp"
+	"github.com/elastic/beats/v7/libbeat/outputs"
+	"github.com/elastic/beats/v7/libbeat/publisher"
+)
+
+func TestRouterTargets(t *testing.T) {
+	outputs := map[string]int{"collector": 0, "archive": 1, "audit": 2}
+	routing := `
+routes:
+  - when.equals.type: audit
+    outputs: [audit, archive]
+  - when.has_fields: [archive]
+    outputs: [archive]
+default: [collector]`
+
+	tests := map[string]struct {
+		mode   string
+		fields common.MapStr
+		want   []int
+	}{
+		"copy default":       {RouteCopy, common.MapStr{"type": "app"}, []int{0}},
+		"copy one route":     {RouteCopy, common.MapStr{"type": "audit"}, []int{2, 1}},
+		"copy routes":        {RouteCopy, common.MapStr{"type": "audit", "archive": true}, []int{2, 1}},
+		"copy second route":  {RouteCopy, common.MapStr{"type": "app", "archive": true}, []int{1}},
+		"exclusive first":    {RouteExclusive, common.MapStr{"type": "audit", "archive": true}, []int{2, 1}},
+		"exclusive second":   {RouteExclusive, common.MapStr{"archive": true}, []int{1}},
+		"exclusive defaults": {RouteExclusive, common.MapStr{}, []int{0}},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			cfg, err := common.NewConfigWithYAML([]byte(routing+"\nmode: "+test.mode), "")
+			require.NoError(t, err)
+			r := &Router{outputs: make([]*routerOutput, len(outputs))}
+			require.NoError(t, r.configureRoutes(cfg, outputs))
+			assert.Equal(t, test.want, r.targets(&beat.Event{Fields: test.fields}))
+		})
+	}
+}
+
+func TestRouterACK(t *testing.T) {
+	var acked []int
+	ack := newRouterACK(acker.RawCounting(func(n int) { acked = append(acked, n) }), 2)
+
+	ack.addEvent(beat.Event{}, true, []int{0, 1})
+	ack.addEvent(beat.Event{}, true, []int{0})
+	ack.addEvent(beat.Event{}, false, nil)
+	ack.addEvent(beat.Event{}, true, nil)
+	ack.addEvent(beat.Event{}, true, []int{1})
+	assert.Empty(t, acked)
+
+	// the first event waits for the second output
+	ack.ack(0, 2)
+	assert.Empty(t, acked)
+
+	ack.ack(1, 1)
+	assert.Equal(t, []int{3}, acked)
+
+	ack.ack(1, 1)
+	assert.Equal(t, []int{3, 1}, acked)
+
+	// a dropped event is not waited for
+	ack.addEvent(beat.Event{}, true, []int{0, 1})
+	ack.addEvent(beat.Event{}, true, []int{0})
+	ack.dropped(0)
+	ack.ack(1, 1)
+	assert.Equal(t, []int{3, 1}, acked)
+	ack.ack(0, 1)
+	assert.Equal(t, []int{3, 1, 2}, acked)
+}
+
+func TestRouterRequiredDropIfFull(t *testing.T) {
+	var received atomic.Int
+	block := make(chan struct{})
+	makeOutput := func(_ outputs.Observer, ns common.ConfigNamespace) (outputs.Group, error) {
+		return outputs.Success(10, 0, newMockClient(func(batch publisher.Batch) error {
+			<-block
+			received.Add(len(batch.Events()))
+			batch.ACK()
+			return nil
+		}))
+	}
+
+	outputsConfig := []*common.Config{
+		common.MustNewConfigFrom(map[string]interface{}{
+			"name": "collector",
+			"slow": map[string]interface{}{},
+			"queue.mem": map[string]interface{}{
+				"events":           32,
+				"flush.min_events": 1,
+			},
+		}),
+	}
+	router, err := LoadRouter(beat.Info{}, Monitors{Logger: logp.NewLogger("test")}, Config{}, outputsConfig, nil, makeOutput, Settings{})
+	require.NoError(t, err)
+	defer router.Close()
+
+	// Like the pipeline, the router takes no ACK handler with DropIfFull.
+	client, err := router.ConnectWith(beat.ClientConfig{PublishMode: beat.DropIfFull})
+	require.NoError(t, err)
+	defer client.Close()
+
+	// The events dropped by the full queue are not waited for.
+	const events = 200
+	published := make(chan struct{})
+	go func() {
+		defer close(published)
+		for i := 0; i < events; i++ {
+			client.Publish(beat.Event{Fields: common.MapStr{"i": i}})
+		}
+	}()
+	select {
+	case <-published:
+	case <-time.After(5 * time.Second):
+		t.Fatal("publishing blocked on the full queue of the required output")
+	}
+	close(block)
+
+	assert.True(t, waitUntilTrue(5*time.Second, func() bool {
+		return received.Load() > 0
+	}))
+	assert.True(t, received.Load() < events)
+}
+
+func TestRouterRequiredDefault(t *testing.T) {
+	makeOutput := func(_ outputs.Observer, ns common.ConfigNamespace) (outputs.Group, error) {
+		return outputs.Success(10, 0, newMockClient(func(batch publisher.Batch) error {
+			batch.ACK()
+			return nil
+		}))
+	}
+	outputsConfig := []*common.Config{
+		common.MustNewConfigFrom(map[string]interface{}{"name": "collector", "fast": map[string]interface{}{}}),
+		common.MustNewConfigFrom(map[string]interface{}{"name": "archive", "fast": map[string]interface{}{}}),
+		common.MustNewConfigFrom(map[string]interface{}{"name": "audit", "required": true, "fast": map[string]interface{}{}}),
+	}
+	router, err := LoadRouter(beat.Info{}, Monitors{Logger: logp.NewLogger("test")}, Config{}, outputsConfig, nil, makeOutput, Settings{})
+	require.NoError(t, err)
+	defer router.Close()
+
+	// Only the first output is required unless configured.
+	var required []bool
+	for _, out := range router.outputs {
+		required = append(required, out.required)
+	}
+	assert.Equal(t, []bool{true, false, true}, required)
+}
+
+func TestRouterSlowOutput(t *testing.T) {
+	var mu sync.Mutex
+	received := map[string]int{}
+	block := make(chan struct{})
+	defer close(block)
+
+	makeOutput := func(_ outputs.Observer, ns common.ConfigNamespace) (outputs.Group, error) {
+		name := ns.Name()
+		return outputs.Success(10, 0, newMockClient(func(batch publisher.Batch) error {
+			if name == "slow" {
+				<-block
+			}
+			mu.Lock()
+			received[name] += len(batch.Events())
+			mu.Unlock()
+			batch.ACK()
+			return nil
+		}))
+	}
+
+	outputsConfig := []*common.Config{
+		common.MustNewConfigFrom(map[string]interface{}{"name": "collector", "fast": map[string]interface{}{}}),
+		common.MustNewConfigFrom(map[string]interface{}{
+			"name": "archive",
+			"slow": map[string]interface{}{},
+			"queue.mem": map[string]interface{}{
+				"events":           32,
+				"flush.min_events": 1,
+			},
+		}),
+	}
+	routing := common.MustNewConfigFrom(map[string]interface{}{
+		"routes": []map[string]interface{}{{"outputs": []string{"collector", "archive"}}},
+	})
+
+	router, err := LoadRouter(beat.Info{}, Monitors{Logger: logp.NewLogger("test")}, Config{}, outputsConfig, routing, makeOutput, Settings{})
+	require.NoError(t, err)
+	defer router.Close()
+
+	var acked atomic.Int
+	client, err := router.ConnectWith(beat.ClientConfig{
+		ACKHandler: acker.RawCounting(func(n int) { acked.Add(n) }),
+	})
+	require.NoError(t, err)
+	defer client.Close()
+
+	const events = 1000
+	for i := 0; i < events; i++ {
+		client.Publish(beat.Event{Fields: common.MapStr{"i": i}})
+	}
+
+	assert.True(t, waitUntilTrue(5*time.Second, func() bool {
+		return acked.Load() == events
+	}))
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, events, received["fast"])
+}
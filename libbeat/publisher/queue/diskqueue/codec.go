@@ -0,0 +1,206 @@
+package diskqueue
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+)
+
+// The frame compressions of the user config.
+const (
+	CompressionNone = "none"
+	CompressionZstd = "zstd"
+	CompressionLZ4  = "lz4"
+)
+
+// The segment flags of the schema version 1 header, they describe how the
+// data of every frame in the segment is encoded.
+const (
+	segmentFlagZstd      uint32 = 1 << 0
+	segmentFlagLZ4       uint32 = 1 << 1
+	segmentFlagEncrypted uint32 = 1 << 2
+
+	segmentFlagsCompression = segmentFlagZstd | segmentFlagLZ4
+	segmentFlagsKnown       = segmentFlagsCompression | segmentFlagEncrypted
+)
+
+// errEncryptionKey is wrapped by the errors decrypting a frame with a
+// missing or wrong encryption key. Unlike the errors of a corrupted frame,
+// it applies to every frame of the segment, so the segment must not be
+// skipped.
+var errEncryptionKey = errors.New("encryption key doesn't match")
+
+// frameCodec compresses and encrypts the serialized events of new frames
+// with the configured settings, and decodes the frames of any segment
+// according to the flags of the segment header, so segments written with
+// other settings remain readable as long as the encryption key is known.
+//
+// encode is safe for concurrent use by the producers, decode must only be
+// called from the reader loop.
+type frameCodec struct {
+	flags uint32
+
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+
+	// nil if no encryption key is configured.
+	aead cipher.AEAD
+}
+
+func newFrameCodec(settings Settings) (*frameCodec, error) {
+	codec := &frameCodec{}
+	switch settings.Compression {
+	case "", CompressionNone:
+	case CompressionZstd:
+		codec.flags |= segmentFlagZstd
+		encoder, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create zstd encoder: %w", err)
+		}
+		codec.zstdEncoder = encoder
+	case CompressionLZ4:
+		codec.flags |= segmentFlagLZ4
+	default:
+		return nil, fmt.Errorf("unknown disk queue compression '%v'", settings.Compression)
+	}
+
+	if settings.EncryptionKey != "" {
+		// The key is a secret of any length, usually from the keystore, which
+		// is stretched to an AES-256 key.
+		key := sha256.Sum256([]byte(settings.EncryptionKey))
+		block, err := aes.NewCipher(key[:])
+		if err != nil {
+			return nil, fmt.Errorf("failed to create aes cipher: %w", err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create aes-gcm cipher: %w", err)
+		}
+		codec.aead = aead
+		codec.flags |= segmentFlagEncrypted
+	}
+	return codec, nil
+}
+
+// encode compresses and then encrypts the serialized event. The returned
+// slice is owned by the caller, data may be returned as is.
+func (c *frameCodec) encode(data []byte) ([]byte, error) {
+	switch {
+	case c.flags&segmentFlagZstd != 0:
+		data = c.zstdEncoder.EncodeAll(data, nil)
+	case c.flags&segmentFlagLZ4 != 0:
+		data = compressLZ4(data)
+	}
+
+	if c.aead != nil {
+		// The sealed data is prefixed by its random nonce.
+		nonceSize := c.aead.NonceSize()
+		sealed := make([]byte, nonceSize, nonceSize+len(data)+c.aead.Overhead())
+		if _, err := io.ReadFull(rand.Reader, sealed); err != nil {
+			return nil, fmt.Errorf("failed to generate nonce: %w", err)
+		}
+		data = c.aead.Seal(sealed, sealed, data, nil)
+	}
+	return data, nil
+}
+
+// decode decrypts and decompresses the frame data of a segment with the
+// given header flags.
+func (c *frameCodec) decode(flags uint32, data []byte) ([]byte, error) {
+	if flags&segmentFlagEncrypted != 0 {
+		if c.aead == nil {
+			return nil, fmt.Errorf("%w: segment is encrypted but no encryption key is configured", errEncryptionKey)
+		}
+		nonceSize := c.aead.NonceSize()
+		if len(data) < nonceSize+c.aead.Overhead() {
+			return nil, fmt.Errorf("encrypted frame of %d bytes is too short", len(data))
+		}
+		opened, err := c.aead.Open(nil, data[:nonceSize], data[nonceSize:], nil)
+		if err != nil {
+			// The authentication fails with a wrong key, or if the frame was
+			// modified after its checksum was computed.
+			return nil, fmt.Errorf("%w: failed to decrypt frame: %v", errEncryptionKey, err)
+		}
+		data = opened
+	}
+
+	switch {
+	case flags&segmentFlagZstd != 0:
+		if c.zstdDecoder == nil {
+			decoder, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+			if err != nil {
+				return nil, fmt.Errorf("failed to create zstd decoder: %w", err)
+			}
+			c.zstdDecoder = decoder
+		}
+		decompressed, err := c.zstdDecoder.DecodeAll(data, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress zstd frame: %w", err)
+		}
+		data = decompressed
+	case flags&segmentFlagLZ4 != 0:
+		decompressed, err := decompressLZ4(data)
+		if err != nil {
+			return nil, err
+		}
+		data = decompressed
+	}
+	return data, nil
+}
+
+func (c *frameCodec) close() {
+	if c.zstdEncoder != nil {
+		c.zstdEncoder.Close()
+	}
+	if c.zstdDecoder != nil {
+		c.zstdDecoder.Close()
+	}
+}
+
+// The lz4 frame data is the uncompressed length followed by the lz4 block,
+// or by the raw data if it is incompressible.
+const lz4HeaderSize = 4
+
+func compressLZ4(data []byte) []byte {
+	buf := make([]byte, lz4HeaderSize+len(data))
+	binary.LittleEndian.PutUint32(buf, uint32(len(data)))
+	// The block must be smaller than the raw data to tell them apart, the
+	// data is incompressible if it does not fit.
+	n, err := lz4.CompressBlock(data, buf[lz4HeaderSize:len(buf)-1], nil)
+	if err != nil || n == 0 {
+		n = copy(buf[lz4HeaderSize:], data)
+	}
+	return buf[:lz4HeaderSize+n]
+}
+
+func decompressLZ4(data []byte) ([]byte, error) {
+	if len(data) < lz4HeaderSize {
+		return nil, fmt.Errorf("lz4 frame of %d bytes is too short", len(data))
+	}
+	size := int(binary.LittleEndian.Uint32(data))
+	block := data[lz4HeaderSize:]
+	if len(block) == size {
+		// stored incompressible
+		return block, nil
+	}
+	if len(block) > size {
+		return nil, fmt.Errorf("lz4 block of %d bytes exceeds the data size %d", len(block), size)
+	}
+	buf := make([]byte, size)
+	n, err := lz4.UncompressBlock(block, buf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress lz4 frame: %w", err)
+	}
+	if n != size {
+		return nil, fmt.Errorf("lz4 frame size mismatch (%d != %d)", n, size)
+	}
+	return buf, nil
+}
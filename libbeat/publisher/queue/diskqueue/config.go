@@ -68,6 +68,21 @@ type Settings struct {
 	// use exponential backoff up to the specified limit.
 	RetryInterval    time.Duration
 	MaxRetryInterval time.Duration
+
+	// Compression is the compression of the data of each frame: "none",
+	// "zstd" or "lz4". Existing segments are read with the compression they
+	// were written with.
+	Compression string
+
+	// EncryptionKey is the secret to encrypt the data of each frame with
+	// AES-GCM, no encryption if it is empty. The key is required to read
+	// encrypted segments, the queue fails to open if it doesn't decrypt the
+	// existing ones.
+	EncryptionKey string
+
+	// The flags of the segment header of new segments, set by the queue
+	// from Compression and EncryptionKey.
+	segmentFlags uint32
 }
 
 // userConfig holds the parameters for a disk queue that are configurable
@@ -82,6 +97,12 @@ type userConfig struct {
 
 	RetryInterval    *time.Duration `config:"retry_interval" validate:"positive"`
 	MaxRetryInterval *time.Duration `config:"max_retry_interval" validate:"positive"`
+
+	Compression string `config:"compression"`
+	Encryption  struct {
+		// The key is usually a reference to the keystore, e.g. ${DISKQUEUE_KEY}.
+		Key string `config:"key"`
+	} `config:"encryption"`
 }
 
 func (c *userConfig) Validate() error {
@@ -114,6 +135,13 @@ func (c *userConfig) Validate() error {
 			*c.MaxRetryInterval, *c.RetryInterval)
 	}
 
+	switch c.Compression {
+	case "", CompressionNone, CompressionZstd, CompressionLZ4:
+	default:
+		return fmt.Errorf(
+			"Disk queue compression '%v' is not one of none, zstd or lz4", c.Compression)
+	}
+
 	return nil
 }
 
@@ -165,6 +193,9 @@ func SettingsForUserConfig(config *common.Config) (Settings, error) {
 		settings.MaxRetryInterval = *userConfig.RetryInterval
 	}
 
+	settings.Compression = userConfig.Compression
+	settings.EncryptionKey = userConfig.Encryption.Key
+
 	return settings, nil
 }
 
@@ -20,13 +20,15 @@ package diskqueue
 import (
 	"fmt"
 
+	"github.com/elastic/beats/v7/libbeat/common/atomic"
 	"github.com/elastic/beats/v7/libbeat/publisher"
 	"github.com/elastic/beats/v7/libbeat/publisher/queue"
 )
 
 type diskQueueConsumer struct {
-	queue  *diskQueue
-	closed bool
+	queue *diskQueue
+	// closed may be set while a Get is waiting for the queue.
+	closed atomic.Bool
 }
 
 type diskQueueBatch struct {
@@ -39,7 +41,7 @@ type diskQueueBatch struct {
 //
 
 func (consumer *diskQueueConsumer) Get(eventCount int) (queue.Batch, error) {
-	if consumer.closed {
+	if consumer.closed.Load() {
 		return nil, fmt.Errorf("Tried to read from a closed disk queue consumer")
 	}
 
@@ -93,7 +95,7 @@ eventLoop:
 }
 
 func (consumer *diskQueueConsumer) Close() error {
-	consumer.closed = true
+	consumer.closed.Store(true)
 	return nil
 }
 
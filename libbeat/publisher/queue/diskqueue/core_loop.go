@@ -17,7 +17,10 @@
 
 package diskqueue
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+)
 
 // This file contains the queue's "core loop" -- the central goroutine
 // that owns all queue state that is not encapsulated in one of the
@@ -41,6 +44,9 @@ func (dq *diskQueue) run() {
 			// writer loop.
 			dq.maybeWritePending()
 
+		case response := <-dq.drainedRequestChan:
+			response <- dq.drained()
+
 		case ackedSegmentID := <-dq.acks.segmentACKChan:
 			dq.handleSegmentACK(ackedSegmentID)
 
@@ -165,6 +171,11 @@ func (dq *diskQueue) handleReaderLoopResponse(response readerLoopResponse) {
 			dq.segments.acking = append(dq.segments.acking, segment)
 			dq.segments.nextReadOffset = 0
 		}
+		if errors.Is(response.err, errEncryptionKey) {
+			// The rest of the segment can't be decrypted, keep it on disk
+			// instead of deleting it once the frames read so far are ACKed.
+			moveSegmentAside(dq.logger, dq.settings.segmentPath(segment.id))
+		}
 	} else {
 		// A segment in the writing list can't be finished writing,
 		// so we don't check the endOffset.
@@ -353,6 +364,30 @@ func (segments *diskQueueSegments) readingSegment() *queueSegment {
 	return nil
 }
 
+// drained returns true if no frame is waiting to be written, read or taken
+// by a consumer.
+func (dq *diskQueue) drained() bool {
+	// The frames read are buffered in the output channel of the reader loop
+	// until the consumers take them.
+	if dq.reading || len(dq.readerLoop.output) > 0 {
+		return false
+	}
+	if dq.writing || len(dq.pendingFrames) > 0 || len(dq.blockedProducers) > 0 {
+		return false
+	}
+	// nextReadOffset is the offset in the first of the remaining segments.
+	offset := dq.segments.nextReadOffset
+	for _, segments := range [][]*queueSegment{dq.segments.reading, dq.segments.writing} {
+		for _, segment := range segments {
+			if offset < segment.endOffset {
+				return false
+			}
+			offset = 0
+		}
+	}
+	return true
+}
+
 // If the reading list is nonempty, and there are no outstanding read
 // requests, send one.
 func (dq *diskQueue) maybeReadPending() {
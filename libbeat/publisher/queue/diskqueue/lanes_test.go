@@ -0,0 +1,74 @@
+package diskqueue
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/logp"
+	"github.com/elastic/beats/v7/libbeat/publisher/queue"
+)
+
+func TestLanes(t *testing.T) {
+	dir := testSettings(t).Path
+	cfg, err := common.NewConfigFrom(map[string]interface{}{
+		"path":     dir,
+		"max_size": "10MB",
+		"lanes": []map[string]interface{}{{
+			"name": "first",
+			"when": map[string]interface{}{"range.index.lt": 10},
+		}},
+	})
+	require.NoError(t, err)
+
+	written := make(chan int, 30)
+	listener := ackListener(func(n int) { written <- n })
+	q, err := queueFactory(listener, logp.NewLogger("test"), cfg, 0)
+	require.NoError(t, err)
+	defer q.Close()
+
+	producer := q.Producer(queue.ProducerConfig{})
+	for i := 0; i < 30; i++ {
+		require.True(t, producer.Publish(*testEvent(i)))
+	}
+	for n := 0; n < 30; {
+		select {
+		case acked := <-written:
+			n += acked
+		case <-time.After(10 * time.Second):
+			t.Fatalf("only %d of 30 events were written", n)
+		}
+	}
+
+	// The default lane keeps the segments of the queue without lanes.
+	for _, path := range []string{dir, filepath.Join(dir, "lanes", "first")} {
+		segments, err := filepath.Glob(filepath.Join(path, "*.seg"))
+		require.NoError(t, err)
+		assert.NotEmpty(t, segments, path)
+	}
+
+	consumer := q.Consumer()
+	defer consumer.Close()
+	var first, other []int
+	for len(first)+len(other) < 30 {
+		batch, err := consumer.Get(8)
+		require.NoError(t, err)
+		for _, event := range batch.Events() {
+			if index := testEventIndex(t, event); index < 10 {
+				first = append(first, index)
+			} else {
+				other = append(other, index)
+			}
+		}
+		batch.ACK()
+	}
+	assert.Equal(t, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, first)
+	assert.Len(t, other, 20)
+	for i, index := range other {
+		assert.Equal(t, 10+i, index)
+	}
+}
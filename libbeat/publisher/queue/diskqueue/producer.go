@@ -70,6 +70,12 @@ func (producer *diskQueueProducer) publish(
 			"Couldn't serialize incoming event: %v", err)
 		return false
 	}
+	serialized, err = producer.queue.codec.encode(serialized)
+	if err != nil {
+		producer.queue.logger.Errorf(
+			"Couldn't encode incoming event: %v", err)
+		return false
+	}
 	request := producerWriteRequest{
 		frame: &writeFrame{
 			serialized: serialized,
@@ -21,12 +21,14 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"sync"
 
 	"github.com/elastic/beats/v7/libbeat/common"
 	"github.com/elastic/beats/v7/libbeat/feature"
 	"github.com/elastic/beats/v7/libbeat/logp"
 	"github.com/elastic/beats/v7/libbeat/publisher/queue"
+	"github.com/elastic/beats/v7/libbeat/publisher/queue/lanes"
 )
 
 // diskQueue is the internal type representing a disk-based implementation
@@ -35,6 +37,10 @@ type diskQueue struct {
 	logger   *logp.Logger
 	settings Settings
 
+	// The codec of the frame data, shared by the producers and the reader
+	// loop.
+	codec *frameCodec
+
 	// Metadata related to the segment files.
 	segments diskQueueSegments
 
@@ -71,6 +77,10 @@ type diskQueue struct {
 	// The API channel used by diskQueueProducer to write events.
 	producerWriteRequestChan chan producerWriteRequest
 
+	// Drained sends its response channel to the core loop through
+	// drainedRequestChan.
+	drainedRequestChan chan chan bool
+
 	// pendingFrames is a list of all incoming data frames that have been
 	// accepted by the queue and are waiting to be sent to the writer loop.
 	// Segment ids in this list always appear in sorted order, even between
@@ -101,6 +111,21 @@ func init() {
 func queueFactory(
 	ackListener queue.ACKListener, logger *logp.Logger, cfg *common.Config, _ int, // input queue size param is unused.
 ) (queue.Queue, error) {
+	if lanes.HasLanes(cfg) {
+		return lanes.NewQueue(logger, cfg, func(name string, laneCfg *common.Config) (queue.Queue, error) {
+			settings, err := SettingsForUserConfig(laneCfg)
+			if err != nil {
+				return nil, fmt.Errorf("disk queue couldn't load user config: %w", err)
+			}
+			// The default lane keeps the segments of the queue without lanes.
+			if name != lanes.DefaultLane {
+				settings.Path = filepath.Join(settings.directoryPath(), "lanes", name)
+			}
+			settings.WriteToDiskListener = ackListener
+			return NewQueue(logger, settings)
+		})
+	}
+
 	settings, err := SettingsForUserConfig(cfg)
 	if err != nil {
 		return nil, fmt.Errorf("disk queue couldn't load user config: %w", err)
@@ -124,8 +149,14 @@ func NewQueue(logger *logp.Logger, settings Settings) (queue.Queue, error) {
 			settings.MaxBufferSize, settings.MaxSegmentSize)
 	}
 
+	codec, err := newFrameCodec(settings)
+	if err != nil {
+		return nil, err
+	}
+	settings.segmentFlags = codec.flags
+
 	// Create the given directory path if it doesn't exist.
-	err := os.MkdirAll(settings.directoryPath(), os.ModePerm)
+	err = os.MkdirAll(settings.directoryPath(), os.ModePerm)
 	if err != nil {
 		return nil, fmt.Errorf("couldn't create disk queue directory: %w", err)
 	}
@@ -150,7 +181,7 @@ func NewQueue(logger *logp.Logger, settings Settings) (queue.Queue, error) {
 	}
 
 	// Index any existing data segments to be placed in segments.reading.
-	initialSegments, err := scanExistingSegments(settings.directoryPath())
+	initialSegments, err := scanExistingSegments(logger, settings.directoryPath())
 	if err != nil {
 		return nil, err
 	}
@@ -171,6 +202,12 @@ func NewQueue(logger *logp.Logger, settings Settings) (queue.Queue, error) {
 		initialSegments = initialSegments[1:]
 	}
 
+	// Fail before anything is read if the remaining segments can't be
+	// decrypted, the frames would be lost otherwise.
+	if err := checkEncryptionKey(logger, settings, codec, initialSegments); err != nil {
+		return nil, err
+	}
+
 	// If the queue position is older than all existing segments, advance
 	// it to the beginning of the first one.
 	if len(initialSegments) > 0 && readSegmentID < initialSegments[0].id {
@@ -189,11 +226,14 @@ func NewQueue(logger *logp.Logger, settings Settings) (queue.Queue, error) {
 
 		acks: newDiskQueueACKs(logger, nextReadPosition, positionFile),
 
-		readerLoop:  newReaderLoop(settings),
+		codec: codec,
+
+		readerLoop:  newReaderLoop(logger, settings, codec),
 		writerLoop:  newWriterLoop(logger, settings),
 		deleterLoop: newDeleterLoop(settings),
 
 		producerWriteRequestChan: make(chan producerWriteRequest),
+		drainedRequestChan:       make(chan chan bool),
 
 		done: make(chan struct{}),
 	}
@@ -223,6 +263,41 @@ func NewQueue(logger *logp.Logger, settings Settings) (queue.Queue, error) {
 	return queue, nil
 }
 
+// checkEncryptionKey verifies that the configured encryption key decrypts
+// the first frame of the encrypted segments.
+func checkEncryptionKey(
+	logger *logp.Logger,
+	settings Settings,
+	codec *frameCodec,
+	segments []*queueSegment,
+) error {
+	rl := newReaderLoop(logger, settings, codec)
+	for _, segment := range segments {
+		if segment.flags&segmentFlagEncrypted == 0 {
+			continue
+		}
+		path := settings.segmentPath(segment.id)
+		if codec.aead == nil {
+			return fmt.Errorf(
+				"segment %v is encrypted but no encryption key is configured", path)
+		}
+		handle, header, err := segment.getReader(settings)
+		if err != nil {
+			// The reader loop reports the errors of the segment file.
+			continue
+		}
+		data, _, err := rl.readFrameData(handle, uint64(segment.endOffset))
+		handle.Close()
+		if err != nil {
+			continue
+		}
+		if _, err := codec.decode(header.flags, data); errors.Is(err, errEncryptionKey) {
+			return fmt.Errorf("couldn't decrypt segment %v: %w", path, err)
+		}
+	}
+	return nil
+}
+
 //
 // diskQueue implementation of the queue.Queue interface
 //
@@ -232,10 +307,24 @@ func (dq *diskQueue) Close() error {
 	// shut down the other helper goroutines and wrap everything up.
 	close(dq.done)
 	dq.waitGroup.Wait()
+	dq.codec.close()
 
 	return nil
 }
 
+// Drained reports whether every frame written to the queue was handed to the
+// consumers or given up on by the reader, unlike the number of events
+// written it accounts for the frames that can't be read.
+func (dq *diskQueue) Drained() bool {
+	response := make(chan bool, 1)
+	select {
+	case dq.drainedRequestChan <- response:
+		return <-response
+	case <-dq.done:
+		return false
+	}
+}
+
 func (dq *diskQueue) BufferConfig() queue.BufferConfig {
 	return queue.BufferConfig{MaxEvents: 0}
 }
@@ -19,8 +19,12 @@ package diskqueue
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"os"
+
+	"github.com/elastic/beats/v7/libbeat/logp"
+	"github.com/elastic/beats/v7/libbeat/publisher"
 )
 
 type readerLoopRequest struct {
@@ -45,6 +49,9 @@ type readerLoopResponse struct {
 }
 
 type readerLoop struct {
+	// The logger for the queue that created this loop.
+	logger *logp.Logger
+
 	// The settings for the queue that created this loop.
 	settings Settings
 
@@ -65,16 +72,22 @@ type readerLoop struct {
 	// The helper object to deserialize binary blobs from the queue into
 	// publisher.Event objects that can be returned in a readFrame.
 	decoder *eventDecoder
+
+	// The codec to decrypt and decompress the frame data before it is
+	// deserialized.
+	codec *frameCodec
 }
 
-func newReaderLoop(settings Settings) *readerLoop {
+func newReaderLoop(logger *logp.Logger, settings Settings, codec *frameCodec) *readerLoop {
 	return &readerLoop{
+		logger:   logger,
 		settings: settings,
 
 		requestChan:  make(chan readerLoopRequest, 1),
 		responseChan: make(chan readerLoopResponse),
 		output:       make(chan *readFrame, settings.ReadAheadLimit),
 		decoder:      newEventDecoder(),
+		codec:        codec,
 	}
 }
 
@@ -97,13 +110,13 @@ func (rl *readerLoop) processRequest(request readerLoopRequest) readerLoopRespon
 	nextFrameID := request.startFrameID
 
 	// Open the file and seek to the starting position.
-	handle, err := request.segment.getReader(rl.settings)
+	handle, header, err := request.segment.getReader(rl.settings)
 	if err != nil {
 		return readerLoopResponse{err: err}
 	}
 	defer handle.Close()
 	_, err = handle.Seek(
-		segmentHeaderSize+int64(request.startOffset), os.SEEK_SET)
+		int64(request.segment.headerSize()+uint64(request.startOffset)), os.SEEK_SET)
 	if err != nil {
 		return readerLoopResponse{err: err}
 	}
@@ -115,7 +128,7 @@ func (rl *readerLoop) processRequest(request readerLoopRequest) readerLoopRespon
 		// Try to read the next frame, clipping to the given bound.
 		// If the next frame extends past this boundary, nextFrame will return
 		// an error.
-		frame, err := rl.nextFrame(handle, remainingLength)
+		frame, err := rl.nextFrame(handle, remainingLength, header.flags)
 		if frame != nil {
 			// Add the segment / frame ID, which nextFrame leaves blank.
 			frame.segment = request.segment
@@ -169,13 +182,55 @@ func (rl *readerLoop) processRequest(request readerLoopRequest) readerLoopRespon
 // nextFrame reads and decodes one frame from the given file handle, as long
 // it does not exceed the given length bound. The returned frame leaves the
 // segment and frame IDs unset.
+// Frames which are intact but can't be decoded are logged and skipped, their
+// size is included in the bytesOnDisk of the returned frame so the queue
+// position stays consistent. Frames that can't be decrypted stop the read,
+// since the whole segment is affected.
 // The returned error will be set if and only if the returned frame is nil.
 func (rl *readerLoop) nextFrame(
-	handle *os.File, maxLength uint64,
+	handle *os.File, maxLength uint64, flags uint32,
 ) (*readFrame, error) {
+	skipped := uint64(0)
+	for {
+		if skipped > 0 && skipped >= maxLength {
+			return nil, fmt.Errorf(
+				"Skipped %d bytes of undecodable data frames up to the end of the read region",
+				skipped)
+		}
+		data, frameLength, err := rl.readFrameData(handle, maxLength-skipped)
+		if err != nil {
+			return nil, err
+		}
+
+		event, err := rl.decodeFrame(flags, data)
+		if errors.Is(err, errEncryptionKey) {
+			return nil, err
+		}
+		if err != nil {
+			// Unlike errors in the segment or frame metadata, this is entirely
+			// a problem in the event decoding which is isolated to this frame
+			// (its checksum is valid), so we advance to the next frame.
+			rl.logger.Errorf("Skipping data frame that couldn't be decoded: %v", err)
+			skipped += frameLength
+			continue
+		}
+
+		frame := &readFrame{
+			event:       event,
+			bytesOnDisk: skipped + frameLength,
+		}
+		return frame, nil
+	}
+}
+
+// readFrameData reads the next frame from the given file handle and returns
+// its data after verifying the frame metadata and checksum.
+func (rl *readerLoop) readFrameData(
+	handle *os.File, maxLength uint64,
+) ([]byte, uint64, error) {
 	// Ensure we are allowed to read the frame header.
 	if maxLength < frameHeaderSize {
-		return nil, fmt.Errorf(
+		return nil, 0, fmt.Errorf(
 			"Can't read next frame: remaining length %d is too low", maxLength)
 	}
 	// Wrap the handle to retry non-fatal errors and always return the full
@@ -184,19 +239,19 @@ func (rl *readerLoop) nextFrame(
 	var frameLength uint32
 	err := binary.Read(reader, binary.LittleEndian, &frameLength)
 	if err != nil {
-		return nil, fmt.Errorf("Couldn't read data frame header: %w", err)
+		return nil, 0, fmt.Errorf("Couldn't read data frame header: %w", err)
 	}
 
 	// If the frame extends past the area we were told to read, return an error.
 	// This should never happen unless the segment file is corrupted.
 	if maxLength < uint64(frameLength) {
-		return nil, fmt.Errorf(
+		return nil, 0, fmt.Errorf(
 			"Can't read next frame: frame size is %d but remaining data is only %d",
 			frameLength, maxLength)
 	}
 	if frameLength <= frameMetadataSize {
 		// Valid enqueued data must have positive length
-		return nil, fmt.Errorf(
+		return nil, 0, fmt.Errorf(
 			"Data frame with no data (length %d)", frameLength)
 	}
 
@@ -205,47 +260,45 @@ func (rl *readerLoop) nextFrame(
 	bytes := rl.decoder.Buffer(int(dataLength))
 	_, err = reader.Read(bytes)
 	if err != nil {
-		return nil, fmt.Errorf("Couldn't read data frame content: %w", err)
+		return nil, 0, fmt.Errorf("Couldn't read data frame content: %w", err)
 	}
 
 	// Read the footer (checksum + duplicate length)
 	var checksum uint32
 	err = binary.Read(reader, binary.LittleEndian, &checksum)
 	if err != nil {
-		return nil, fmt.Errorf("Couldn't read data frame checksum: %w", err)
+		return nil, 0, fmt.Errorf("Couldn't read data frame checksum: %w", err)
 	}
 	expected := computeChecksum(bytes)
 	if checksum != expected {
-		return nil, fmt.Errorf(
+		return nil, 0, fmt.Errorf(
 			"Data frame checksum mismatch (%x != %x)", checksum, expected)
 	}
 
 	var duplicateLength uint32
 	err = binary.Read(reader, binary.LittleEndian, &duplicateLength)
 	if err != nil {
-		return nil, fmt.Errorf("Couldn't read data frame footer: %w", err)
+		return nil, 0, fmt.Errorf("Couldn't read data frame footer: %w", err)
 	}
 	if duplicateLength != frameLength {
-		return nil, fmt.Errorf(
+		return nil, 0, fmt.Errorf(
 			"Inconsistent data frame length (%d vs %d)",
 			frameLength, duplicateLength)
 	}
 
-	event, err := rl.decoder.Decode()
+	return bytes, uint64(frameLength), nil
+}
+
+// decodeFrame decrypts and decompresses the frame data according to the
+// segment flags, and deserializes the event.
+func (rl *readerLoop) decodeFrame(flags uint32, data []byte) (publisher.Event, error) {
+	data, err := rl.codec.decode(flags, data)
 	if err != nil {
-		// Unlike errors in the segment or frame metadata, this is entirely
-		// a problem in the event [de]serialization which may be isolated (i.e.
-		// may not indicate data corruption in the segment).
-		// TODO: Rather than pass this error back to the read request, which
-		// discards the rest of the segment, we should just log the error and
-		// advance to the next frame, which is likely still valid.
-		return nil, fmt.Errorf("Couldn't decode data frame: %w", err)
+		return publisher.Event{}, fmt.Errorf("Couldn't decode data frame: %w", err)
 	}
-
-	frame := &readFrame{
-		event:       event,
-		bytesOnDisk: uint64(frameLength),
+	event, err := rl.decoder.Decode(data)
+	if err != nil {
+		return publisher.Event{}, fmt.Errorf("Couldn't deserialize data frame: %w", err)
 	}
-
-	return frame, nil
+	return event, nil
 }
@@ -0,0 +1,406 @@
+package diskqueue
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/logp"
+	"github.com/elastic/beats/v7/libbeat/publisher"
+	"github.com/elastic/beats/v7/libbeat/publisher/queue"
+)
+
+func TestReadSegmentVersions(t *testing.T) {
+	tests := map[string]struct {
+		version     uint32
+		compression string
+		key         string
+	}{
+		"version 0":      {0, "", ""},
+		"uncompressed":   {1, CompressionNone, ""},
+		"zstd":           {1, CompressionZstd, ""},
+		"lz4":            {1, CompressionLZ4, ""},
+		"encrypted":      {1, CompressionNone, "secret"},
+		"zstd encrypted": {1, CompressionZstd, "secret"},
+		"lz4 encrypted":  {1, CompressionLZ4, "secret"},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			settings := testSettings(t)
+			settings.Compression = test.compression
+			settings.EncryptionKey = test.key
+			codec, err := newFrameCodec(settings)
+			require.NoError(t, err)
+
+			frames := encodeTestFrames(t, codec, 10)
+			header := &segmentHeader{version: test.version, flags: codec.flags}
+			writeTestSegment(t, settings, 1, header, frames)
+
+			segments, err := scanExistingSegments(logp.NewLogger("test"), settings.directoryPath())
+			require.NoError(t, err)
+			require.Len(t, segments, 1)
+			segment := segments[0]
+			assert.Equal(t, test.version, *segment.schemaVersion)
+			assert.Equal(t, frameBytes(frames), uint64(segment.endOffset))
+
+			events, response := readTestSegment(settings, codec, segment)
+			require.NoError(t, response.err)
+			assertTestEvents(t, events, 0, 10)
+			assert.Equal(t, uint64(10), response.frameCount)
+			assert.Equal(t, uint64(segment.endOffset), response.byteCount)
+		})
+	}
+}
+
+func TestLZ4Incompressible(t *testing.T) {
+	data := make([]byte, 1000)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+
+	compressed := compressLZ4(data)
+	assert.Len(t, compressed, lz4HeaderSize+len(data))
+	decompressed, err := decompressLZ4(compressed)
+	require.NoError(t, err)
+	assert.Equal(t, data, decompressed)
+}
+
+func TestScanCorruptedSegments(t *testing.T) {
+	settings := testSettings(t)
+	codec, err := newFrameCodec(settings)
+	require.NoError(t, err)
+	frames := encodeTestFrames(t, codec, 2)
+
+	writeTestSegment(t, settings, 1, &segmentHeader{version: 1}, frames)
+	// unknown schema version
+	writeTestSegment(t, settings, 2, &segmentHeader{version: 7}, frames)
+	// unknown flags
+	writeTestSegment(t, settings, 3, &segmentHeader{version: 1, flags: 1 << 10}, frames)
+	// both compressions
+	writeTestSegment(t, settings, 4, &segmentHeader{version: 1, flags: segmentFlagZstd | segmentFlagLZ4}, frames)
+	// a truncated header
+	require.NoError(t, ioutil.WriteFile(settings.segmentPath(5), []byte{1, 0, 0, 0, 0}, 0600))
+	// header only
+	writeTestSegment(t, settings, 6, &segmentHeader{version: 1}, nil)
+
+	segments, err := scanExistingSegments(logp.NewLogger("test"), settings.directoryPath())
+	require.NoError(t, err)
+	require.Len(t, segments, 1)
+	assert.Equal(t, segmentID(1), segments[0].id)
+
+	// The segments with an unreadable header are kept aside.
+	for id := segmentID(2); id <= 5; id++ {
+		assert.NoFileExists(t, settings.segmentPath(id))
+		assert.FileExists(t, settings.segmentPath(id)+unreadableSegmentSuffix)
+	}
+	segments, err = scanExistingSegments(logp.NewLogger("test"), settings.directoryPath())
+	require.NoError(t, err)
+	assert.Len(t, segments, 1)
+}
+
+func TestReadCorruptedFrames(t *testing.T) {
+	settings := testSettings(t)
+	settings.Compression = CompressionZstd
+	settings.EncryptionKey = "secret"
+	codec, err := newFrameCodec(settings)
+	require.NoError(t, err)
+	header := &segmentHeader{version: 1, flags: codec.flags}
+
+	t.Run("checksum mismatch discards the rest of the segment", func(t *testing.T) {
+		frames := encodeTestFrames(t, codec, 5)
+		path := writeTestSegment(t, settings, 1, header, frames)
+		corruptByte(t, path, int64(segmentHeaderSize+frameBytes(frames[:2])+frameHeaderSize))
+
+		events, response := readTestSegment(settings, codec, &queueSegment{
+			id: 1, endOffset: segmentOffset(frameBytes(frames)),
+		})
+		assert.Error(t, response.err)
+		assertTestEvents(t, events, 0, 2)
+		assert.Equal(t, frameBytes(frames[:2]), response.byteCount)
+	})
+
+	t.Run("truncated segment", func(t *testing.T) {
+		frames := encodeTestFrames(t, codec, 5)
+		path := writeTestSegment(t, settings, 1, header, frames)
+		size := segmentHeaderSize + frameBytes(frames[:3]) + 6
+		require.NoError(t, os.Truncate(path, int64(size)))
+
+		events, response := readTestSegment(settings, codec, &queueSegment{
+			id: 1, endOffset: segmentOffset(frameBytes(frames)),
+		})
+		assert.Error(t, response.err)
+		assertTestEvents(t, events, 0, 3)
+	})
+
+	t.Run("undecodable frames are skipped", func(t *testing.T) {
+		frames := encodeTestFrames(t, codec, 5)
+		frames[2] = []byte("not an encrypted frame")
+		writeTestSegment(t, settings, 1, header, frames)
+
+		events, response := readTestSegment(settings, codec, &queueSegment{
+			id: 1, endOffset: segmentOffset(frameBytes(frames)),
+		})
+		require.NoError(t, response.err)
+		require.Len(t, events, 4)
+		assert.Equal(t, 0, testEventIndex(t, events[0]))
+		assert.Equal(t, 1, testEventIndex(t, events[1]))
+		assert.Equal(t, 3, testEventIndex(t, events[2]))
+		assert.Equal(t, 4, testEventIndex(t, events[3]))
+		assert.Equal(t, uint64(4), response.frameCount)
+		assert.Equal(t, frameBytes(frames), response.byteCount)
+	})
+
+	t.Run("frames failing authentication stop the read", func(t *testing.T) {
+		frames := encodeTestFrames(t, codec, 5)
+		// A frame with a valid checksum but corrupted ciphertext.
+		frames[1][len(frames[1])-1] ^= 0xff
+		writeTestSegment(t, settings, 1, header, frames)
+
+		events, response := readTestSegment(settings, codec, &queueSegment{
+			id: 1, endOffset: segmentOffset(frameBytes(frames)),
+		})
+		assert.True(t, errors.Is(response.err, errEncryptionKey))
+		assertTestEvents(t, events, 0, 1)
+		assert.Equal(t, frameBytes(frames[:1]), response.byteCount)
+	})
+
+	t.Run("missing encryption key", func(t *testing.T) {
+		frames := encodeTestFrames(t, codec, 3)
+		writeTestSegment(t, settings, 1, header, frames)
+
+		plain, err := newFrameCodec(testSettings(t))
+		require.NoError(t, err)
+		events, response := readTestSegment(settings, plain, &queueSegment{
+			id: 1, endOffset: segmentOffset(frameBytes(frames)),
+		})
+		assert.True(t, errors.Is(response.err, errEncryptionKey))
+		assert.Empty(t, events)
+		assert.Equal(t, uint64(0), response.byteCount)
+	})
+}
+
+func TestQueueEncryptionKeyMismatch(t *testing.T) {
+	settings := testSettings(t)
+	settings.EncryptionKey = "secret"
+	publishTestEvents(t, settings, 0, 20)
+	segments, err := scanExistingSegments(logp.NewLogger("test"), settings.directoryPath())
+	require.NoError(t, err)
+	require.NotEmpty(t, segments)
+
+	for _, key := range []string{"", "other"} {
+		settings.EncryptionKey = key
+		_, err := NewQueue(logp.NewLogger("test"), settings)
+		assert.Error(t, err, "key %q", key)
+	}
+
+	// Nothing was deleted, the events are read with the right key.
+	for _, segment := range segments {
+		assert.FileExists(t, settings.segmentPath(segment.id))
+	}
+	settings.EncryptionKey = "secret"
+	q, err := NewQueue(logp.NewLogger("test"), settings)
+	require.NoError(t, err)
+	defer q.Close()
+	consumer := q.Consumer()
+	var events []publisher.Event
+	for len(events) < 20 {
+		batch, err := consumer.Get(20 - len(events))
+		require.NoError(t, err)
+		events = append(events, batch.Events()...)
+	}
+	assertTestEvents(t, events, 0, 20)
+}
+
+func TestQueueDecryptionFailureKeepsSegment(t *testing.T) {
+	settings := testSettings(t)
+	settings.EncryptionKey = "secret"
+	codec, err := newFrameCodec(settings)
+	require.NoError(t, err)
+	frames := encodeTestFrames(t, codec, 10)
+	frames[5][len(frames[5])-1] ^= 0xff
+	path := writeTestSegment(t, settings, 1, &segmentHeader{version: 1, flags: codec.flags}, frames)
+
+	q, err := NewQueue(logp.NewLogger("test"), settings)
+	require.NoError(t, err)
+	defer q.Close()
+	consumer := q.Consumer()
+	var events []publisher.Event
+	for len(events) < 5 {
+		batch, err := consumer.Get(10)
+		require.NoError(t, err)
+		events = append(events, batch.Events()...)
+		batch.ACK()
+	}
+	assertTestEvents(t, events, 0, 5)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := os.Stat(path + unreadableSegmentSuffix); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.FileExists(t, path+unreadableSegmentSuffix)
+	assert.NoFileExists(t, path)
+}
+
+func TestQueueChangedCodec(t *testing.T) {
+	settings := testSettings(t)
+	settings.Compression = CompressionZstd
+	settings.EncryptionKey = "secret"
+	publishTestEvents(t, settings, 0, 20)
+
+	// The segments of the previous settings remain readable.
+	settings.Compression = CompressionLZ4
+	publishTestEvents(t, settings, 20, 20)
+
+	q, err := NewQueue(logp.NewLogger("test"), settings)
+	require.NoError(t, err)
+	defer q.Close()
+	consumer := q.Consumer()
+	var events []publisher.Event
+	for len(events) < 40 {
+		batch, err := consumer.Get(40 - len(events))
+		require.NoError(t, err)
+		events = append(events, batch.Events()...)
+		batch.ACK()
+	}
+	assertTestEvents(t, events, 0, 40)
+}
+
+func testSettings(t *testing.T) Settings {
+	dir, err := ioutil.TempDir("", "diskqueue")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	settings := DefaultSettings()
+	settings.Path = dir
+	settings.ReadAheadLimit = 100
+	return settings
+}
+
+func encodeTestFrames(t *testing.T, codec *frameCodec, count int) [][]byte {
+	encoder := newEventEncoder()
+	frames := make([][]byte, count)
+	for i := range frames {
+		serialized, err := encoder.encode(testEvent(i))
+		require.NoError(t, err)
+		frames[i], err = codec.encode(serialized)
+		require.NoError(t, err)
+	}
+	return frames
+}
+
+func testEvent(i int) *publisher.Event {
+	return &publisher.Event{Content: beat.Event{
+		Timestamp: time.Now(),
+		Fields: common.MapStr{
+			"index":   i,
+			"message": strings.Repeat(string('a'+rune(i%26)), 100+i),
+		},
+	}}
+}
+
+// writeTestSegment writes the segment file the way the writer loop does.
+func writeTestSegment(t *testing.T, settings Settings, id segmentID, header *segmentHeader, frames [][]byte) string {
+	var buf bytes.Buffer
+	require.NoError(t, writeSegmentHeader(&buf, header))
+	for _, frame := range frames {
+		frameSize := uint32(len(frame) + frameMetadataSize)
+		binary.Write(&buf, binary.LittleEndian, frameSize)
+		buf.Write(frame)
+		binary.Write(&buf, binary.LittleEndian, computeChecksum(frame))
+		binary.Write(&buf, binary.LittleEndian, frameSize)
+	}
+	path := settings.segmentPath(id)
+	require.NoError(t, ioutil.WriteFile(path, buf.Bytes(), 0600))
+	return path
+}
+
+func frameBytes(frames [][]byte) uint64 {
+	size := uint64(0)
+	for _, frame := range frames {
+		size += uint64(len(frame) + frameMetadataSize)
+	}
+	return size
+}
+
+func corruptByte(t *testing.T, path string, offset int64) {
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	data[offset] ^= 0xff
+	require.NoError(t, ioutil.WriteFile(path, data, 0600))
+}
+
+func readTestSegment(settings Settings, codec *frameCodec, segment *queueSegment) ([]publisher.Event, readerLoopResponse) {
+	rl := newReaderLoop(logp.NewLogger("test"), settings, codec)
+	response := rl.processRequest(readerLoopRequest{
+		segment:   segment,
+		endOffset: segment.endOffset,
+	})
+	close(rl.output)
+	var events []publisher.Event
+	for frame := range rl.output {
+		events = append(events, frame.event)
+	}
+	return events, response
+}
+
+func publishTestEvents(t *testing.T, settings Settings, from, count int) {
+	written := make(chan int, count)
+	settings.WriteToDiskListener = ackListener(func(n int) { written <- n })
+	q, err := NewQueue(logp.NewLogger("test"), settings)
+	require.NoError(t, err)
+	defer q.Close()
+
+	producer := q.Producer(queue.ProducerConfig{})
+	for i := from; i < from+count; i++ {
+		require.True(t, producer.Publish(*testEvent(i)))
+	}
+	for n := 0; n < count; {
+		select {
+		case acked := <-written:
+			n += acked
+		case <-time.After(10 * time.Second):
+			t.Fatalf("only %d of %d events were written", n, count)
+		}
+	}
+}
+
+type ackListener func(int)
+
+func (l ackListener) OnACK(n int) { l(n) }
+
+func testEventIndex(t *testing.T, event publisher.Event) int {
+	index, err := event.Content.Fields.GetValue("index")
+	require.NoError(t, err)
+	switch v := index.(type) {
+	case int:
+		return v
+	case uint64:
+		return int(v)
+	case int64:
+		return int(v)
+	}
+	t.Fatalf("unexpected index %v (%T)", index, index)
+	return 0
+}
+
+func assertTestEvents(t *testing.T, events []publisher.Event, from, count int) {
+	require.Len(t, events, count)
+	for i, event := range events {
+		assert.Equal(t, from+i, testEventIndex(t, event))
+		message, _ := event.Content.Fields.GetValue("message")
+		assert.Len(t, message, 100+from+i)
+	}
+}
@@ -20,11 +20,15 @@ package diskqueue
 import (
 	"encoding/binary"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
+
+	"github.com/elastic/beats/v7/libbeat/logp"
 )
 
 // diskQueueSegments encapsulates segment-related queue metadata.
@@ -91,10 +95,19 @@ type queueSegment struct {
 	// A segment id is globally unique within its originating queue.
 	id segmentID
 
+	// The schema version of the segment header, read when scanning the
+	// existing segments. If this is nil, the segment is written in this
+	// session with the current schema version.
+	schemaVersion *uint32
+
+	// The flags of the segment header, read when scanning the existing
+	// segments.
+	flags uint32
+
 	// The byte offset of the end of the segment's data region. This is
 	// updated when the segment is written to, and should always correspond
 	// to the end of a complete data frame. The total size of a segment file
-	// on disk is segmentHeaderSize + segment.endOffset.
+	// on disk is segment.headerSize() + segment.endOffset.
 	endOffset segmentOffset
 
 	// The ID of the first frame that was / will be read from this segment.
@@ -112,12 +125,21 @@ type queueSegment struct {
 	framesRead uint64
 }
 
+// segmentHeader is the header at the start of each segment file. Version 0
+// headers are just the version, version 1 adds the flags of the encoding of
+// the frame data (see codec.go).
 type segmentHeader struct {
 	version uint32
+	flags   uint32
 }
 
-// Segment headers are currently just a 32-bit version.
-const segmentHeaderSize = 4
+// The current schema version of new segments.
+const currentSchemaVersion = 1
+
+// The size of the header of the current schema version, the header of
+// version 0 segments is segmentHeaderSizeV0.
+const segmentHeaderSize = 8
+const segmentHeaderSizeV0 = 4
 
 // Sort order: we store loaded segments in ascending order by their id.
 type bySegmentID []*queueSegment
@@ -126,9 +148,13 @@ func (s bySegmentID) Len() int           { return len(s) }
 func (s bySegmentID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
 func (s bySegmentID) Less(i, j int) bool { return s[i].id < s[j].id }
 
+// The suffix of the segment files moved aside because they can't be read,
+// they are no longer scanned or deleted by the queue.
+const unreadableSegmentSuffix = ".unreadable"
+
 // Scan the given path for segment files, and return them in a list
 // ordered by segment id.
-func scanExistingSegments(path string) ([]*queueSegment, error) {
+func scanExistingSegments(logger *logp.Logger, path string) ([]*queueSegment, error) {
 	files, err := ioutil.ReadDir(path)
 	if err != nil {
 		return nil, fmt.Errorf("Couldn't read queue directory '%s': %w", path, err)
@@ -136,52 +162,86 @@ func scanExistingSegments(path string) ([]*queueSegment, error) {
 
 	segments := []*queueSegment{}
 	for _, file := range files {
-		if file.Size() <= segmentHeaderSize {
+		components := strings.Split(file.Name(), ".")
+		if len(components) != 2 || strings.ToLower(components[1]) != "seg" {
+			continue
+		}
+		// Parse the id as base-10 64-bit unsigned int. We ignore file names that
+		// don't match the "[uint64].seg" pattern.
+		id, err := strconv.ParseUint(components[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		// Move aside segments whose header can't be read (a corrupted or
+		// unsupported header), the frames can't be decoded without it.
+		segmentPath := filepath.Join(path, file.Name())
+		header, err := readSegmentHeaderFromPath(segmentPath)
+		if err != nil {
+			logger.Errorf("Couldn't read the header of segment %v: %v", segmentPath, err)
+			moveSegmentAside(logger, segmentPath)
+			continue
+		}
+		segment := &queueSegment{
+			id:            segmentID(id),
+			schemaVersion: &header.version,
+			flags:         header.flags,
+		}
+		if file.Size() <= int64(segment.headerSize()) {
 			// Ignore segments that don't have at least some data beyond the
 			// header (this will always be true of segments we write unless there
 			// is an error).
 			continue
 		}
-		components := strings.Split(file.Name(), ".")
-		if len(components) == 2 && strings.ToLower(components[1]) == "seg" {
-			// Parse the id as base-10 64-bit unsigned int. We ignore file names that
-			// don't match the "[uint64].seg" pattern.
-			if id, err := strconv.ParseUint(components[0], 10, 64); err == nil {
-				segments = append(segments,
-					&queueSegment{
-						id:        segmentID(id),
-						endOffset: segmentOffset(file.Size() - segmentHeaderSize),
-					})
-			}
-		}
+		segment.endOffset = segmentOffset(file.Size() - int64(segment.headerSize()))
+		segments = append(segments, segment)
 	}
 	sort.Sort(bySegmentID(segments))
 	return segments, nil
 }
 
+// moveSegmentAside renames a segment file which can't be read, so it is kept
+// on disk for inspection but no longer read or deleted by the queue.
+func moveSegmentAside(logger *logp.Logger, path string) {
+	asidePath := path + unreadableSegmentSuffix
+	if err := os.Rename(path, asidePath); err != nil {
+		logger.Errorf("Couldn't move unreadable segment %v aside: %v", path, err)
+		return
+	}
+	logger.Warnf("Moved unreadable segment %v to %v", path, asidePath)
+}
+
+// headerSize returns the size of the segment header on disk, which depends
+// on the schema version of the segment.
+func (segment *queueSegment) headerSize() uint64 {
+	if segment.schemaVersion != nil && *segment.schemaVersion == 0 {
+		return segmentHeaderSizeV0
+	}
+	return segmentHeaderSize
+}
+
 func (segment *queueSegment) sizeOnDisk() uint64 {
-	return uint64(segment.endOffset) + segmentHeaderSize
+	return uint64(segment.endOffset) + segment.headerSize()
 }
 
-// Should only be called from the reader loop.
+// Should only be called from the reader loop. The returned file is
+// positioned at the start of the data region, the header describes the
+// encoding of the frames.
 func (segment *queueSegment) getReader(
 	queueSettings Settings,
-) (*os.File, error) {
+) (*os.File, *segmentHeader, error) {
 	path := queueSettings.segmentPath(segment.id)
 	file, err := os.Open(path)
 	if err != nil {
-		return nil, fmt.Errorf(
+		return nil, nil, fmt.Errorf(
 			"Couldn't open segment %d: %w", segment.id, err)
 	}
-	// Right now there is only one valid header (indicating schema version
-	// zero) so we don't need the value itself.
-	_, err = readSegmentHeader(file)
+	header, err := readSegmentHeader(file)
 	if err != nil {
 		file.Close()
-		return nil, fmt.Errorf("Couldn't read segment header: %w", err)
+		return nil, nil, fmt.Errorf("Couldn't read segment header: %w", err)
 	}
 
-	return file, nil
+	return file, header, nil
 }
 
 // Should only be called from the writer loop.
@@ -193,7 +253,10 @@ func (segment *queueSegment) getWriter(
 	if err != nil {
 		return nil, err
 	}
-	header := &segmentHeader{version: 0}
+	header := &segmentHeader{
+		version: currentSchemaVersion,
+		flags:   queueSettings.segmentFlags,
+	}
 	err = writeSegmentHeader(file, header)
 	if err != nil {
 		return nil, fmt.Errorf("Couldn't write segment header: %w", err)
@@ -222,20 +285,44 @@ func (segment *queueSegment) getWriterWithRetry(
 	return file, err
 }
 
-func readSegmentHeader(in *os.File) (*segmentHeader, error) {
+func readSegmentHeaderFromPath(path string) (*segmentHeader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return readSegmentHeader(file)
+}
+
+func readSegmentHeader(in io.Reader) (*segmentHeader, error) {
 	header := &segmentHeader{}
 	err := binary.Read(in, binary.LittleEndian, &header.version)
 	if err != nil {
 		return nil, err
 	}
-	if header.version != 0 {
+	switch header.version {
+	case 0:
+		// Version 0 segments hold plain JSON frames.
+	case 1:
+		err = binary.Read(in, binary.LittleEndian, &header.flags)
+		if err != nil {
+			return nil, err
+		}
+		if header.flags&^segmentFlagsKnown != 0 ||
+			header.flags&segmentFlagsCompression == segmentFlagsCompression {
+			return nil, fmt.Errorf("Unrecognized segment flags %x", header.flags)
+		}
+	default:
 		return nil, fmt.Errorf("Unrecognized schema version %d", header.version)
 	}
 	return header, nil
 }
 
-func writeSegmentHeader(out *os.File, header *segmentHeader) error {
+func writeSegmentHeader(out io.Writer, header *segmentHeader) error {
 	err := binary.Write(out, binary.LittleEndian, header.version)
+	if err == nil && header.version > 0 {
+		err = binary.Write(out, binary.LittleEndian, header.flags)
+	}
 	return err
 }
 
@@ -257,3 +344,68 @@ func (segments *diskQueueSegments) sizeOnDisk() uint64 {
 	}
 	return total
 }
+
+// PendingFrameCount returns the number of frames in the queue at the path of
+// the given settings which have not been acknowledged yet, by scanning the
+// frame headers of the existing segments. It must not be called while a
+// queue is open on the path.
+func PendingFrameCount(settings Settings) (uint64, error) {
+	if _, err := os.Stat(settings.directoryPath()); os.IsNotExist(err) {
+		return 0, nil
+	}
+	// Without a valid position the queue starts at the oldest segment.
+	position, _ := queuePositionFromPath(settings.stateFilePath())
+	segments, err := scanExistingSegments(logp.NewLogger("diskqueue"), settings.directoryPath())
+	if err != nil {
+		return 0, err
+	}
+
+	count := uint64(0)
+	for _, segment := range segments {
+		if segment.id < position.segmentID {
+			continue
+		}
+		startOffset := segmentOffset(0)
+		if segment.id == position.segmentID {
+			startOffset = position.offset
+		}
+		frames, err := segment.countFrames(settings, startOffset)
+		if err != nil {
+			return 0, err
+		}
+		count += frames
+	}
+	return count, nil
+}
+
+// countFrames counts the frames from the given offset to the end of the
+// segment or up to the first inconsistent frame length.
+func (segment *queueSegment) countFrames(
+	settings Settings, offset segmentOffset,
+) (uint64, error) {
+	file, _, err := segment.getReader(settings)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	count := uint64(0)
+	for offset+frameMetadataSize <= segment.endOffset {
+		_, err = file.Seek(int64(segment.headerSize()+uint64(offset)), io.SeekStart)
+		if err != nil {
+			return 0, err
+		}
+		var frameLength uint32
+		err = binary.Read(file, binary.LittleEndian, &frameLength)
+		if err != nil {
+			return 0, err
+		}
+		if frameLength <= frameMetadataSize ||
+			offset+segmentOffset(frameLength) > segment.endOffset {
+			break
+		}
+		count++
+		offset += segmentOffset(frameLength)
+	}
+	return count, nil
+}
@@ -127,7 +127,9 @@ func (d *eventDecoder) Buffer(n int) []byte {
 	return d.buf
 }
 
-func (d *eventDecoder) Decode() (publisher.Event, error) {
+// Decode deserializes the event of the given data, which is the buffer of
+// Buffer or the data decoded from it.
+func (d *eventDecoder) Decode(data []byte) (publisher.Event, error) {
 	var (
 		to  entry
 		err error
@@ -136,7 +138,7 @@ func (d *eventDecoder) Decode() (publisher.Event, error) {
 	d.unfolder.SetTarget(&to)
 	defer d.unfolder.Reset()
 
-	err = d.parser.Parse(d.buf)
+	err = d.parser.Parse(data)
 
 	if err != nil {
 		d.reset() // reset parser just in case
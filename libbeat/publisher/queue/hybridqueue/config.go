@@ -0,0 +1,57 @@
+package hybridqueue
+
+import (
+	"errors"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/common"
+)
+
+type config struct {
+	Mem   memConfig      `config:"mem"`
+	Disk  *common.Config `config:"disk" validate:"required"`
+	Spill spillConfig    `config:"spill"`
+}
+
+// memConfig are the settings of the memory queue, as queue.mem.
+type memConfig struct {
+	Events         int           `config:"events" validate:"min=32"`
+	FlushMinEvents int           `config:"flush.min_events" validate:"min=0"`
+	FlushTimeout   time.Duration `config:"flush.timeout"`
+}
+
+type spillConfig struct {
+	// Occupancy is the ratio of the memory queue in use from which new
+	// events are spilled to disk.
+	Occupancy float64 `config:"occupancy"`
+
+	// MaxAge spills new events to disk once the oldest event in memory waits
+	// longer than MaxAge for the output, 0 disables it.
+	MaxAge time.Duration `config:"max_age" validate:"min=0"`
+}
+
+var defaultConfig = config{
+	Mem: memConfig{
+		Events:         4 * 1024,
+		FlushMinEvents: 2 * 1024,
+		FlushTimeout:   1 * time.Second,
+	},
+	Spill: spillConfig{
+		Occupancy: 0.8,
+		MaxAge:    30 * time.Second,
+	},
+}
+
+func (c *memConfig) Validate() error {
+	if c.FlushMinEvents > c.Events {
+		return errors.New("mem.flush.min_events must be less events")
+	}
+	return nil
+}
+
+func (c *spillConfig) Validate() error {
+	if c.Occupancy <= 0 || c.Occupancy > 1 {
+		return errors.New("spill.occupancy must be in (0, 1]")
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package hybridqueue
+
+import (
+	"errors"
+	"io"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/common/atomic"
+	"github.com/elastic/beats/v7/libbeat/publisher"
+	"github.com/elastic/beats/v7/libbeat/publisher/queue"
+)
+
+type consumer struct {
+	queue  *hybridQueue
+	done   chan struct{}
+	closed atomic.Bool
+}
+
+// source is the consumer of the memory or disk queue. A get is left pending
+// when the consumer has to choose the source again, the next get of the
+// source takes its result.
+type source struct {
+	consumer queue.Consumer
+	disk     bool
+	pending  chan getResult
+}
+
+type getResult struct {
+	batch queue.Batch
+	err   error
+}
+
+type batch struct {
+	queue *hybridQueue
+	inner queue.Batch
+	disk  bool
+}
+
+func newConsumer(q *hybridQueue) *consumer {
+	return &consumer{queue: q, done: make(chan struct{})}
+}
+
+func (c *consumer) Get(sz int) (queue.Batch, error) {
+	if c.closed.Load() {
+		return nil, io.EOF
+	}
+
+	// Only one consumer reads at a time, so the events are read from the
+	// sources in order.
+	q := c.queue
+	select {
+	case q.getSem <- struct{}{}:
+	case <-c.done:
+		return nil, io.EOF
+	case <-q.done:
+		return nil, io.EOF
+	}
+	defer func() { <-q.getSem }()
+
+	for {
+		src, n, changed := q.nextSource(sz)
+
+		var drainCheck <-chan time.Time
+		var leftover <-chan getResult
+		if src.disk {
+			drainCheck = time.After(drainCheckInterval)
+		} else if !q.isSpilling() {
+			// A get of the disk left pending when the disk was found drained
+			// may still return the events it took.
+			leftover = q.diskSrc.pending
+		}
+
+		select {
+		case res := <-src.get(n):
+			src.pending = nil
+			if res.err != nil {
+				return nil, res.err
+			}
+			return q.consumed(src, res.batch), nil
+		case res := <-leftover:
+			if q.isSpilling() {
+				// Events were spilled since, the events of the result are
+				// read in their turn.
+				q.diskSrc.pending = readyResult(res)
+				continue
+			}
+			q.diskSrc.pending = nil
+			if res.err != nil {
+				return nil, res.err
+			}
+			return q.consumed(q.diskSrc, res.batch), nil
+		case <-drainCheck:
+			q.checkDrained()
+		case <-changed:
+		case <-c.done:
+			return nil, io.EOF
+		case <-q.done:
+			return nil, io.EOF
+		}
+	}
+}
+
+func (c *consumer) Close() error {
+	if c.closed.Swap(true) {
+		return errors.New("already closed")
+	}
+	close(c.done)
+	return nil
+}
+
+func (s *source) get(n int) <-chan getResult {
+	if s.pending == nil {
+		pending := make(chan getResult, 1)
+		s.pending = pending
+		go func() {
+			b, err := s.consumer.Get(n)
+			pending <- getResult{batch: b, err: err}
+		}()
+	}
+	return s.pending
+}
+
+func readyResult(res getResult) chan getResult {
+	ready := make(chan getResult, 1)
+	ready <- res
+	return ready
+}
+
+func (q *hybridQueue) consumed(src *source, inner queue.Batch) queue.Batch {
+	n := len(inner.Events())
+	if src.disk {
+		q.consumedDisk(uint64(n), true)
+	} else {
+		q.consumedMem(n)
+	}
+	return &batch{queue: q, inner: inner, disk: src.disk}
+}
+
+func (b *batch) Events() []publisher.Event {
+	return b.inner.Events()
+}
+
+func (b *batch) ACK() {
+	n := len(b.inner.Events())
+	b.inner.ACK()
+	if !b.disk {
+		b.queue.ackedMem(n)
+		return
+	}
+	// The memory queue notifies the listener itself.
+	if b.queue.settings.ACKListener != nil {
+		b.queue.settings.ACKListener.OnACK(n)
+	}
+}
@@ -0,0 +1,154 @@
+package hybridqueue
+
+import (
+	"sync"
+
+	"github.com/elastic/beats/v7/libbeat/publisher"
+	"github.com/elastic/beats/v7/libbeat/publisher/queue"
+)
+
+type producer struct {
+	queue *hybridQueue
+	mem   queue.Producer
+	disk  queue.Producer
+
+	// nil if the producer has no ACK callback.
+	acks *producerACKs
+}
+
+func newProducer(q *hybridQueue, cfg queue.ProducerConfig) *producer {
+	p := &producer{queue: q}
+	memCfg, diskCfg := cfg, cfg
+	if cfg.ACK != nil {
+		// The memory queue acknowledges the events once the output
+		// acknowledged them, the disk queue once they are written, so the
+		// ACKs are merged in the order the events were published.
+		p.acks = &producerACKs{cb: cfg.ACK}
+		memCfg.ACK = func(n int) { p.acks.ack(false, n) }
+		diskCfg.ACK = func(n int) { p.acks.ack(true, n) }
+	}
+	p.mem = q.mem.Producer(memCfg)
+	p.disk = q.disk.Producer(diskCfg)
+	return p
+}
+
+func (p *producer) Publish(event publisher.Event) bool {
+	return p.publish(event, true)
+}
+
+func (p *producer) TryPublish(event publisher.Event) bool {
+	return p.publish(event, false)
+}
+
+func (p *producer) publish(event publisher.Event, block bool) bool {
+	toDisk := p.queue.reserve()
+	target := p.mem
+	if toDisk {
+		target = p.disk
+	}
+	if p.acks != nil {
+		p.acks.add(toDisk)
+	}
+
+	var ok bool
+	if block {
+		ok = target.Publish(event)
+	} else {
+		ok = target.TryPublish(event)
+	}
+	if toDisk {
+		p.queue.publishedDisk()
+	}
+	if !ok {
+		if p.acks != nil {
+			p.acks.removeLast()
+		}
+		p.queue.release(toDisk)
+		return false
+	}
+	if toDisk {
+		p.queue.metrics.spilled.Inc()
+	}
+	return true
+}
+
+func (p *producer) Cancel() int {
+	dropped := p.mem.Cancel()
+	if dropped > 0 {
+		p.queue.removeMem(dropped)
+	}
+	return dropped + p.disk.Cancel()
+}
+
+// producerACKs merges the ACKs of the memory and disk queue, so the events
+// of a producer are acknowledged in the order they were published.
+type producerACKs struct {
+	mu sync.Mutex
+	cb func(int)
+
+	// The consecutive runs of events published to the same queue which are
+	// not acknowledged yet.
+	runs []ackRun
+	// The number of events acknowledged by the memory and disk queue which
+	// wait for an earlier run.
+	acked [2]int
+}
+
+type ackRun struct {
+	disk   bool
+	events int
+}
+
+func (a *producerACKs) add(disk bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if n := len(a.runs); n > 0 && a.runs[n-1].disk == disk {
+		a.runs[n-1].events++
+		return
+	}
+	a.runs = append(a.runs, ackRun{disk: disk, events: 1})
+}
+
+func (a *producerACKs) removeLast() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	last := len(a.runs) - 1
+	a.runs[last].events--
+	if a.runs[last].events == 0 {
+		a.runs = a.runs[:last]
+	}
+}
+
+// ack is called by both queues, the callback is called with mu held so
+// it is never called concurrently.
+func (a *producerACKs) ack(disk bool, n int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.acked[index(disk)] += n
+	released := 0
+	for len(a.runs) > 0 {
+		run := &a.runs[0]
+		acked := &a.acked[index(run.disk)]
+		count := run.events
+		if *acked < count {
+			count = *acked
+		}
+		*acked -= count
+		run.events -= count
+		released += count
+		if run.events > 0 {
+			break
+		}
+		a.runs = a.runs[1:]
+	}
+	if released > 0 {
+		a.cb(released)
+	}
+}
+
+func index(disk bool) int {
+	if disk {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,419 @@
+// Package hybridqueue implements a queue keeping the events in memory while
+// the output keeps up, and spilling new events to a disk queue once the
+// memory queue fills up or its events get too old. The spilled events are
+// drained in order before new events are kept in memory again.
+package hybridqueue
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/feature"
+	"github.com/elastic/beats/v7/libbeat/logp"
+	"github.com/elastic/beats/v7/libbeat/monitoring"
+	"github.com/elastic/beats/v7/libbeat/publisher/queue"
+	"github.com/elastic/beats/v7/libbeat/publisher/queue/diskqueue"
+	"github.com/elastic/beats/v7/libbeat/publisher/queue/memqueue"
+)
+
+// Settings contains the settings to create a hybrid queue.
+//
+// The events in memory are acknowledged to the producers once the output
+// acknowledged them, the spilled events once they are written to disk: an
+// input may then consider a spilled event sent while it is only on disk,
+// so the spilled events survive a restart but not the loss of Disk.Path.
+type Settings struct {
+	// ACKListener is notified when the events are acknowledged by the
+	// consumers, the ACKListener of Mem and the WriteToDiskListener of Disk
+	// are replaced.
+	ACKListener queue.ACKListener
+
+	Mem  memqueue.Settings
+	Disk diskqueue.Settings
+
+	// SpillOccupancy is the ratio of Mem.Events in use from which new events
+	// are spilled to disk.
+	SpillOccupancy float64
+
+	// SpillMaxAge spills new events to disk once the oldest event in memory
+	// waits longer than SpillMaxAge, 0 disables it.
+	SpillMaxAge time.Duration
+}
+
+type hybridQueue struct {
+	logger   *logp.Logger
+	settings Settings
+
+	mem  queue.Queue
+	disk queue.Queue
+	// drainer is the disk queue, nil if it can't tell whether it is drained.
+	drainer drainer
+
+	// The sources of the consumers, they are only used while holding getSem
+	// so the pending gets are passed on between consumers.
+	getSem  chan struct{}
+	memSrc  *source
+	diskSrc *source
+
+	mu sync.Mutex
+	// spilling is true while new events are written to disk, until all the
+	// events on disk are drained.
+	spilling bool
+	// memEvents is the number of events in memory not yet consumed, with
+	// their publish times in memTimes.
+	memEvents int
+	memTimes  []time.Time
+	// memActive is the number of events in memory not yet acknowledged.
+	memActive int
+	// diskEvents is the number of events on disk not yet consumed. It
+	// includes the frames the disk queue skips because they can't be read,
+	// so the disk queue is asked whether it is drained once it has nothing
+	// left to read.
+	diskEvents uint64
+	// diskPublishing is the number of events being published to disk, and
+	// diskPublishes the total number of events published to disk.
+	diskPublishing int
+	diskPublishes  uint64
+	// changed is closed and replaced when the consumers must choose the
+	// source again.
+	changed chan struct{}
+
+	metrics metrics
+	done    chan struct{}
+}
+
+// drainer is implemented by the disk queue.
+type drainer interface {
+	Drained() bool
+}
+
+// drainCheckInterval is the interval at which the disk queue is asked
+// whether it is drained while the consumers wait for the events on disk.
+const drainCheckInterval = time.Second
+
+type metrics struct {
+	spilling    *monitoring.Bool
+	spills      *monitoring.Uint
+	spilled     *monitoring.Uint
+	drains      *monitoring.Uint
+	drained     *monitoring.Uint
+	memEvents   *monitoring.Int
+	diskPending *monitoring.Uint
+}
+
+func init() {
+	queue.RegisterQueueType(
+		"hybrid",
+		create,
+		feature.MakeDetails(
+			"Hybrid queue",
+			"Buffer events in memory and spill them to disk while the output falls behind.",
+			feature.Beta))
+}
+
+func create(
+	ackListener queue.ACKListener, logger *logp.Logger, cfg *common.Config, inQueueSize int,
+) (queue.Queue, error) {
+	config := defaultConfig
+	if err := cfg.Unpack(&config); err != nil {
+		return nil, err
+	}
+	diskSettings, err := diskqueue.SettingsForUserConfig(config.Disk)
+	if err != nil {
+		return nil, fmt.Errorf("hybrid queue couldn't load disk config: %w", err)
+	}
+
+	if logger == nil {
+		logger = logp.L()
+	}
+	return NewQueue(logger, Settings{
+		ACKListener: ackListener,
+		Mem: memqueue.Settings{
+			Events:         config.Mem.Events,
+			FlushMinEvents: config.Mem.FlushMinEvents,
+			FlushTimeout:   config.Mem.FlushTimeout,
+			InputQueueSize: inQueueSize,
+		},
+		Disk:           diskSettings,
+		SpillOccupancy: config.Spill.Occupancy,
+		SpillMaxAge:    config.Spill.MaxAge,
+	})
+}
+
+// NewQueue creates a hybrid queue. The events left on disk by a previous
+// run are drained before new events are kept in memory.
+func NewQueue(logger *logp.Logger, settings Settings) (queue.Queue, error) {
+	logger = logger.Named("hybridqueue")
+
+	// The events on disk are counted before the disk queue opens them.
+	leftover, err := diskqueue.PendingFrameCount(settings.Disk)
+	if err != nil {
+		return nil, fmt.Errorf("hybrid queue couldn't count the events on disk: %w", err)
+	}
+
+	memSettings := settings.Mem
+	memSettings.ACKListener = settings.ACKListener
+	memSettings.WaitOnClose = true
+	mem := memqueue.NewQueue(logger, memSettings)
+
+	diskSettings := settings.Disk
+	diskSettings.WriteToDiskListener = nil
+	disk, err := diskqueue.NewQueue(logger, diskSettings)
+	if err != nil {
+		mem.Close()
+		return nil, err
+	}
+
+	q := &hybridQueue{
+		logger:   logger,
+		settings: settings,
+		mem:      mem,
+		disk:     disk,
+		getSem:   make(chan struct{}, 1),
+		memSrc:   &source{consumer: mem.Consumer()},
+		diskSrc:  &source{consumer: disk.Consumer(), disk: true},
+		changed:  make(chan struct{}),
+		metrics:  newMetrics(),
+		done:     make(chan struct{}),
+	}
+	q.drainer, _ = disk.(drainer)
+	if leftover > 0 {
+		logger.Infof("Draining %d events left on disk before keeping events in memory", leftover)
+		q.diskEvents = leftover
+		q.spilling = true
+		q.metrics.spills.Inc()
+	}
+	q.updateGauges()
+	return q, nil
+}
+
+func newMetrics() metrics {
+	return metrics{
+		spilling:    &monitoring.Bool{},
+		spills:      &monitoring.Uint{},
+		spilled:     &monitoring.Uint{},
+		drains:      &monitoring.Uint{},
+		drained:     &monitoring.Uint{},
+		memEvents:   &monitoring.Int{},
+		diskPending: &monitoring.Uint{},
+	}
+}
+
+// RegisterMetrics exports whether the queue is spilling, the spills and
+// drains, and the events in memory and on disk as queue.hybrid.
+func (q *hybridQueue) RegisterMetrics(reg *monitoring.Registry) {
+	hybridReg := reg.NewRegistry("queue.hybrid")
+	hybridReg.Add("spilling", q.metrics.spilling, monitoring.Reported)
+	hybridReg.Add("spill.count", q.metrics.spills, monitoring.Reported)
+	hybridReg.Add("spill.events", q.metrics.spilled, monitoring.Reported)
+	hybridReg.Add("drain.count", q.metrics.drains, monitoring.Reported)
+	hybridReg.Add("drain.events", q.metrics.drained, monitoring.Reported)
+	hybridReg.Add("mem.events", q.metrics.memEvents, monitoring.Reported)
+	hybridReg.Add("disk.events", q.metrics.diskPending, monitoring.Reported)
+}
+
+func (q *hybridQueue) Close() error {
+	close(q.done)
+	// Closing the consumers stops the pending gets of the memory queue.
+	q.memSrc.consumer.Close()
+	q.diskSrc.consumer.Close()
+	memErr := q.mem.Close()
+	diskErr := q.disk.Close()
+	if memErr != nil {
+		return memErr
+	}
+	return diskErr
+}
+
+func (q *hybridQueue) BufferConfig() queue.BufferConfig {
+	return queue.BufferConfig{MaxEvents: 0}
+}
+
+func (q *hybridQueue) Producer(cfg queue.ProducerConfig) queue.Producer {
+	return newProducer(q, cfg)
+}
+
+func (q *hybridQueue) Consumer() queue.Consumer {
+	return newConsumer(q)
+}
+
+// reserve chooses the queue of a new event and counts it before it is
+// published, so the consumers don't stop draining the disk while it is
+// published. It starts spilling when the memory queue is too full or its
+// oldest event is too old.
+func (q *hybridQueue) reserve() (toDisk bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if !q.spilling && q.shouldSpill() {
+		q.logger.Infof("Spilling events to disk, %d events in memory", q.memActive)
+		q.spilling = true
+		q.metrics.spills.Inc()
+		q.notifyChanged()
+	}
+	if q.spilling {
+		q.diskEvents++
+		q.diskPublishing++
+		q.diskPublishes++
+	} else {
+		q.memEvents++
+		q.memActive++
+		q.memTimes = append(q.memTimes, time.Now())
+	}
+	q.updateGauges()
+	return q.spilling
+}
+
+func (q *hybridQueue) shouldSpill() bool {
+	if float64(q.memActive) >= q.settings.SpillOccupancy*float64(q.settings.Mem.Events) {
+		return true
+	}
+	return q.settings.SpillMaxAge > 0 && len(q.memTimes) > 0 &&
+		time.Since(q.memTimes[0]) >= q.settings.SpillMaxAge
+}
+
+// publishedDisk is called once the disk queue accepted or rejected an event.
+func (q *hybridQueue) publishedDisk() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.diskPublishing--
+}
+
+// release uncounts an event which could not be published.
+func (q *hybridQueue) release(toDisk bool) {
+	if toDisk {
+		q.consumedDisk(1, false)
+	} else {
+		q.removeMem(1)
+	}
+}
+
+// removeMem uncounts the memory events dropped by the queue.
+func (q *hybridQueue) removeMem(n int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if n > q.memEvents {
+		n = q.memEvents
+	}
+	q.memEvents -= n
+	q.memActive -= n
+	// The dropped events are not necessarily the newest, but the times are
+	// only used to estimate the age of the oldest event.
+	q.memTimes = q.memTimes[:len(q.memTimes)-n]
+	q.updateGauges()
+	q.notifyChanged()
+}
+
+func (q *hybridQueue) consumedMem(n int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if n > q.memEvents {
+		n = q.memEvents
+	}
+	q.memEvents -= n
+	q.memTimes = q.memTimes[n:]
+	q.updateGauges()
+}
+
+func (q *hybridQueue) ackedMem(n int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.memActive -= n
+}
+
+// consumedDisk uncounts the events read from or not written to disk, and
+// stops spilling once all events on disk are drained.
+func (q *hybridQueue) consumedDisk(n uint64, drained bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if n > q.diskEvents {
+		// The count of the events left by a previous run includes frames
+		// that can't be decoded.
+		n = q.diskEvents
+	}
+	q.diskEvents -= n
+	if drained {
+		q.metrics.drained.Add(n)
+	}
+	if q.spilling && q.diskEvents == 0 {
+		q.stopSpilling()
+	}
+	q.updateGauges()
+}
+
+// checkDrained stops spilling if the disk queue is drained while events on
+// disk are still counted, they were frames the disk queue couldn't read.
+func (q *hybridQueue) checkDrained() {
+	if q.drainer == nil {
+		return
+	}
+	q.mu.Lock()
+	if !q.spilling || q.diskPublishing > 0 {
+		q.mu.Unlock()
+		return
+	}
+	publishes := q.diskPublishes
+	q.mu.Unlock()
+
+	drained := q.drainer.Drained()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	// The answer is outdated if events were published to disk meanwhile.
+	if !drained || !q.spilling || q.diskPublishes != publishes {
+		return
+	}
+	q.logger.Warnf("The disk queue is drained but %d events were counted, they couldn't be read", q.diskEvents)
+	q.diskEvents = 0
+	q.stopSpilling()
+	q.updateGauges()
+}
+
+// stopSpilling must be called with mu held.
+func (q *hybridQueue) stopSpilling() {
+	q.logger.Info("Drained the events spilled to disk, keeping events in memory")
+	q.spilling = false
+	q.metrics.drains.Inc()
+	q.notifyChanged()
+}
+
+func (q *hybridQueue) isSpilling() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.spilling
+}
+
+// nextSource returns the source of the next events and how many events can
+// be read from it: the events in memory are older than the events on disk
+// while spilling, and newer otherwise.
+func (q *hybridQueue) nextSource(n int) (*source, int, <-chan struct{}) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.memEvents > 0 || !q.spilling {
+		if q.spilling && (n <= 0 || n > q.memEvents) {
+			n = q.memEvents
+		}
+		return q.memSrc, n, q.changed
+	}
+	if n <= 0 || uint64(n) > q.diskEvents {
+		n = int(q.diskEvents)
+	}
+	return q.diskSrc, n, q.changed
+}
+
+// notifyChanged wakes up the consumers waiting on a source. Must be called
+// with mu held.
+func (q *hybridQueue) notifyChanged() {
+	close(q.changed)
+	q.changed = make(chan struct{})
+}
+
+// updateGauges must be called with mu held.
+func (q *hybridQueue) updateGauges() {
+	q.metrics.spilling.Set(q.spilling)
+	q.metrics.memEvents.Set(int64(q.memEvents))
+	q.metrics.diskPending.Set(q.diskEvents)
+}
@@ -0,0 +1,254 @@
+package hybridqueue
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/common/atomic"
+	"github.com/elastic/beats/v7/libbeat/logp"
+	"github.com/elastic/beats/v7/libbeat/monitoring"
+	"github.com/elastic/beats/v7/libbeat/publisher"
+	"github.com/elastic/beats/v7/libbeat/publisher/queue"
+	"github.com/elastic/beats/v7/libbeat/publisher/queue/diskqueue"
+	"github.com/elastic/beats/v7/libbeat/publisher/queue/memqueue"
+	"github.com/elastic/beats/v7/libbeat/publisher/queue/queuetest"
+)
+
+func TestProduceConsumer(t *testing.T) {
+	// The small memory queue spills most events to disk.
+	factory := makeTestQueue(0.5, 0)
+	t.Run("single", func(t *testing.T) {
+		queuetest.TestSingleProducerConsumer(t, 500, 64, factory)
+	})
+	t.Run("multi", func(t *testing.T) {
+		queuetest.TestMultiProducerConsumer(t, 500, 64, factory)
+	})
+}
+
+func TestProducerCancelRemovesEvents(t *testing.T) {
+	queuetest.TestProducerCancelRemovesEvents(t, makeTestQueue(1, 0))
+}
+
+func TestSpillAndDrain(t *testing.T) {
+	settings := testSettings(t, 0.5, 0)
+	q := newTestQueue(t, settings)
+	defer q.Close()
+
+	// The output is stalled, the events after the first 16 are spilled.
+	var acked atomic.Int
+	producer := q.Producer(queue.ProducerConfig{ACK: func(n int) { acked.Add(n) }})
+	publishEvents(t, producer, 0, 100)
+	metrics := q.(*hybridQueue).metrics
+	assert.True(t, metrics.spilling.Get())
+	assert.Equal(t, uint64(84), metrics.spilled.Get())
+
+	// The written events are not acknowledged before the events in memory.
+	assert.Equal(t, 0, acked.Load())
+
+	events := consumeEvents(t, q, 100)
+	assertEvents(t, events, 0, 100)
+	assert.False(t, metrics.spilling.Get())
+	assert.Equal(t, uint64(1), metrics.drains.Get())
+	assert.Equal(t, uint64(84), metrics.drained.Get())
+	assert.Eventually(t, func() bool { return acked.Load() == 100 }, 5*time.Second, 10*time.Millisecond)
+
+	// The memory is used again once the disk is drained.
+	publishEvents(t, producer, 100, 10)
+	assert.Equal(t, int64(10), metrics.memEvents.Get())
+	assertEvents(t, consumeEvents(t, q, 10), 100, 10)
+}
+
+func TestSpillMaxAge(t *testing.T) {
+	q := newTestQueue(t, testSettings(t, 1, 10*time.Millisecond))
+	defer q.Close()
+
+	producer := q.Producer(queue.ProducerConfig{})
+	publishEvents(t, producer, 0, 1)
+	time.Sleep(20 * time.Millisecond)
+	publishEvents(t, producer, 1, 2)
+
+	metrics := q.(*hybridQueue).metrics
+	assert.Equal(t, uint64(2), metrics.spilled.Get())
+	assertEvents(t, consumeEvents(t, q, 3), 0, 3)
+}
+
+func TestDrainAfterRestart(t *testing.T) {
+	settings := testSettings(t, 0.5, 0)
+	q := newTestQueue(t, settings)
+	var acked atomic.Int
+	publishEvents(t, q.Producer(queue.ProducerConfig{ACK: func(n int) { acked.Add(n) }}), 0, 50)
+	// Only the events in memory are consumed before the restart.
+	assertEvents(t, consumeEvents(t, q, 16), 0, 16)
+	// All events are acknowledged once the spilled events are written.
+	require.Eventually(t, func() bool { return acked.Load() == 50 }, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, q.Close())
+
+	q = newTestQueue(t, settings)
+	defer q.Close()
+	assert.True(t, q.(*hybridQueue).metrics.spilling.Get())
+	publishEvents(t, q.Producer(queue.ProducerConfig{}), 50, 10)
+	assertEvents(t, consumeEvents(t, q, 44), 16, 44)
+}
+
+func TestDrainSkipsUnreadableFrames(t *testing.T) {
+	settings := testSettings(t, 0.5, 0)
+	q := newTestQueue(t, settings)
+	var acked atomic.Int
+	publishEvents(t, q.Producer(queue.ProducerConfig{ACK: func(n int) { acked.Add(n) }}), 0, 50)
+	assertEvents(t, consumeEvents(t, q, 16), 0, 16)
+	require.Eventually(t, func() bool { return acked.Load() == 50 }, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, q.Close())
+
+	// The disk queue skips the first spilled event, but it was counted.
+	corruptFirstFrame(t, filepath.Join(settings.Disk.Path, "0.seg"))
+	q = newTestQueue(t, settings)
+	defer q.Close()
+	assertEvents(t, consumeEvents(t, q, 33), 17, 33)
+
+	consumer := q.Consumer()
+	defer consumer.Close()
+	got := make(chan queue.Batch, 1)
+	go func() {
+		batch, err := consumer.Get(1)
+		assert.NoError(t, err)
+		got <- batch
+	}()
+	metrics := q.(*hybridQueue).metrics
+	require.Eventually(t, func() bool { return !metrics.spilling.Get() }, 5*time.Second, 10*time.Millisecond)
+
+	publishEvents(t, q.Producer(queue.ProducerConfig{}), 50, 1)
+	assert.Equal(t, int64(1), metrics.memEvents.Get())
+	batch := <-got
+	require.NotNil(t, batch)
+	assertEvents(t, batch.Events(), 50, 1)
+	batch.ACK()
+}
+
+func TestProducerACKs(t *testing.T) {
+	var acked []int
+	acks := &producerACKs{cb: func(n int) { acked = append(acked, n) }}
+	for _, disk := range []bool{false, false, true, true, true, false} {
+		acks.add(disk)
+	}
+	acks.add(true)
+	acks.removeLast()
+
+	acks.ack(true, 2)
+	assert.Empty(t, acked)
+	acks.ack(false, 1)
+	assert.Equal(t, []int{1}, acked)
+	acks.ack(false, 2)
+	assert.Equal(t, []int{1, 3}, acked)
+	acks.ack(true, 1)
+	assert.Equal(t, []int{1, 3, 2}, acked)
+}
+
+func makeTestQueue(occupancy float64, maxAge time.Duration) queuetest.QueueFactory {
+	return func(t *testing.T) queue.Queue {
+		return newTestQueue(t, testSettings(t, occupancy, maxAge))
+	}
+}
+
+func TestRegisterMetrics(t *testing.T) {
+	q := newTestQueue(t, testSettings(t, 0.5, 0))
+	defer q.Close()
+
+	reg := monitoring.NewRegistry()
+	q.(queue.MetricsReporter).RegisterMetrics(reg)
+	publishEvents(t, q.Producer(queue.ProducerConfig{}), 0, 100)
+
+	snapshot := monitoring.CollectFlatSnapshot(reg, monitoring.Full, false)
+	assert.Equal(t, true, snapshot.Bools["queue.hybrid.spilling"])
+	assert.Equal(t, int64(84), snapshot.Ints["queue.hybrid.spill.events"])
+	assert.Equal(t, int64(16), snapshot.Ints["queue.hybrid.mem.events"])
+}
+
+func testSettings(t *testing.T, occupancy float64, maxAge time.Duration) Settings {
+	dir, err := ioutil.TempDir("", "hybridqueue")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	disk := diskqueue.DefaultSettings()
+	disk.Path = dir
+	return Settings{
+		Mem:            memqueue.Settings{Events: 32},
+		Disk:           disk,
+		SpillOccupancy: occupancy,
+		SpillMaxAge:    maxAge,
+	}
+}
+
+func newTestQueue(t *testing.T, settings Settings) queue.Queue {
+	q, err := NewQueue(logp.NewLogger("test"), settings)
+	require.NoError(t, err)
+	return q
+}
+
+func publishEvents(t *testing.T, producer queue.Producer, from, count int) {
+	for i := from; i < from+count; i++ {
+		require.True(t, producer.Publish(publisher.Event{Content: beat.Event{
+			Timestamp: time.Now(),
+			Fields:    common.MapStr{"index": i},
+		}}))
+	}
+}
+
+func consumeEvents(t *testing.T, q queue.Queue, count int) []publisher.Event {
+	consumer := q.Consumer()
+	defer consumer.Close()
+
+	var events []publisher.Event
+	for len(events) < count {
+		batch, err := consumer.Get(count - len(events))
+		require.NoError(t, err)
+		events = append(events, batch.Events()...)
+		batch.ACK()
+	}
+	return events
+}
+
+func assertEvents(t *testing.T, events []publisher.Event, from, count int) {
+	require.Len(t, events, count)
+	for i, event := range events {
+		index, err := event.Content.Fields.GetValue("index")
+		require.NoError(t, err)
+		// The events read from disk are decoded as uint64.
+		assert.EqualValues(t, from+i, index)
+	}
+}
+
+// corruptFirstFrame replaces the data of the first frame of the segment,
+// keeping its checksum valid.
+func corruptFirstFrame(t *testing.T, path string) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	require.NoError(t, err)
+	defer f.Close()
+
+	// The frame length follows the segment header.
+	const headerSize = 8
+	var frameLength uint32
+	_, err = f.Seek(headerSize, io.SeekStart)
+	require.NoError(t, err)
+	require.NoError(t, binary.Read(f, binary.LittleEndian, &frameLength))
+
+	// A JSON string isn't an event.
+	data := bytes.Repeat([]byte{'"'}, int(frameLength)-12)
+	hash := crc32.NewIEEE()
+	binary.Write(hash, binary.LittleEndian, frameLength)
+	hash.Write(data)
+	_, err = f.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, binary.Write(f, binary.LittleEndian, hash.Sum32()))
+}
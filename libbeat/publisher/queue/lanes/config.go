@@ -0,0 +1,75 @@
+package lanes
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/conditions"
+)
+
+// DefaultLane is the name of the lane of the events matching no other lane.
+const DefaultLane = "default"
+
+type config struct {
+	Lanes []*common.Config `config:"lanes"`
+}
+
+// laneConfig are the settings of a lane, the other settings of the lane
+// override the settings of the queue.
+type laneConfig struct {
+	Name   string             `config:"name" validate:"required"`
+	When   *conditions.Config `config:"when"`
+	Weight int                `config:"weight" validate:"min=1"`
+}
+
+var defaultLaneConfig = laneConfig{
+	Weight: 1,
+}
+
+// laneFields are removed from the settings passed to the queue of a lane.
+var laneFields = []string{"name", "when", "weight"}
+
+func (c *laneConfig) Validate() error {
+	if c.Name == DefaultLane {
+		if c.When != nil {
+			return errors.New("the default lane can't have a condition")
+		}
+		return nil
+	}
+	if c.When == nil {
+		return fmt.Errorf("lane %v requires a condition", c.Name)
+	}
+	return nil
+}
+
+// HasLanes returns true if the queue settings configure priority lanes.
+func HasLanes(cfg *common.Config) bool {
+	return cfg != nil && cfg.HasField("lanes")
+}
+
+// laneSettings returns the queue settings of a lane, the settings of the
+// lane merged into the settings of the queue.
+func laneSettings(base, lane *common.Config) (*common.Config, error) {
+	settings := common.NewConfig()
+	if err := settings.Merge(base); err != nil {
+		return nil, err
+	}
+	if _, err := settings.Remove("lanes", -1); err != nil {
+		return nil, err
+	}
+	if lane == nil {
+		return settings, nil
+	}
+	if err := settings.Merge(lane); err != nil {
+		return nil, err
+	}
+	for _, field := range laneFields {
+		if settings.HasField(field) {
+			if _, err := settings.Remove(field, -1); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return settings, nil
+}
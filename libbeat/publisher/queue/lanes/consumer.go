@@ -0,0 +1,118 @@
+package lanes
+
+import (
+	"errors"
+	"io"
+
+	"github.com/elastic/beats/v7/libbeat/common/atomic"
+	"github.com/elastic/beats/v7/libbeat/publisher/queue"
+)
+
+type consumer struct {
+	queue  *laneQueue
+	done   chan struct{}
+	closed atomic.Bool
+}
+
+// source is the consumer of a lane. A get is always pending on every lane,
+// its result is kept until the lane is chosen.
+type source struct {
+	consumer queue.Consumer
+	pending  chan getResult
+	result   *getResult
+}
+
+type getResult struct {
+	batch queue.Batch
+	err   error
+}
+
+func newConsumer(q *laneQueue) *consumer {
+	return &consumer{queue: q, done: make(chan struct{})}
+}
+
+func (c *consumer) Get(sz int) (queue.Batch, error) {
+	if c.closed.Load() {
+		return nil, io.EOF
+	}
+
+	q := c.queue
+	select {
+	case q.getSem <- struct{}{}:
+	case <-c.done:
+		return nil, io.EOF
+	case <-q.done:
+		return nil, io.EOF
+	}
+	defer func() { <-q.getSem }()
+
+	var l *lane
+	for {
+		// The lane chosen is kept while waiting for its events, choosing
+		// again would skip its turn.
+		if l == nil || !q.hasEvents(l, sz) {
+			l = q.nextLane(sz)
+		}
+		var pending <-chan getResult
+		if l != nil {
+			if l.src.result != nil {
+				return q.consumed(l, l.src.take())
+			}
+			pending = l.src.pending
+		}
+		select {
+		case res := <-pending:
+			l.src.pending = nil
+			return q.consumed(l, res)
+		case <-q.ready:
+			// Another lane has events or the events of the lane were
+			// removed.
+		case <-c.done:
+			return nil, io.EOF
+		case <-q.done:
+			return nil, io.EOF
+		}
+	}
+}
+
+func (c *consumer) Close() error {
+	if c.closed.Swap(true) {
+		return errors.New("already closed")
+	}
+	close(c.done)
+	return nil
+}
+
+// poll starts a get if none is pending and returns true if the result of
+// the get is available. Must be called with getSem held.
+func (s *source) poll(n int, ready chan<- struct{}) bool {
+	if s.result != nil {
+		return true
+	}
+	if s.pending == nil {
+		pending := make(chan getResult, 1)
+		s.pending = pending
+		go func() {
+			b, err := s.consumer.Get(n)
+			pending <- getResult{batch: b, err: err}
+			select {
+			case ready <- struct{}{}:
+			default:
+			}
+		}()
+	}
+	select {
+	case res := <-s.pending:
+		s.pending = nil
+		s.result = &res
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *source) take() getResult {
+	res := *s.result
+	s.result = nil
+	return res
+}
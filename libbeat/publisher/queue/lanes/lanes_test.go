@@ -0,0 +1,152 @@
+package lanes_test
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/logp"
+	"github.com/elastic/beats/v7/libbeat/publisher"
+	"github.com/elastic/beats/v7/libbeat/publisher/queue"
+	_ "github.com/elastic/beats/v7/libbeat/publisher/queue/diskqueue"
+	_ "github.com/elastic/beats/v7/libbeat/publisher/queue/memqueue"
+	"github.com/elastic/beats/v7/libbeat/publisher/queue/queuetest"
+)
+
+func TestProduceConsumer(t *testing.T) {
+	tests := map[string]queuetest.QueueFactory{
+		"mem": makeTestQueue("mem", map[string]interface{}{
+			"events": 64,
+			"lanes": []map[string]interface{}{{
+				"name":                "low",
+				"when.range.count.lt": 50,
+				"weight":              4,
+				"events":              32,
+			}},
+		}),
+		"disk": makeTestQueue("disk", map[string]interface{}{
+			"max_size": "10MB",
+			"lanes": []map[string]interface{}{{
+				"name":                "low",
+				"when.range.count.lt": 50,
+				"weight":              4,
+			}},
+		}),
+	}
+	for name, factory := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Run("single", func(t *testing.T) {
+				queuetest.TestSingleProducerConsumer(t, 200, 16, factory)
+			})
+			t.Run("multi", func(t *testing.T) {
+				queuetest.TestMultiProducerConsumer(t, 200, 16, factory)
+			})
+		})
+	}
+}
+
+func TestProducerCancelRemovesEvents(t *testing.T) {
+	queuetest.TestProducerCancelRemovesEvents(t, makeTestQueue("mem", map[string]interface{}{
+		"lanes": []map[string]interface{}{{
+			"name":                "first",
+			"when.range.value.lt": 2,
+		}},
+	}))
+}
+
+func TestWeights(t *testing.T) {
+	q := makeTestQueue("mem", map[string]interface{}{
+		"events": 256,
+		"lanes": []map[string]interface{}{
+			{"name": "errors", "when.equals.level": "error", "weight": 4},
+			{"name": "default", "weight": 1},
+		},
+	})(t)
+	defer q.Close()
+
+	// The default lane has a backlog when the error events are published.
+	producer := q.Producer(queue.ProducerConfig{})
+	for i := 0; i < 100; i++ {
+		require.True(t, producer.Publish(makeLevelEvent(i, "debug")))
+	}
+	for i := 100; i < 140; i++ {
+		require.True(t, producer.Publish(makeLevelEvent(i, "error")))
+	}
+	// The memory queues insert the published events asynchronously.
+	time.Sleep(50 * time.Millisecond)
+
+	consumer := q.Consumer()
+	defer consumer.Close()
+	var batches []string
+	for len(batches) < 10 {
+		batch, err := consumer.Get(5)
+		require.NoError(t, err)
+		for _, event := range batch.Events() {
+			assert.Equal(t, batch.Events()[0].Content.Fields["level"], event.Content.Fields["level"])
+		}
+		batches = append(batches, batch.Events()[0].Content.Fields["level"].(string))
+		batch.ACK()
+	}
+	// The lane with weight 4 is read 4 times for each read of the backlog.
+	assert.Equal(t, []string{
+		"error", "error", "debug", "error", "error",
+		"error", "error", "debug", "error", "error",
+	}, batches)
+}
+
+func TestCloseWhileGetPending(t *testing.T) {
+	q := makeTestQueue("mem", map[string]interface{}{
+		"lanes": []map[string]interface{}{{
+			"name":              "errors",
+			"when.equals.level": "error",
+		}},
+	})(t)
+
+	consumer := q.Consumer()
+	result := make(chan error, 1)
+	go func() {
+		_, err := consumer.Get(5)
+		result <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, q.Close())
+
+	select {
+	case err := <-result:
+		assert.Equal(t, io.EOF, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the pending Get didn't return once the queue was closed")
+	}
+}
+
+func makeTestQueue(queueType string, settings map[string]interface{}) queuetest.QueueFactory {
+	return func(t *testing.T) queue.Queue {
+		cfg, err := common.NewConfigFrom(settings)
+		require.NoError(t, err)
+		if queueType == "mem" {
+			require.NoError(t, cfg.SetInt("flush.min_events", -1, 0))
+		} else {
+			dir, err := ioutil.TempDir("", "lanes")
+			require.NoError(t, err)
+			t.Cleanup(func() { os.RemoveAll(dir) })
+			require.NoError(t, cfg.SetString("path", -1, dir))
+		}
+		q, err := queue.FindFactory(queueType)(nil, logp.NewLogger("test"), cfg, 0)
+		require.NoError(t, err)
+		return q
+	}
+}
+
+func makeLevelEvent(i int, level string) publisher.Event {
+	return publisher.Event{Content: beat.Event{
+		Timestamp: time.Now(),
+		Fields:    common.MapStr{"index": i, "level": level},
+	}}
+}
@@ -0,0 +1,156 @@
+package lanes
+
+import (
+	"sync"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/publisher"
+	"github.com/elastic/beats/v7/libbeat/publisher/queue"
+)
+
+type producer struct {
+	queue     *laneQueue
+	producers []queue.Producer
+
+	// nil if the producer has no ACK callback.
+	acks *producerACKs
+}
+
+func newProducer(q *laneQueue, cfg queue.ProducerConfig) *producer {
+	p := &producer{queue: q, producers: make([]queue.Producer, len(q.lanes))}
+	if cfg.ACK != nil {
+		// The lanes acknowledge the events independently, so the ACKs are
+		// merged in the order the events were published.
+		p.acks = newProducerACKs(len(q.lanes), cfg.ACK)
+	}
+	for i, l := range q.lanes {
+		laneCfg := cfg
+		if p.acks != nil {
+			index := i
+			laneCfg.ACK = func(n int) { p.acks.ack(index, n) }
+		}
+		// The events dropped after the producer was cancelled are not
+		// counted by Cancel.
+		l := l
+		laneCfg.OnDrop = func(event beat.Event) {
+			p.queue.remove(l, 1)
+			if cfg.OnDrop != nil {
+				cfg.OnDrop(event)
+			}
+		}
+		p.producers[i] = l.queue.Producer(laneCfg)
+	}
+	return p
+}
+
+func (p *producer) Publish(event publisher.Event) bool {
+	return p.publish(event, true)
+}
+
+func (p *producer) TryPublish(event publisher.Event) bool {
+	return p.publish(event, false)
+}
+
+func (p *producer) publish(event publisher.Event, block bool) bool {
+	l := p.queue.laneOf(&event.Content)
+	p.queue.reserve(l)
+	if p.acks != nil {
+		p.acks.add(l.index)
+	}
+
+	var ok bool
+	if block {
+		ok = p.producers[l.index].Publish(event)
+	} else {
+		ok = p.producers[l.index].TryPublish(event)
+	}
+	if !ok {
+		if p.acks != nil {
+			p.acks.removeLast()
+		}
+		p.queue.remove(l, 1)
+	}
+	return ok
+}
+
+func (p *producer) Cancel() int {
+	total := 0
+	for i, producer := range p.producers {
+		dropped := producer.Cancel()
+		if dropped > 0 {
+			p.queue.remove(p.queue.lanes[i], dropped)
+		}
+		total += dropped
+	}
+	return total
+}
+
+// producerACKs merges the ACKs of the lanes, so the events of a producer are
+// acknowledged in the order they were published.
+type producerACKs struct {
+	mu sync.Mutex
+	cb func(int)
+
+	// The consecutive runs of events published to the same lane which are
+	// not acknowledged yet.
+	runs []ackRun
+	// The number of events acknowledged by every lane which wait for an
+	// earlier run.
+	acked []int
+}
+
+type ackRun struct {
+	lane   int
+	events int
+}
+
+func newProducerACKs(lanes int, cb func(int)) *producerACKs {
+	return &producerACKs{cb: cb, acked: make([]int, lanes)}
+}
+
+func (a *producerACKs) add(lane int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if n := len(a.runs); n > 0 && a.runs[n-1].lane == lane {
+		a.runs[n-1].events++
+		return
+	}
+	a.runs = append(a.runs, ackRun{lane: lane, events: 1})
+}
+
+func (a *producerACKs) removeLast() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	last := len(a.runs) - 1
+	a.runs[last].events--
+	if a.runs[last].events == 0 {
+		a.runs = a.runs[:last]
+	}
+}
+
+// ack is called by all lanes, the callback is called with mu held so it is
+// never called concurrently.
+func (a *producerACKs) ack(lane int, n int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.acked[lane] += n
+	released := 0
+	for len(a.runs) > 0 {
+		run := &a.runs[0]
+		acked := &a.acked[run.lane]
+		count := run.events
+		if *acked < count {
+			count = *acked
+		}
+		*acked -= count
+		run.events -= count
+		released += count
+		if run.events > 0 {
+			break
+		}
+		a.runs = a.runs[1:]
+	}
+	if released > 0 {
+		a.cb(released)
+	}
+}
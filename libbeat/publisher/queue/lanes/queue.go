@@ -0,0 +1,292 @@
+// Package lanes implements priority lanes on top of the other queue types.
+// Every lane is a queue of its own, with its own capacity, and the events are
+// assigned to the first lane whose condition they match. The consumers read
+// the lanes by smooth weighted round robin, so a backlog in a lane with a low
+// weight doesn't delay the events of the lanes with a higher weight.
+package lanes
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/conditions"
+	"github.com/elastic/beats/v7/libbeat/logp"
+	"github.com/elastic/beats/v7/libbeat/monitoring"
+	"github.com/elastic/beats/v7/libbeat/monitoring/adapter"
+	"github.com/elastic/beats/v7/libbeat/publisher/queue"
+)
+
+// LaneFactory creates the queue of a lane from the settings of the queue
+// merged with the settings of the lane.
+type LaneFactory func(name string, cfg *common.Config) (queue.Queue, error)
+
+type laneQueue struct {
+	logger *logp.Logger
+
+	// The lanes in the order their conditions are checked, the default lane
+	// is the last one.
+	lanes []*lane
+
+	// Only one consumer reads at a time, the pending gets of the lanes are
+	// passed on between consumers.
+	getSem chan struct{}
+	// ready is signaled when the get of a lane returns or events are
+	// removed from a lane.
+	ready chan struct{}
+
+	mu sync.Mutex
+
+	done chan struct{}
+}
+
+type lane struct {
+	name      string
+	index     int
+	condition conditions.Condition
+	weight    int
+	queue     queue.Queue
+	src       *source
+
+	// events is the number of events published to the lane and not yet
+	// consumed, with their publish times in times. Guarded by laneQueue.mu.
+	events int
+	times  []time.Time
+	// current is the smooth weighted round robin state, only used with
+	// getSem held.
+	current int
+
+	depth   *monitoring.Int
+	latency metrics.Sample
+}
+
+// NewQueue creates a queue with the lanes configured in cfg, the queues of
+// the lanes are created by newLane.
+func NewQueue(logger *logp.Logger, cfg *common.Config, newLane LaneFactory) (queue.Queue, error) {
+	var config config
+	if err := cfg.Unpack(&config); err != nil {
+		return nil, err
+	}
+	if logger == nil {
+		logger = logp.L()
+	}
+
+	q := &laneQueue{
+		logger: logger.Named("lanes"),
+		getSem: make(chan struct{}, 1),
+		ready:  make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+
+	var defaultSettings *common.Config
+	defaultWeight := defaultLaneConfig.Weight
+	names := map[string]bool{}
+	for _, laneCfg := range config.Lanes {
+		lc := defaultLaneConfig
+		if err := laneCfg.Unpack(&lc); err != nil {
+			q.closeLanes()
+			return nil, err
+		}
+		if names[lc.Name] {
+			q.closeLanes()
+			return nil, fmt.Errorf("duplicate lane %v", lc.Name)
+		}
+		names[lc.Name] = true
+
+		if lc.Name == DefaultLane {
+			defaultSettings, defaultWeight = laneCfg, lc.Weight
+			continue
+		}
+		condition, err := conditions.NewCondition(lc.When)
+		if err != nil {
+			q.closeLanes()
+			return nil, fmt.Errorf("failed to create the condition of lane %v: %w", lc.Name, err)
+		}
+		if err := q.addLane(cfg, laneCfg, lc.Name, lc.Weight, condition, newLane); err != nil {
+			q.closeLanes()
+			return nil, err
+		}
+	}
+	if err := q.addLane(cfg, defaultSettings, DefaultLane, defaultWeight, nil, newLane); err != nil {
+		q.closeLanes()
+		return nil, err
+	}
+	return q, nil
+}
+
+func (q *laneQueue) addLane(
+	base, laneCfg *common.Config,
+	name string,
+	weight int,
+	condition conditions.Condition,
+	newLane LaneFactory,
+) error {
+	settings, err := laneSettings(base, laneCfg)
+	if err != nil {
+		return fmt.Errorf("failed to load the settings of lane %v: %w", name, err)
+	}
+	inner, err := newLane(name, settings)
+	if err != nil {
+		return fmt.Errorf("failed to create the queue of lane %v: %w", name, err)
+	}
+	q.lanes = append(q.lanes, &lane{
+		name:      name,
+		index:     len(q.lanes),
+		condition: condition,
+		weight:    weight,
+		queue:     inner,
+		src:       &source{consumer: inner.Consumer()},
+		depth:     &monitoring.Int{},
+		latency:   metrics.NewUniformSample(1028),
+	})
+	return nil
+}
+
+func (q *laneQueue) closeLanes() error {
+	var firstErr error
+	for _, l := range q.lanes {
+		// Closing the consumers stops the pending gets.
+		l.src.consumer.Close()
+		if err := l.queue.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (q *laneQueue) Close() error {
+	close(q.done)
+	return q.closeLanes()
+}
+
+// BufferConfig reports the sum of the capacities of the lanes, or no bound
+// if a lane has none.
+func (q *laneQueue) BufferConfig() queue.BufferConfig {
+	total := 0
+	for _, l := range q.lanes {
+		events := l.queue.BufferConfig().MaxEvents
+		if events <= 0 {
+			return queue.BufferConfig{MaxEvents: 0}
+		}
+		total += events
+	}
+	return queue.BufferConfig{MaxEvents: total}
+}
+
+func (q *laneQueue) Producer(cfg queue.ProducerConfig) queue.Producer {
+	return newProducer(q, cfg)
+}
+
+func (q *laneQueue) Consumer() queue.Consumer {
+	return newConsumer(q)
+}
+
+// RegisterMetrics exports the depth and the latency in milliseconds of every
+// lane as queue.lanes.<name>.
+func (q *laneQueue) RegisterMetrics(reg *monitoring.Registry) {
+	for _, l := range q.lanes {
+		laneReg := reg.NewRegistry("queue.lanes." + l.name)
+		laneReg.Add("events", l.depth, monitoring.Reported)
+		adapter.NewGoMetrics(laneReg, "latency", adapter.Accept).
+			Register("ms", metrics.NewHistogram(l.latency))
+	}
+}
+
+// laneOf returns the first lane whose condition matches the event.
+func (q *laneQueue) laneOf(event *beat.Event) *lane {
+	last := len(q.lanes) - 1
+	for _, l := range q.lanes[:last] {
+		if l.condition.Check(event) {
+			return l
+		}
+	}
+	return q.lanes[last]
+}
+
+// reserve counts an event before it is published.
+func (q *laneQueue) reserve(l *lane) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	l.events++
+	l.times = append(l.times, time.Now())
+	l.depth.Set(int64(l.events))
+}
+
+// remove uncounts the events of a lane which were not published or were
+// dropped by the queue.
+func (q *laneQueue) remove(l *lane, n int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if n > l.events {
+		n = l.events
+	}
+	l.events -= n
+	// The dropped events are not necessarily the newest, the times are only
+	// used to estimate the latency.
+	l.times = l.times[:len(l.times)-n]
+	l.depth.Set(int64(l.events))
+	// The consumer waiting for the events of the lane chooses again.
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (q *laneQueue) consumed(l *lane, res getResult) (queue.Batch, error) {
+	if res.err != nil {
+		return nil, res.err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := len(res.batch.Events())
+	if n > l.events {
+		n = l.events
+	}
+	now := time.Now()
+	for _, published := range l.times[:n] {
+		l.latency.Update(int64(now.Sub(published) / time.Millisecond))
+	}
+	l.events -= n
+	l.times = l.times[n:]
+	l.depth.Set(int64(l.events))
+	// The queue of the lane notifies the ACK listener itself.
+	return res.batch, nil
+}
+
+// hasEvents returns true if the lane has events to read. Must be called
+// with getSem held.
+func (q *laneQueue) hasEvents(l *lane, n int) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return l.src.poll(n, q.ready) || l.events > 0
+}
+
+// nextLane chooses the lane to read by smooth weighted round robin among
+// the lanes with events, it returns nil if all lanes are empty. Must be
+// called with getSem held.
+func (q *laneQueue) nextLane(n int) *lane {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var next *lane
+	total := 0
+	for _, l := range q.lanes {
+		if !l.src.poll(n, q.ready) && l.events == 0 {
+			continue
+		}
+		l.current += l.weight
+		total += l.weight
+		if next == nil || l.current > next.current {
+			next = l
+		}
+	}
+	if next != nil {
+		next.current -= total
+	}
+	return next
+}
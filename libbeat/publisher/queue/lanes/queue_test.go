@@ -0,0 +1,110 @@
+package lanes
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/beats/v7/libbeat/common"
+)
+
+func TestLaneConfig(t *testing.T) {
+	tests := map[string]struct {
+		config string
+		err    bool
+	}{
+		"lane":                 {config: "{name: errors, when.equals.level: error, weight: 4}"},
+		"default lane":         {config: "{name: default, weight: 2}"},
+		"missing name":         {config: "{when.equals.level: error}", err: true},
+		"missing condition":    {config: "{name: errors}", err: true},
+		"default condition":    {config: "{name: default, when.equals.level: error}", err: true},
+		"invalid weight":       {config: "{name: errors, when.equals.level: error, weight: 0}", err: true},
+		"missing default name": {config: "{weight: 2}", err: true},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			cfg, err := common.NewConfigFrom(test.config)
+			require.NoError(t, err)
+			config := defaultLaneConfig
+			err = cfg.Unpack(&config)
+			if test.err {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestLaneSettings(t *testing.T) {
+	base, err := common.NewConfigFrom(`
+events: 4096
+flush.timeout: 1s
+lanes:
+  - {name: errors, when.equals.level: error, weight: 4, events: 512}
+`)
+	require.NoError(t, err)
+	var config config
+	require.NoError(t, base.Unpack(&config))
+
+	settings, err := laneSettings(base, config.Lanes[0])
+	require.NoError(t, err)
+	var fields map[string]interface{}
+	require.NoError(t, settings.Unpack(&fields))
+	assert.Equal(t, map[string]interface{}{
+		"events": uint64(512),
+		"flush":  map[string]interface{}{"timeout": "1s"},
+	}, fields)
+
+	settings, err = laneSettings(base, nil)
+	require.NoError(t, err)
+	assert.False(t, settings.HasField("lanes"))
+}
+
+func TestNextLane(t *testing.T) {
+	q := &laneQueue{ready: make(chan struct{}, 1)}
+	for _, weight := range []int{3, 1, 2} {
+		q.lanes = append(q.lanes, &lane{
+			index:  len(q.lanes),
+			weight: weight,
+			src:    &source{result: &getResult{}},
+		})
+	}
+	// The empty lane is skipped.
+	q.lanes[2].src.result = nil
+	q.lanes[2].src.pending = make(chan getResult)
+
+	var order []int
+	for i := 0; i < 8; i++ {
+		order = append(order, q.nextLane(0).index)
+	}
+	assert.Equal(t, []int{0, 0, 1, 0, 0, 0, 1, 0}, order)
+
+	q.lanes[0].src.result = nil
+	q.lanes[0].src.pending = make(chan getResult)
+	q.lanes[1].src.result = nil
+	q.lanes[1].src.pending = make(chan getResult)
+	assert.Nil(t, q.nextLane(0))
+}
+
+func TestProducerACKs(t *testing.T) {
+	var acked []int
+	acks := newProducerACKs(3, func(n int) { acked = append(acked, n) })
+	for _, lane := range []int{0, 0, 2, 1, 1, 0} {
+		acks.add(lane)
+	}
+	acks.add(2)
+	acks.removeLast()
+
+	acks.ack(1, 2)
+	assert.Empty(t, acked)
+	acks.ack(0, 1)
+	assert.Equal(t, []int{1}, acked)
+	acks.ack(0, 1)
+	assert.Equal(t, []int{1, 1}, acked)
+	acks.ack(2, 1)
+	assert.Equal(t, []int{1, 1, 3}, acked)
+	acks.ack(0, 1)
+	assert.Equal(t, []int{1, 1, 3, 1}, acked)
+}
@@ -25,6 +25,7 @@ import (
 	"github.com/elastic/beats/v7/libbeat/feature"
 	"github.com/elastic/beats/v7/libbeat/logp"
 	"github.com/elastic/beats/v7/libbeat/publisher/queue"
+	"github.com/elastic/beats/v7/libbeat/publisher/queue/lanes"
 )
 
 const (
@@ -90,6 +91,12 @@ func init() {
 func create(
 	ackListener queue.ACKListener, logger *logp.Logger, cfg *common.Config, inQueueSize int,
 ) (queue.Queue, error) {
+	if lanes.HasLanes(cfg) {
+		return lanes.NewQueue(logger, cfg, func(_ string, laneCfg *common.Config) (queue.Queue, error) {
+			return create(ackListener, logger, laneCfg, inQueueSize)
+		})
+	}
+
 	config := defaultConfig
 	if err := cfg.Unpack(&config); err != nil {
 		return nil, err
@@ -0,0 +1,120 @@
+package memqueue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/beats/v7/libbeat/beat"
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/common/atomic"
+	"github.com/elastic/beats/v7/libbeat/monitoring"
+	"github.com/elastic/beats/v7/libbeat/publisher"
+	"github.com/elastic/beats/v7/libbeat/publisher/queue"
+	"github.com/elastic/beats/v7/libbeat/publisher/queue/queuetest"
+)
+
+func TestLanesProduceConsumer(t *testing.T) {
+	factory := makeTestLanes(`
+events: 64
+lanes:
+  - name: low
+    when.range.count.lt: 50
+    weight: 4
+    events: 32
+`)
+	t.Run("single", func(t *testing.T) {
+		queuetest.TestSingleProducerConsumer(t, 200, 16, factory)
+	})
+	t.Run("multi", func(t *testing.T) {
+		queuetest.TestMultiProducerConsumer(t, 200, 16, factory)
+	})
+}
+
+func TestLanesProducerCancelRemovesEvents(t *testing.T) {
+	queuetest.TestProducerCancelRemovesEvents(t, makeTestLanes(`
+lanes:
+  - name: first
+    when.range.value.lt: 2
+`))
+}
+
+func TestLanesPriority(t *testing.T) {
+	q := makeTestLanes(`
+events: 256
+lanes:
+  - name: errors
+    when.equals.level: error
+    weight: 3
+    events: 64
+`)(t)
+	defer q.Close()
+	reg := monitoring.NewRegistry()
+	q.(queue.MetricsReporter).RegisterMetrics(reg)
+
+	var acked atomic.Int
+	producer := q.Producer(queue.ProducerConfig{ACK: func(n int) { acked.Add(n) }})
+	for i := 0; i < 100; i++ {
+		require.True(t, producer.Publish(makeLevelEvent(i, "debug")))
+	}
+	for i := 100; i < 110; i++ {
+		require.True(t, producer.Publish(makeLevelEvent(i, "error")))
+	}
+	assert.Equal(t, int64(10), reg.Get("queue.lanes.errors.events").(*monitoring.Int).Get())
+	assert.Equal(t, int64(100), reg.Get("queue.lanes.default.events").(*monitoring.Int).Get())
+
+	// The memory queues insert the published events asynchronously.
+	time.Sleep(50 * time.Millisecond)
+
+	// The error events are read first, before the backlog of debug events.
+	consumer := q.Consumer()
+	defer consumer.Close()
+	var batches []queue.Batch
+	var levels []string
+	for len(levels) < 40 {
+		batch, err := consumer.Get(5)
+		require.NoError(t, err)
+		batches = append(batches, batch)
+		for _, event := range batch.Events() {
+			levels = append(levels, event.Content.Fields["level"].(string))
+		}
+	}
+	assert.Equal(t, []string{"error", "error", "error", "error", "error"}, levels[:5])
+	errors := 0
+	for _, level := range levels[:20] {
+		if level == "error" {
+			errors++
+		}
+	}
+	assert.Equal(t, 10, errors)
+	assert.Equal(t, int64(0), reg.Get("queue.lanes.errors.events").(*monitoring.Int).Get())
+
+	// The producer ACKs follow the publish order, the error events wait for
+	// the debug events published before them.
+	for i := len(batches) - 1; i >= 0; i-- {
+		batches[i].ACK()
+	}
+	assert.Eventually(t, func() bool {
+		return acked.Load() == len(levels)-10
+	}, time.Second, 10*time.Millisecond)
+}
+
+func makeTestLanes(settings string) queuetest.QueueFactory {
+	return func(t *testing.T) queue.Queue {
+		cfg, err := common.NewConfigFrom(settings)
+		require.NoError(t, err)
+		require.NoError(t, cfg.SetInt("flush.min_events", -1, 0))
+		q, err := create(nil, nil, cfg, 0)
+		require.NoError(t, err)
+		return q
+	}
+}
+
+func makeLevelEvent(i int, level string) publisher.Event {
+	return publisher.Event{Content: beat.Event{
+		Timestamp: time.Now(),
+		Fields:    common.MapStr{"index": i, "level": level},
+	}}
+}
@@ -23,6 +23,7 @@ import (
 	"github.com/elastic/beats/v7/libbeat/beat"
 	"github.com/elastic/beats/v7/libbeat/common"
 	"github.com/elastic/beats/v7/libbeat/logp"
+	"github.com/elastic/beats/v7/libbeat/monitoring"
 	"github.com/elastic/beats/v7/libbeat/publisher"
 )
 
@@ -122,3 +123,9 @@ type Batch interface {
 	Events() []publisher.Event
 	ACK()
 }
+
+// MetricsReporter is implemented by the queues exporting their own metrics.
+// The pipeline registers them in its monitoring registry.
+type MetricsReporter interface {
+	RegisterMetrics(reg *monitoring.Registry)
+}
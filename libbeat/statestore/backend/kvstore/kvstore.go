@@ -0,0 +1,255 @@
+// Package kvstore implements a statestore backend on the embedded key-value
+// engine badger.
+//
+// Unlike memlog the key-value pairs are not held in memory. Updates are
+// appended to the write-ahead log of badger and merged into sorted tables on
+// disk by background compactions, the memory is bounded by the size of the
+// memtables and caches. Old entries of the value log are collected
+// incrementally every GCInterval.
+//
+// Each store is a badger database in the sub-directory <name>.kv of the
+// registry root, next to the directories of memlog.
+package kvstore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v2"
+	"github.com/dgraph-io/badger/v2/options"
+
+	"github.com/elastic/beats/v7/libbeat/logp"
+	"github.com/elastic/beats/v7/libbeat/statestore/backend"
+)
+
+// Registry configures access to kvstore based stores.
+type Registry struct {
+	log *logp.Logger
+
+	mu     sync.Mutex
+	active bool
+	dbs    map[string]*sharedDB
+
+	settings Settings
+}
+
+// Settings configures a new Registry.
+type Settings struct {
+	// Registry root directory. Stores will be single sub-directories.
+	Root string
+
+	// SyncWrites fsyncs the write-ahead log on each update. If not set the
+	// updates are synced by Checkpoint and on close, the store is consistent
+	// after a crash but can miss the last updates.
+	SyncWrites bool
+
+	// GCInterval configures how often the value log is collected. Defaults
+	// to 5 minutes if not set.
+	GCInterval time.Duration
+
+	// CacheSize is the size in bytes of the block and index caches. Defaults
+	// to 8MB if not set.
+	CacheSize int64
+}
+
+const (
+	storeDirSuffix = ".kv"
+
+	defaultGCInterval = 5 * time.Minute
+	defaultCacheSize  = 8 << 20
+
+	// gcDiscardRatio is the ratio of stale entries a value log file must
+	// have to be rewritten.
+	gcDiscardRatio = 0.5
+)
+
+var (
+	errRegClosed  = errors.New("registry has been closed")
+	errKeyUnknown = errors.New("key unknown")
+)
+
+type sharedDB struct {
+	db   *badger.DB
+	refs int
+
+	gcQuit chan struct{}
+	gcDone chan struct{}
+}
+
+// New configures a kvstore Registry that can be used to open stores.
+func New(log *logp.Logger, settings Settings) (*Registry, error) {
+	if settings.GCInterval <= 0 {
+		settings.GCInterval = defaultGCInterval
+	}
+	if settings.CacheSize <= 0 {
+		settings.CacheSize = defaultCacheSize
+	}
+
+	root, err := filepath.Abs(settings.Root)
+	if err != nil {
+		return nil, err
+	}
+
+	settings.Root = root
+	return &Registry{
+		log:      log,
+		active:   true,
+		dbs:      map[string]*sharedDB{},
+		settings: settings,
+	}, nil
+}
+
+// Path returns the directory of the store.
+func Path(root, name string) string {
+	return filepath.Join(root, name+storeDirSuffix)
+}
+
+// Access creates or opens a store. The database of the store is shared by
+// all accesses and closed with the last store.
+func (r *Registry) Access(name string) (backend.Store, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.active {
+		return nil, errRegClosed
+	}
+
+	shared, exists := r.dbs[name]
+	if !exists {
+		logger := r.log.With("store", name)
+		db, err := r.open(logger, Path(r.settings.Root, name))
+		if err != nil {
+			return nil, err
+		}
+		shared = &sharedDB{
+			db:     db,
+			gcQuit: make(chan struct{}),
+			gcDone: make(chan struct{}),
+		}
+		go runGC(logger, db, r.settings.GCInterval, shared.gcQuit, shared.gcDone)
+		r.dbs[name] = shared
+	}
+	shared.refs++
+
+	return &store{
+		db:      shared.db,
+		release: func() error { return r.release(name) },
+	}, nil
+}
+
+// open opens a badger database with options bounding the memory usage, a
+// registry has small values of a few hundred bytes.
+func (r *Registry) open(log *logp.Logger, home string) (*badger.DB, error) {
+	if err := os.MkdirAll(home, os.ModeDir|0770); err != nil {
+		return nil, err
+	}
+
+	opts := badger.DefaultOptions(home).
+		WithLogger(badgerLogger{log.Named("badger")}).
+		WithSyncWrites(r.settings.SyncWrites).
+		WithTruncate(true).
+		WithTableLoadingMode(options.FileIO).
+		WithValueLogLoadingMode(options.FileIO).
+		WithMaxTableSize(8 << 20).
+		WithLevelOneSize(32 << 20).
+		WithNumMemtables(2).
+		WithNumLevelZeroTables(2).
+		WithNumLevelZeroTablesStall(4).
+		WithValueLogFileSize(64 << 20).
+		WithBlockCacheSize(r.settings.CacheSize / 2).
+		WithIndexCacheSize(r.settings.CacheSize / 2).
+		WithDetectConflicts(false)
+
+	db, err := badger.Open(opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open key-value store %v: %w", home, err)
+	}
+	return db, nil
+}
+
+func (r *Registry) release(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	shared, exists := r.dbs[name]
+	if !exists {
+		return nil
+	}
+	shared.refs--
+	if shared.refs > 0 {
+		return nil
+	}
+
+	delete(r.dbs, name)
+	close(shared.gcQuit)
+	<-shared.gcDone
+	return shared.db.Close()
+}
+
+// Close closes the registry. No new store can be accessed after close.
+// The databases of stores not closed yet are closed.
+func (r *Registry) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.active = false
+	var errs []error
+	for name, shared := range r.dbs {
+		delete(r.dbs, name)
+		close(shared.gcQuit)
+		<-shared.gcDone
+		if err := shared.db.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to close key-value stores: %v", errs)
+	}
+	return nil
+}
+
+// runGC collects the value log every interval, one file per run until no
+// file has enough stale entries.
+func runGC(log *logp.Logger, db *badger.DB, interval time.Duration, quit, done chan struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			count, err := collect(db)
+			log.Debugf("Value log collected %d times: %v", count, err)
+		case <-quit:
+			return
+		}
+	}
+}
+
+func collect(db *badger.DB) (int, error) {
+	count := 0
+	for {
+		err := db.RunValueLogGC(gcDiscardRatio)
+		if err == badger.ErrNoRewrite {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+}
+
+// badgerLogger is an adapter between a logp logger and the loggers expected by badger.
+type badgerLogger struct {
+	*logp.Logger
+}
+
+// Warningf logs a message at the warning level.
+func (l badgerLogger) Warningf(format string, args ...interface{}) {
+	l.Warnf(format, args...)
+}
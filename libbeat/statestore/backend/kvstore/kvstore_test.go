@@ -0,0 +1,114 @@
+package kvstore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/beats/v7/libbeat/logp"
+	"github.com/elastic/beats/v7/libbeat/statestore/backend"
+	"github.com/elastic/beats/v7/libbeat/statestore/internal/storecompliance"
+)
+
+func init() {
+	logp.DevelopmentSetup()
+}
+
+func TestCompliance_Default(t *testing.T) {
+	storecompliance.TestBackendCompliance(t, func(testPath string) (backend.Registry, error) {
+		return New(logp.NewLogger("test"), Settings{Root: testPath})
+	})
+}
+
+func TestCompliance_SyncWrites(t *testing.T) {
+	storecompliance.TestBackendCompliance(t, func(testPath string) (backend.Registry, error) {
+		return New(logp.NewLogger("test"), Settings{Root: testPath, SyncWrites: true})
+	})
+}
+
+func TestStore(t *testing.T) {
+	type state struct {
+		Source  string
+		Offset  int64
+		TTL     time.Duration
+		Updated time.Time
+	}
+
+	root, err := ioutil.TempDir("", "kvstore")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	withStore := func(fn func(store backend.Store)) {
+		reg, err := New(logp.NewLogger("test"), Settings{Root: root})
+		require.NoError(t, err)
+		defer reg.Close()
+		store, err := reg.Access("filebeat")
+		require.NoError(t, err)
+		defer store.Close()
+		fn(store)
+	}
+
+	updated := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	withStore(func(store backend.Store) {
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("filebeat::logs::native::%03d", i)
+			require.NoError(t, store.Set(key, state{Source: key, Offset: int64(i), TTL: -1, Updated: updated}))
+		}
+		for i := 0; i < 100; i += 2 {
+			require.NoError(t, store.Remove(fmt.Sprintf("filebeat::logs::native::%03d", i)))
+		}
+		require.NoError(t, store.(interface{ Checkpoint() error }).Checkpoint())
+	})
+
+	withStore(func(store backend.Store) {
+		var st state
+		require.NoError(t, store.Get("filebeat::logs::native::001", &st))
+		assert.Equal(t, state{Source: "filebeat::logs::native::001", Offset: 1, TTL: -1, Updated: updated}, st)
+		assert.Error(t, store.Get("filebeat::logs::native::000", &st))
+
+		// updates while iterating are not visible to the iteration
+		var keys []string
+		require.NoError(t, store.Each(func(key string, dec backend.ValueDecoder) (bool, error) {
+			keys = append(keys, key)
+			return true, store.Remove(key)
+		}))
+		assert.Len(t, keys, 50)
+		assert.Equal(t, "filebeat::logs::native::001", keys[0])
+
+		has, err := store.Has("filebeat::logs::native::001")
+		require.NoError(t, err)
+		assert.False(t, has)
+	})
+}
+
+func TestSharedAccess(t *testing.T) {
+	root, err := ioutil.TempDir("", "kvstore")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	reg, err := New(logp.NewLogger("test"), Settings{Root: root})
+	require.NoError(t, err)
+	defer reg.Close()
+
+	store1, err := reg.Access("test")
+	require.NoError(t, err)
+	store2, err := reg.Access("test")
+	require.NoError(t, err)
+
+	require.NoError(t, store1.Set("key", map[string]interface{}{"a": 1}))
+	require.NoError(t, store1.Close())
+
+	has, err := store2.Has("key")
+	require.NoError(t, err)
+	assert.True(t, has)
+	require.NoError(t, store2.Close())
+
+	require.NoError(t, reg.Close())
+	_, err = reg.Access("test")
+	assert.Error(t, err)
+}
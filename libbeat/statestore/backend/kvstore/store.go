@@ -0,0 +1,120 @@
+package kvstore
+
+import (
+	"encoding/json"
+
+	badger "github.com/dgraph-io/badger/v2"
+
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/common/transform/typeconv"
+	"github.com/elastic/beats/v7/libbeat/statestore/backend"
+)
+
+// store implements a store on a shared badger database. The values are
+// normalized with typeconv like in memlog and encoded as json.
+type store struct {
+	db      *badger.DB
+	release func() error
+}
+
+type entry struct {
+	raw []byte
+}
+
+// Close releases the database, the database is closed with the last store.
+func (s *store) Close() error {
+	return s.release()
+}
+
+// Has checks if the key is known.
+func (s *store) Has(key string) (bool, error) {
+	err := s.db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get([]byte(key))
+		return err
+	})
+	if err == badger.ErrKeyNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Get retrieves and decodes the key-value pair into to.
+func (s *store) Get(key string, to interface{}) error {
+	return s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(key))
+		if err == badger.ErrKeyNotFound {
+			return errKeyUnknown
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			return entry{raw: val}.Decode(to)
+		})
+	})
+}
+
+// Set inserts or overwrites a key-value pair.
+func (s *store) Set(key string, value interface{}) error {
+	var tmp common.MapStr
+	if err := typeconv.Convert(&tmp, value); err != nil {
+		return err
+	}
+	raw, err := json.Marshal(tmp)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(key), raw)
+	})
+}
+
+// Remove removes a key. The operation does not check if the key exists.
+func (s *store) Remove(key string) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte(key))
+	})
+}
+
+// Checkpoint syncs the write-ahead log and collects the value log.
+func (s *store) Checkpoint() error {
+	if err := s.db.Sync(); err != nil {
+		return err
+	}
+	_, err := collect(s.db)
+	return err
+}
+
+// Each iterates over all key-value pairs in the store in key order. The
+// iteration runs on a snapshot, fn can update the store.
+func (s *store) Each(fn func(string, backend.ValueDecoder) (bool, error)) error {
+	return s.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			key := string(item.Key())
+
+			cont := true
+			err := item.Value(func(val []byte) error {
+				var err error
+				cont, err = fn(key, entry{raw: val})
+				return err
+			})
+			if !cont || err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (e entry) Decode(to interface{}) error {
+	var tmp common.MapStr
+	if err := json.Unmarshal(e.raw, &tmp); err != nil {
+		return err
+	}
+	return typeconv.Convert(to, tmp)
+}